@@ -35,6 +35,10 @@ type ReplicaClient struct {
 	// Azure Blob Storage container information
 	Bucket string
 	Path   string
+
+	// Determines which names are listed as generations.
+	// Uses DefaultGenerationFormat if nil.
+	GenerationFormat litestream.GenerationFormat
 }
 
 // NewReplicaClient returns a new instance of ReplicaClient.
@@ -47,6 +51,19 @@ func (c *ReplicaClient) Type() string {
 	return ReplicaClientType
 }
 
+// Location returns the account, container & path as a URL.
+func (c *ReplicaClient) Location() string {
+	if c.AccountName != "" {
+		return "abs://" + c.AccountName + "@" + path.Join(c.Bucket, c.Path)
+	}
+	return "abs://" + path.Join(c.Bucket, c.Path)
+}
+
+// IsValidGenerationName returns true if name matches the client's generation format.
+func (c *ReplicaClient) IsValidGenerationName(name string) bool {
+	return litestream.IsValidGenerationName(c.GenerationFormat, name)
+}
+
 // Init initializes the connection to Azure. No-op if already initialized.
 func (c *ReplicaClient) Init(ctx context.Context) (err error) {
 	c.mu.Lock()
@@ -111,7 +128,7 @@ func (c *ReplicaClient) Generations(ctx context.Context) ([]string, error) {
 
 		for _, prefix := range resp.Segment.BlobPrefixes {
 			name := path.Base(strings.TrimSuffix(prefix.Name, "/"))
-			if !litestream.IsGenerationName(name) {
+			if !c.IsValidGenerationName(name) {
 				continue
 			}
 			generations = append(generations, name)
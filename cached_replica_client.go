@@ -0,0 +1,321 @@
+package litestream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ ReplicaClient = (*CachedReplicaClient)(nil)
+var _ ImmutableGenerationClient = (*CachedReplicaClient)(nil)
+var _ AttachedClient = (*CachedReplicaClient)(nil)
+
+// CachedReplicaClient wraps a client & caches the snapshots & WAL segments
+// read through it in a local directory. Later reads are served from the cache
+// if the cached file matches the size reported by the underlying client.
+//
+// Listings, writes & deletes pass through to the underlying client. Cached
+// files are removed when they are overwritten or deleted through this client.
+type CachedReplicaClient struct {
+	client ReplicaClient
+	dir    string
+}
+
+// NewCachedReplicaClient returns a wrapper for client which caches reads in dir.
+func NewCachedReplicaClient(client ReplicaClient, dir string) *CachedReplicaClient {
+	return &CachedReplicaClient{client: client, dir: dir}
+}
+
+// Client returns the underlying client.
+func (c *CachedReplicaClient) Client() ReplicaClient { return c.client }
+
+// Dir returns the cache directory.
+func (c *CachedReplicaClient) Dir() string { return c.dir }
+
+// Type returns the type of the underlying client.
+func (c *CachedReplicaClient) Type() string { return c.client.Type() }
+
+// Location returns the location of the underlying client.
+func (c *CachedReplicaClient) Location() string { return c.client.Location() }
+
+// Generations returns a list of available generations from the underlying client.
+func (c *CachedReplicaClient) Generations(ctx context.Context) ([]string, error) {
+	return c.client.Generations(ctx)
+}
+
+// DeleteGeneration deletes a generation from the underlying client & the cache.
+func (c *CachedReplicaClient) DeleteGeneration(ctx context.Context, generation string) error {
+	if generation == "" {
+		return fmt.Errorf("generation required")
+	} else if err := c.client.DeleteGeneration(ctx, generation); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(c.dir, generation))
+}
+
+// Snapshots returns an iterator of snapshots from the underlying client.
+func (c *CachedReplicaClient) Snapshots(ctx context.Context, generation string) (SnapshotIterator, error) {
+	return c.client.Snapshots(ctx, generation)
+}
+
+// WriteSnapshot writes a snapshot to the underlying client & removes any
+// cached snapshot at the same index.
+func (c *CachedReplicaClient) WriteSnapshot(ctx context.Context, generation string, index int, r io.Reader) (SnapshotInfo, error) {
+	filename, err := c.snapshotPath(generation, index)
+	if err != nil {
+		return SnapshotInfo{}, err
+	} else if err := removeIfExists(filename); err != nil {
+		return SnapshotInfo{}, err
+	}
+	return c.client.WriteSnapshot(ctx, generation, index, r)
+}
+
+// DeleteSnapshot deletes a snapshot from the underlying client & the cache.
+func (c *CachedReplicaClient) DeleteSnapshot(ctx context.Context, generation string, index int) error {
+	filename, err := c.snapshotPath(generation, index)
+	if err != nil {
+		return err
+	} else if err := c.client.DeleteSnapshot(ctx, generation, index); err != nil {
+		return err
+	}
+	return removeIfExists(filename)
+}
+
+// SnapshotReader returns a reader for a snapshot. The snapshot is downloaded
+// into the cache first if it is not cached or its size has changed.
+func (c *CachedReplicaClient) SnapshotReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	filename, err := c.snapshotPath(generation, index)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := SnapshotInfoAt(ctx, c.client, generation, index)
+	if err != nil {
+		return nil, err
+	}
+	return c.open(filename, info.Size, func() (io.ReadCloser, error) {
+		return c.client.SnapshotReader(ctx, generation, index)
+	})
+}
+
+// WALSegments returns an iterator of WAL segments from the underlying client.
+func (c *CachedReplicaClient) WALSegments(ctx context.Context, generation string) (WALSegmentIterator, error) {
+	return c.client.WALSegments(ctx, generation)
+}
+
+// WriteWALSegment writes a WAL segment to the underlying client & removes any
+// cached segment at the same position.
+func (c *CachedReplicaClient) WriteWALSegment(ctx context.Context, pos Pos, r io.Reader) (WALSegmentInfo, error) {
+	filename, err := c.walSegmentPath(pos)
+	if err != nil {
+		return WALSegmentInfo{}, err
+	} else if err := removeIfExists(filename); err != nil {
+		return WALSegmentInfo{}, err
+	}
+	return c.client.WriteWALSegment(ctx, pos, r)
+}
+
+// DeleteWALSegments deletes WAL segments from the underlying client & the cache.
+func (c *CachedReplicaClient) DeleteWALSegments(ctx context.Context, a []Pos) error {
+	if err := c.client.DeleteWALSegments(ctx, a); err != nil {
+		return err
+	}
+
+	for _, pos := range a {
+		filename, err := c.walSegmentPath(pos)
+		if err != nil {
+			return err
+		} else if err := removeIfExists(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WALSegmentReader returns a reader for a WAL segment. The segment is
+// downloaded into the cache first if it is not cached or its size has changed.
+func (c *CachedReplicaClient) WALSegmentReader(ctx context.Context, pos Pos) (io.ReadCloser, error) {
+	filename, err := c.walSegmentPath(pos)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := WALInfoAt(ctx, c.client, pos)
+	if err != nil {
+		return nil, err
+	}
+	return c.open(filename, info.Size, func() (io.ReadCloser, error) {
+		return c.client.WALSegmentReader(ctx, pos)
+	})
+}
+
+// SnapshotInfoAt returns metadata for a snapshot from the underlying client.
+func (c *CachedReplicaClient) SnapshotInfoAt(ctx context.Context, generation string, index int) (*SnapshotInfo, error) {
+	return SnapshotInfoAt(ctx, c.client, generation, index)
+}
+
+// WALInfoAt returns metadata for a WAL segment from the underlying client.
+func (c *CachedReplicaClient) WALInfoAt(ctx context.Context, pos Pos) (*WALSegmentInfo, error) {
+	return WALInfoAt(ctx, c.client, pos)
+}
+
+// Flush flushes the underlying client, if it supports flushing.
+func (c *CachedReplicaClient) Flush(ctx context.Context) error {
+	return flushClient(ctx, c.client)
+}
+
+// FreeSpace returns the free space of the underlying client, if it supports it.
+func (c *CachedReplicaClient) FreeSpace(ctx context.Context) (int64, error) {
+	return freeSpace(ctx, c.client)
+}
+
+// IsValidGenerationName returns true if name is a valid generation name for
+// the underlying client.
+func (c *CachedReplicaClient) IsValidGenerationName(name string) bool {
+	return isValidClientGenerationName(c.client, name)
+}
+
+// SetGenerationImmutable marks or unmarks a generation as immutable on the
+// underlying client. Returns an error if the client does not support it.
+func (c *CachedReplicaClient) SetGenerationImmutable(ctx context.Context, generation string, immutable bool) error {
+	client, ok := c.client.(ImmutableGenerationClient)
+	if !ok {
+		return fmt.Errorf("replica client does not support immutable generations: %s", c.client.Type())
+	}
+	return client.SetGenerationImmutable(ctx, generation, immutable)
+}
+
+// IsGenerationImmutable returns true if the generation has been marked as
+// immutable on the underlying client. Always returns false if the client does
+// not support immutable generations.
+func (c *CachedReplicaClient) IsGenerationImmutable(ctx context.Context, generation string) (bool, error) {
+	return isGenerationImmutable(ctx, c.client, generation)
+}
+
+// WriteAttachedSnapshot writes an image of an attached database to the
+// underlying client.
+func (c *CachedReplicaClient) WriteAttachedSnapshot(ctx context.Context, name string, pos Pos, rd io.Reader) (SnapshotInfo, error) {
+	client, err := c.attachedClient()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	return client.WriteAttachedSnapshot(ctx, name, pos, rd)
+}
+
+// AttachedSnapshotPos returns the position of an attached database image from
+// the underlying client.
+func (c *CachedReplicaClient) AttachedSnapshotPos(ctx context.Context, generation, name string, index int) (Pos, error) {
+	client, err := c.attachedClient()
+	if err != nil {
+		return Pos{}, err
+	}
+	return client.AttachedSnapshotPos(ctx, generation, name, index)
+}
+
+// AttachedSnapshotReader returns a reader for an attached database image from
+// the underlying client. Attached images are not cached.
+func (c *CachedReplicaClient) AttachedSnapshotReader(ctx context.Context, name string, pos Pos) (io.ReadCloser, error) {
+	client, err := c.attachedClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.AttachedSnapshotReader(ctx, name, pos)
+}
+
+// AttachedNames returns the names of attached databases with images in a
+// generation from the underlying client.
+func (c *CachedReplicaClient) AttachedNames(ctx context.Context, generation string) ([]string, error) {
+	client, err := c.attachedClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.AttachedNames(ctx, generation)
+}
+
+// attachedClient returns the underlying client if it supports attached
+// databases. Otherwise returns an error.
+func (c *CachedReplicaClient) attachedClient() (AttachedClient, error) {
+	client, ok := c.client.(AttachedClient)
+	if !ok {
+		return nil, fmt.Errorf("replica client does not support attached databases: %s", c.client.Type())
+	}
+	return client, nil
+}
+
+// snapshotPath returns the path of a cached snapshot.
+func (c *CachedReplicaClient) snapshotPath(generation string, index int) (string, error) {
+	if generation == "" {
+		return "", fmt.Errorf("generation required")
+	}
+	return filepath.Join(c.dir, generation, "snapshots", FormatIndex(index)+".snapshot.lz4"), nil
+}
+
+// walSegmentPath returns the path of a cached WAL segment.
+func (c *CachedReplicaClient) walSegmentPath(pos Pos) (string, error) {
+	if pos.Generation == "" {
+		return "", fmt.Errorf("generation required")
+	}
+	return filepath.Join(c.dir, pos.Generation, "wal", FormatIndex(pos.Index), FormatOffset(pos.Offset)+".wal.lz4"), nil
+}
+
+// open returns the cached file at filename if it has the given size.
+// Otherwise the file is downloaded into the cache from the reader returned
+// by fn & then opened.
+func (c *CachedReplicaClient) open(filename string, size int64, fn func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if f, err := os.Open(filename); err == nil {
+		if fi, err := f.Stat(); err == nil && fi.Size() == size {
+			return f, nil
+		}
+		_ = f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := c.download(filename, size, fn); err != nil {
+		return nil, fmt.Errorf("cache: %w", err)
+	}
+	return os.Open(filename)
+}
+
+// download copies the reader returned by fn to filename via a temporary file
+// so that partially downloaded files are never served.
+func (c *CachedReplicaClient) download(filename string, size int64, fn func() (io.ReadCloser, error)) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	rc, err := fn()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	defer f.Close()
+
+	if n, err := io.Copy(f, rc); err != nil {
+		return err
+	} else if n != size {
+		return fmt.Errorf("size mismatch: %s: got=%d want=%d", filepath.Base(filename), n, size)
+	} else if err := f.Close(); err != nil {
+		return err
+	} else if err := rc.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// removeIfExists removes filename. Returns nil if the file does not exist.
+func removeIfExists(filename string) error {
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
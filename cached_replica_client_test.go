@@ -0,0 +1,169 @@
+package litestream_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/mock"
+)
+
+func TestCachedReplicaClient(t *testing.T) {
+	// newClient returns a cached client over a file client & a function that
+	// returns the number of snapshot & WAL segment reads from the primary.
+	newClient := func(tb testing.TB) (*litestream.CachedReplicaClient, *litestream.FileReplicaClient, func() int) {
+		var mu sync.Mutex
+		var n int
+		fc := litestream.NewFileReplicaClient(tb.TempDir())
+		primary := &mock.ReplicaClient{
+			GenerationsFunc:       fc.Generations,
+			SnapshotsFunc:         fc.Snapshots,
+			WriteSnapshotFunc:     fc.WriteSnapshot,
+			DeleteSnapshotFunc:    fc.DeleteSnapshot,
+			WALSegmentsFunc:       fc.WALSegments,
+			WriteWALSegmentFunc:   fc.WriteWALSegment,
+			DeleteWALSegmentsFunc: fc.DeleteWALSegments,
+			SnapshotReaderFunc: func(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+				mu.Lock()
+				n++
+				mu.Unlock()
+				return fc.SnapshotReader(ctx, generation, index)
+			},
+			WALSegmentReaderFunc: func(ctx context.Context, pos litestream.Pos) (io.ReadCloser, error) {
+				mu.Lock()
+				n++
+				mu.Unlock()
+				return fc.WALSegmentReader(ctx, pos)
+			},
+		}
+		return litestream.NewCachedReplicaClient(primary, tb.TempDir()), fc, func() int { mu.Lock(); defer mu.Unlock(); return n }
+	}
+
+	// mustReadAll returns the contents of the reader returned by fn.
+	mustReadAll := func(tb testing.TB, fn func() (io.ReadCloser, error)) string {
+		tb.Helper()
+		rc, err := fn()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		defer rc.Close()
+
+		buf, err := ioutil.ReadAll(rc)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return string(buf)
+	}
+
+	t.Run("SnapshotReader", func(t *testing.T) {
+		c, _, readN := newClient(t)
+		if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 1, strings.NewReader("snapshot")); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if got, want := mustReadAll(t, func() (io.ReadCloser, error) { return c.SnapshotReader(context.Background(), "0000000000000000", 1) }), "snapshot"; got != want {
+				t.Fatalf("data=%q, want %q", got, want)
+			}
+		}
+		if got, want := readN(), 1; got != want {
+			t.Fatalf("primary reads=%d, want %d", got, want)
+		}
+	})
+
+	t.Run("WALSegmentReader", func(t *testing.T) {
+		c, _, readN := newClient(t)
+		pos := litestream.Pos{Generation: "0000000000000000", Index: 2, Offset: 32}
+		if _, err := c.WriteWALSegment(context.Background(), pos, strings.NewReader("wal")); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if got, want := mustReadAll(t, func() (io.ReadCloser, error) { return c.WALSegmentReader(context.Background(), pos) }), "wal"; got != want {
+				t.Fatalf("data=%q, want %q", got, want)
+			}
+		}
+		if got, want := readN(), 1; got != want {
+			t.Fatalf("primary reads=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure a cached file is replaced if its size no longer matches the
+	// primary, such as when the file is overwritten by another client.
+	t.Run("SizeChanged", func(t *testing.T) {
+		c, fc, readN := newClient(t)
+		if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 1, strings.NewReader("snapshot")); err != nil {
+			t.Fatal(err)
+		}
+		mustReadAll(t, func() (io.ReadCloser, error) { return c.SnapshotReader(context.Background(), "0000000000000000", 1) })
+
+		if _, err := fc.WriteSnapshot(context.Background(), "0000000000000000", 1, strings.NewReader("new snapshot")); err != nil {
+			t.Fatal(err)
+		} else if got, want := mustReadAll(t, func() (io.ReadCloser, error) { return c.SnapshotReader(context.Background(), "0000000000000000", 1) }), "new snapshot"; got != want {
+			t.Fatalf("data=%q, want %q", got, want)
+		} else if got, want := readN(), 2; got != want {
+			t.Fatalf("primary reads=%d, want %d", got, want)
+		}
+	})
+
+	t.Run("DeleteSnapshot", func(t *testing.T) {
+		c, _, _ := newClient(t)
+		if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 1, strings.NewReader("snapshot")); err != nil {
+			t.Fatal(err)
+		}
+		mustReadAll(t, func() (io.ReadCloser, error) { return c.SnapshotReader(context.Background(), "0000000000000000", 1) })
+
+		if err := c.DeleteSnapshot(context.Background(), "0000000000000000", 1); err != nil {
+			t.Fatal(err)
+		} else if _, err := c.SnapshotReader(context.Background(), "0000000000000000", 1); !os.IsNotExist(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure retention sees generations marked immutable on the underlying
+	// client through the cache.
+	t.Run("ImmutableGeneration", func(t *testing.T) {
+		fc := litestream.NewFileReplicaClient(t.TempDir())
+		c := litestream.NewCachedReplicaClient(fc, t.TempDir())
+		if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 1, strings.NewReader("snapshot")); err != nil {
+			t.Fatal(err)
+		} else if err := c.SetGenerationImmutable(context.Background(), "0000000000000000", true); err != nil {
+			t.Fatal(err)
+		} else if ok, err := fc.IsGenerationImmutable(context.Background(), "0000000000000000"); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatal("expected immutable on underlying client")
+		} else if ok, err := c.IsGenerationImmutable(context.Background(), "0000000000000000"); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatal("expected immutable")
+		}
+
+		// Clients without support report all generations as mutable.
+		c = litestream.NewCachedReplicaClient(&mock.ReplicaClient{}, t.TempDir())
+		if err := c.SetGenerationImmutable(context.Background(), "0000000000000000", true); err == nil {
+			t.Fatal("expected error")
+		} else if ok, err := c.IsGenerationImmutable(context.Background(), "0000000000000000"); err != nil || ok {
+			t.Fatalf("IsGenerationImmutable()=<%v,%v>", ok, err)
+		}
+	})
+
+	t.Run("AttachedSnapshot", func(t *testing.T) {
+		c := litestream.NewCachedReplicaClient(litestream.NewFileReplicaClient(t.TempDir()), t.TempDir())
+		pos := litestream.Pos{Generation: "0000000000000000", Index: 1, Offset: 32}
+		if _, err := c.WriteAttachedSnapshot(context.Background(), "aux", pos, strings.NewReader("attached")); err != nil {
+			t.Fatal(err)
+		} else if got, err := c.AttachedSnapshotPos(context.Background(), pos.Generation, "aux", pos.Index); err != nil {
+			t.Fatal(err)
+		} else if got != pos {
+			t.Fatalf("pos=%s, want %s", got, pos)
+		} else if got, want := mustReadAll(t, func() (io.ReadCloser, error) { return c.AttachedSnapshotReader(context.Background(), "aux", pos) }), "attached"; got != want {
+			t.Fatalf("data=%q, want %q", got, want)
+		}
+	})
+}
@@ -290,6 +290,8 @@ type DBConfig struct {
 	MinCheckpointPageN   *int           `yaml:"min-checkpoint-page-count"`
 	MaxCheckpointPageN   *int           `yaml:"max-checkpoint-page-count"`
 	ShadowRetentionN     *int           `yaml:"shadow-retention-count"`
+	RecoverTmpFiles      *bool          `yaml:"recover-tmp-files"`
+	ReadOnly             bool           `yaml:"read-only"`
 
 	Replicas []*ReplicaConfig `yaml:"replicas"`
 }
@@ -334,6 +336,10 @@ func NewDBFromConfigWithPath(dbc *DBConfig, path string) (*litestream.DB, error)
 	if dbc.ShadowRetentionN != nil {
 		db.ShadowRetentionN = *dbc.ShadowRetentionN
 	}
+	if dbc.RecoverTmpFiles != nil {
+		db.RecoverTmpFiles = *dbc.RecoverTmpFiles
+	}
+	db.ReadOnly = dbc.ReadOnly
 
 	// Instantiate and attach replicas.
 	for _, rc := range dbc.Replicas {
@@ -359,10 +365,38 @@ type ReplicaConfig struct {
 	Path                   string         `yaml:"path"`
 	URL                    string         `yaml:"url"`
 	Retention              *time.Duration `yaml:"retention"`
+	WALRetention           *time.Duration `yaml:"wal-retention"`
+	MinRetainedSnapshots   *int           `yaml:"min-retained-snapshots"`
+	MaxGenerations         *int           `yaml:"max-generations"`
 	RetentionCheckInterval *time.Duration `yaml:"retention-check-interval"`
+	RunRetentionOnStart    bool           `yaml:"run-retention-on-start"`
+	PruneWALOnSnapshot     bool           `yaml:"prune-wal-on-snapshot"`
+	MinWALBytes            int64          `yaml:"min-wal-bytes"`
+	MaxWALSegmentBytes     int64          `yaml:"max-wal-segment-bytes"`
+	WALFlushInterval       *time.Duration `yaml:"wal-flush-interval"`
+	SyncOnCommit           bool           `yaml:"sync-on-commit"`
 	SyncInterval           *time.Duration `yaml:"sync-interval"`
+	MaxSnapshotRetries     int            `yaml:"max-snapshot-retries"`
+	SnapshotRetryBackoff   *time.Duration `yaml:"snapshot-retry-backoff"`
+	RetryBaseDelay         *time.Duration `yaml:"retry-base-delay"`
+	RetryMaxDelay          *time.Duration `yaml:"retry-max-delay"`
 	SnapshotInterval       *time.Duration `yaml:"snapshot-interval"`
 	ValidationInterval     *time.Duration `yaml:"validation-interval"`
+	SnapshotCodec          string         `yaml:"snapshot-codec"`
+	WALCodec               string         `yaml:"wal-codec"`
+	EmbedTimestamps        bool           `yaml:"embed-timestamps"`
+	DeltaSnapshots         bool           `yaml:"delta-snapshots"`
+	MaxDeltaSnapshots      int            `yaml:"max-delta-snapshots"`
+	Mode                   string         `yaml:"mode"`
+	CopyBufferSize         int            `yaml:"copy-buffer-size"`
+	VerifyWrites           bool           `yaml:"verify-writes"`
+	MaxSegmentRetries      int            `yaml:"max-segment-retries"`
+	FsyncMode              string         `yaml:"fsync-mode"`
+	SnapshotTimestampNames bool           `yaml:"snapshot-timestamp-names"`
+	Manifest               bool           `yaml:"manifest"`
+
+	// Paths of attached databases to snapshot, keyed by name.
+	Attached map[string]string `yaml:"attached"`
 
 	// S3 settings
 	AccessKeyID     string `yaml:"access-key-id"`
@@ -423,18 +457,69 @@ func NewReplicaFromConfig(c *ReplicaConfig, db *litestream.DB) (_ *litestream.Re
 	if v := c.Retention; v != nil {
 		r.Retention = *v
 	}
+	if v := c.WALRetention; v != nil {
+		r.WALRetention = *v
+	}
+	if v := c.MinRetainedSnapshots; v != nil {
+		r.MinRetainedSnapshots = *v
+	}
+	if v := c.MaxGenerations; v != nil {
+		r.MaxGenerations = *v
+	}
 	if v := c.RetentionCheckInterval; v != nil {
 		r.RetentionCheckInterval = *v
 	}
+	r.RunRetentionOnStart = c.RunRetentionOnStart
+	r.PruneWALOnSnapshot = c.PruneWALOnSnapshot
+	r.MinWALBytes = c.MinWALBytes
+	r.MaxWALSegmentBytes = c.MaxWALSegmentBytes
+	if v := c.WALFlushInterval; v != nil {
+		r.WALFlushInterval = *v
+	}
+	r.SyncOnCommit = c.SyncOnCommit
 	if v := c.SyncInterval; v != nil {
 		r.SyncInterval = *v
 	}
+	r.MaxSnapshotRetries = c.MaxSnapshotRetries
+	if v := c.SnapshotRetryBackoff; v != nil {
+		r.SnapshotRetryBackoff = *v
+	}
+	if v := c.RetryBaseDelay; v != nil {
+		r.RetryBaseDelay = *v
+	}
+	if v := c.RetryMaxDelay; v != nil {
+		r.RetryMaxDelay = *v
+	}
 	if v := c.SnapshotInterval; v != nil {
 		r.SnapshotInterval = *v
 	}
 	if v := c.ValidationInterval; v != nil {
 		r.ValidationInterval = *v
 	}
+	if err := litestream.ValidateCodec(c.SnapshotCodec); err != nil {
+		return nil, fmt.Errorf("snapshot-codec: %w", err)
+	} else if err := litestream.ValidateCodec(c.WALCodec); err != nil {
+		return nil, fmt.Errorf("wal-codec: %w", err)
+	}
+	r.SnapshotCodec = c.SnapshotCodec
+	r.WALCodec = c.WALCodec
+	r.EmbedTimestamps = c.EmbedTimestamps
+	r.DeltaSnapshots = c.DeltaSnapshots
+	r.MaxDeltaSnapshots = c.MaxDeltaSnapshots
+	for name, path := range c.Attached {
+		if path, err = expand(path); err != nil {
+			return nil, err
+		} else if r.Attached == nil {
+			r.Attached = make(map[string]string)
+		}
+		r.Attached[name] = path
+	}
+	r.CopyBufferSize = c.CopyBufferSize
+	r.VerifyWrites = c.VerifyWrites
+	r.MaxSegmentRetries = c.MaxSegmentRetries
+	if r.Mode, err = litestream.ParseReplicaMode(c.Mode); err != nil {
+		return nil, err
+	}
 
 	return r, nil
 }
@@ -465,7 +550,13 @@ func newFileReplicaClientFromConfig(c *ReplicaConfig) (_ *litestream.FileReplica
 	}
 
 	// Instantiate replica and apply time fields, if set.
-	return litestream.NewFileReplicaClient(path), nil
+	client := litestream.NewFileReplicaClient(path)
+	if client.FsyncMode, err = litestream.ParseFsyncMode(c.FsyncMode); err != nil {
+		return nil, err
+	}
+	client.SnapshotTimestampNames = c.SnapshotTimestampNames
+	client.Manifest = c.Manifest
+	return client, nil
 }
 
 // newS3ReplicaClientFromConfig returns a new instance of s3.ReplicaClient built from config.
@@ -111,6 +111,12 @@ func TestNewFileReplicaFromConfig(t *testing.T) {
 	}
 }
 
+func TestNewReplicaFromConfig_ErrUnsupportedCodec(t *testing.T) {
+	if _, err := main.NewReplicaFromConfig(&main.ReplicaConfig{Path: "/foo", WALCodec: "zstd"}, nil); err == nil || err.Error() != `wal-codec: unsupported codec: "zstd"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 func TestNewS3ReplicaFromConfig(t *testing.T) {
 	t.Run("URL", func(t *testing.T) {
 		r, err := main.NewReplicaFromConfig(&main.ReplicaConfig{URL: "s3://foo/bar"}, nil)
@@ -140,7 +140,8 @@ func (c *ReplicateCommand) Run(ctx context.Context) (err error) {
 			case *sftp.ReplicaClient:
 				log.Printf("replicating to: name=%q type=%q host=%q user=%q path=%q sync-interval=%s", r.Name(), client.Type(), client.Host, client.User, client.Path, r.SyncInterval)
 			default:
-				log.Printf("replicating to: name=%q type=%q", r.Name(), client.Type())
+				info := r.Info()
+				log.Printf("replicating to: name=%q type=%q location=%q", info.Name, info.Type, info.Location)
 			}
 		}
 	}
@@ -57,6 +57,7 @@ func (c *RestoreCommand) Run(ctx context.Context, args []string) (err error) {
 	fs.Var((*indexVar)(&c.targetIndex), "index", "wal index")
 	timestampStr := fs.String("timestamp", "", "point-in-time restore (ISO 8601)")
 	fs.IntVar(&c.opt.Parallelism, "parallelism", c.opt.Parallelism, "parallelism")
+	fs.BoolVar(&c.opt.VerifySnapshot, "verify-snapshot", false, "")
 	fs.BoolVar(&c.ifDBNotExists, "if-db-not-exists", false, "")
 	fs.BoolVar(&c.ifReplicaExists, "if-replica-exists", false, "")
 	fs.Usage = c.Usage
@@ -91,7 +92,10 @@ func (c *RestoreCommand) Run(ctx context.Context, args []string) (err error) {
 	}
 
 	// Exit successfully if the output file already exists and flag is set.
-	if _, err := os.Stat(c.outputPath); os.IsNotExist(err) {
+	// Writing to STDOUT does not require an output file.
+	if c.outputPath == "-" {
+		// writing to STDOUT, continue
+	} else if _, err := os.Stat(c.outputPath); os.IsNotExist(err) {
 		// file doesn't exist, continue
 	} else if err != nil {
 		return err
@@ -132,7 +136,13 @@ func (c *RestoreCommand) Run(ctx context.Context, args []string) (err error) {
 
 	// Determine the maximum available index for the generation if one is not specified.
 	if !c.timestamp.IsZero() {
-		if c.targetIndex, err = litestream.FindIndexByTimestamp(ctx, r.Client(), c.generation, c.timestamp); err != nil {
+		// Embedded timestamps are only read if the replica writes them as
+		// each file must be opened.
+		findIndex := litestream.FindIndexByTimestamp
+		if r.EmbedTimestamps {
+			findIndex = litestream.FindIndexByEmbeddedTimestamp
+		}
+		if c.targetIndex, err = findIndex(ctx, r.Client(), c.generation, c.timestamp); err != nil {
 			return fmt.Errorf("cannot find index for timestamp in generation %q: %w", c.generation, err)
 		}
 	} else if c.targetIndex == -1 {
@@ -147,6 +157,23 @@ func (c *RestoreCommand) Run(ctx context.Context, args []string) (err error) {
 		return fmt.Errorf("cannot find snapshot index: %w", err)
 	}
 
+	// Stream the restored database to STDOUT, if requested. Logs are written
+	// to STDERR so they do not interleave with the database contents.
+	if c.outputPath == "-" {
+		c.opt.Logger = log.New(c.stderr, "", log.LstdFlags|log.Lmicroseconds)
+
+		rc, err := litestream.RestoreReader(ctx, r.Client(), c.generation, c.snapshotIndex, c.targetIndex, c.opt)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		if _, err := io.Copy(c.stdout, rc); err != nil {
+			return err
+		}
+		return rc.Close()
+	}
+
 	// Create parent directory if it doesn't already exist.
 	if err := os.MkdirAll(filepath.Dir(c.outputPath), 0700); err != nil {
 		return fmt.Errorf("cannot create parent directory: %w", err)
@@ -263,6 +290,7 @@ Arguments:
 
 	-o PATH
 	    Output path of the restored database.
+	    Use "-" to write the database to STDOUT.
 	    Defaults to original DB path.
 
 	-if-db-not-exists
@@ -275,6 +303,9 @@ Arguments:
 	    Determines the number of WAL files downloaded in parallel.
 	    Defaults to `+strconv.Itoa(litestream.DefaultRestoreParallelism)+`.
 
+	-verify-snapshot
+	    Validates the snapshot checksum before writing the output file.
+
 
 Examples:
 
@@ -290,6 +321,9 @@ Examples:
 	# Restore database from specific generation on S3.
 	$ litestream restore -replica s3 -generation xxxxxxxx /path/to/db
 
+	# Write the latest database from a replica URL to STDOUT.
+	$ litestream restore -o - s3://mybkt.litestream.io/db > /tmp/db
+
 	# Restore database to a specific point in time.
 	$ litestream restore -generation xxxxxxxx -timestamp 2000-01-01T00:00:00Z /path/to/db
 
@@ -1,6 +1,7 @@
 package main_test
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"os"
@@ -64,6 +65,29 @@ func TestRestoreCommand(t *testing.T) {
 		}
 	})
 
+	t.Run("Stdout", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		defer testingutil.Setenv(t, "LITESTREAM_TESTDIR", testDir)()
+		tempDir := t.TempDir()
+
+		m, _, stdout, stderr := newMain()
+		if err := m.Run(context.Background(), []string{"restore", "-config", filepath.Join(testDir, "litestream.yml"), "-o", "-", filepath.Join(testDir, "db")}); err != nil {
+			t.Fatal(err)
+		} else if !strings.Contains(stderr.String(), `renaming database from temporary location`) {
+			t.Fatalf("unexpected stderr: %s", stderr)
+		}
+
+		// Compare with a restore to a file.
+		m, _, _, _ = newMain()
+		if err := m.Run(context.Background(), []string{"restore", "-config", filepath.Join(testDir, "litestream.yml"), "-o", filepath.Join(tempDir, "db"), filepath.Join(testDir, "db")}); err != nil {
+			t.Fatal(err)
+		} else if buf, err := os.ReadFile(filepath.Join(tempDir, "db")); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(stdout.Bytes(), buf) {
+			t.Fatalf("stdout mismatch: len(%d), len(%d)", stdout.Len(), len(buf))
+		}
+	})
+
 	t.Run("ReplicaURL", func(t *testing.T) {
 		testDir := filepath.Join(testingutil.Getwd(t), "testdata", "restore", "replica-url")
 		tempDir := t.TempDir()
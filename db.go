@@ -117,6 +117,16 @@ type DB struct {
 	// better precision.
 	CheckpointInterval time.Duration
 
+	// If true, temporary files left over from a crash are renamed into place
+	// on open if they contain a complete LZ4 stream. Otherwise they are removed.
+	RecoverTmpFiles bool
+
+	// If true, the database is opened read-only. Litestream does not create
+	// its internal tables, write to the WAL, or issue checkpoints. Instead, it
+	// follows frames written by other processes & relies on them to checkpoint.
+	// The WAL must already exist before replication begins.
+	ReadOnly bool
+
 	// List of replicas for the database.
 	// Must be set before calling Open().
 	Replicas []*Replica
@@ -218,6 +228,30 @@ func (db *DB) Replica(name string) *Replica {
 	return nil
 }
 
+// ReplicaPos returns the minimum position across all replicas. This is the
+// position which every replica has durably stored. Returns a zero position if
+// there are no replicas, if any replica has no position, or if replicas are
+// replicating different generations.
+func (db *DB) ReplicaPos() Pos {
+	var min Pos
+	for i, r := range db.Replicas {
+		pos := r.Pos()
+		if pos.IsZero() {
+			return Pos{}
+		} else if i == 0 {
+			min = pos
+			continue
+		} else if pos.Generation != min.Generation {
+			return Pos{}
+		}
+
+		if pos.Index < min.Index || (pos.Index == min.Index && pos.Offset < min.Offset) {
+			min = pos
+		}
+	}
+	return min
+}
+
 // Pos returns the cached position of the database.
 // Returns a zero position if no position has been calculated or if there is no generation.
 func (db *DB) Pos() Pos {
@@ -363,6 +397,36 @@ func (db *DB) WALReader(ctx context.Context, generation string, index int) (_ io
 	return internal.NewMultiReadCloser(rcs), nil
 }
 
+// CommittedWALReader returns the uncompressed WAL data for a given index up to
+// the last known-valid position along with the length of that data. For the
+// current index, the data is limited to the offset of the current position so
+// segments written ahead of a position update are never returned. Earlier
+// indexes are returned in full.
+func (db *DB) CommittedWALReader(ctx context.Context, generation string, index int) (io.ReadCloser, int64, error) {
+	// Read the position first so segments written afterward are excluded.
+	pos := db.Pos()
+
+	var n int64
+	switch {
+	case pos.Generation == generation && pos.Index == index:
+		n = pos.Offset
+	case pos.Generation == generation && pos.Index < index:
+		n = 0 // no committed data yet
+	default:
+		size, err := db.walIndexSize(ctx, generation, index)
+		if err != nil {
+			return nil, 0, fmt.Errorf("wal index size: %w", err)
+		}
+		n = size
+	}
+
+	rc, err := db.WALReader(ctx, generation, index)
+	if err != nil {
+		return nil, 0, err
+	}
+	return internal.NewReadCloser(io.LimitReader(rc, n), rc), n, nil
+}
+
 func (db *DB) walSegmentOffsetsByIndex(generation string, index int) ([]int64, error) {
 	// Read files from index directory.
 	ents, err := os.ReadDir(filepath.Join(db.ShadowWALDir(generation), FormatIndex(index)))
@@ -388,6 +452,30 @@ func (db *DB) walSegmentOffsetsByIndex(generation string, index int) ([]int64, e
 	return offsets, nil
 }
 
+// walIndexSize returns the uncompressed size of a shadow WAL index. This is
+// computed from the last segment's offset so only that segment is read.
+func (db *DB) walIndexSize(ctx context.Context, generation string, index int) (int64, error) {
+	offsets, err := db.walSegmentOffsetsByIndex(generation, index)
+	if err != nil {
+		return 0, fmt.Errorf("wal segment offsets: %w", err)
+	} else if len(offsets) == 0 {
+		return 0, nil
+	}
+
+	pos := Pos{Generation: generation, Index: index, Offset: offsets[len(offsets)-1]}
+	rd, err := db.WALSegmentReader(ctx, pos)
+	if err != nil {
+		return 0, err
+	}
+	defer rd.Close()
+
+	n, err := io.Copy(ioutil.Discard, lz4.NewReader(rd))
+	if err != nil {
+		return 0, err
+	}
+	return pos.Offset + n, nil
+}
+
 // NotifyCh returns a channel that can be used to signal changes in the DB.
 func (db *DB) NotifyCh() chan<- struct{} {
 	return db.notifyCh
@@ -418,7 +506,7 @@ func (db *DB) Open() (err error) {
 	}
 
 	// Clear old temporary files that my have been left from a crash.
-	if err := removeTmpFiles(db.MetaPath()); err != nil {
+	if err := removeTmpFiles(db.MetaPath(), db.Logger, db.RecoverTmpFiles); err != nil {
 		return fmt.Errorf("cannot remove tmp files: %w", err)
 	}
 
@@ -533,7 +621,12 @@ func (db *DB) init() (err error) {
 	db.dirMode = fi.Mode()
 
 	dsn := db.path
-	dsn += fmt.Sprintf("?_busy_timeout=%d", BusyTimeout.Milliseconds())
+	if db.ReadOnly {
+		dsn = "file:" + dsn + "?mode=ro&"
+	} else {
+		dsn += "?"
+	}
+	dsn += fmt.Sprintf("_busy_timeout=%d", BusyTimeout.Milliseconds())
 
 	// Connect to SQLite database. Use the driver registered with a hook to
 	// prevent WAL files from being removed.
@@ -543,8 +636,15 @@ func (db *DB) init() (err error) {
 
 	// Enable WAL and ensure it is set. New mode should be returned on success:
 	// https://www.sqlite.org/pragma.html#pragma_journal_mode
+	//
+	// Read-only databases cannot change their journal mode so the writer must
+	// have already enabled WAL mode.
+	q := `PRAGMA journal_mode = wal;`
+	if db.ReadOnly {
+		q = `PRAGMA journal_mode;`
+	}
 	var mode string
-	if err := db.db.QueryRow(`PRAGMA journal_mode = wal;`).Scan(&mode); err != nil {
+	if err := db.db.QueryRow(q).Scan(&mode); err != nil {
 		return err
 	} else if mode != "wal" {
 		return fmt.Errorf("enable wal failed, mode=%q", mode)
@@ -555,16 +655,18 @@ func (db *DB) init() (err error) {
 		return fmt.Errorf("disable autocheckpoint: %w", err)
 	}
 
-	// Create a table to force writes to the WAL when empty.
-	// There should only ever be one row with id=1.
-	if _, err := db.db.ExecContext(db.ctx, `CREATE TABLE IF NOT EXISTS _litestream_seq (id INTEGER PRIMARY KEY, seq INTEGER);`); err != nil {
-		return fmt.Errorf("create _litestream_seq table: %w", err)
-	}
+	if !db.ReadOnly {
+		// Create a table to force writes to the WAL when empty.
+		// There should only ever be one row with id=1.
+		if _, err := db.db.ExecContext(db.ctx, `CREATE TABLE IF NOT EXISTS _litestream_seq (id INTEGER PRIMARY KEY, seq INTEGER);`); err != nil {
+			return fmt.Errorf("create _litestream_seq table: %w", err)
+		}
 
-	// Create a lock table to force write locks during sync.
-	// The sync write transaction always rolls back so no data should be in this table.
-	if _, err := db.db.ExecContext(db.ctx, `CREATE TABLE IF NOT EXISTS _litestream_lock (id INTEGER);`); err != nil {
-		return fmt.Errorf("create _litestream_lock table: %w", err)
+		// Create a lock table to force write locks during sync.
+		// The sync write transaction always rolls back so no data should be in this table.
+		if _, err := db.db.ExecContext(db.ctx, `CREATE TABLE IF NOT EXISTS _litestream_lock (id INTEGER);`); err != nil {
+			return fmt.Errorf("create _litestream_lock table: %w", err)
+		}
 	}
 
 	// Open long-running database file descriptor. Required for non-OFD locks.
@@ -720,6 +822,19 @@ func (db *DB) clearGeneration(ctx context.Context) error {
 	return nil
 }
 
+// resetGeneration clears the current generation & cached position so the next
+// sync starts a new generation.
+func (db *DB) resetGeneration() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.clearGeneration(db.ctx); err != nil {
+		return err
+	}
+	db.reset()
+	return nil
+}
+
 // verifyHeadersMatch returns true if the primary WAL and last shadow WAL header match.
 func (db *DB) verifyHeadersMatch() error {
 	// Skip verification if we have no current position.
@@ -847,7 +962,7 @@ func (db *DB) acquireReadLock() error {
 	}
 
 	// Execute read query to obtain read lock.
-	if _, err := tx.Exec(`SELECT COUNT(1) FROM _litestream_seq;`); err != nil {
+	if _, err := tx.Exec(db.readLockQuery()); err != nil {
 		_ = tx.Rollback()
 		return err
 	}
@@ -857,6 +972,15 @@ func (db *DB) acquireReadLock() error {
 	return nil
 }
 
+// readLockQuery returns a query used to obtain a read lock on the database.
+// Read-only databases may not contain the litestream tables.
+func (db *DB) readLockQuery() string {
+	if db.ReadOnly {
+		return `SELECT COUNT(1) FROM sqlite_master;`
+	}
+	return `SELECT COUNT(1) FROM _litestream_seq;`
+}
+
 // releaseReadLock rolls back the long-running read transaction.
 func (db *DB) releaseReadLock() error {
 	// Ignore if we do not have a read lock.
@@ -981,8 +1105,15 @@ func (db *DB) sync(ctx context.Context) (err error) {
 		db.syncSecondsCounter.Add(float64(time.Since(t).Seconds()))
 	}()
 
-	// Ensure WAL has at least one frame in it.
-	if err := db.ensureWALExists(); err != nil {
+	// Ensure WAL has at least one frame in it. Read-only databases must wait
+	// for another process to write to the WAL.
+	if db.ReadOnly {
+		if fi, err := os.Stat(db.WALPath()); os.IsNotExist(err) || (err == nil && fi.Size() < WALHeaderSize) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	} else if err := db.ensureWALExists(); err != nil {
 		return fmt.Errorf("ensure wal exists: %w", err)
 	}
 
@@ -1012,6 +1143,17 @@ func (db *DB) sync(ctx context.Context) (err error) {
 		return fmt.Errorf("cannot copy to shadow wal: %w", err)
 	}
 
+	// Read-only databases cannot checkpoint so the read lock is renewed after
+	// each copy. This lets other processes checkpoint frames that have been
+	// copied without allowing them to restart the WAL before the next sync.
+	if db.ReadOnly {
+		if err := db.releaseReadLock(); err != nil {
+			return fmt.Errorf("release read lock: %w", err)
+		} else if err := db.acquireReadLock(); err != nil {
+			return fmt.Errorf("acquire read lock: %w", err)
+		}
+	}
+
 	// If we are at the end of the WAL file, start a new index.
 	if info.restart {
 		// Move to beginning of next index.
@@ -1038,7 +1180,7 @@ func (db *DB) sync(ctx context.Context) (err error) {
 	}
 
 	// Issue the checkpoint.
-	if checkpoint {
+	if checkpoint && !db.ReadOnly {
 		// Under rare circumstances, a checkpoint can be unable to verify continuity
 		// and will require a restart.
 		if err := db.checkpoint(ctx, info.generation, checkpointMode); errors.Is(err, errRestartGeneration) {
@@ -1411,7 +1553,7 @@ func (db *DB) writeWALSegment(ctx context.Context, pos Pos, rd io.Reader) error
 		Index:      pos.Index,
 		Offset:     pos.Offset,
 		Size:       n,
-		CreatedAt:  time.Now(),
+		CreatedAt:  time.Now().UTC(),
 	}
 
 	// Notify all managed segment iterators.
@@ -1512,6 +1654,10 @@ const (
 
 // Checkpoint performs a checkpoint on the WAL file.
 func (db *DB) Checkpoint(ctx context.Context, mode string) (err error) {
+	if db.ReadOnly {
+		return fmt.Errorf("cannot checkpoint read-only database")
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -1668,8 +1814,9 @@ func (db *DB) monitorLocal(ctx context.Context) error {
 		case <-db.notifyCh:
 		}
 
-		// Wait for small delay before processing changes.
-		if timer != nil {
+		// Wait for small delay before processing changes. Changes are processed
+		// immediately if any replica syncs on every commit.
+		if timer != nil && !db.syncOnCommit() {
 			timer.Reset(db.MonitorDelayInterval)
 			<-timer.C
 		}
@@ -1683,6 +1830,43 @@ func (db *DB) monitorLocal(ctx context.Context) error {
 		if err := db.Sync(ctx); err != nil && !errors.Is(err, context.Canceled) {
 			db.Logger.Printf("sync error: %s", err)
 		}
+		db.syncReplicasOnCommit(ctx)
+	}
+}
+
+// syncOnCommit returns true if any replica has SyncOnCommit enabled.
+func (db *DB) syncOnCommit() bool {
+	for _, r := range db.Replicas {
+		if r.SyncOnCommit {
+			return true
+		}
+	}
+	return false
+}
+
+// syncReplicasOnCommit synchronously syncs each replica with SyncOnCommit
+// enabled so new shadow WAL data is shipped before the next change is handled.
+//
+// Replicas which have stopped with a terminal error are skipped. After a
+// failure, a replica is skipped until its monitor's retry delay has elapsed
+// so a failing client does not stall every commit.
+func (db *DB) syncReplicasOnCommit(ctx context.Context) {
+	for _, r := range db.Replicas {
+		if !r.SyncOnCommit || r.Err() != nil || time.Now().Before(r.commitRetryAt) {
+			continue
+		}
+
+		err := r.Sync(ctx)
+		if ctx.Err() != nil {
+			return
+		} else if err == nil || err == ErrNoGeneration {
+			r.commitFailures, r.commitRetryAt = 0, time.Time{}
+			continue
+		}
+
+		r.commitFailures++
+		r.commitRetryAt = time.Now().Add(r.syncDelay(r.commitFailures))
+		r.Logger.Printf("sync on commit error (failures=%d): %s", r.commitFailures, err)
 	}
 }
 
@@ -1995,6 +2179,63 @@ var (
 	}, []string{"db", "mode"})
 )
 
+// verifyWAL reads WAL data from r and verifies the header checksum, that each
+// frame carries the header salt, and that frame checksums form a valid chain.
+// WAL data must start from the beginning of the WAL header and must end on a
+// commit frame, if any frames exist. Returns ErrChecksumMismatch if a header
+// or frame checksum is invalid.
+func verifyWAL(r io.Reader) error {
+	hdr := make([]byte, WALHeaderSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return fmt.Errorf("short wal header: %w", err)
+	}
+
+	byteOrder, err := headerByteOrder(hdr)
+	if err != nil {
+		return err
+	}
+
+	chksum0, chksum1 := Checksum(byteOrder, 0, 0, hdr[:24])
+	if v0, v1 := binary.BigEndian.Uint32(hdr[24:]), binary.BigEndian.Uint32(hdr[28:]); v0 != chksum0 || v1 != chksum1 {
+		return fmt.Errorf("wal header: %w", ErrChecksumMismatch)
+	}
+
+	pageSize := int(binary.BigEndian.Uint32(hdr[8:]))
+	if pageSize < 512 || pageSize > 65536 || pageSize&(pageSize-1) != 0 {
+		return fmt.Errorf("invalid wal page size: %d", pageSize)
+	}
+	salt0 := binary.BigEndian.Uint32(hdr[16:])
+	salt1 := binary.BigEndian.Uint32(hdr[20:])
+
+	frame := make([]byte, pageSize+WALFrameHeaderSize)
+	offset, commit := int64(WALHeaderSize), true
+	for {
+		if n, err := io.ReadFull(r, frame); err == io.EOF {
+			break // end of WAL data
+		} else if err != nil {
+			return fmt.Errorf("short wal frame at offset %s (n=%d): %w", FormatOffset(offset), n, err)
+		}
+
+		if binary.BigEndian.Uint32(frame[8:]) != salt0 || binary.BigEndian.Uint32(frame[12:]) != salt1 {
+			return fmt.Errorf("wal frame salt mismatch at offset %s", FormatOffset(offset))
+		}
+
+		chksum0, chksum1 = Checksum(byteOrder, chksum0, chksum1, frame[:8])  // frame header
+		chksum0, chksum1 = Checksum(byteOrder, chksum0, chksum1, frame[24:]) // frame data
+		if v0, v1 := binary.BigEndian.Uint32(frame[16:]), binary.BigEndian.Uint32(frame[20:]); v0 != chksum0 || v1 != chksum1 {
+			return fmt.Errorf("wal frame at offset %s: %w", FormatOffset(offset), ErrChecksumMismatch)
+		}
+
+		commit = binary.BigEndian.Uint32(frame[4:]) != 0
+		offset += int64(len(frame))
+	}
+
+	if !commit {
+		return fmt.Errorf("wal does not end on a commit frame")
+	}
+	return nil
+}
+
 func headerByteOrder(hdr []byte) (binary.ByteOrder, error) {
 	magic := binary.BigEndian.Uint32(hdr[0:])
 	switch magic {
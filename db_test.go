@@ -5,13 +5,16 @@ import (
 	"context"
 	"database/sql"
 	"encoding/binary"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/benbjohnson/litestream"
+	"github.com/pierrec/lz4/v4"
 )
 
 func TestDB_Path(t *testing.T) {
@@ -64,6 +67,45 @@ func TestDB_ShadowWALDir(t *testing.T) {
 	}
 }
 
+func TestDB_Open(t *testing.T) {
+	t.Run("RecoverTmpFiles", func(t *testing.T) {
+		db := litestream.NewDB(filepath.Join(t.TempDir(), "db"))
+		db.RecoverTmpFiles = true
+
+		// Write a complete LZ4 stream & a truncated one as orphaned temp files.
+		var buf bytes.Buffer
+		zw := lz4.NewWriter(&buf)
+		if _, err := zw.Write(bytes.Repeat([]byte("foo"), 1000)); err != nil {
+			t.Fatal(err)
+		} else if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.MkdirAll(db.MetaPath(), 0700); err != nil {
+			t.Fatal(err)
+		} else if err := os.WriteFile(filepath.Join(db.MetaPath(), "valid.lz4.tmp"), buf.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		} else if err := os.WriteFile(filepath.Join(db.MetaPath(), "invalid.lz4.tmp"), buf.Bytes()[:buf.Len()-4], 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer MustCloseDB(t, db)
+
+		// Valid file should be renamed into place & the invalid one removed.
+		if _, err := os.Stat(filepath.Join(db.MetaPath(), "valid.lz4")); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"valid.lz4.tmp", "invalid.lz4.tmp", "invalid.lz4"} {
+			if _, err := os.Stat(filepath.Join(db.MetaPath(), name)); !os.IsNotExist(err) {
+				t.Fatalf("expected %s to not exist: %v", name, err)
+			}
+		}
+	})
+}
+
 // Ensure we can check the last modified time of the real database and its WAL.
 func TestDB_UpdatedAt(t *testing.T) {
 	t.Run("ErrNotExist", func(t *testing.T) {
@@ -430,6 +472,175 @@ func TestDB_Sync(t *testing.T) {
 	})
 }
 
+// Ensure changes fan out to every replica & the replica position reflects
+// the slowest replica.
+func TestDB_ReplicaPos(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	if got := db.ReplicaPos(); !got.IsZero() {
+		t.Fatalf("ReplicaPos()=%v, want zero", got)
+	}
+
+	// Replicas are started when the database is initialized.
+	c0, c1 := litestream.NewFileReplicaClient(t.TempDir()), litestream.NewFileReplicaClient(t.TempDir())
+	r0, r1 := litestream.NewReplica(db, "r0", c0), litestream.NewReplica(db, "r1", c1)
+	r0.SyncInterval, r1.SyncInterval = time.Millisecond, time.Millisecond
+	db.Replicas = []*litestream.Replica{r0, r1}
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, r := range db.Replicas {
+		if err := r.WaitForPos(ctx, db.Pos()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []*litestream.FileReplicaClient{c0, c1} {
+		if generations, err := c.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := generations, []string{db.Pos().Generation}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: Generations()=%v, want %v", c.Path(), got, want)
+		}
+	}
+	if got, want := db.ReplicaPos(), db.Pos(); got != want {
+		t.Fatalf("ReplicaPos()=%v, want %v", got, want)
+	}
+
+	// Advance only the first replica.
+	r1.Stop()
+	prev := r1.Pos()
+	if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r0.WaitForPos(ctx, db.Pos()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := db.ReplicaPos(), prev; got != want {
+		t.Fatalf("ReplicaPos()=%v, want %v", got, want)
+	}
+}
+
+func TestDB_CommittedWALReader(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	pos := db.Pos()
+
+	// Simulate a segment written to the active index ahead of the position.
+	var buf bytes.Buffer
+	zw := lz4.NewWriter(&buf)
+	if _, err := zw.Write(make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	} else if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(filepath.Join(db.ShadowWALDir(pos.Generation), litestream.FormatIndex(pos.Index), litestream.FormatOffset(pos.Offset)+".wal.lz4"), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The raw index includes the uncommitted segment.
+	rc, err := db.WALReader(context.Background(), pos.Generation, pos.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if b, err := io.ReadAll(rc); err != nil {
+		t.Fatal(err)
+	} else if got, want := int64(len(b)), pos.Offset+4096; got != want {
+		t.Fatalf("raw len=%d, want %d", got, want)
+	}
+
+	// The committed reader stops at the position offset.
+	crc, n, err := db.CommittedWALReader(context.Background(), pos.Generation, pos.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer crc.Close()
+	if got, want := n, pos.Offset; got != want {
+		t.Fatalf("n=%d, want %d", got, want)
+	} else if b, err := io.ReadAll(crc); err != nil {
+		t.Fatal(err)
+	} else if got, want := int64(len(b)), pos.Offset; got != want {
+		t.Fatalf("committed len=%d, want %d", got, want)
+	}
+}
+
+func TestDB_ReadOnly(t *testing.T) {
+	// Create database & WAL from a separate writer connection.
+	path := filepath.Join(t.TempDir(), "db")
+	sqldb := MustOpenSQLDB(t, path)
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		t.Fatal(err)
+	}
+
+	db := litestream.NewDB(path)
+	db.ReadOnly = true
+	client := litestream.NewFileReplicaClient(t.TempDir())
+	r := litestream.NewReplica(db, "", client)
+	r.MonitorEnabled = false
+	db.Replicas = []*litestream.Replica{r}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer MustCloseDBs(t, db, sqldb)
+
+	// Snapshot & replicate the existing frames.
+	if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if _, err := r.Snapshot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replicate frames written by the writer after the snapshot.
+	if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('bat');`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if got, want := r.Pos(), db.Pos(); got != want {
+		t.Fatalf("Pos()=%s, want %s", got, want)
+	}
+
+	// Litestream should not have written its internal tables or checkpointed.
+	var n int
+	if err := sqldb.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE name LIKE '_litestream%'`).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("unexpected litestream tables: n=%d", n)
+	}
+	if err := db.Checkpoint(context.Background(), litestream.CheckpointModePassive); err == nil || err.Error() != `cannot checkpoint read-only database` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "db")
+	if err := litestream.RestoreLatest(context.Background(), client, filename, litestream.NewRestoreOptions()); err != nil {
+		t.Fatal(err)
+	}
+	other := MustOpenSQLDB(t, filename)
+	defer MustCloseSQLDB(t, other)
+	if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("n=%d, want 2", n)
+	}
+}
+
 func TestReadWALFields(t *testing.T) {
 	b, err := os.ReadFile("testdata/read-wal-fields/ok")
 	if err != nil {
@@ -1,15 +1,20 @@
 package litestream
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/benbjohnson/litestream/internal"
 )
@@ -18,15 +23,117 @@ import (
 const FileReplicaClientType = "file"
 
 var _ ReplicaClient = (*FileReplicaClient)(nil)
+var _ ImmutableGenerationClient = (*FileReplicaClient)(nil)
+var _ FlushClient = (*FileReplicaClient)(nil)
+var _ InfoClient = (*FileReplicaClient)(nil)
+var _ FreeSpaceClient = (*FileReplicaClient)(nil)
+var _ AttachedClient = (*FileReplicaClient)(nil)
+var _ WALIndexClient = (*FileReplicaClient)(nil)
+
+// FsyncMode determines when FileReplicaClient fsyncs written WAL segments.
+type FsyncMode int
+
+const (
+	// FsyncPerFile fsyncs each WAL segment before it is moved into place.
+	FsyncPerFile FsyncMode = iota
+
+	// FsyncPerSync defers fsyncs until Flush() is called at the end of each
+	// replica sync. A crash before the flush can lose or truncate segments
+	// which the replica has already recorded as written.
+	FsyncPerSync
+)
+
+// ParseFsyncMode returns the fsync mode for a config string.
+func ParseFsyncMode(s string) (FsyncMode, error) {
+	switch s {
+	case "", "per-file":
+		return FsyncPerFile, nil
+	case "per-sync":
+		return FsyncPerSync, nil
+	default:
+		return 0, fmt.Errorf("invalid fsync mode: %q", s)
+	}
+}
+
+// Directory layout versions of a file replica.
+const (
+	// FileReplicaLayoutV1 stores WAL segments directly within each
+	// generation's WAL directory as "<index>_<offset>.wal.lz4".
+	FileReplicaLayoutV1 = 1
+
+	// FileReplicaLayoutV2 stores WAL segments within a directory per index as
+	// "<index>/<offset>.wal.lz4". Indexes may also be packed into archives.
+	FileReplicaLayoutV2 = 2
+
+	// FileReplicaLayoutVersion is the layout written by this client.
+	FileReplicaLayoutVersion = FileReplicaLayoutV2
+)
+
+// Kinds of files passed to FileReplicaClient.PathRewriter.
+const (
+	FilePathKindSnapshot = "snapshot"
+	FilePathKindWAL      = "wal"
+)
 
 // FileReplicaClient is a client for writing snapshots & WAL segments to disk.
 type FileReplicaClient struct {
 	path string // destination path
 
+	mu       sync.Mutex
+	unsynced map[string]struct{} // WAL segments awaiting fsync
+	layout   int                 // cached layout version, if non-zero
+	versionW bool                // true once the VERSION file is known to exist
+	mum      sync.Mutex          // serializes manifest updates
+
 	// File info
 	FileMode os.FileMode
 	DirMode  os.FileMode
 	Uid, Gid int
+
+	// If true, all WAL segments within an index are packed into a single
+	// archive file once the first segment of the next index is written.
+	// This reduces file counts for destinations with a per-file cost.
+	ArchiveWAL bool
+
+	// Determines which names are listed as generations.
+	// Uses DefaultGenerationFormat if nil.
+	GenerationFormat GenerationFormat
+
+	// Filesystem used to read & write replica files.
+	// Uses the local filesystem via the os package if nil.
+	FS FileReplicaFS
+
+	// Determines when WAL segments are fsynced. Snapshots are always
+	// fsynced before they are moved into place.
+	FsyncMode FsyncMode
+
+	// If true, snapshots are written with a UTC timestamp prefix such as
+	// "20240115T143000Z-0000000000001234.snapshot.lz4". Snapshots are read
+	// under either naming regardless of this setting. Other replica clients
+	// do not recognize timestamped names so these files should not be copied
+	// to another replica type directly.
+	SnapshotTimestampNames bool
+
+	// If true, a manifest listing the snapshots & WAL segments of each
+	// generation is kept in a "manifest.json" file within the generation &
+	// listings are read from it instead of walking the generation's
+	// directories. The whole manifest is read & rewritten on every write &
+	// delete so the cost of each write grows with the number of files in the
+	// generation. This trades write cost for cheaper listings & suits
+	// generations which are snapshotted & retained regularly. A missing manifest is rebuilt
+	// from the files & an existing one is removed when files change while
+	// this is disabled so that it never becomes stale.
+	Manifest bool
+
+	// Optional function which returns the root directory used in place of
+	// the client path for a snapshot or WAL file of a generation. An empty
+	// root uses the client path. Files keep the same layout under the root
+	// so their names still parse. The root is chosen per kind & generation,
+	// rather than per index, so that listings, reads & writes of a generation
+	// always resolve to the same directory. Generation directories, markers &
+	// manifests are always kept under the client path. GC only scans the
+	// client path.
+	PathRewriter func(kind, generation string) string
 }
 
 // NewFileReplicaClient returns a new instance of FileReplicaClient.
@@ -39,16 +146,42 @@ func NewFileReplicaClient(path string) *FileReplicaClient {
 	}
 }
 
+// fsys returns the filesystem used by the client.
+func (c *FileReplicaClient) fsys() FileReplicaFS {
+	if c.FS != nil {
+		return c.FS
+	}
+	return &osFS{uid: c.Uid, gid: c.Gid}
+}
+
 // Type returns "file" as the client type.
 func (c *FileReplicaClient) Type() string {
 	return FileReplicaClientType
 }
 
+// Location returns the destination path.
+func (c *FileReplicaClient) Location() string {
+	return c.path
+}
+
+// IsValidGenerationName returns true if name matches the client's generation format.
+func (c *FileReplicaClient) IsValidGenerationName(name string) bool {
+	return IsValidGenerationName(c.GenerationFormat, name)
+}
+
 // Path returns the destination path to replicate the database to.
 func (c *FileReplicaClient) Path() string {
 	return c.path
 }
 
+// VersionPath returns the path to the file holding the layout version.
+func (c *FileReplicaClient) VersionPath() (string, error) {
+	if c.path == "" {
+		return "", fmt.Errorf("file replica path required")
+	}
+	return filepath.Join(c.path, "VERSION"), nil
+}
+
 // GenerationsDir returns the path to a generation root directory.
 func (c *FileReplicaClient) GenerationsDir() (string, error) {
 	if c.path == "" {
@@ -68,27 +201,88 @@ func (c *FileReplicaClient) GenerationDir(generation string) (string, error) {
 	return filepath.Join(dir, generation), nil
 }
 
+// kindGenerationDir returns the generation directory holding files of kind,
+// as routed by PathRewriter. Uses GenerationDir if no root is returned.
+func (c *FileReplicaClient) kindGenerationDir(kind, generation string) (string, error) {
+	if c.PathRewriter == nil {
+		return c.GenerationDir(generation)
+	} else if generation == "" {
+		return "", fmt.Errorf("generation required")
+	}
+
+	root := c.PathRewriter(kind, generation)
+	if root == "" {
+		return c.GenerationDir(generation)
+	}
+	return filepath.Join(root, "generations", generation), nil
+}
+
+// ensureGenerationDir creates the generation directory under the client path
+// so generations are listed when their files are routed elsewhere.
+func (c *FileReplicaClient) ensureGenerationDir(generation string) error {
+	if c.PathRewriter == nil {
+		return nil
+	}
+
+	dir, err := c.GenerationDir(generation)
+	if err != nil {
+		return err
+	}
+	return c.fsys().MkdirAll(dir, c.DirMode)
+}
+
+// ImmutablePath returns the path to a generation's immutable marker file.
+func (c *FileReplicaClient) ImmutablePath(generation string) (string, error) {
+	dir, err := c.GenerationDir(generation)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "immutable"), nil
+}
+
 // SnapshotsDir returns the path to a generation's snapshot directory.
 func (c *FileReplicaClient) SnapshotsDir(generation string) (string, error) {
-	dir, err := c.GenerationDir(generation)
+	dir, err := c.kindGenerationDir(FilePathKindSnapshot, generation)
 	if err != nil {
 		return "", err
 	}
 	return filepath.Join(dir, "snapshots"), nil
 }
 
-// SnapshotPath returns the path to an uncompressed snapshot file.
+// SnapshotPath returns the path to a snapshot file. If the snapshot only
+// exists under a timestamped name then that path is returned. Otherwise the
+// path without a timestamp is returned.
 func (c *FileReplicaClient) SnapshotPath(generation string, index int) (string, error) {
 	dir, err := c.SnapshotsDir(generation)
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(dir, FormatIndex(index)+".snapshot.lz4"), nil
+
+	filename := filepath.Join(dir, internal.FormatSnapshotPath(index, time.Time{}))
+	if _, err := c.fsys().Stat(filename); err == nil {
+		return filename, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	// Search for the snapshot under a timestamped name.
+	names, err := readDirNames(c.fsys(), dir)
+	if os.IsNotExist(err) {
+		return filename, nil
+	} else if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if i, err := internal.ParseTimestampedSnapshotPath(name); err == nil && i == index {
+			return filepath.Join(dir, name), nil
+		}
+	}
+	return filename, nil
 }
 
 // WALDir returns the path to a generation's WAL directory
 func (c *FileReplicaClient) WALDir(generation string) (string, error) {
-	dir, err := c.GenerationDir(generation)
+	dir, err := c.kindGenerationDir(FilePathKindWAL, generation)
 	if err != nil {
 		return "", err
 	}
@@ -104,6 +298,210 @@ func (c *FileReplicaClient) WALSegmentPath(generation string, index int, offset
 	return filepath.Join(dir, FormatIndex(index), fmt.Sprintf("%s.wal.lz4", FormatOffset(offset))), nil
 }
 
+// legacyWALSegmentPath returns the path to a WAL segment file in the
+// FileReplicaLayoutV1 layout.
+func (c *FileReplicaClient) legacyWALSegmentPath(generation string, index int, offset int64) (string, error) {
+	dir, err := c.WALDir(generation)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, FormatIndex(index)+"_"+FormatOffset(offset)+WALSegmentExt), nil
+}
+
+// parseLegacyWALSegmentName returns the index & offset of a WAL segment file
+// name in the FileReplicaLayoutV1 layout.
+func parseLegacyWALSegmentName(name string) (index int, offset int64, ok bool) {
+	a := strings.Split(strings.TrimSuffix(name, WALSegmentExt), "_")
+	if !strings.HasSuffix(name, WALSegmentExt) || len(a) != 2 {
+		return 0, 0, false
+	}
+
+	index, err := ParseIndex(a[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	if offset, err = ParseOffset(a[1]); err != nil {
+		return 0, 0, false
+	}
+	return index, offset, true
+}
+
+// LayoutVersion returns the directory layout version of the replica as stored
+// in its VERSION file. Replicas without a VERSION file are reported as
+// FileReplicaLayoutV1 if any WAL segments use the older flat layout & as the
+// current version otherwise. The result is cached by the client.
+func (c *FileReplicaClient) LayoutVersion(ctx context.Context) (int, error) {
+	c.mu.Lock()
+	v := c.layout
+	c.mu.Unlock()
+	if v != 0 {
+		return v, nil
+	}
+
+	v, exists, err := c.readLayoutVersion(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	c.layout, c.versionW = v, exists
+	c.mu.Unlock()
+	return v, nil
+}
+
+// readLayoutVersion reads the layout version from the VERSION file or, if it
+// does not exist, detects it from the WAL files of each generation.
+func (c *FileReplicaClient) readLayoutVersion(ctx context.Context) (v int, exists bool, err error) {
+	filename, err := c.VersionPath()
+	if err != nil {
+		return 0, false, err
+	}
+
+	if f, err := c.fsys().Open(filename); err == nil {
+		defer f.Close()
+
+		buf, err := io.ReadAll(f)
+		if err != nil {
+			return 0, false, err
+		} else if v, err = strconv.Atoi(strings.TrimSpace(string(buf))); err != nil {
+			return 0, false, fmt.Errorf("invalid layout version: %q", buf)
+		} else if v < FileReplicaLayoutV1 || v > FileReplicaLayoutVersion {
+			return 0, false, fmt.Errorf("unsupported layout version: %d", v)
+		}
+		return v, true, f.Close()
+	} else if !os.IsNotExist(err) {
+		return 0, false, err
+	}
+
+	generations, err := c.Generations(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, generation := range generations {
+		dir, err := c.WALDir(generation)
+		if err != nil {
+			return 0, false, err
+		}
+		names, err := readDirNames(c.fsys(), dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return 0, false, err
+		}
+		for _, name := range names {
+			if _, _, ok := parseLegacyWALSegmentName(name); ok {
+				return FileReplicaLayoutV1, false, nil
+			}
+		}
+	}
+	return FileReplicaLayoutVersion, false, nil
+}
+
+// ensureLayoutVersion writes the VERSION file if the replica uses the current
+// layout but does not have one yet. Older layouts are left for Migrate().
+func (c *FileReplicaClient) ensureLayoutVersion(ctx context.Context) error {
+	v, err := c.LayoutVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	exists := c.versionW
+	c.mu.Unlock()
+	if exists || v != FileReplicaLayoutVersion {
+		return nil
+	}
+	return c.writeLayoutVersion()
+}
+
+// writeLayoutVersion atomically writes the current layout version to the
+// VERSION file.
+func (c *FileReplicaClient) writeLayoutVersion() error {
+	filename, err := c.VersionPath()
+	if err != nil {
+		return err
+	} else if err := c.fsys().MkdirAll(c.path, c.DirMode); err != nil {
+		return err
+	}
+
+	f, err := c.fsys().Create(filename+".tmp", c.FileMode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "%d\n", FileReplicaLayoutVersion); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	} else if err := c.fsys().Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.layout, c.versionW = FileReplicaLayoutVersion, true
+	c.mu.Unlock()
+	return nil
+}
+
+// Migrate upgrades a replica written with an older directory layout to the
+// current layout & records the version in the VERSION file. WAL segments in
+// the FileReplicaLayoutV1 flat layout are moved into per-index directories.
+// It is safe to run on a replica which already uses the current layout.
+func (c *FileReplicaClient) Migrate(ctx context.Context) error {
+	generations, err := c.Generations(ctx)
+	if err != nil {
+		return fmt.Errorf("generations: %w", err)
+	}
+
+	for _, generation := range generations {
+		dir, err := c.WALDir(generation)
+		if err != nil {
+			return err
+		}
+		names, err := readDirNames(c.fsys(), dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			index, offset, ok := parseLegacyWALSegmentName(name)
+			if !ok {
+				continue
+			} else if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			filename, err := c.WALSegmentPath(generation, index, offset)
+			if err != nil {
+				return err
+			} else if err := c.fsys().MkdirAll(filepath.Dir(filename), c.DirMode); err != nil {
+				return err
+			} else if err := c.fsys().Rename(filepath.Join(dir, name), filename); err != nil {
+				return fmt.Errorf("move wal segment: %w", err)
+			}
+		}
+	}
+
+	if err := c.writeLayoutVersion(); err != nil {
+		return fmt.Errorf("write layout version: %w", err)
+	}
+	return nil
+}
+
+// WALArchivePath returns the path to the archive of all WAL segments in an index.
+func (c *FileReplicaClient) WALArchivePath(generation string, index int) (string, error) {
+	dir, err := c.WALDir(generation)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, FormatIndex(index)+WALArchiveExt), nil
+}
+
 // Generations returns a list of available generation names.
 func (c *FileReplicaClient) Generations(ctx context.Context) ([]string, error) {
 	root, err := c.GenerationsDir()
@@ -111,254 +509,1476 @@ func (c *FileReplicaClient) Generations(ctx context.Context) ([]string, error) {
 		return nil, fmt.Errorf("cannot determine generations path: %w", err)
 	}
 
-	fis, err := ioutil.ReadDir(root)
+	fis, err := c.fsys().ReadDir(root)
 	if os.IsNotExist(err) {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
 
-	var generations []string
-	for _, fi := range fis {
-		if !IsGenerationName(fi.Name()) {
-			continue
-		} else if !fi.IsDir() {
-			continue
+	var generations []string
+	for _, fi := range fis {
+		if !c.IsValidGenerationName(fi.Name()) {
+			continue
+		} else if !fi.IsDir() {
+			continue
+		}
+		generations = append(generations, fi.Name())
+	}
+	return generations, nil
+}
+
+// DeleteGeneration deletes all snapshots & WAL segments within a generation.
+func (c *FileReplicaClient) DeleteGeneration(ctx context.Context, generation string) error {
+	dir, err := c.GenerationDir(generation)
+	if err != nil {
+		return fmt.Errorf("cannot determine generation path: %w", err)
+	}
+
+	if err := c.fsys().RemoveAll(dir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Remove directories the generation's files were routed to.
+	for _, kind := range []string{FilePathKindSnapshot, FilePathKindWAL} {
+		other, err := c.kindGenerationDir(kind, generation)
+		if err != nil {
+			return fmt.Errorf("cannot determine generation path: %w", err)
+		} else if other == dir {
+			continue
+		} else if err := c.fsys().RemoveAll(other); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetGenerationImmutable marks a generation as immutable by writing a marker
+// file to the generation directory. The marker is removed if immutable is false.
+func (c *FileReplicaClient) SetGenerationImmutable(ctx context.Context, generation string, immutable bool) error {
+	filename, err := c.ImmutablePath(generation)
+	if err != nil {
+		return fmt.Errorf("cannot determine immutable marker path: %w", err)
+	}
+
+	if !immutable {
+		if err := c.fsys().Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	// Only mark generations which exist.
+	if _, err := c.fsys().Stat(filepath.Dir(filename)); err != nil {
+		return err
+	}
+
+	f, err := c.fsys().Create(filename, c.FileMode)
+	if err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// IsGenerationImmutable returns true if the generation's marker file exists.
+func (c *FileReplicaClient) IsGenerationImmutable(ctx context.Context, generation string) (bool, error) {
+	filename, err := c.ImmutablePath(generation)
+	if err != nil {
+		return false, fmt.Errorf("cannot determine immutable marker path: %w", err)
+	}
+
+	if _, err := c.fsys().Stat(filename); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Snapshots returns an iterator over all available snapshots for a generation.
+// Snapshots are read from the generation's manifest, if enabled & present.
+func (c *FileReplicaClient) Snapshots(ctx context.Context, generation string) (SnapshotIterator, error) {
+	if m, err := c.readManifest(generation); err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	} else if m != nil {
+		return NewSnapshotInfoSliceIterator(m.Snapshots), nil
+	}
+	return c.walkSnapshots(ctx, generation)
+}
+
+// walkSnapshots returns an iterator over the snapshot files of a generation.
+func (c *FileReplicaClient) walkSnapshots(ctx context.Context, generation string) (SnapshotIterator, error) {
+	dir, err := c.SnapshotsDir(generation)
+	if err != nil {
+		return nil, err
+	}
+
+	fis, err := c.fsys().ReadDir(dir)
+	if os.IsNotExist(err) {
+		return NewSnapshotInfoSliceIterator(nil), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Iterate over every file and convert to metadata.
+	infos := make([]SnapshotInfo, 0, len(fis))
+	for _, fi := range fis {
+		// Parse index from filename.
+		index, err := internal.ParseTimestampedSnapshotPath(filepath.Base(fi.Name()))
+		if err != nil {
+			continue
+		}
+
+		infos = append(infos, SnapshotInfo{
+			Generation: generation,
+			Index:      index,
+			Size:       fi.Size(),
+			CreatedAt:  fi.ModTime().UTC(),
+		})
+	}
+
+	sort.Sort(SnapshotInfoSlice(infos))
+
+	return NewSnapshotInfoSliceIterator(infos), nil
+}
+
+// SnapshotInfoAt returns metadata for the snapshot at index by reading the
+// attributes of its file. Returns os.ErrNotExist if the snapshot does not exist.
+func (c *FileReplicaClient) SnapshotInfoAt(ctx context.Context, generation string, index int) (*SnapshotInfo, error) {
+	filename, err := c.SnapshotPath(generation, index)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := c.fsys().Stat(filename)
+	if os.IsNotExist(err) {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &SnapshotInfo{
+		Generation: generation,
+		Index:      index,
+		Size:       fi.Size(),
+		CreatedAt:  fi.ModTime().UTC(),
+	}, nil
+}
+
+// WriteSnapshot writes LZ4 compressed data from rd into a file on disk.
+// Any existing snapshot at the same index is replaced, even if it was written
+// under a different naming.
+func (c *FileReplicaClient) WriteSnapshot(ctx context.Context, generation string, index int, rd io.Reader) (info SnapshotInfo, err error) {
+	existing, err := c.SnapshotPath(generation, index)
+	if err != nil {
+		return info, err
+	} else if err := c.ensureLayoutVersion(ctx); err != nil {
+		return info, fmt.Errorf("layout version: %w", err)
+	}
+
+	var createdAt time.Time
+	if c.SnapshotTimestampNames {
+		createdAt = time.Now()
+	}
+	filename := filepath.Join(filepath.Dir(existing), internal.FormatSnapshotPath(index, createdAt))
+
+	// Ensure parent directory exists.
+	if err := c.fsys().MkdirAll(filepath.Dir(filename), c.DirMode); err != nil {
+		return info, err
+	} else if err := c.ensureGenerationDir(generation); err != nil {
+		return info, err
+	}
+
+	// Write snapshot to temporary file next to destination path. The partial
+	// file is removed if the write fails, such as when the disk is full.
+	f, err := c.fsys().Create(filename+".tmp", c.FileMode)
+	if err != nil {
+		return info, err
+	}
+	defer func() {
+		if err != nil {
+			_ = c.fsys().Remove(filename + ".tmp")
+		}
+	}()
+	defer f.Close()
+
+	if _, err := io.Copy(f, rd); err != nil {
+		return info, err
+	} else if err := f.Sync(); err != nil {
+		return info, err
+	} else if err := f.Close(); err != nil {
+		return info, err
+	}
+
+	// Build metadata.
+	fi, err := c.fsys().Stat(filename + ".tmp")
+	if err != nil {
+		return info, err
+	}
+	info = SnapshotInfo{
+		Generation: generation,
+		Index:      index,
+		Size:       fi.Size(),
+		CreatedAt:  fi.ModTime().UTC(),
+	}
+
+	// Move snapshot to final path when it has been fully written & synced to disk.
+	if err := c.fsys().Rename(filename+".tmp", filename); err != nil {
+		return info, err
+	}
+
+	// Remove the previous snapshot if it was stored under another name.
+	if existing != filename {
+		if err := c.fsys().Remove(existing); err != nil && !os.IsNotExist(err) {
+			return info, err
+		}
+	}
+
+	if err := c.updateManifest(ctx, generation, func(m *fileReplicaManifest) { m.addSnapshot(info) }); err != nil {
+		return info, fmt.Errorf("update manifest: %w", err)
+	}
+
+	return info, nil
+}
+
+// SnapshotReader returns a reader for snapshot data at the given generation/index.
+// Returns os.ErrNotExist if no matching index is found.
+func (c *FileReplicaClient) SnapshotReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	filename, err := c.SnapshotPath(generation, index)
+	if err != nil {
+		return nil, err
+	}
+	return c.fsys().Open(filename)
+}
+
+// SnapshotReaderAt returns a random access reader for the uncompressed
+// snapshot data along with its size. Uncompressed full snapshots are read
+// directly from the snapshot file while compressed & delta snapshots are first
+// reconstructed into a temporary file. The returned reader implements
+// io.Closer and should be closed by the caller to release the file & remove
+// any temporary data.
+func (c *FileReplicaClient) SnapshotReaderAt(ctx context.Context, generation string, index int) (io.ReaderAt, int64, error) {
+	filename, err := c.SnapshotPath(generation, index)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f, err := c.fsys().Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Return the file directly if it does not begin with the LZ4 magic number
+	// or the delta snapshot magic.
+	magic := make([]byte, len(deltaSnapshotMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	compressed := n >= len(lz4FrameMagic) && isLZ4Magic(magic[:len(lz4FrameMagic)])
+	if !compressed && string(magic[:n]) != deltaSnapshotMagic {
+		fi, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, 0, err
+		}
+		return f, fi.Size(), nil
+	} else if err := f.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	// Reconstruct the database image in a temporary file on the local
+	// filesystem which is removed when closed.
+	tmp, err := ioutil.TempFile("", "litestream-snapshot-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	rd := &tmpFileReaderAt{File: tmp}
+
+	if err := writeSnapshotImage(ctx, c, tmp, generation, index, nil); err != nil {
+		_ = rd.Close()
+		return nil, 0, fmt.Errorf("decompress snapshot: %w", err)
+	}
+	fi, err := tmp.Stat()
+	if err != nil {
+		_ = rd.Close()
+		return nil, 0, err
+	}
+	return rd, fi.Size(), nil
+}
+
+// tmpFileReaderAt wraps a temporary file & removes it when closed.
+type tmpFileReaderAt struct {
+	*os.File
+}
+
+// Close closes & removes the underlying file.
+func (f *tmpFileReaderAt) Close() error {
+	err := f.File.Close()
+	if e := os.Remove(f.Name()); err == nil {
+		err = e
+	}
+	return err
+}
+
+// DeleteSnapshot deletes a snapshot with the given generation & index. Images
+// of attached databases captured with the snapshot are also deleted.
+func (c *FileReplicaClient) DeleteSnapshot(ctx context.Context, generation string, index int) error {
+	filename, err := c.SnapshotPath(generation, index)
+	if err != nil {
+		return fmt.Errorf("cannot determine snapshot path: %w", err)
+	}
+	if err := c.fsys().Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err := c.deleteAttachedSnapshots(generation, index); err != nil {
+		return err
+	}
+
+	if err := c.updateManifest(ctx, generation, func(m *fileReplicaManifest) { m.removeSnapshot(index) }); err != nil {
+		return fmt.Errorf("update manifest: %w", err)
+	}
+	return nil
+}
+
+// AttachedDir returns the path to the directory holding the images of an
+// attached database within a generation.
+func (c *FileReplicaClient) AttachedDir(generation, name string) (string, error) {
+	dir, err := c.GenerationDir(generation)
+	if err != nil {
+		return "", err
+	} else if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid attached database name: %q", name)
+	}
+	return filepath.Join(dir, "attached", name), nil
+}
+
+// AttachedSnapshotPath returns the path to the image of an attached database
+// captured at pos.
+func (c *FileReplicaClient) AttachedSnapshotPath(name string, pos Pos) (string, error) {
+	dir, err := c.AttachedDir(pos.Generation, name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, FormatIndex(pos.Index), FormatOffset(pos.Offset)+SnapshotExt), nil
+}
+
+// WriteAttachedSnapshot writes the image of an attached database captured at
+// pos. Images previously written for the same index are removed.
+func (c *FileReplicaClient) WriteAttachedSnapshot(ctx context.Context, name string, pos Pos, rd io.Reader) (info SnapshotInfo, err error) {
+	filename, err := c.AttachedSnapshotPath(name, pos)
+	if err != nil {
+		return info, err
+	} else if err := c.fsys().MkdirAll(filepath.Dir(filename), c.DirMode); err != nil {
+		return info, err
+	}
+
+	f, err := c.fsys().Create(filename+".tmp", c.FileMode)
+	if err != nil {
+		return info, err
+	}
+	defer func() {
+		if err != nil {
+			_ = c.fsys().Remove(filename + ".tmp")
+		}
+	}()
+	defer f.Close()
+
+	if _, err := io.Copy(f, rd); err != nil {
+		return info, err
+	} else if err := f.Sync(); err != nil {
+		return info, err
+	} else if err := f.Close(); err != nil {
+		return info, err
+	}
+
+	fi, err := c.fsys().Stat(filename + ".tmp")
+	if err != nil {
+		return info, err
+	}
+	info = SnapshotInfo{
+		Generation: pos.Generation,
+		Index:      pos.Index,
+		Size:       fi.Size(),
+		CreatedAt:  fi.ModTime().UTC(),
+	}
+
+	if err := c.fsys().Rename(filename+".tmp", filename); err != nil {
+		return info, err
+	}
+
+	// Remove images captured at other offsets within the same index.
+	names, err := readDirNames(c.fsys(), filepath.Dir(filename))
+	if err != nil {
+		return info, err
+	}
+	for _, s := range names {
+		if s != filepath.Base(filename) && strings.HasSuffix(s, SnapshotExt) {
+			if err := c.fsys().Remove(filepath.Join(filepath.Dir(filename), s)); err != nil && !os.IsNotExist(err) {
+				return info, err
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// AttachedSnapshotPos returns the position the image of an attached database
+// was captured at for the snapshot at index. Returns os.ErrNotExist if no
+// image exists.
+func (c *FileReplicaClient) AttachedSnapshotPos(ctx context.Context, generation, name string, index int) (Pos, error) {
+	dir, err := c.AttachedDir(generation, name)
+	if err != nil {
+		return Pos{}, err
+	}
+
+	names, err := readDirNames(c.fsys(), filepath.Join(dir, FormatIndex(index)))
+	if os.IsNotExist(err) {
+		return Pos{}, os.ErrNotExist
+	} else if err != nil {
+		return Pos{}, err
+	}
+	for _, s := range names {
+		if !strings.HasSuffix(s, SnapshotExt) {
+			continue
+		}
+		offset, err := ParseOffset(strings.TrimSuffix(s, SnapshotExt))
+		if err != nil {
+			continue
+		}
+		return Pos{Generation: generation, Index: index, Offset: offset}, nil
+	}
+	return Pos{}, os.ErrNotExist
+}
+
+// AttachedSnapshotReader returns a reader for the image of an attached
+// database captured at pos. Returns os.ErrNotExist if no image exists.
+func (c *FileReplicaClient) AttachedSnapshotReader(ctx context.Context, name string, pos Pos) (io.ReadCloser, error) {
+	filename, err := c.AttachedSnapshotPath(name, pos)
+	if err != nil {
+		return nil, err
+	}
+	return c.fsys().Open(filename)
+}
+
+// AttachedNames returns the names of attached databases with images in a
+// generation.
+func (c *FileReplicaClient) AttachedNames(ctx context.Context, generation string) ([]string, error) {
+	dir, err := c.GenerationDir(generation)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := readDirNames(c.fsys(), filepath.Join(dir, "attached"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return names, err
+}
+
+// deleteAttachedSnapshots removes the images of all attached databases which
+// were captured with the snapshot at index.
+func (c *FileReplicaClient) deleteAttachedSnapshots(generation string, index int) error {
+	dir, err := c.GenerationDir(generation)
+	if err != nil {
+		return err
+	}
+
+	names, err := readDirNames(c.fsys(), filepath.Join(dir, "attached"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := c.fsys().RemoveAll(filepath.Join(dir, "attached", name, FormatIndex(index))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// WALSegments returns an iterator over all available WAL files for a generation.
+// Segments are read from the generation's manifest, if enabled & present.
+func (c *FileReplicaClient) WALSegments(ctx context.Context, generation string) (WALSegmentIterator, error) {
+	if m, err := c.readManifest(generation); err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	} else if m != nil {
+		return NewWALSegmentInfoSliceIterator(m.WALSegments), nil
+	}
+	return c.walkWALSegments(ctx, generation)
+}
+
+// walkWALSegments returns an iterator over the WAL segment files of a generation.
+func (c *FileReplicaClient) walkWALSegments(ctx context.Context, generation string) (WALSegmentIterator, error) {
+	dir, err := c.WALDir(generation)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes, _, err := readWALIndexes(c.fsys(), dir)
+	if os.IsNotExist(err) {
+		return NewWALSegmentInfoSliceIterator(nil), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	itr := NewFileWALSegmentIterator(dir, generation, indexes)
+	itr.fsys = c.fsys()
+
+	// Older replicas may also hold segments in the flat layout.
+	if v, err := c.LayoutVersion(ctx); err != nil {
+		_ = itr.Close()
+		return nil, err
+	} else if v == FileReplicaLayoutV1 {
+		return c.legacyWALSegments(dir, generation, itr)
+	}
+	return itr, nil
+}
+
+// legacyWALSegments returns the segments from itr combined with any segments
+// stored in the FileReplicaLayoutV1 flat layout within dir.
+func (c *FileReplicaClient) legacyWALSegments(dir, generation string, itr WALSegmentIterator) (WALSegmentIterator, error) {
+	infos, err := SliceWALSegmentIterator(itr)
+	if err != nil {
+		return nil, err
+	}
+
+	fis, err := c.fsys().ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if index, offset, ok := parseLegacyWALSegmentName(fi.Name()); ok && !fi.IsDir() {
+			infos = append(infos, WALSegmentInfo{
+				Generation: generation,
+				Index:      index,
+				Offset:     offset,
+				Size:       fi.Size(),
+				CreatedAt:  fi.ModTime().UTC(),
+			})
+		}
+	}
+	sort.Sort(WALSegmentInfoSlice(infos))
+
+	return NewWALSegmentInfoSliceIterator(infos), nil
+}
+
+// WALIndices returns a sorted list of WAL indexes that contain at least one
+// segment within a generation. This includes indexes that are only available
+// as an archive. Returns nil if the generation has no WAL directory.
+func (c *FileReplicaClient) WALIndices(ctx context.Context, generation string) ([]int, error) {
+	dir, err := c.WALDir(generation)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes, archived, err := readWALIndexes(c.fsys(), dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Exclude index directories that no longer hold any segments.
+	other := make([]int, 0, len(indexes))
+	for _, index := range indexes {
+		if _, ok := archived[index]; !ok {
+			names, err := readDirNames(c.fsys(), filepath.Join(dir, FormatIndex(index)))
+			if err != nil {
+				return nil, err
+			} else if !containsSuffix(names, WALSegmentExt) {
+				continue
+			}
+		}
+		other = append(other, index)
+	}
+
+	// Include indexes stored in the flat layout used by older replicas.
+	if v, err := c.LayoutVersion(ctx); err != nil {
+		return nil, err
+	} else if v == FileReplicaLayoutV1 {
+		names, err := readDirNames(c.fsys(), dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if index, _, ok := parseLegacyWALSegmentName(name); ok {
+				other = append(other, index)
+			}
+		}
+		other = uniqueInts(other)
+	}
+	return other, nil
+}
+
+// uniqueInts returns a sorted copy of a with duplicates removed.
+func uniqueInts(a []int) []int {
+	other := append([]int(nil), a...)
+	sort.Ints(other)
+
+	n := 0
+	for i, v := range other {
+		if i == 0 || v != other[n-1] {
+			other[n] = v
+			n++
+		}
+	}
+	return other[:n]
+}
+
+// readWALIndexes returns a sorted, unique list of indexes within a WAL
+// directory. Indexes may exist as either a directory of segments or as a
+// single archive file. The set of indexes with an archive is also returned.
+func readWALIndexes(fsys FileReplicaFS, dir string) (indexes []int, archived map[int]struct{}, err error) {
+	fis, err := fsys.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := make(map[int]struct{}, len(fis))
+	archived = make(map[int]struct{})
+	indexes = make([]int, 0, len(fis))
+	for _, fi := range fis {
+		name := fi.Name()
+		if !fi.IsDir() {
+			if !strings.HasSuffix(name, WALArchiveExt) {
+				continue
+			}
+			name = strings.TrimSuffix(name, WALArchiveExt)
+		}
+
+		index, err := ParseIndex(name)
+		if err != nil {
+			continue
+		} else if !fi.IsDir() {
+			archived[index] = struct{}{}
+		}
+
+		if _, ok := m[index]; ok {
+			continue
+		}
+		m[index] = struct{}{}
+		indexes = append(indexes, index)
+	}
+
+	sort.Ints(indexes)
+
+	return indexes, archived, nil
+}
+
+// readDirNames returns the names of all entries in a directory.
+func readDirNames(fsys FileReplicaFS, dir string) ([]string, error) {
+	fis, err := fsys.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, nil
+}
+
+// containsSuffix returns true if any string in a ends with suffix.
+func containsSuffix(a []string, suffix string) bool {
+	for _, s := range a {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteWALSegment writes LZ4 compressed data from rd into a file on disk.
+// Returns an error if the segment's index has already been archived as the
+// archive would no longer hold every segment of the index.
+func (c *FileReplicaClient) WriteWALSegment(ctx context.Context, pos Pos, rd io.Reader) (info WALSegmentInfo, err error) {
+	filename, err := c.WALSegmentPath(pos.Generation, pos.Index, pos.Offset)
+	if err != nil {
+		return info, err
+	}
+
+	if archivePath, err := c.WALArchivePath(pos.Generation, pos.Index); err != nil {
+		return info, err
+	} else if _, err := c.fsys().Stat(archivePath); err == nil {
+		return info, fmt.Errorf("wal index already archived: generation=%s index=%s", pos.Generation, FormatIndex(pos.Index))
+	} else if !os.IsNotExist(err) {
+		return info, err
+	}
+
+	// Ensure parent directory exists.
+	if err := c.fsys().MkdirAll(filepath.Dir(filename), c.DirMode); err != nil {
+		return info, err
+	} else if err := c.ensureGenerationDir(pos.Generation); err != nil {
+		return info, err
+	}
+
+	// Write WAL segment to temporary file next to destination path so a
+	// partial write never becomes a live segment. The partial file is removed
+	// if the write fails, such as when the disk is full.
+	f, err := c.fsys().Create(filename+".tmp", c.FileMode)
+	if err != nil {
+		return info, err
+	}
+	defer func() {
+		if err != nil {
+			_ = c.fsys().Remove(filename + ".tmp")
+		}
+	}()
+	defer f.Close()
+
+	if _, err := io.Copy(f, rd); err != nil {
+		return info, err
+	} else if c.FsyncMode == FsyncPerFile {
+		if err := f.Sync(); err != nil {
+			return info, err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return info, err
+	}
+
+	// Build metadata.
+	fi, err := c.fsys().Stat(filename + ".tmp")
+	if err != nil {
+		return info, err
+	}
+	info = WALSegmentInfo{
+		Generation: pos.Generation,
+		Index:      pos.Index,
+		Offset:     pos.Offset,
+		Size:       fi.Size(),
+		CreatedAt:  fi.ModTime().UTC(),
+	}
+
+	// Move WAL segment to final path when it has been written & synced to disk.
+	if err := c.fsys().Rename(filename+".tmp", filename); err != nil {
+		return info, err
+	}
+
+	// Track the segment so it can be fsynced on the next flush, if batched.
+	if c.FsyncMode == FsyncPerSync {
+		c.mu.Lock()
+		if c.unsynced == nil {
+			c.unsynced = make(map[string]struct{})
+		}
+		c.unsynced[filename] = struct{}{}
+		c.mu.Unlock()
+	}
+
+	// The previous index is complete once a new index begins so pack it.
+	// The manifest is rebuilt after archiving as segment metadata is then
+	// read from the archive.
+	if c.ArchiveWAL && pos.Offset == 0 && pos.Index > 0 {
+		if err := c.archiveWALIndex(pos.Generation, pos.Index-1); err != nil {
+			return info, fmt.Errorf("archive wal index: %w", err)
+		} else if err := c.updateManifest(ctx, pos.Generation, nil); err != nil {
+			return info, fmt.Errorf("update manifest: %w", err)
+		}
+		return info, nil
+	}
+
+	if err := c.updateManifest(ctx, pos.Generation, func(m *fileReplicaManifest) { m.addWALSegment(info) }); err != nil {
+		return info, fmt.Errorf("update manifest: %w", err)
+	}
+
+	return info, nil
+}
+
+// Flush fsyncs all WAL segments written since the last flush when using
+// FsyncPerSync. Segments which have since been removed or archived are skipped.
+func (c *FileReplicaClient) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for filename := range c.unsynced {
+		if err := c.fsyncFile(filename); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("fsync %s: %w", filename, err)
+		}
+		delete(c.unsynced, filename)
+	}
+	return nil
+}
+
+// FreeSpace returns the bytes available on the filesystem containing the
+// replica path. The nearest existing parent is used if the path has not been
+// created yet. Returns -1 if a custom FS is set as it may not be on local disk.
+func (c *FileReplicaClient) FreeSpace(ctx context.Context) (int64, error) {
+	if c.FS != nil || c.path == "" {
+		return -1, nil
+	}
+
+	dir := c.path
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return 0, err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return -1, nil
+		}
+		dir = parent
+	}
+	return internal.FreeSpace(dir)
+}
+
+// fsyncFile opens & fsyncs a file.
+func (c *FileReplicaClient) fsyncFile(filename string) error {
+	f, err := c.fsys().Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// archiveWALIndex packs all segment files in an index directory into a single
+// tar archive and then removes the directory. Skipped if no directory exists.
+func (c *FileReplicaClient) archiveWALIndex(generation string, index int) (err error) {
+	dir, err := c.WALDir(generation)
+	if err != nil {
+		return err
+	}
+	indexDir := filepath.Join(dir, FormatIndex(index))
+
+	fis, err := c.fsys().ReadDir(indexDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	filename, err := c.WALArchivePath(generation, index)
+	if err != nil {
+		return err
+	}
+
+	// Remove the partial archive if packing fails.
+	f, err := c.fsys().Create(filename+".tmp", c.FileMode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = c.fsys().Remove(filename + ".tmp")
+		}
+	}()
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), WALSegmentExt) {
+			continue
+		}
+
+		if err := func() error {
+			hdr, err := tar.FileInfoHeader(fi, "")
+			if err != nil {
+				return err
+			} else if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+
+			sf, err := c.fsys().Open(filepath.Join(indexDir, fi.Name()))
+			if err != nil {
+				return err
+			}
+			defer sf.Close()
+
+			_, err = io.Copy(tw, sf)
+			return err
+		}(); err != nil {
+			return fmt.Errorf("cannot archive %s: %w", fi.Name(), err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	} else if err := gw.Close(); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+
+	// Move archive into place before removing the original segments.
+	if err := c.fsys().Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+	return c.fsys().RemoveAll(indexDir)
+}
+
+// WALSegmentReader returns a reader for a section of WAL data at the given position.
+// Falls back to reading from the index archive if the segment file does not exist.
+// Returns os.ErrNotExist if no matching index/offset is found.
+func (c *FileReplicaClient) WALSegmentReader(ctx context.Context, pos Pos) (io.ReadCloser, error) {
+	filename, err := c.WALSegmentPath(pos.Generation, pos.Index, pos.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := c.fsys().Open(filename)
+	if !os.IsNotExist(err) {
+		return f, err
+	}
+
+	archivePath, err := c.WALArchivePath(pos.Generation, pos.Index)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := openWALArchiveSegment(c.fsys(), archivePath, pos.Offset)
+	if !os.IsNotExist(err) {
+		return rc, err
+	}
+
+	// Fall back to the flat layout used by older replicas.
+	if v, err := c.LayoutVersion(ctx); err != nil {
+		return nil, err
+	} else if v != FileReplicaLayoutV1 {
+		return nil, os.ErrNotExist
+	}
+	if filename, err = c.legacyWALSegmentPath(pos.Generation, pos.Index, pos.Offset); err != nil {
+		return nil, err
+	}
+	return c.fsys().Open(filename)
+}
+
+// ReadWALIndex calls fn in offset order with a reader for each WAL segment at
+// offsets within an index. An archived index is read in a single pass rather
+// than scanning the archive from the start for every segment.
+func (c *FileReplicaClient) ReadWALIndex(ctx context.Context, generation string, index int, offsets []int64, fn func(offset int64, rd io.Reader) error) error {
+	archivePath, err := c.WALArchivePath(generation, index)
+	if err != nil {
+		return err
+	}
+
+	f, err := c.fsys().Open(archivePath)
+	if os.IsNotExist(err) {
+		return readWALSegments(ctx, c, generation, index, offsets, fn)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	// Segments are archived in offset order so a single scan finds them all.
+	tr := tar.NewReader(gr)
+	for len(offsets) > 0 {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return os.ErrNotExist
+		} else if err != nil {
+			return err
+		} else if hdr.Name != FormatOffset(offsets[0])+WALSegmentExt {
+			continue
+		}
+
+		if err := fn(offsets[0], tr); err != nil {
+			return err
+		}
+		offsets = offsets[1:]
+	}
+	return f.Close()
+}
+
+// WALInfoAt returns metadata for the WAL segment at pos by reading the
+// attributes of its file or, if its index has been archived, its archive
+// entry. Returns os.ErrNotExist if the WAL segment does not exist.
+func (c *FileReplicaClient) WALInfoAt(ctx context.Context, pos Pos) (*WALSegmentInfo, error) {
+	filename, err := c.WALSegmentPath(pos.Generation, pos.Index, pos.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi, err := c.fsys().Stat(filename); err == nil {
+		return &WALSegmentInfo{
+			Generation: pos.Generation,
+			Index:      pos.Index,
+			Offset:     pos.Offset,
+			Size:       fi.Size(),
+			CreatedAt:  fi.ModTime().UTC(),
+		}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Fall back to the index archive, if available.
+	archivePath, err := c.WALArchivePath(pos.Generation, pos.Index)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := readWALArchiveInfos(c.fsys(), archivePath, pos.Generation, pos.Index)
+	if os.IsNotExist(err) {
+		return c.legacyWALInfoAt(ctx, pos)
+	} else if err != nil {
+		return nil, err
+	}
+	for i := range infos {
+		if infos[i].Offset == pos.Offset {
+			return &infos[i], nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// legacyWALInfoAt returns metadata for a WAL segment stored in the flat layout
+// used by older replicas. Returns os.ErrNotExist for current layouts.
+func (c *FileReplicaClient) legacyWALInfoAt(ctx context.Context, pos Pos) (*WALSegmentInfo, error) {
+	if v, err := c.LayoutVersion(ctx); err != nil {
+		return nil, err
+	} else if v != FileReplicaLayoutV1 {
+		return nil, os.ErrNotExist
+	}
+
+	filename, err := c.legacyWALSegmentPath(pos.Generation, pos.Index, pos.Offset)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := c.fsys().Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &WALSegmentInfo{
+		Generation: pos.Generation,
+		Index:      pos.Index,
+		Offset:     pos.Offset,
+		Size:       fi.Size(),
+		CreatedAt:  fi.ModTime().UTC(),
+	}, nil
+}
+
+// DeleteWALSegments deletes WAL segments at the given positions. An archive
+// cannot be partially removed so archived segments are only deleted once every
+// segment in the archive's index is listed. Files are still removed one at a
+// time but deletion stops early if ctx is canceled.
+func (c *FileReplicaClient) DeleteWALSegments(ctx context.Context, a []Pos) error {
+	if len(a) == 0 {
+		return nil
+	}
+
+	v, err := c.LayoutVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Group the listed offsets by index to check archives for full coverage.
+	offsets := make(map[Pos]map[int64]struct{})
+	for _, pos := range a {
+		key := Pos{Generation: pos.Generation, Index: pos.Index}
+		if offsets[key] == nil {
+			offsets[key] = make(map[int64]struct{})
+		}
+		offsets[key][pos.Offset] = struct{}{}
+	}
+
+	archived := make(map[Pos]struct{})
+	for _, pos := range a {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		filename, err := c.WALSegmentPath(pos.Generation, pos.Index, pos.Offset)
+		if err != nil {
+			return err
+		}
+		if err := c.fsys().Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		// Check the archive for each index only once.
+		key := Pos{Generation: pos.Generation, Index: pos.Index}
+		if _, ok := archived[key]; !ok {
+			archived[key] = struct{}{}
+
+			archivePath, err := c.WALArchivePath(pos.Generation, pos.Index)
+			if err != nil {
+				return err
+			}
+			infos, err := readWALArchiveInfos(c.fsys(), archivePath, pos.Generation, pos.Index)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			} else if err == nil && walArchiveCovered(infos, offsets[key]) {
+				if err := c.fsys().Remove(archivePath); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+
+		// Remove segments stored in the flat layout used by older replicas.
+		if v == FileReplicaLayoutV1 {
+			if filename, err = c.legacyWALSegmentPath(pos.Generation, pos.Index, pos.Offset); err != nil {
+				return err
+			} else if err := c.fsys().Remove(filename); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	// Rebuild manifests from the remaining files as archived segments may not
+	// have been removed.
+	generations := make(map[string]struct{})
+	for _, pos := range a {
+		if _, ok := generations[pos.Generation]; !ok {
+			generations[pos.Generation] = struct{}{}
+			if err := c.updateManifest(ctx, pos.Generation, nil); err != nil {
+				return fmt.Errorf("update manifest: %w", err)
+			}
 		}
-		generations = append(generations, fi.Name())
 	}
-	return generations, nil
+	return nil
 }
 
-// DeleteGeneration deletes all snapshots & WAL segments within a generation.
-func (c *FileReplicaClient) DeleteGeneration(ctx context.Context, generation string) error {
+// ManifestPath returns the path to a generation's manifest file.
+func (c *FileReplicaClient) ManifestPath(generation string) (string, error) {
 	dir, err := c.GenerationDir(generation)
 	if err != nil {
-		return fmt.Errorf("cannot determine generation path: %w", err)
+		return "", err
 	}
+	return filepath.Join(dir, "manifest.json"), nil
+}
 
-	if err := os.RemoveAll(dir); err != nil && !os.IsNotExist(err) {
-		return err
+// readManifest returns the manifest of a generation. Returns nil if manifests
+// are disabled or if the generation has no manifest.
+func (c *FileReplicaClient) readManifest(generation string) (*fileReplicaManifest, error) {
+	if !c.Manifest {
+		return nil, nil
 	}
-	return nil
-}
 
-// Snapshots returns an iterator over all available snapshots for a generation.
-func (c *FileReplicaClient) Snapshots(ctx context.Context, generation string) (SnapshotIterator, error) {
-	dir, err := c.SnapshotsDir(generation)
+	filename, err := c.ManifestPath(generation)
 	if err != nil {
 		return nil, err
 	}
 
-	f, err := os.Open(dir)
+	f, err := c.fsys().Open(filename)
 	if os.IsNotExist(err) {
-		return NewSnapshotInfoSliceIterator(nil), nil
+		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	fis, err := f.Readdir(-1)
+	var m fileReplicaManifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", filename, err)
+	}
+	return &m, nil
+}
+
+// updateManifest applies fn to the manifest of a generation & writes it back.
+// The manifest is rebuilt from the generation's files if it does not exist or
+// if fn is nil. If manifests are disabled, any existing manifest is removed.
+func (c *FileReplicaClient) updateManifest(ctx context.Context, generation string, fn func(m *fileReplicaManifest)) error {
+	filename, err := c.ManifestPath(generation)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Iterate over every file and convert to metadata.
-	infos := make([]SnapshotInfo, 0, len(fis))
-	for _, fi := range fis {
-		// Parse index from filename.
-		index, err := internal.ParseSnapshotPath(filepath.Base(fi.Name()))
-		if err != nil {
-			continue
-		}
+	c.mum.Lock()
+	defer c.mum.Unlock()
 
-		infos = append(infos, SnapshotInfo{
-			Generation: generation,
-			Index:      index,
-			Size:       fi.Size(),
-			CreatedAt:  fi.ModTime().UTC(),
-		})
+	if !c.Manifest {
+		if err := c.fsys().Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
 	}
 
-	sort.Sort(SnapshotInfoSlice(infos))
-
-	return NewSnapshotInfoSliceIterator(infos), nil
-}
+	// Skip generations which no longer exist, such as after a delete.
+	if _, err := c.fsys().Stat(filepath.Dir(filename)); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
 
-// WriteSnapshot writes LZ4 compressed data from rd into a file on disk.
-func (c *FileReplicaClient) WriteSnapshot(ctx context.Context, generation string, index int, rd io.Reader) (info SnapshotInfo, err error) {
-	filename, err := c.SnapshotPath(generation, index)
+	m, err := c.readManifest(generation)
 	if err != nil {
-		return info, err
+		return err
+	} else if m != nil && fn != nil {
+		fn(m)
+	} else if m, err = c.buildManifest(ctx, generation); err != nil {
+		return err
 	}
 
-	// Ensure parent directory exists.
-	if err := internal.MkdirAll(filepath.Dir(filename), c.DirMode, c.Uid, c.Gid); err != nil {
-		return info, err
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
 	}
 
-	// Write snapshot to temporary file next to destination path.
-	f, err := internal.CreateFile(filename+".tmp", c.FileMode, c.Uid, c.Gid)
+	// Write to a temporary file & rename so readers never see a partial file.
+	f, err := c.fsys().Create(filename+".tmp", c.FileMode)
 	if err != nil {
-		return info, err
+		return err
 	}
+	defer func() { _ = c.fsys().Remove(filename + ".tmp") }()
 	defer f.Close()
 
-	if _, err := io.Copy(f, rd); err != nil {
-		return info, err
-	} else if err := f.Sync(); err != nil {
-		return info, err
+	if _, err := f.Write(buf); err != nil {
+		return err
 	} else if err := f.Close(); err != nil {
-		return info, err
+		return err
 	}
+	return c.fsys().Rename(filename+".tmp", filename)
+}
 
-	// Build metadata.
-	fi, err := os.Stat(filename + ".tmp")
+// buildManifest returns a manifest built by walking a generation's files.
+func (c *FileReplicaClient) buildManifest(ctx context.Context, generation string) (*fileReplicaManifest, error) {
+	sitr, err := c.walkSnapshots(ctx, generation)
 	if err != nil {
-		return info, err
+		return nil, err
 	}
-	info = SnapshotInfo{
-		Generation: generation,
-		Index:      index,
-		Size:       fi.Size(),
-		CreatedAt:  fi.ModTime().UTC(),
+	snapshots, err := SliceSnapshotIterator(sitr)
+	if err != nil {
+		return nil, err
 	}
 
-	// Move snapshot to final path when it has been fully written & synced to disk.
-	if err := os.Rename(filename+".tmp", filename); err != nil {
-		return info, err
+	witr, err := c.walkWALSegments(ctx, generation)
+	if err != nil {
+		return nil, err
 	}
-
-	return info, nil
-}
-
-// SnapshotReader returns a reader for snapshot data at the given generation/index.
-// Returns os.ErrNotExist if no matching index is found.
-func (c *FileReplicaClient) SnapshotReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
-	filename, err := c.SnapshotPath(generation, index)
+	segments, err := SliceWALSegmentIterator(witr)
 	if err != nil {
 		return nil, err
 	}
-	return os.Open(filename)
+
+	return &fileReplicaManifest{Snapshots: snapshots, WALSegments: segments}, nil
 }
 
-// DeleteSnapshot deletes a snapshot with the given generation & index.
-func (c *FileReplicaClient) DeleteSnapshot(ctx context.Context, generation string, index int) error {
-	filename, err := c.SnapshotPath(generation, index)
-	if err != nil {
-		return fmt.Errorf("cannot determine snapshot path: %w", err)
+// fileReplicaManifest lists the snapshots & WAL segments of a generation.
+type fileReplicaManifest struct {
+	Snapshots   []SnapshotInfo
+	WALSegments []WALSegmentInfo
+}
+
+// addSnapshot adds info to the manifest, replacing any snapshot at its index.
+func (m *fileReplicaManifest) addSnapshot(info SnapshotInfo) {
+	m.removeSnapshot(info.Index)
+	m.Snapshots = append(m.Snapshots, info)
+	sort.Sort(SnapshotInfoSlice(m.Snapshots))
+}
+
+// removeSnapshot removes the snapshot at index from the manifest.
+func (m *fileReplicaManifest) removeSnapshot(index int) {
+	other := m.Snapshots[:0]
+	for _, info := range m.Snapshots {
+		if info.Index != index {
+			other = append(other, info)
+		}
 	}
-	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
-		return err
+	m.Snapshots = other
+}
+
+// addWALSegment adds info to the manifest, replacing any segment at its position.
+func (m *fileReplicaManifest) addWALSegment(info WALSegmentInfo) {
+	other := m.WALSegments[:0]
+	for _, a := range m.WALSegments {
+		if a.Index != info.Index || a.Offset != info.Offset {
+			other = append(other, a)
+		}
 	}
-	return nil
+	m.WALSegments = append(other, info)
+	sort.Sort(WALSegmentInfoSlice(m.WALSegments))
 }
 
-// WALSegments returns an iterator over all available WAL files for a generation.
-func (c *FileReplicaClient) WALSegments(ctx context.Context, generation string) (WALSegmentIterator, error) {
-	dir, err := c.WALDir(generation)
-	if err != nil {
-		return nil, err
+// walArchiveCovered returns true if offsets contains every segment in infos.
+func walArchiveCovered(infos []WALSegmentInfo, offsets map[int64]struct{}) bool {
+	for _, info := range infos {
+		if _, ok := offsets[info.Offset]; !ok {
+			return false
+		}
 	}
+	return true
+}
 
-	f, err := os.Open(dir)
-	if os.IsNotExist(err) {
-		return NewWALSegmentInfoSliceIterator(nil), nil
-	} else if err != nil {
+// openWALArchiveSegment returns a reader for a single segment within a WAL
+// index archive. Returns os.ErrNotExist if the segment is not in the archive.
+func openWALArchiveSegment(fsys FileReplicaFS, filename string, offset int64) (_ io.ReadCloser, err error) {
+	f, err := fsys.Open(filename)
+	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+		}
+	}()
 
-	fis, err := f.Readdir(-1)
+	gr, err := gzip.NewReader(f)
 	if err != nil {
 		return nil, err
 	}
 
-	// Iterate over every file and convert to metadata.
-	indexes := make([]int, 0, len(fis))
-	for _, fi := range fis {
-		index, err := ParseIndex(fi.Name())
-		if err != nil || !fi.IsDir() {
-			continue
+	name := FormatOffset(offset) + WALSegmentExt
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, os.ErrNotExist
+		} else if err != nil {
+			return nil, err
+		} else if hdr.Name == name {
+			return internal.NewReadCloser(tr, f), nil
 		}
-		indexes = append(indexes, index)
 	}
+}
 
-	sort.Ints(indexes)
-
-	return NewFileWALSegmentIterator(dir, generation, indexes), nil
+// GCReport summarizes the files removed by FileReplicaClient.GC().
+type GCReport struct {
+	TmpFiles     int   // number of orphaned temp files removed
+	InvalidFiles int   // number of empty or partial data files removed
+	Bytes        int64 // total bytes reclaimed
 }
 
-// WriteWALSegment writes LZ4 compressed data from rd into a file on disk.
-func (c *FileReplicaClient) WriteWALSegment(ctx context.Context, pos Pos, rd io.Reader) (info WALSegmentInfo, err error) {
-	filename, err := c.WALSegmentPath(pos.Generation, pos.Index, pos.Offset)
+// gcTmpFileMinAge is the minimum age of a temp file before GC removes it so
+// that files currently being written are not removed.
+const gcTmpFileMinAge = 1 * time.Minute
+
+// GC walks all generations and removes orphaned temp files as well as data
+// files that are empty or contain a partial LZ4 stream. Files without an LZ4
+// header are never removed as they may hold uncompressed data. The manifest of
+// each generation with removed data files is rebuilt afterward.
+func (c *FileReplicaClient) GC(ctx context.Context) (report GCReport, err error) {
+	root, err := c.GenerationsDir()
 	if err != nil {
-		return info, err
+		return report, fmt.Errorf("cannot determine generations path: %w", err)
 	}
 
-	// Ensure parent directory exists.
-	if err := internal.MkdirAll(filepath.Dir(filename), c.DirMode, c.Uid, c.Gid); err != nil {
-		return info, err
-	}
+	fsys := c.fsys()
+	generations := make(map[string]struct{})
+	err = walkFS(fsys, root, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if err := ctx.Err(); err != nil {
+			return err
+		} else if fi.IsDir() {
+			return nil
+		}
+
+		switch {
+		case strings.HasSuffix(path, ".tmp"):
+			if time.Since(fi.ModTime()) < gcTmpFileMinAge {
+				return nil // may still be written to
+			}
+			report.TmpFiles++
+
+		case strings.HasSuffix(path, SnapshotExt), strings.HasSuffix(path, WALSegmentExt):
+			if ok, err := isPartialLZ4File(fsys, path, fi.Size()); err != nil {
+				return err
+			} else if !ok {
+				return nil
+			}
+			report.InvalidFiles++
+
+			// Track the generation so its manifest can be rebuilt.
+			if rel, err := filepath.Rel(root, path); err == nil {
+				generations[strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]] = struct{}{}
+			}
+
+		default:
+			return nil
+		}
 
-	// Write WAL segment to temporary file next to destination path.
-	f, err := internal.CreateFile(filename+".tmp", c.FileMode, c.Uid, c.Gid)
+		if err := fsys.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		report.Bytes += fi.Size()
+		return nil
+	})
 	if err != nil {
-		return info, err
+		return report, err
 	}
-	defer f.Close()
 
-	if _, err := io.Copy(f, rd); err != nil {
-		return info, err
-	} else if err := f.Sync(); err != nil {
-		return info, err
-	} else if err := f.Close(); err != nil {
-		return info, err
+	for generation := range generations {
+		if err := c.updateManifest(ctx, generation, nil); err != nil {
+			return report, fmt.Errorf("update manifest: %w", err)
+		}
 	}
+	return report, nil
+}
 
-	// Build metadata.
-	fi, err := os.Stat(filename + ".tmp")
-	if err != nil {
-		return info, err
+// isPartialLZ4File returns true if the file is empty or begins with an LZ4
+// frame header but cannot be fully decompressed.
+func isPartialLZ4File(fsys FileReplicaFS, path string, size int64) (bool, error) {
+	if size == 0 {
+		return true, nil
 	}
-	info = WALSegmentInfo{
-		Generation: pos.Generation,
-		Index:      pos.Index,
-		Offset:     pos.Offset,
-		Size:       fi.Size(),
-		CreatedAt:  fi.ModTime().UTC(),
+
+	f, err := fsys.Open(path)
+	if err != nil {
+		return false, err
 	}
+	defer f.Close()
 
-	// Move WAL segment to final path when it has been written & synced to disk.
-	if err := os.Rename(filename+".tmp", filename); err != nil {
-		return info, err
+	magic := make([]byte, len(lz4FrameMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || !isLZ4Magic(magic) {
+		return false, nil
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
 	}
 
-	return info, nil
+	// Only complete streams with a valid end mark can be decompressed.
+	if _, err := io.Copy(ioutil.Discard, newDecompressReader(f)); err != nil {
+		return true, nil
+	}
+	return false, f.Close()
 }
 
-// WALSegmentReader returns a reader for a section of WAL data at the given position.
-// Returns os.ErrNotExist if no matching index/offset is found.
-func (c *FileReplicaClient) WALSegmentReader(ctx context.Context, pos Pos) (io.ReadCloser, error) {
-	filename, err := c.WALSegmentPath(pos.Generation, pos.Index, pos.Offset)
+// readWALArchiveInfos returns metadata for every segment within a WAL index archive.
+func readWALArchiveInfos(fsys FileReplicaFS, filename, generation string, index int) ([]WALSegmentInfo, error) {
+	f, err := fsys.Open(filename)
 	if err != nil {
 		return nil, err
 	}
-	return os.Open(filename)
-}
+	defer f.Close()
 
-// DeleteWALSegments deletes WAL segments at the given positions.
-func (c *FileReplicaClient) DeleteWALSegments(ctx context.Context, a []Pos) error {
-	for _, pos := range a {
-		filename, err := c.WALSegmentPath(pos.Generation, pos.Index, pos.Offset)
-		if err != nil {
-			return err
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []WALSegmentInfo
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
 		}
-		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
-			return err
+
+		offset, err := ParseOffset(strings.TrimSuffix(hdr.Name, WALSegmentExt))
+		if err != nil {
+			continue
 		}
+
+		infos = append(infos, WALSegmentInfo{
+			Generation: generation,
+			Index:      index,
+			Offset:     offset,
+			Size:       hdr.Size,
+			CreatedAt:  hdr.ModTime.UTC(),
+		})
 	}
-	return nil
+	return infos, f.Close()
 }
 
 type FileWALSegmentIterator struct {
@@ -366,6 +1986,7 @@ type FileWALSegmentIterator struct {
 	notifyCh  chan struct{}
 	closeFunc func() error
 
+	fsys       FileReplicaFS
 	dir        string
 	generation string
 	indexes    []int
@@ -377,6 +1998,7 @@ type FileWALSegmentIterator struct {
 
 func NewFileWALSegmentIterator(dir, generation string, indexes []int) *FileWALSegmentIterator {
 	return &FileWALSegmentIterator{
+		fsys:       &osFS{},
 		dir:        dir,
 		generation: generation,
 		indexes:    indexes,
@@ -445,18 +2067,19 @@ func (itr *FileWALSegmentIterator) Next() bool {
 		// Read segments into a cache for the current index.
 		index := itr.indexes[0]
 		itr.indexes = itr.indexes[1:]
-		f, err := os.Open(filepath.Join(itr.dir, FormatIndex(index)))
-		if err != nil {
-			itr.err = err
-			return false
-		}
-		defer f.Close()
-
-		fis, err := f.Readdir(-1)
-		if err != nil {
-			itr.err = err
-			return false
-		} else if err := f.Close(); err != nil {
+		fis, err := itr.fsys.ReadDir(filepath.Join(itr.dir, FormatIndex(index)))
+		if os.IsNotExist(err) {
+			// Fall back to reading segments from an index archive, if available.
+			if itr.infos, err = readWALArchiveInfos(itr.fsys, filepath.Join(itr.dir, FormatIndex(index)+WALArchiveExt), itr.generation, index); err != nil {
+				itr.err = err
+				return false
+			}
+			sort.Sort(WALSegmentInfoSlice(itr.infos))
+			if len(itr.infos) > 0 {
+				return true
+			}
+			continue
+		} else if err != nil {
 			itr.err = err
 			return false
 		}
@@ -581,3 +2204,99 @@ func (itr *FileWALSegmentIterator) Append(info WALSegmentInfo) error {
 
 	return nil
 }
+
+// FileReplicaFS represents the filesystem operations used by FileReplicaClient.
+// This allows replicas to be stored on alternate backends such as an
+// in-memory filesystem for testing.
+type FileReplicaFS interface {
+	// Opens a file for reading.
+	Open(name string) (FileReplicaFile, error)
+
+	// Creates or truncates a file for writing with the given permissions.
+	Create(name string, perm os.FileMode) (FileReplicaFile, error)
+
+	// Returns the entries within a directory, sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+
+	Remove(name string) error
+	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
+	Stat(name string) (os.FileInfo, error)
+
+	// Creates a directory along with any missing parents.
+	MkdirAll(path string, perm os.FileMode) error
+}
+
+// FileReplicaFile represents a file opened through a FileReplicaFS.
+type FileReplicaFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+
+	Stat() (os.FileInfo, error)
+	Sync() error
+}
+
+var _ FileReplicaFS = (*osFS)(nil)
+
+// osFS implements FileReplicaFS using the local filesystem. Created files &
+// directories are assigned the given owner.
+type osFS struct {
+	uid, gid int
+}
+
+func (fsys *osFS) Open(name string) (FileReplicaFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err // avoid non-nil interface wrapping a nil file
+	}
+	return f, nil
+}
+
+func (fsys *osFS) Create(name string, perm os.FileMode) (FileReplicaFile, error) {
+	f, err := internal.CreateFile(name, perm, fsys.uid, fsys.gid)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fsys *osFS) ReadDir(name string) ([]os.FileInfo, error) { return ioutil.ReadDir(name) }
+func (fsys *osFS) Remove(name string) error                   { return os.Remove(name) }
+func (fsys *osFS) RemoveAll(path string) error                { return os.RemoveAll(path) }
+func (fsys *osFS) Rename(oldpath, newpath string) error       { return os.Rename(oldpath, newpath) }
+func (fsys *osFS) Stat(name string) (os.FileInfo, error)      { return os.Stat(name) }
+
+func (fsys *osFS) MkdirAll(path string, perm os.FileMode) error {
+	return internal.MkdirAll(path, perm, fsys.uid, fsys.gid)
+}
+
+// walkFS walks the file tree rooted at root, calling fn for each file or
+// directory in lexical order. This is similar to filepath.Walk() except that
+// it reads through fsys.
+func walkFS(fsys FileReplicaFS, root string, fn filepath.WalkFunc) error {
+	fi, err := fsys.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	return walkFSDir(fsys, root, fi, fn)
+}
+
+func walkFSDir(fsys FileReplicaFS, path string, fi os.FileInfo, fn filepath.WalkFunc) error {
+	if err := fn(path, fi, nil); err != nil || !fi.IsDir() {
+		return err
+	}
+
+	fis, err := fsys.ReadDir(path)
+	if err != nil {
+		return fn(path, fi, err)
+	}
+	for _, fi := range fis {
+		if err := walkFSDir(fsys, filepath.Join(path, fi.Name()), fi, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
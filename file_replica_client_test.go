@@ -1,8 +1,21 @@
 package litestream_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/benbjohnson/litestream"
 )
@@ -264,3 +277,1520 @@ func TestFileWALSegmentIterator_Append(t *testing.T) {
 		}
 	})
 }
+
+func TestFileReplicaClient_ArchiveWAL(t *testing.T) {
+	t.Run("Restore", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		src := litestream.NewFileReplicaClient(testDir)
+
+		// Copy the unpacked layout into a client that archives completed indexes.
+		dst := litestream.NewFileReplicaClient(t.TempDir())
+		dst.ArchiveWAL = true
+		mustCopyReplicaClient(t, dst, src, "0000000000000000")
+
+		// All but the last index should be archived.
+		for index, archived := range []bool{true, true, false} {
+			filename, err := dst.WALArchivePath("0000000000000000", index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filename); (err == nil) != archived {
+				t.Fatalf("index %d: archived=%v, want %v (err=%v)", index, err == nil, archived, err)
+			}
+		}
+
+		// Listing should be identical between layouts, excluding timestamps.
+		if got, want := mustWALSegmentPositions(t, dst, "0000000000000000"), mustWALSegmentPositions(t, src, "0000000000000000"); !reflect.DeepEqual(got, want) {
+			t.Fatalf("WALSegments()=%v, want %v", got, want)
+		}
+
+		// Restore from both layouts & compare against the expected database.
+		for _, client := range []*litestream.FileReplicaClient{src, dst} {
+			filename := filepath.Join(t.TempDir(), "db")
+			if err := litestream.Restore(context.Background(), client, filename, "0000000000000000", 0, 2, litestream.NewRestoreOptions()); err != nil {
+				t.Fatal(err)
+			} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), filename) {
+				t.Fatalf("file mismatch: %s", client.Path())
+			}
+		}
+	})
+
+	// Ensure a partially written archive is removed if packing fails.
+	t.Run("ErrPartialArchive", func(t *testing.T) {
+		fsys := newFullFS(-1)
+		client := litestream.NewFileReplicaClient("/data")
+		client.FS = fsys
+		client.ArchiveWAL = true
+
+		if _, err := client.WriteWALSegment(context.Background(), litestream.Pos{Generation: "0000000000000000", Index: 0, Offset: 0}, strings.NewReader("wal0")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Allow the next segment to be written but not the archive.
+		fsys.SetAvail(4)
+		if _, err := client.WriteWALSegment(context.Background(), litestream.Pos{Generation: "0000000000000000", Index: 1, Offset: 0}, strings.NewReader("wal1")); err == nil {
+			t.Fatal("expected error")
+		}
+
+		filename, err := client.WALArchivePath("0000000000000000", 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := fsys.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+			t.Fatalf("unexpected temporary archive: %v", err)
+		} else if _, err := fsys.Stat(filename); !os.IsNotExist(err) {
+			t.Fatalf("unexpected archive: %v", err)
+		}
+		if got, want := len(mustWALSegmentPositions(t, client, "0000000000000000")), 2; got != want {
+			t.Fatalf("len(WALSegments())=%d, want %d", got, want)
+		}
+	})
+
+	t.Run("DeleteWALSegments", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		client.ArchiveWAL = true
+		mustCopyReplicaClient(t, client, litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")), "0000000000000000")
+
+		if err := client.DeleteWALSegments(context.Background(), []litestream.Pos{
+			{Generation: "0000000000000000", Index: 0, Offset: 0},
+			{Generation: "0000000000000000", Index: 0, Offset: 8272},
+			{Generation: "0000000000000000", Index: 0, Offset: 12392},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := mustWALSegmentPositions(t, client, "0000000000000000"), []litestream.Pos{
+			{Generation: "0000000000000000", Index: 1, Offset: 0},
+			{Generation: "0000000000000000", Index: 2, Offset: 0},
+			{Generation: "0000000000000000", Index: 2, Offset: 4152},
+		}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("WALSegments()=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure an archive is kept unless every segment in its index is deleted.
+	t.Run("DeleteWALSegments/Partial", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		client.ArchiveWAL = true
+		mustCopyReplicaClient(t, client, litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")), "0000000000000000")
+		want := mustWALSegmentPositions(t, client, "0000000000000000")
+
+		if err := client.DeleteWALSegments(context.Background(), []litestream.Pos{
+			{Generation: "0000000000000000", Index: 0, Offset: 0},
+		}); err != nil {
+			t.Fatal(err)
+		} else if got := mustWALSegmentPositions(t, client, "0000000000000000"); !reflect.DeepEqual(got, want) {
+			t.Fatalf("WALSegments()=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure segments cannot be added to an index once it is archived.
+	t.Run("ErrArchivedIndex", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		client.ArchiveWAL = true
+		mustCopyReplicaClient(t, client, litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")), "0000000000000000")
+		want := mustWALSegmentPositions(t, client, "0000000000000000")
+
+		if _, err := client.WriteWALSegment(context.Background(), litestream.Pos{Generation: "0000000000000000", Index: 0, Offset: 16512}, strings.NewReader("wal")); err == nil || err.Error() != `wal index already archived: generation=0000000000000000 index=0000000000000000` {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got := mustWALSegmentPositions(t, client, "0000000000000000"); !reflect.DeepEqual(got, want) {
+			t.Fatalf("WALSegments()=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure all segments of an archived index are read with a single scan.
+	t.Run("ReadWALIndex", func(t *testing.T) {
+		fsys := &openCountFS{memFS: newMemFS()}
+		client := litestream.NewFileReplicaClient("/data")
+		client.FS = fsys
+		client.ArchiveWAL = true
+		mustCopyReplicaClient(t, client, litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")), "0000000000000000")
+
+		archivePath, err := client.WALArchivePath("0000000000000000", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		offsets := []int64{0, 8272, 12392}
+		var a [][]byte
+		if err := client.ReadWALIndex(context.Background(), "0000000000000000", 0, offsets, func(offset int64, rd io.Reader) error {
+			buf, err := io.ReadAll(rd)
+			a = append(a, buf)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		} else if got, want := fsys.OpenN(archivePath), 1; got != want {
+			t.Fatalf("archive opened %d times, want %d", got, want)
+		}
+
+		for i, offset := range offsets {
+			rc, err := client.WALSegmentReader(context.Background(), litestream.Pos{Generation: "0000000000000000", Index: 0, Offset: offset})
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			} else if err := rc.Close(); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(a[i], buf) {
+				t.Fatalf("offset %d: data mismatch", offset)
+			}
+		}
+
+		if err := client.ReadWALIndex(context.Background(), "0000000000000000", 0, []int64{1}, func(int64, io.Reader) error { return nil }); !os.IsNotExist(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// mustCopyReplicaClient copies all snapshots & WAL segments in a generation
+// from src to dst, in order.
+func mustCopyReplicaClient(tb testing.TB, dst, src litestream.ReplicaClient, generation string) {
+	tb.Helper()
+	ctx := context.Background()
+
+	snapshots, err := litestream.SliceSnapshotIterator(mustSnapshots(tb, src, generation))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, info := range snapshots {
+		rd, err := src.SnapshotReader(ctx, generation, info.Index)
+		if err != nil {
+			tb.Fatal(err)
+		} else if _, err := dst.WriteSnapshot(ctx, generation, info.Index, rd); err != nil {
+			tb.Fatal(err)
+		} else if err := rd.Close(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	itr, err := src.WALSegments(ctx, generation)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	infos, err := litestream.SliceWALSegmentIterator(itr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, info := range infos {
+		rd, err := src.WALSegmentReader(ctx, info.Pos())
+		if err != nil {
+			tb.Fatal(err)
+		} else if _, err := dst.WriteWALSegment(ctx, info.Pos(), rd); err != nil {
+			tb.Fatal(err)
+		} else if err := rd.Close(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func mustSnapshots(tb testing.TB, client litestream.ReplicaClient, generation string) litestream.SnapshotIterator {
+	tb.Helper()
+	itr, err := client.Snapshots(context.Background(), generation)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return itr
+}
+
+// mustWALSegmentPositions returns the position of every WAL segment in a generation.
+func mustWALSegmentPositions(tb testing.TB, client litestream.ReplicaClient, generation string) []litestream.Pos {
+	tb.Helper()
+	itr, err := client.WALSegments(context.Background(), generation)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	infos, err := litestream.SliceWALSegmentIterator(itr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var a []litestream.Pos
+	for _, info := range infos {
+		a = append(a, info.Pos())
+	}
+	return a
+}
+
+func TestFileReplicaClient_SnapshotInfoAt(t *testing.T) {
+	client := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+
+	t.Run("OK", func(t *testing.T) {
+		filename, err := client.SnapshotPath("0000000000000000", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info, err := client.SnapshotInfoAt(context.Background(), "0000000000000000", 0); err != nil {
+			t.Fatal(err)
+		} else if got, want := *info, (litestream.SnapshotInfo{Generation: "0000000000000000", Index: 0, Size: fi.Size(), CreatedAt: fi.ModTime().UTC()}); got != want {
+			t.Fatalf("SnapshotInfoAt()=%#v, want %#v", got, want)
+		}
+	})
+
+	t.Run("ErrNotExist", func(t *testing.T) {
+		if _, err := client.SnapshotInfoAt(context.Background(), "0000000000000000", 1); err != os.ErrNotExist {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, err := client.SnapshotInfoAt(context.Background(), "0000000000000001", 0); err != os.ErrNotExist {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestFileReplicaClient_WALInfoAt(t *testing.T) {
+	src := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+
+	t.Run("OK", func(t *testing.T) {
+		pos := litestream.Pos{Generation: "0000000000000000", Index: 2, Offset: 0x1038}
+		if info, err := src.WALInfoAt(context.Background(), pos); err != nil {
+			t.Fatal(err)
+		} else if info.Pos() != pos || info.Size == 0 {
+			t.Fatalf("unexpected info: %#v", info)
+		}
+	})
+
+	// Segments stored only within an index archive are found in the archive.
+	t.Run("Archived", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		client.ArchiveWAL = true
+		mustCopyReplicaClient(t, client, src, "0000000000000000")
+
+		pos := litestream.Pos{Generation: "0000000000000000", Index: 0, Offset: 0x2050}
+		want, err := src.WALInfoAt(context.Background(), pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info, err := client.WALInfoAt(context.Background(), pos); err != nil {
+			t.Fatal(err)
+		} else if info.Pos() != pos || info.Size != want.Size {
+			t.Fatalf("unexpected info: %#v", info)
+		}
+
+		if _, err := client.WALInfoAt(context.Background(), litestream.Pos{Generation: "0000000000000000", Index: 0, Offset: 0x1000}); err != os.ErrNotExist {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrNotExist", func(t *testing.T) {
+		for _, pos := range []litestream.Pos{
+			{Generation: "0000000000000000", Index: 2, Offset: 0x2000},
+			{Generation: "0000000000000000", Index: 3, Offset: 0},
+			{Generation: "0000000000000001", Index: 0, Offset: 0},
+		} {
+			if _, err := src.WALInfoAt(context.Background(), pos); err != os.ErrNotExist {
+				t.Fatalf("%s: unexpected error: %v", pos, err)
+			}
+		}
+	})
+}
+
+func TestFileReplicaClient_WALIndices(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+		if got, err := client.WALIndices(context.Background(), "0000000000000000"); err != nil {
+			t.Fatal(err)
+		} else if want := []int{0, 1, 2}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("WALIndices()=%v, want %v", got, want)
+		}
+	})
+
+	t.Run("Archived", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		client.ArchiveWAL = true
+		mustCopyReplicaClient(t, client, litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")), "0000000000000000")
+
+		// Remove all segments from the last index but leave its directory.
+		if err := client.DeleteWALSegments(context.Background(), []litestream.Pos{
+			{Generation: "0000000000000000", Index: 2, Offset: 0},
+			{Generation: "0000000000000000", Index: 2, Offset: 4152},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Indexes 0 & 1 only exist as archives.
+		if got, err := client.WALIndices(context.Background(), "0000000000000000"); err != nil {
+			t.Fatal(err)
+		} else if want := []int{0, 1}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("WALIndices()=%v, want %v", got, want)
+		}
+	})
+
+	t.Run("NoWAL", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		if got, err := client.WALIndices(context.Background(), "0000000000000000"); err != nil {
+			t.Fatal(err)
+		} else if got != nil {
+			t.Fatalf("WALIndices()=%v, want nil", got)
+		}
+	})
+}
+
+func TestFileReplicaClient_SnapshotReaderAt(t *testing.T) {
+	// newClient returns a client with a copy of the test snapshot along with
+	// the decompressed contents of that snapshot.
+	newClient := func(tb testing.TB) (*litestream.FileReplicaClient, []byte) {
+		tb.Helper()
+		c := litestream.NewFileReplicaClient(tb.TempDir())
+		mustCopyReplicaClient(tb, c, litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")), "0000000000000000")
+
+		// Decompress a copy of the snapshot to determine the expected data.
+		snapshotPath, err := c.SnapshotPath("0000000000000000", 0)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		buf, err := os.ReadFile(snapshotPath)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		filename := filepath.Join(tb.TempDir(), "db")
+		if err := os.WriteFile(filename, buf, 0600); err != nil {
+			tb.Fatal(err)
+		}
+		mustDecompressFile(tb, filename)
+		if buf, err = os.ReadFile(filename); err != nil {
+			tb.Fatal(err)
+		}
+		return c, buf
+	}
+
+	// readPage reads the last 100 bytes of the database from the reader.
+	readPage := func(tb testing.TB, c *litestream.FileReplicaClient, want []byte) {
+		tb.Helper()
+		ra, size, err := c.SnapshotReaderAt(context.Background(), "0000000000000000", 0)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		defer ra.(io.Closer).Close()
+
+		if got, want := size, int64(len(want)); got != want {
+			tb.Fatalf("size=%d, want %d", got, want)
+		}
+
+		off := len(want) - 100
+		buf := make([]byte, 100)
+		if _, err := ra.ReadAt(buf, int64(off)); err != nil {
+			tb.Fatal(err)
+		} else if !bytes.Equal(buf, want[off:]) {
+			tb.Fatal("page data mismatch")
+		}
+	}
+
+	t.Run("Compressed", func(t *testing.T) {
+		c, want := newClient(t)
+		readPage(t, c, want)
+	})
+
+	t.Run("Uncompressed", func(t *testing.T) {
+		c, want := newClient(t)
+		snapshotPath, err := c.SnapshotPath("0000000000000000", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustDecompressFile(t, snapshotPath)
+		readPage(t, c, want)
+	})
+
+	t.Run("ErrNotExist", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		if _, _, err := c.SnapshotReaderAt(context.Background(), "0000000000000000", 0); !os.IsNotExist(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// ulidGenerationFormat accepts 26 character uppercase ULID generation names.
+type ulidGenerationFormat struct{}
+
+func (ulidGenerationFormat) IsValid(name string) bool {
+	return len(name) == 26 && strings.ToUpper(name) == name
+}
+
+func TestFileReplicaClient_GenerationFormat(t *testing.T) {
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	for _, generation := range []string{"0000000000000000", "01ARZ3NDEKTSV4RRFFQ69G5FAV"} {
+		dir, err := c.GenerationDir(generation)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		if generations, err := c.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := generations, []string{"0000000000000000"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Generations()=%v, want %v", got, want)
+		}
+	})
+
+	t.Run("Custom", func(t *testing.T) {
+		c.GenerationFormat = ulidGenerationFormat{}
+		defer func() { c.GenerationFormat = nil }()
+
+		if generations, err := c.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := generations, []string{"01ARZ3NDEKTSV4RRFFQ69G5FAV"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Generations()=%v, want %v", got, want)
+		}
+	})
+}
+
+func TestFileReplicaClient_Migrate(t *testing.T) {
+	const generation = "0000000000000000"
+	testDir := filepath.Join("testdata", "restore", "ok")
+
+	// Build a replica using the flat WAL layout without a VERSION file.
+	dir := t.TempDir()
+	mustCopyReplicaClient(t, litestream.NewFileReplicaClient(dir), litestream.NewFileReplicaClient(testDir), generation)
+	if err := os.Remove(filepath.Join(dir, "VERSION")); err != nil {
+		t.Fatal(err)
+	}
+	walDir := filepath.Join(dir, "generations", generation, "wal")
+	for _, pos := range mustWALSegmentPositions(t, litestream.NewFileReplicaClient(dir), generation) {
+		src := filepath.Join(walDir, litestream.FormatIndex(pos.Index), litestream.FormatOffset(pos.Offset)+litestream.WALSegmentExt)
+		dst := filepath.Join(walDir, litestream.FormatIndex(pos.Index)+"_"+litestream.FormatOffset(pos.Offset)+litestream.WALSegmentExt)
+		if err := os.Rename(src, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for index := 0; index <= 2; index++ {
+		if err := os.Remove(filepath.Join(walDir, litestream.FormatIndex(index))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := litestream.NewFileReplicaClient(dir)
+	if v, err := client.LayoutVersion(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if got, want := v, litestream.FileReplicaLayoutV1; got != want {
+		t.Fatalf("LayoutVersion()=%d, want %d", got, want)
+	}
+
+	// Reads should adapt to the old layout before migration.
+	if got, want := mustWALSegmentPositions(t, client, generation), mustWALSegmentPositions(t, litestream.NewFileReplicaClient(testDir), generation); !reflect.DeepEqual(got, want) {
+		t.Fatalf("WALSegments()=%v, want %v", got, want)
+	}
+	filename := filepath.Join(t.TempDir(), "db")
+	if err := litestream.RestoreLatest(context.Background(), client, filename, litestream.NewRestoreOptions()); err != nil {
+		t.Fatal(err)
+	} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), filename) {
+		t.Fatal("file mismatch before migration")
+	}
+
+	// Migrate twice to ensure it is idempotent.
+	for i := 0; i < 2; i++ {
+		if err := client.Migrate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if buf, err := os.ReadFile(filepath.Join(dir, "VERSION")); err != nil {
+		t.Fatal(err)
+	} else if got, want := string(buf), "2\n"; got != want {
+		t.Fatalf("VERSION=%q, want %q", got, want)
+	}
+	if matches, err := filepath.Glob(filepath.Join(walDir, "*"+litestream.WALSegmentExt)); err != nil {
+		t.Fatal(err)
+	} else if len(matches) != 0 {
+		t.Fatalf("unexpected flat segments: %v", matches)
+	}
+
+	// A new client should detect the current layout & restore from it.
+	client = litestream.NewFileReplicaClient(dir)
+	if v, err := client.LayoutVersion(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if got, want := v, litestream.FileReplicaLayoutVersion; got != want {
+		t.Fatalf("LayoutVersion()=%d, want %d", got, want)
+	}
+	filename = filepath.Join(t.TempDir(), "db")
+	if err := litestream.RestoreLatest(context.Background(), client, filename, litestream.NewRestoreOptions()); err != nil {
+		t.Fatal(err)
+	} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), filename) {
+		t.Fatal("file mismatch after migration")
+	}
+}
+
+func TestFileReplicaClient_GC(t *testing.T) {
+	client := litestream.NewFileReplicaClient(t.TempDir())
+	testDir := filepath.Join("testdata", "restore", "ok")
+	mustCopyReplicaClient(t, client, litestream.NewFileReplicaClient(testDir), "0000000000000000")
+
+	snapshotPath, err := client.SnapshotPath("0000000000000000", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := os.ReadFile(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seed junk files across multiple generations.
+	genDir0, _ := client.GenerationDir("0000000000000000")
+	genDir1, _ := client.GenerationDir("0000000000000001")
+	old := time.Now().Add(-1 * time.Hour)
+	for _, file := range []struct {
+		path string
+		data []byte
+		old  bool
+	}{
+		{path: filepath.Join(genDir0, "snapshots", "0000000000000001.snapshot.lz4.tmp"), data: []byte("foo"), old: true},
+		{path: filepath.Join(genDir0, "wal", "0000000000000001", "0000000000001000.wal.lz4.tmp"), data: []byte("bar"), old: true},
+		{path: filepath.Join(genDir0, "wal", "0000000000000003", "0000000000000000.wal.lz4"), data: nil},
+		{path: filepath.Join(genDir1, "snapshots", "0000000000000000.snapshot.lz4"), data: snapshot[:len(snapshot)/2]},
+		{path: filepath.Join(genDir1, "wal", "0000000000000000", "0000000000000000.wal.lz4.tmp"), data: []byte("baz"), old: true},
+
+		// Files that must not be removed.
+		{path: filepath.Join(genDir1, "snapshots", "0000000000000001.snapshot.lz4.tmp"), data: []byte("in progress")},
+		{path: filepath.Join(genDir1, "wal", "0000000000000001", "0000000000000000.wal.lz4"), data: []byte("uncompressed")},
+	} {
+		if err := os.MkdirAll(filepath.Dir(file.path), 0700); err != nil {
+			t.Fatal(err)
+		} else if err := os.WriteFile(file.path, file.data, 0600); err != nil {
+			t.Fatal(err)
+		} else if file.old {
+			if err := os.Chtimes(file.path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	report, err := client.GC(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if got, want := report, (litestream.GCReport{TmpFiles: 3, InvalidFiles: 2, Bytes: int64(9 + len(snapshot)/2)}); got != want {
+		t.Fatalf("GC()=%#v, want %#v", got, want)
+	}
+
+	// Ensure files that are in progress or uncompressed are kept.
+	for _, path := range []string{
+		filepath.Join(genDir1, "snapshots", "0000000000000001.snapshot.lz4.tmp"),
+		filepath.Join(genDir1, "wal", "0000000000000001", "0000000000000000.wal.lz4"),
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Ensure valid data is untouched.
+	filename := filepath.Join(t.TempDir(), "db")
+	if err := litestream.Restore(context.Background(), client, filename, "0000000000000000", 0, 2, litestream.NewRestoreOptions()); err != nil {
+		t.Fatal(err)
+	} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), filename) {
+		t.Fatalf("file mismatch")
+	}
+}
+
+// TestFileReplicaClient_FS runs the same client operations against the local
+// filesystem & an in-memory filesystem to ensure all access goes through FS.
+func TestFileReplicaClient_FS(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		newClient func(tb testing.TB) *litestream.FileReplicaClient
+	}{
+		{"OS", func(tb testing.TB) *litestream.FileReplicaClient {
+			return litestream.NewFileReplicaClient(tb.TempDir())
+		}},
+		{"Memory", func(tb testing.TB) *litestream.FileReplicaClient {
+			c := litestream.NewFileReplicaClient("/replica")
+			c.FS = newMemFS()
+			return c
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Run("Snapshots", func(t *testing.T) {
+				c := tt.newClient(t)
+				for _, index := range []int{2, 0} {
+					if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", index, strings.NewReader(litestream.FormatIndex(index))); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if generations, err := c.Generations(context.Background()); err != nil {
+					t.Fatal(err)
+				} else if got, want := generations, []string{"0000000000000000"}; !reflect.DeepEqual(got, want) {
+					t.Fatalf("Generations()=%v, want %v", got, want)
+				}
+
+				infos, err := litestream.SliceSnapshotIterator(mustSnapshots(t, c, "0000000000000000"))
+				if err != nil {
+					t.Fatal(err)
+				} else if got, want := len(infos), 2; got != want {
+					t.Fatalf("len=%d, want %d", got, want)
+				} else if infos[0].Index != 0 || infos[1].Index != 2 || infos[1].Size != 16 {
+					t.Fatalf("unexpected snapshots: %#v", infos)
+				}
+
+				rd, err := c.SnapshotReader(context.Background(), "0000000000000000", 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer rd.Close()
+				if buf, err := io.ReadAll(rd); err != nil {
+					t.Fatal(err)
+				} else if got, want := string(buf), litestream.FormatIndex(2); got != want {
+					t.Fatalf("data=%q, want %q", got, want)
+				}
+
+				ra, n, err := c.SnapshotReaderAt(context.Background(), "0000000000000000", 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer ra.(io.Closer).Close()
+				buf := make([]byte, 4)
+				if n != 16 {
+					t.Fatalf("size=%d", n)
+				} else if _, err := ra.ReadAt(buf, 12); err != nil {
+					t.Fatal(err)
+				} else if got, want := string(buf), "0002"; got != want {
+					t.Fatalf("ReadAt()=%q, want %q", got, want)
+				}
+
+				if err := c.DeleteSnapshot(context.Background(), "0000000000000000", 0); err != nil {
+					t.Fatal(err)
+				} else if _, err := c.SnapshotReader(context.Background(), "0000000000000000", 0); !os.IsNotExist(err) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			})
+
+			t.Run("WALSegments", func(t *testing.T) {
+				c := tt.newClient(t)
+				c.ArchiveWAL = true
+				for _, pos := range []litestream.Pos{
+					{Generation: "0000000000000000", Index: 0, Offset: 0},
+					{Generation: "0000000000000000", Index: 0, Offset: 4},
+					{Generation: "0000000000000000", Index: 1, Offset: 0},
+				} {
+					if _, err := c.WriteWALSegment(context.Background(), pos, strings.NewReader(pos.String())); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				// Index 0 is archived once index 1 begins but is still listed.
+				if got, want := mustWALSegmentPositions(t, c, "0000000000000000"), []litestream.Pos{
+					{Generation: "0000000000000000", Index: 0, Offset: 0},
+					{Generation: "0000000000000000", Index: 0, Offset: 4},
+					{Generation: "0000000000000000", Index: 1, Offset: 0},
+				}; !reflect.DeepEqual(got, want) {
+					t.Fatalf("positions=%v, want %v", got, want)
+				} else if indexes, err := c.WALIndices(context.Background(), "0000000000000000"); err != nil {
+					t.Fatal(err)
+				} else if got, want := indexes, []int{0, 1}; !reflect.DeepEqual(got, want) {
+					t.Fatalf("WALIndices()=%v, want %v", got, want)
+				}
+
+				pos := litestream.Pos{Generation: "0000000000000000", Index: 0, Offset: 4}
+				rd, err := c.WALSegmentReader(context.Background(), pos)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer rd.Close()
+				if buf, err := io.ReadAll(rd); err != nil {
+					t.Fatal(err)
+				} else if got, want := string(buf), pos.String(); got != want {
+					t.Fatalf("data=%q, want %q", got, want)
+				}
+
+				if err := c.DeleteWALSegments(context.Background(), []litestream.Pos{{Generation: "0000000000000000", Index: 1}}); err != nil {
+					t.Fatal(err)
+				} else if got, want := len(mustWALSegmentPositions(t, c, "0000000000000000")), 2; got != want {
+					t.Fatalf("len=%d, want %d", got, want)
+				}
+			})
+
+			t.Run("Restore", func(t *testing.T) {
+				c := tt.newClient(t)
+				testDir := filepath.Join("testdata", "restore", "ok")
+				mustCopyReplicaClient(t, c, litestream.NewFileReplicaClient(testDir), "0000000000000000")
+
+				filename := filepath.Join(t.TempDir(), "db")
+				if err := litestream.Restore(context.Background(), c, filename, "0000000000000000", 0, 2, litestream.NewRestoreOptions()); err != nil {
+					t.Fatal(err)
+				} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), filename) {
+					t.Fatalf("file mismatch")
+				}
+			})
+
+			t.Run("GC", func(t *testing.T) {
+				c := tt.newClient(t)
+				if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 0, bytes.NewReader(lz4FrameMagic)); err != nil {
+					t.Fatal(err)
+				} else if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 1, strings.NewReader("uncompressed")); err != nil {
+					t.Fatal(err)
+				}
+
+				if report, err := c.GC(context.Background()); err != nil {
+					t.Fatal(err)
+				} else if got, want := report, (litestream.GCReport{InvalidFiles: 1, Bytes: int64(len(lz4FrameMagic))}); got != want {
+					t.Fatalf("GC()=%#v, want %#v", got, want)
+				} else if got, want := len(mustSnapshotInfos(t, c, "0000000000000000")), 1; got != want {
+					t.Fatalf("len=%d, want %d", got, want)
+				}
+			})
+
+			t.Run("DeleteGeneration", func(t *testing.T) {
+				c := tt.newClient(t)
+				if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 0, strings.NewReader("data")); err != nil {
+					t.Fatal(err)
+				} else if err := c.SetGenerationImmutable(context.Background(), "0000000000000000", true); err != nil {
+					t.Fatal(err)
+				} else if immutable, err := c.IsGenerationImmutable(context.Background(), "0000000000000000"); err != nil {
+					t.Fatal(err)
+				} else if !immutable {
+					t.Fatal("expected immutable generation")
+				}
+
+				if err := c.DeleteGeneration(context.Background(), "0000000000000000"); err != nil {
+					t.Fatal(err)
+				} else if generations, err := c.Generations(context.Background()); err != nil {
+					t.Fatal(err)
+				} else if len(generations) != 0 {
+					t.Fatalf("unexpected generations: %v", generations)
+				}
+			})
+		})
+	}
+}
+
+// lz4FrameMagic is the initial bytes of an LZ4 frame. A file containing only
+// the magic number is a partial stream.
+var lz4FrameMagic = []byte{0x04, 0x22, 0x4d, 0x18}
+
+func mustSnapshotInfos(tb testing.TB, client litestream.ReplicaClient, generation string) []litestream.SnapshotInfo {
+	tb.Helper()
+	infos, err := litestream.SliceSnapshotIterator(mustSnapshots(tb, client, generation))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return infos
+}
+
+// memFS is an in-memory implementation of litestream.FileReplicaFS.
+type memFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+func newMemFS() *memFS {
+	return &memFS{nodes: map[string]*memNode{"/": {name: "/", dir: true, modTime: time.Now()}}}
+}
+
+func (fsys *memFS) Open(name string) (litestream.FileReplicaFile, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	node, ok := fsys.nodes[filepath.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFile{fsys: fsys, node: node, Reader: bytes.NewReader(append([]byte(nil), node.data...))}, nil
+}
+
+func (fsys *memFS) Create(name string, perm os.FileMode) (litestream.FileReplicaFile, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	name = filepath.Clean(name)
+	if parent, ok := fsys.nodes[filepath.Dir(name)]; !ok || !parent.dir {
+		return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrNotExist}
+	}
+	node := &memNode{name: filepath.Base(name), mode: perm, modTime: time.Now()}
+	fsys.nodes[name] = node
+	return &memFile{fsys: fsys, node: node, Reader: bytes.NewReader(nil)}, nil
+}
+
+func (fsys *memFS) ReadDir(name string) ([]os.FileInfo, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	name = filepath.Clean(name)
+	if node, ok := fsys.nodes[name]; !ok || !node.dir {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+
+	var fis []os.FileInfo
+	for path, node := range fsys.nodes {
+		if path != name && filepath.Dir(path) == name {
+			fis = append(fis, *node)
+		}
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+func (fsys *memFS) Remove(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := fsys.nodes[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	for path := range fsys.nodes {
+		if strings.HasPrefix(path, name+"/") {
+			return &os.PathError{Op: "remove", Path: name, Err: fmt.Errorf("directory not empty")}
+		}
+	}
+	delete(fsys.nodes, name)
+	return nil
+}
+
+func (fsys *memFS) RemoveAll(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	name = filepath.Clean(name)
+	for path := range fsys.nodes {
+		if path == name || strings.HasPrefix(path, name+"/") {
+			delete(fsys.nodes, path)
+		}
+	}
+	return nil
+}
+
+func (fsys *memFS) Rename(oldpath, newpath string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	node, ok := fsys.nodes[oldpath]
+	if !ok || node.dir {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: os.ErrNotExist}
+	}
+	delete(fsys.nodes, oldpath)
+	node.name = filepath.Base(newpath)
+	fsys.nodes[newpath] = node
+	return nil
+}
+
+func (fsys *memFS) Stat(name string) (os.FileInfo, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	node, ok := fsys.nodes[filepath.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return *node, nil
+}
+
+func (fsys *memFS) MkdirAll(path string, perm os.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	for path = filepath.Clean(path); path != "/"; path = filepath.Dir(path) {
+		if node, ok := fsys.nodes[path]; ok && !node.dir {
+			return &os.PathError{Op: "mkdir", Path: path, Err: fmt.Errorf("not a directory")}
+		} else if !ok {
+			fsys.nodes[path] = &memNode{name: filepath.Base(path), dir: true, mode: perm | os.ModeDir, modTime: time.Now()}
+		}
+	}
+	return nil
+}
+
+// memNode represents a file or directory in a memFS. It implements os.FileInfo.
+type memNode struct {
+	name    string
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+	dir     bool
+}
+
+func (n memNode) Name() string       { return n.name }
+func (n memNode) Size() int64        { return int64(len(n.data)) }
+func (n memNode) Mode() os.FileMode  { return n.mode }
+func (n memNode) ModTime() time.Time { return n.modTime }
+func (n memNode) IsDir() bool        { return n.dir }
+func (n memNode) Sys() interface{}   { return nil }
+
+// memFile is a handle to a memNode. Reads use a copy of the data at open time
+// while writes append to the node.
+type memFile struct {
+	*bytes.Reader
+	fsys *memFS
+	node *memNode
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	f.node.data = append(f.node.data, p...)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	return *f.node, nil
+}
+
+func (f *memFile) Sync() error  { return nil }
+func (f *memFile) Close() error { return nil }
+
+// fullFS is a memFS which fails writes with ENOSPC once its available space
+// has been used. A negative amount of available space is unlimited.
+// openCountFS is an in-memory file system which counts opens of each file.
+type openCountFS struct {
+	*memFS
+	openMu sync.Mutex
+	opens  map[string]int
+}
+
+func (fsys *openCountFS) Open(name string) (litestream.FileReplicaFile, error) {
+	fsys.openMu.Lock()
+	if fsys.opens == nil {
+		fsys.opens = make(map[string]int)
+	}
+	fsys.opens[name]++
+	fsys.openMu.Unlock()
+	return fsys.memFS.Open(name)
+}
+
+// OpenN returns the number of times name has been opened.
+func (fsys *openCountFS) OpenN(name string) int {
+	fsys.openMu.Lock()
+	defer fsys.openMu.Unlock()
+	return fsys.opens[name]
+}
+
+type fullFS struct {
+	*memFS
+	availMu sync.Mutex
+	avail   int64
+}
+
+func newFullFS(avail int64) *fullFS {
+	return &fullFS{memFS: newMemFS(), avail: avail}
+}
+
+// SetAvail sets the number of bytes which can be written before failing.
+func (fsys *fullFS) SetAvail(n int64) {
+	fsys.availMu.Lock()
+	defer fsys.availMu.Unlock()
+	fsys.avail = n
+}
+
+func (fsys *fullFS) Create(name string, perm os.FileMode) (litestream.FileReplicaFile, error) {
+	f, err := fsys.memFS.Create(name, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &fullFile{FileReplicaFile: f, fsys: fsys, name: name}, nil
+}
+
+// fullFile writes through to a memFile until its filesystem is full.
+type fullFile struct {
+	litestream.FileReplicaFile
+	fsys *fullFS
+	name string
+}
+
+func (f *fullFile) Write(p []byte) (int, error) {
+	f.fsys.availMu.Lock()
+	defer f.fsys.availMu.Unlock()
+
+	if f.fsys.avail < 0 || int64(len(p)) <= f.fsys.avail {
+		if f.fsys.avail >= 0 {
+			f.fsys.avail -= int64(len(p))
+		}
+		return f.FileReplicaFile.Write(p)
+	}
+
+	// Write as much as fits & then report the disk as full.
+	n, err := f.FileReplicaFile.Write(p[:f.fsys.avail])
+	f.fsys.avail -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, &os.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+}
+
+func TestFileReplicaClient_DiskFull(t *testing.T) {
+	// tmpNames returns the paths of any temporary files in fsys.
+	tmpNames := func(fsys *fullFS) []string {
+		fsys.mu.Lock()
+		defer fsys.mu.Unlock()
+
+		var a []string
+		for name := range fsys.nodes {
+			if strings.HasSuffix(name, ".tmp") {
+				a = append(a, name)
+			}
+		}
+		return a
+	}
+
+	t.Run("WALSegment", func(t *testing.T) {
+		fsys := newFullFS(4)
+		c := litestream.NewFileReplicaClient("/replica")
+		c.FS = fsys
+
+		pos := litestream.Pos{Generation: "0000000000000000"}
+		if _, err := c.WriteWALSegment(context.Background(), pos, strings.NewReader("partial")); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if a := tmpNames(fsys); len(a) != 0 {
+			t.Fatalf("temporary files remain: %v", a)
+		} else if _, err := c.WALSegmentReader(context.Background(), pos); !os.IsNotExist(err) {
+			t.Fatalf("expected no wal segment, got %v", err)
+		}
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		fsys := newFullFS(4)
+		c := litestream.NewFileReplicaClient("/replica")
+		c.FS = fsys
+
+		if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 0, strings.NewReader("partial")); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if a := tmpNames(fsys); len(a) != 0 {
+			t.Fatalf("temporary files remain: %v", a)
+		} else if _, err := c.SnapshotReader(context.Background(), "0000000000000000", 0); !os.IsNotExist(err) {
+			t.Fatalf("expected no snapshot, got %v", err)
+		}
+	})
+
+	t.Run("Replica", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		fsys := newFullFS(-1)
+		c := litestream.NewFileReplicaClient("/replica")
+		c.FS = fsys
+		r := litestream.NewReplica(db, "", c)
+		r.MonitorEnabled = false
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		prev := r.Pos()
+
+		// Fill the disk & attempt to replicate a new transaction.
+		fsys.SetAvail(0)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if a := tmpNames(fsys); len(a) != 0 {
+			t.Fatalf("temporary files remain: %v", a)
+		} else if pos := r.Pos(); !pos.IsZero() && pos != prev {
+			t.Fatalf("position advanced: %s, previous %s", pos, prev)
+		}
+		if got, want := mustWALSegmentPositions(t, c, prev.Generation), []litestream.Pos{{Generation: prev.Generation}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("wal segments=%v, want %v", got, want)
+		}
+
+		// Replication should resume from the last complete segment.
+		fsys.SetAvail(-1)
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := r.Pos(), db.Pos(); got != want {
+			t.Fatalf("Pos()=%s, want %s", got, want)
+		}
+	})
+}
+
+func TestFileReplicaClient_FsyncPerSync(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	c.FsyncMode = litestream.FsyncPerSync
+	r := litestream.NewReplica(db, "", c)
+	r.SyncInterval = 10 * time.Millisecond
+	r.Start(context.Background())
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Wait for the replica to catch up & then stop cleanly.
+	for i := 0; r.Pos() != db.Pos(); i++ {
+		if i > 100 {
+			t.Fatalf("timeout waiting for replica: replica=%s db=%s", r.Pos(), db.Pos())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.Stop()
+
+	// A new client sees all of the data.
+	filename := filepath.Join(t.TempDir(), "db")
+	if err := litestream.RestoreLatest(context.Background(), litestream.NewFileReplicaClient(c.Path()), filename, litestream.NewRestoreOptions()); err != nil {
+		t.Fatal(err)
+	}
+	other := MustOpenSQLDB(t, filename)
+	defer MustCloseSQLDB(t, other)
+
+	var n int
+	if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 10 {
+		t.Fatalf("n=%d, want 10", n)
+	}
+}
+
+func BenchmarkFileReplicaClient_WriteWALSegment(b *testing.B) {
+	for _, tt := range []struct {
+		name string
+		mode litestream.FsyncMode
+	}{
+		{"PerFile", litestream.FsyncPerFile},
+		{"PerSync", litestream.FsyncPerSync},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			c := litestream.NewFileReplicaClient(b.TempDir())
+			c.FsyncMode = tt.mode
+			data := make([]byte, 4096)
+
+			// Each batch of segments represents a single replica sync.
+			const batchN = 16
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pos := litestream.Pos{Generation: "0000000000000000", Index: i / batchN, Offset: int64(i%batchN) * int64(len(data))}
+				if _, err := c.WriteWALSegment(context.Background(), pos, bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				} else if i%batchN == batchN-1 {
+					if err := c.Flush(context.Background()); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFileReplicaClient_FreeSpace(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		// Path does not need to exist yet; its nearest parent is used.
+		c := litestream.NewFileReplicaClient(filepath.Join(t.TempDir(), "a", "b"))
+		if n, err := c.FreeSpace(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if n == 0 {
+			t.Fatal("expected free space")
+		}
+	})
+
+	t.Run("FS", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient("/replica")
+		c.FS = newMemFS()
+		if n, err := c.FreeSpace(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := n, int64(-1); got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestFileReplicaClient_SnapshotTimestampNames(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		c.SnapshotTimestampNames = true
+
+		if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 0x1234, strings.NewReader("snapshot")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Ensure the file is written with a timestamp prefix.
+		filename, err := c.SnapshotPath("0000000000000000", 0x1234)
+		if err != nil {
+			t.Fatal(err)
+		} else if ok, _ := filepath.Match("????????T??????Z-0000000000001234.snapshot.lz4", filepath.Base(filename)); !ok {
+			t.Fatalf("unexpected filename: %s", filepath.Base(filename))
+		}
+
+		// Ensure the index is parsed back out when listing & reading.
+		if infos := mustSnapshotInfos(t, c, "0000000000000000"); len(infos) != 1 {
+			t.Fatalf("n=%d, want 1", len(infos))
+		} else if got, want := infos[0].Index, 0x1234; got != want {
+			t.Fatalf("index=%d, want %d", got, want)
+		} else if info, err := c.SnapshotInfoAt(context.Background(), "0000000000000000", 0x1234); err != nil {
+			t.Fatal(err)
+		} else if got, want := info.Size, int64(8); got != want {
+			t.Fatalf("size=%d, want %d", got, want)
+		}
+
+		if rc, err := c.SnapshotReader(context.Background(), "0000000000000000", 0x1234); err != nil {
+			t.Fatal(err)
+		} else if buf, err := io.ReadAll(rc); err != nil {
+			t.Fatal(err)
+		} else if err := rc.Close(); err != nil {
+			t.Fatal(err)
+		} else if got, want := string(buf), "snapshot"; got != want {
+			t.Fatalf("data=%q, want %q", got, want)
+		}
+
+		if err := c.DeleteSnapshot(context.Background(), "0000000000000000", 0x1234); err != nil {
+			t.Fatal(err)
+		} else if infos := mustSnapshotInfos(t, c, "0000000000000000"); len(infos) != 0 {
+			t.Fatalf("n=%d, want 0", len(infos))
+		}
+	})
+
+	// Ensure snapshots written under both namings are listed & that rewriting
+	// an index under the new naming replaces the old file.
+	t.Run("Mixed", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 1, strings.NewReader("old")); err != nil {
+			t.Fatal(err)
+		} else if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 2, strings.NewReader("old")); err != nil {
+			t.Fatal(err)
+		}
+
+		c.SnapshotTimestampNames = true
+		if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 2, strings.NewReader("new")); err != nil {
+			t.Fatal(err)
+		} else if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 3, strings.NewReader("new")); err != nil {
+			t.Fatal(err)
+		}
+
+		infos := mustSnapshotInfos(t, c, "0000000000000000")
+		if got, want := len(infos), 3; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+		for i, info := range infos {
+			if got, want := info.Index, i+1; got != want {
+				t.Fatalf("index=%d, want %d", got, want)
+			}
+		}
+
+		if dir, err := c.SnapshotsDir("0000000000000000"); err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(filepath.Join(dir, "0000000000000002.snapshot.lz4")); !os.IsNotExist(err) {
+			t.Fatalf("expected old snapshot to be removed: %v", err)
+		}
+	})
+}
+
+func TestFileReplicaClient_DeleteWALSegments(t *testing.T) {
+	t.Run("Canceled", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		pos := litestream.Pos{Generation: "0000000000000000"}
+		if _, err := c.WriteWALSegment(context.Background(), pos, strings.NewReader("wal")); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := c.DeleteWALSegments(ctx, []litestream.Pos{pos}); err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := len(mustWALSegmentPositions(t, c, "0000000000000000")), 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestFileReplicaClient_Manifest(t *testing.T) {
+	// mustListings returns the snapshot & WAL segment listings of a generation.
+	mustListings := func(tb testing.TB, c litestream.ReplicaClient, generation string) ([]litestream.SnapshotInfo, []litestream.WALSegmentInfo) {
+		tb.Helper()
+		itr, err := c.WALSegments(context.Background(), generation)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		segments, err := litestream.SliceWALSegmentIterator(itr)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return mustSnapshotInfos(tb, c, generation), segments
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		c.Manifest = true
+		r := litestream.NewReplica(db, "", c)
+		r.MonitorEnabled = false
+
+		// Compare against a client which walks the same directories.
+		walker := litestream.NewFileReplicaClient(c.Path())
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			} else if err := r.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			// Start a new index & snapshot it.
+			if err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			} else if err := r.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			} else if _, err := r.Snapshot(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		generation := r.Pos().Generation
+
+		if filename, err := c.ManifestPath(generation); err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(filename); err != nil {
+			t.Fatal(err)
+		}
+
+		snapshots, segments := mustListings(t, c, generation)
+		wantSnapshots, wantSegments := mustListings(t, walker, generation)
+		if !reflect.DeepEqual(snapshots, wantSnapshots) {
+			t.Fatalf("snapshots=%#v, want %#v", snapshots, wantSnapshots)
+		} else if !reflect.DeepEqual(segments, wantSegments) {
+			t.Fatalf("segments=%#v, want %#v", segments, wantSegments)
+		} else if len(snapshots) < 2 {
+			t.Fatalf("unexpected snapshot count: %d", len(snapshots))
+		}
+
+		// Remove all but the latest snapshot & its WAL.
+		r.Retention = time.Nanosecond
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		snapshots, segments = mustListings(t, c, generation)
+		wantSnapshots, wantSegments = mustListings(t, walker, generation)
+		if !reflect.DeepEqual(snapshots, wantSnapshots) {
+			t.Fatalf("snapshots=%#v, want %#v", snapshots, wantSnapshots)
+		} else if !reflect.DeepEqual(segments, wantSegments) {
+			t.Fatalf("segments=%#v, want %#v", segments, wantSegments)
+		} else if got, want := len(snapshots), 1; got != want {
+			t.Fatalf("len(snapshots)=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure the manifest no longer lists files removed by GC.
+	t.Run("GC", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		c.Manifest = true
+		if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 0, bytes.NewReader(mustCompressLZ4(t, []byte("snapshot")))); err != nil {
+			t.Fatal(err)
+		} else if _, err := c.WriteWALSegment(context.Background(), litestream.Pos{Generation: "0000000000000000"}, strings.NewReader("wal")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Truncate the snapshot so it only contains part of its LZ4 stream.
+		snapshotPath, err := c.SnapshotPath("0000000000000000", 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := os.Truncate(snapshotPath, 8); err != nil {
+			t.Fatal(err)
+		}
+
+		if report, err := c.GC(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := report.InvalidFiles, 1; got != want {
+			t.Fatalf("InvalidFiles=%d, want %d", got, want)
+		}
+
+		snapshots, segments := mustListings(t, c, "0000000000000000")
+		if got, want := len(snapshots), 0; got != want {
+			t.Fatalf("len(snapshots)=%d, want %d", got, want)
+		} else if got, want := len(segments), 1; got != want {
+			t.Fatalf("len(segments)=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure a manifest is removed when files change while it is disabled.
+	t.Run("Disabled", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		c.Manifest = true
+		if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 0, strings.NewReader("snapshot")); err != nil {
+			t.Fatal(err)
+		}
+
+		filename, err := c.ManifestPath("0000000000000000")
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(filename); err != nil {
+			t.Fatal(err)
+		}
+
+		c.Manifest = false
+		if _, err := c.WriteWALSegment(context.Background(), litestream.Pos{Generation: "0000000000000000"}, strings.NewReader("wal")); err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Fatalf("expected manifest to be removed: %v", err)
+		}
+	})
+}
+
+func TestFileReplicaClient_PathRewriter(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		evenRoot, oddRoot := t.TempDir(), t.TempDir()
+
+		// Route even generations & odd generations to separate roots.
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		c.PathRewriter = func(kind, generation string) string {
+			if n, err := strconv.ParseUint(generation, 16, 64); err == nil && n%2 == 1 {
+				return oddRoot
+			}
+			return evenRoot
+		}
+		c.ArchiveWAL = true
+
+		// Copy the test replica into an even & an odd generation.
+		src := litestream.NewFileReplicaClient(t.TempDir())
+		mustCopyReplicaClient(t, src, litestream.NewFileReplicaClient(testDir), "0000000000000000")
+		mustCopyReplicaClient(t, c, src, "0000000000000000")
+		if err := os.Rename(filepath.Join(src.Path(), "generations", "0000000000000000"), filepath.Join(src.Path(), "generations", "0000000000000001")); err != nil {
+			t.Fatal(err)
+		}
+		mustCopyReplicaClient(t, c, src, "0000000000000001")
+
+		// Files should be stored under the roots chosen by the rewriter.
+		for generation, root := range map[string]string{"0000000000000000": evenRoot, "0000000000000001": oddRoot} {
+			if _, err := os.Stat(filepath.Join(root, "generations", generation, "snapshots", "0000000000000000.snapshot.lz4")); err != nil {
+				t.Fatal(err)
+			} else if _, err := os.Stat(filepath.Join(root, "generations", generation, "wal", "0000000000000002", "0000000000001038.wal.lz4")); err != nil {
+				t.Fatal(err)
+			} else if _, err := os.Stat(filepath.Join(root, "generations", generation, "wal", "0000000000000000"+litestream.WALArchiveExt)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(c.Path(), "generations", "0000000000000000", "snapshots")); !os.IsNotExist(err) {
+			t.Fatalf("unexpected snapshots directory under client path: %v", err)
+		}
+
+		if generations, err := c.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := generations, []string{"0000000000000000", "0000000000000001"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("generations=%v, want %v", got, want)
+		}
+
+		for _, generation := range []string{"0000000000000000", "0000000000000001"} {
+			filename := filepath.Join(t.TempDir(), "db")
+			if err := litestream.Restore(context.Background(), c, filename, generation, 0, 2, litestream.NewRestoreOptions()); err != nil {
+				t.Fatal(err)
+			} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), filename) {
+				t.Fatalf("file mismatch: %s", generation)
+			}
+		}
+
+		// Deleting a generation removes its files from the routed root.
+		if err := c.DeleteGeneration(context.Background(), "0000000000000001"); err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(filepath.Join(oddRoot, "generations", "0000000000000001")); !os.IsNotExist(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
@@ -30,6 +30,10 @@ type ReplicaClient struct {
 	// GS bucket information
 	Bucket string
 	Path   string
+
+	// Determines which names are listed as generations.
+	// Uses DefaultGenerationFormat if nil.
+	GenerationFormat litestream.GenerationFormat
 }
 
 // NewReplicaClient returns a new instance of ReplicaClient.
@@ -42,6 +46,16 @@ func (c *ReplicaClient) Type() string {
 	return ReplicaClientType
 }
 
+// Location returns the bucket & path as a URL.
+func (c *ReplicaClient) Location() string {
+	return "gs://" + path.Join(c.Bucket, c.Path)
+}
+
+// IsValidGenerationName returns true if name matches the client's generation format.
+func (c *ReplicaClient) IsValidGenerationName(name string) bool {
+	return litestream.IsValidGenerationName(c.GenerationFormat, name)
+}
+
 // Init initializes the connection to GS. No-op if already initialized.
 func (c *ReplicaClient) Init(ctx context.Context) (err error) {
 	c.mu.Lock()
@@ -83,7 +97,7 @@ func (c *ReplicaClient) Generations(ctx context.Context) ([]string, error) {
 		}
 
 		name := path.Base(strings.TrimSuffix(attrs.Prefix, "/"))
-		if !litestream.IsGenerationName(name) {
+		if !c.IsValidGenerationName(name) {
 			continue
 		}
 		generations = append(generations, name)
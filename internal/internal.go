@@ -192,6 +192,37 @@ func ParseSnapshotPath(s string) (index int, err error) {
 
 var snapshotPathRegex = regexp.MustCompile(`^([0-9a-f]{16})\.snapshot\.lz4$`)
 
+// ParseTimestampedSnapshotPath parses the index from a snapshot filename which
+// may have a timestamp prefix, as written by FormatSnapshotPath. Only clients
+// which resolve snapshots by index under either name should accept these.
+func ParseTimestampedSnapshotPath(s string) (index int, err error) {
+	a := timestampedSnapshotPathRegex.FindStringSubmatch(s)
+	if a == nil {
+		return 0, fmt.Errorf("invalid snapshot path")
+	}
+
+	i64, _ := strconv.ParseUint(a[2], 16, 64)
+	if i64 > uint64(MaxInt) {
+		return 0, fmt.Errorf("index too large in snapshot path %q", s)
+	}
+	return int(i64), nil
+}
+
+var timestampedSnapshotPathRegex = regexp.MustCompile(`^(?:([0-9]{8}T[0-9]{6}Z)-)?([0-9a-f]{16})\.snapshot\.lz4$`)
+
+// SnapshotTimestampFormat is the layout of the timestamp prefix of snapshot filenames.
+const SnapshotTimestampFormat = "20060102T150405Z"
+
+// FormatSnapshotPath returns the filename for a snapshot at index. If t is
+// non-zero, the name is prefixed with the UTC timestamp of t so that it is
+// readable by humans, e.g. "20240115T143000Z-0000000000001234.snapshot.lz4".
+func FormatSnapshotPath(index int, t time.Time) string {
+	if t.IsZero() {
+		return fmt.Sprintf("%016x.snapshot.lz4", index)
+	}
+	return fmt.Sprintf("%s-%016x.snapshot.lz4", t.UTC().Format(SnapshotTimestampFormat), index)
+}
+
 // ParseWALSegmentPath parses the index/offset from a segment filename. Used by path-based replicas.
 func ParseWALSegmentPath(s string) (index int, offset int64, err error) {
 	a := walSegmentPathRegex.FindStringSubmatch(s)
@@ -225,6 +256,48 @@ var (
 	}, []string{"replica_type", "operation"})
 )
 
+// JitterDuration returns d randomly adjusted by up to ±fraction of d. The
+// random value r must be in the range [0, 1), such as from rand.Float64().
+// The fraction is clamped to [0, 1] so the result is never negative.
+func JitterDuration(d time.Duration, fraction, r float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	return d + time.Duration((2*r-1)*fraction*float64(d))
+}
+
+// JitterDelay returns a random delay within [0, fraction*d). It is used to
+// spread out the first tick of periodic operations that start together. The
+// fraction is clamped to [0, 1] so the delay is never longer than d.
+func JitterDelay(d time.Duration, fraction, r float64) time.Duration {
+	if fraction <= 0 {
+		return 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	return time.Duration(r * fraction * float64(d))
+}
+
+// FullJitterBackoff returns a random delay within [base, ceil] where ceil is
+// base doubled for each failure after the first, up to max. The random value,
+// r, must be within [0, 1). Spreading retries across the whole range keeps
+// many clients that fail together from retrying at the same moment.
+func FullJitterBackoff(base, max time.Duration, failures int, r float64) time.Duration {
+	ceil := base
+	for i := 1; i < failures && ceil < max; i++ {
+		ceil *= 2
+	}
+	if ceil > max {
+		ceil = max
+	}
+	if ceil <= base {
+		return base
+	}
+	return base + time.Duration(r*float64(ceil-base))
+}
+
 // TruncateDuration truncates d to the nearest major unit (s, ms, µs, ns).
 func TruncateDuration(d time.Duration) time.Duration {
 	if d < 0 {
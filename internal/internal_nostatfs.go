@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package internal
+
+// FreeSpace returns -1 as free space cannot be determined on this platform.
+func FreeSpace(path string) (int64, error) {
+	return -1, nil
+}
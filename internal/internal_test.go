@@ -17,6 +17,7 @@ func TestParseSnapshotPath(t *testing.T) {
 		err   error
 	}{
 		{"0000000000bc614e.snapshot.lz4", 12345678, nil},
+		{"20240115T143000Z-0000000000bc614e.snapshot.lz4", 0, fmt.Errorf("invalid snapshot path")},
 		{"xxxxxxxxxxxxxxxx.snapshot.lz4", 0, fmt.Errorf("invalid snapshot path")},
 		{"0000000000bc614.snapshot.lz4", 0, fmt.Errorf("invalid snapshot path")},
 		{"0000000000bc614e.snapshot.lz", 0, fmt.Errorf("invalid snapshot path")},
@@ -35,6 +36,50 @@ func TestParseSnapshotPath(t *testing.T) {
 	}
 }
 
+func TestParseTimestampedSnapshotPath(t *testing.T) {
+	for _, tt := range []struct {
+		s     string
+		index int
+		err   error
+	}{
+		{"0000000000bc614e.snapshot.lz4", 12345678, nil},
+		{"20240115T143000Z-0000000000bc614e.snapshot.lz4", 12345678, nil},
+		{"20240115T1430Z-0000000000bc614e.snapshot.lz4", 0, fmt.Errorf("invalid snapshot path")},
+		{"-0000000000bc614e.snapshot.lz4", 0, fmt.Errorf("invalid snapshot path")},
+		{"xxxxxxxxxxxxxxxx.snapshot.lz4", 0, fmt.Errorf("invalid snapshot path")},
+		{"", 0, fmt.Errorf("invalid snapshot path")},
+	} {
+		t.Run("", func(t *testing.T) {
+			index, err := internal.ParseTimestampedSnapshotPath(tt.s)
+			if got, want := index, tt.index; got != want {
+				t.Errorf("index=%#v, want %#v", got, want)
+			} else if got, want := err, tt.err; !reflect.DeepEqual(got, want) {
+				t.Errorf("err=%#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestFormatSnapshotPath(t *testing.T) {
+	t.Run("Plain", func(t *testing.T) {
+		if got, want := internal.FormatSnapshotPath(12345678, time.Time{}), "0000000000bc614e.snapshot.lz4"; got != want {
+			t.Fatalf("path=%s, want %s", got, want)
+		}
+	})
+
+	t.Run("Timestamp", func(t *testing.T) {
+		ts := time.Date(2024, 1, 15, 15, 30, 0, 0, time.FixedZone("CET", 3600))
+		s := internal.FormatSnapshotPath(12345678, ts)
+		if got, want := s, "20240115T143000Z-0000000000bc614e.snapshot.lz4"; got != want {
+			t.Fatalf("path=%s, want %s", got, want)
+		} else if index, err := internal.ParseTimestampedSnapshotPath(s); err != nil {
+			t.Fatal(err)
+		} else if got, want := index, 12345678; got != want {
+			t.Fatalf("index=%d, want %d", got, want)
+		}
+	})
+}
+
 func TestParseWALSegmentPath(t *testing.T) {
 	for _, tt := range []struct {
 		s      string
@@ -102,6 +147,79 @@ func TestTruncateDuration(t *testing.T) {
 	}
 }
 
+func TestJitterDuration(t *testing.T) {
+	t.Run("Bounds", func(t *testing.T) {
+		for _, r := range []float64{0, 0.25, 0.5, 0.75, 0.999999} {
+			if got := internal.JitterDuration(time.Minute, 0.1, r); got < 54*time.Second || got > 66*time.Second {
+				t.Fatalf("JitterDuration(r=%v)=%s, want within [54s, 66s]", r, got)
+			}
+		}
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		if got, want := internal.JitterDuration(time.Minute, 0.1, 0), 54*time.Second; got != want {
+			t.Fatalf("JitterDuration()=%s, want %s", got, want)
+		} else if got, want := internal.JitterDuration(time.Minute, 0.1, 0.5), time.Minute; got != want {
+			t.Fatalf("JitterDuration()=%s, want %s", got, want)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		if got, want := internal.JitterDuration(time.Minute, 0, 0.9), time.Minute; got != want {
+			t.Fatalf("JitterDuration()=%s, want %s", got, want)
+		}
+	})
+
+	t.Run("Clamped", func(t *testing.T) {
+		if got, want := internal.JitterDuration(time.Minute, 5, 0), time.Duration(0); got != want {
+			t.Fatalf("JitterDuration()=%s, want %s", got, want)
+		} else if got, want := internal.JitterDuration(time.Minute, -1, 0), time.Minute; got != want {
+			t.Fatalf("JitterDuration()=%s, want %s", got, want)
+		}
+	})
+}
+
+func TestJitterDelay(t *testing.T) {
+	for _, r := range []float64{0, 0.25, 0.5, 0.75, 0.999999} {
+		if got := internal.JitterDelay(time.Minute, 0.1, r); got < 0 || got >= 6*time.Second {
+			t.Fatalf("JitterDelay(r=%v)=%s, want within [0s, 6s)", r, got)
+		}
+	}
+	if got := internal.JitterDelay(time.Minute, 0, 0.5); got != 0 {
+		t.Fatalf("JitterDelay()=%s, want 0", got)
+	} else if got, want := internal.JitterDelay(time.Minute, 5, 0.5), 30*time.Second; got != want {
+		t.Fatalf("JitterDelay()=%s, want %s", got, want)
+	}
+}
+
+func TestFullJitterBackoff(t *testing.T) {
+	t.Run("Bounds", func(t *testing.T) {
+		for failures, ceil := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+			for _, r := range []float64{0, 0.25, 0.5, 0.75, 0.999999} {
+				if got := internal.FullJitterBackoff(time.Second, 10*time.Second, failures, r); got < time.Second || got > ceil {
+					t.Fatalf("FullJitterBackoff(failures=%d, r=%v)=%s, want within [1s, %s]", failures, r, got, ceil)
+				}
+			}
+		}
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		if got, want := internal.FullJitterBackoff(time.Second, 10*time.Second, 3, 0), time.Second; got != want {
+			t.Fatalf("FullJitterBackoff()=%s, want %s", got, want)
+		} else if got, want := internal.FullJitterBackoff(time.Second, 10*time.Second, 3, 0.5), 2500*time.Millisecond; got != want {
+			t.Fatalf("FullJitterBackoff()=%s, want %s", got, want)
+		} else if got, want := internal.FullJitterBackoff(time.Second, 10*time.Second, 100, 0.5), 5500*time.Millisecond; got != want {
+			t.Fatalf("FullJitterBackoff()=%s, want %s", got, want)
+		}
+	})
+
+	t.Run("MaxBelowBase", func(t *testing.T) {
+		if got, want := internal.FullJitterBackoff(time.Second, time.Millisecond, 5, 0.5), time.Second; got != want {
+			t.Fatalf("FullJitterBackoff()=%s, want %s", got, want)
+		}
+	})
+}
+
 func TestMD5Hash(t *testing.T) {
 	for _, tt := range []struct {
 		input []byte
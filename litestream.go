@@ -1,22 +1,27 @@
 package litestream
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/benbjohnson/litestream/internal"
 	"github.com/mattn/go-sqlite3"
+	"github.com/pierrec/lz4/v4"
 )
 
 // Naming constants.
@@ -26,6 +31,7 @@ const (
 	WALDirName    = "wal"
 	WALExt        = ".wal"
 	WALSegmentExt = ".wal.lz4"
+	WALArchiveExt = ".wal.tar.gz"
 	SnapshotExt   = ".snapshot.lz4"
 
 	GenerationNameLen = 16
@@ -44,9 +50,17 @@ var (
 	ErrDBClosed          = errors.New("database closed")
 	ErrNoGeneration      = errors.New("no generation available")
 	ErrGenerationChanged = errors.New("generation changed")
+	ErrGenerationExists  = errors.New("generation already exists")
 	ErrNoSnapshots       = errors.New("no snapshots available")
 	ErrNoWALSegments     = errors.New("no wal segments available")
 	ErrChecksumMismatch  = errors.New("invalid replica, checksum mismatch")
+	ErrReadOnly          = errors.New("replica is read-only")
+	ErrSourceMissing     = errors.New("source database missing")
+
+	ErrDestinationChanged = errors.New("replica destination cannot change without restart")
+	ErrGenerationTakeover = errors.New("generation advanced by another writer")
+	ErrInsufficientSpace  = errors.New("insufficient space for snapshot")
+	ErrNoSource           = errors.New("replica has no source database")
 )
 
 var (
@@ -263,10 +277,13 @@ func (a SnapshotInfoSlice) Less(i, j int) bool {
 }
 
 // FilterSnapshotsAfter returns all snapshots that were created on or after t.
+// Times are compared in UTC.
 func FilterSnapshotsAfter(a []SnapshotInfo, t time.Time) []SnapshotInfo {
+	t = t.UTC()
+
 	other := make([]SnapshotInfo, 0, len(a))
 	for _, snapshot := range a {
-		if !snapshot.CreatedAt.Before(t) {
+		if !snapshot.CreatedAt.UTC().Before(t) {
 			other = append(other, snapshot)
 		}
 	}
@@ -288,6 +305,21 @@ func FindMinSnapshotByGeneration(a []SnapshotInfo, generation string) *SnapshotI
 	return min
 }
 
+// FindMaxSnapshotByGeneration finds the snapshot with the highest index in a generation.
+func FindMaxSnapshotByGeneration(a []SnapshotInfo, generation string) *SnapshotInfo {
+	var max *SnapshotInfo
+	for i := range a {
+		snapshot := &a[i]
+
+		if snapshot.Generation != generation {
+			continue
+		} else if max == nil || snapshot.Index > max.Index {
+			max = snapshot
+		}
+	}
+	return max
+}
+
 // WALInfo represents file information about a WAL file.
 type WALInfo struct {
 	Generation string
@@ -477,8 +509,358 @@ func readWALFileAt(filename string, offset, n int64) ([]byte, error) {
 	return buf, nil
 }
 
-// removeTmpFiles recursively finds and removes .tmp files.
-func removeTmpFiles(root string) error {
+// Compression codecs used when writing replicated data. Files keep the same
+// names regardless of codec as readers detect LZ4 data by its magic number.
+// Other compression formats, such as zstd, are not supported.
+const (
+	CodecLZ4  = "lz4"
+	CodecNone = "none"
+
+	// CodecAuto compresses a sample from the start of each file & stores the
+	// file with CodecNone if the sample does not compress well, such as for
+	// already compressed data, or with CodecLZ4 otherwise.
+	CodecAuto = "auto"
+)
+
+// Sample size & maximum compressed to uncompressed size ratio of the sample
+// for CodecAuto to store a file with LZ4.
+const (
+	autoCompressSampleSize = 64 * 1024
+	autoCompressMaxRatio   = 0.8
+)
+
+// ValidateCodec returns an error if codec is not a supported codec.
+func ValidateCodec(codec string) error {
+	switch codec {
+	case "", CodecLZ4, CodecNone, CodecAuto:
+		return nil
+	default:
+		return fmt.Errorf("unsupported codec: %q", codec)
+	}
+}
+
+// newCompressWriter returns a writer that compresses data to w using codec.
+// An empty codec defaults to LZ4. Data written with any codec can be read
+// back with newDecompressReader() which detects the format by its content.
+func newCompressWriter(w io.Writer, codec string) (io.WriteCloser, error) {
+	if err := ValidateCodec(codec); err != nil {
+		return nil, err
+	}
+
+	switch codec {
+	case CodecNone:
+		return &autoCompressWriter{w: w, none: true}, nil
+	case CodecAuto:
+		return &autoCompressWriter{w: w}, nil
+	default:
+		return lz4.NewWriter(w), nil
+	}
+}
+
+// autoCompressWriter buffers a sample of the data written to it & then writes
+// all data to w either LZ4 compressed or uncompressed, depending on how well
+// the sample compresses. If set, prefix is written ahead of LZ4 data only.
+//
+// Data is always compressed if it begins with an LZ4 magic number, such as a
+// WAL frame for a page number with the same bytes, as it would otherwise be
+// read back as LZ4 data.
+type autoCompressWriter struct {
+	w      io.Writer
+	prefix []byte
+	none   bool // if true, only compress data beginning with an LZ4 magic
+	buf    []byte
+	zw     io.WriteCloser // nil until the codec is chosen
+}
+
+// sampleSize returns the number of bytes buffered before choosing the codec.
+func (w *autoCompressWriter) sampleSize() int {
+	if w.none {
+		return len(lz4FrameMagic)
+	}
+	return autoCompressSampleSize
+}
+
+func (w *autoCompressWriter) Write(p []byte) (int, error) {
+	if w.zw != nil {
+		return w.zw.Write(p)
+	}
+
+	sz := w.sampleSize() - len(w.buf)
+	if sz > len(p) {
+		sz = len(p)
+	}
+	if w.buf = append(w.buf, p[:sz]...); len(w.buf) < w.sampleSize() {
+		return len(p), nil
+	}
+
+	if err := w.init(); err != nil {
+		return 0, err
+	} else if _, err := w.zw.Write(p[sz:]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// init chooses the codec based on the buffered sample & writes the sample.
+func (w *autoCompressWriter) init() error {
+	compress := !w.none && isCompressible(w.buf)
+	if len(w.buf) >= len(lz4FrameMagic) && isLZ4Magic(w.buf[:len(lz4FrameMagic)]) {
+		compress = true
+	}
+
+	if compress {
+		var dst io.Writer = w.w
+		if w.prefix != nil {
+			dst = &prefixWriter{w: w.w, prefix: w.prefix}
+		}
+		w.zw = lz4.NewWriter(dst)
+	} else {
+		w.zw = nopWriteCloser{w.w}
+	}
+
+	_, err := w.zw.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+// Close chooses the codec, if fewer bytes than the sample size were written,
+// & closes the underlying compression writer.
+func (w *autoCompressWriter) Close() error {
+	if w.zw == nil {
+		if err := w.init(); err != nil {
+			return err
+		}
+	}
+	return w.zw.Close()
+}
+
+// isCompressible returns true if sample is empty or LZ4 compresses it to at
+// most autoCompressMaxRatio of its size.
+func isCompressible(sample []byte) bool {
+	if len(sample) == 0 {
+		return true
+	}
+
+	dst := make([]byte, lz4.CompressBlockBound(len(sample)))
+	n, err := lz4.CompressBlock(sample, dst, nil)
+	if err != nil || n == 0 {
+		return false // incompressible
+	}
+	return float64(n) <= autoCompressMaxRatio*float64(len(sample))
+}
+
+// nopWriteCloser wraps a writer with a no-op Close() method.
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// copyBuffer copies src to dst using a buffer of the given size. The buffer is
+// always used, even if src or dst implement io.WriterTo or io.ReaderFrom.
+// Falls back to io.Copy() if size is not positive.
+func copyBuffer(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		return io.Copy(dst, src)
+	}
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, size))
+}
+
+// lz4FrameMagic is the magic number that begins every LZ4 frame.
+var lz4FrameMagic = []byte{0x04, 0x22, 0x4D, 0x18}
+
+// lz4TimestampFrameMagic is the magic number of the LZ4 skippable frame used to
+// embed a creation timestamp ahead of compressed data. LZ4 decoders ignore
+// skippable frames so the data remains readable by any LZ4 reader.
+var lz4TimestampFrameMagic = []byte{0x5B, 0x2A, 0x4D, 0x18}
+
+// timestampFrameSize is the total size of an embedded timestamp frame: the
+// magic number, the little-endian payload size & the payload of big-endian
+// nanoseconds since the Unix epoch.
+const timestampFrameSize = 16
+
+// isLZ4Magic returns true if b begins an LZ4 stream, with or without an
+// embedded timestamp frame.
+func isLZ4Magic(b []byte) bool {
+	return bytes.Equal(b, lz4FrameMagic) || bytes.Equal(b, lz4TimestampFrameMagic)
+}
+
+// encodeTimestampFrame returns a skippable LZ4 frame containing t.
+func encodeTimestampFrame(t time.Time) []byte {
+	b := make([]byte, timestampFrameSize)
+	copy(b, lz4TimestampFrameMagic)
+	binary.LittleEndian.PutUint32(b[4:], 8)
+	binary.BigEndian.PutUint64(b[8:], uint64(t.UnixNano()))
+	return b
+}
+
+// readTimestampFrame reads the embedded timestamp frame from the start of r.
+// Returns false if the data does not begin with a timestamp frame.
+func readTimestampFrame(r io.Reader) (time.Time, bool, error) {
+	b := make([]byte, timestampFrameSize)
+	if _, err := io.ReadFull(r, b); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	} else if !bytes.Equal(b[:4], lz4TimestampFrameMagic) || binary.LittleEndian.Uint32(b[4:]) != 8 {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b[8:]))).UTC(), true, nil
+}
+
+// prefixWriter writes prefix to the underlying writer before the first write.
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	if w.prefix != nil {
+		if _, err := w.w.Write(w.prefix); err != nil {
+			return 0, err
+		}
+		w.prefix = nil
+	}
+	return w.w.Write(p)
+}
+
+// deltaSnapshotMagic is written at the start of the uncompressed contents of a
+// delta snapshot. It has the same length as the SQLite header magic so either
+// can be detected by peeking at the same number of bytes.
+const deltaSnapshotMagic = "litestream delta"
+
+// deltaSnapshotHeaderSize is the size of the header of a delta snapshot.
+const deltaSnapshotHeaderSize = len(deltaSnapshotMagic) + 16
+
+// deltaSnapshotHeader represents the header of a delta snapshot. The header is
+// followed by records containing a 4-byte page number & the page data for each
+// page which changed since the base snapshot. A zero page number ends the list.
+type deltaSnapshotHeader struct {
+	BaseIndex int // index of the snapshot the delta applies to
+	PageSize  int // database page size, in bytes
+	PageN     int // number of pages in the database
+}
+
+// encodeDeltaSnapshotHeader returns the binary encoding of hdr.
+func encodeDeltaSnapshotHeader(hdr deltaSnapshotHeader) []byte {
+	b := make([]byte, deltaSnapshotHeaderSize)
+	copy(b, deltaSnapshotMagic)
+	binary.BigEndian.PutUint64(b[16:], uint64(hdr.BaseIndex))
+	binary.BigEndian.PutUint32(b[24:], uint32(hdr.PageSize))
+	binary.BigEndian.PutUint32(b[28:], uint32(hdr.PageN))
+	return b
+}
+
+// readDeltaSnapshotHeader reads the delta snapshot header from the start of r.
+// Returns false without consuming any data if r is not a delta snapshot.
+func readDeltaSnapshotHeader(r *bufio.Reader) (hdr deltaSnapshotHeader, ok bool, err error) {
+	if magic, err := r.Peek(len(deltaSnapshotMagic)); err == io.EOF {
+		return hdr, false, nil
+	} else if err != nil {
+		return hdr, false, err
+	} else if string(magic) != deltaSnapshotMagic {
+		return hdr, false, nil
+	}
+
+	b := make([]byte, deltaSnapshotHeaderSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return hdr, false, fmt.Errorf("read delta header: %w", err)
+	}
+	hdr.BaseIndex = int(binary.BigEndian.Uint64(b[16:]))
+	hdr.PageSize = int(binary.BigEndian.Uint32(b[24:]))
+	hdr.PageN = int(binary.BigEndian.Uint32(b[28:]))
+
+	if hdr.PageSize < 512 || hdr.PageSize > 65536 || hdr.PageSize&(hdr.PageSize-1) != 0 {
+		return hdr, false, fmt.Errorf("invalid delta page size: %d", hdr.PageSize)
+	}
+	return hdr, true, nil
+}
+
+// newDecompressReader returns a reader that decompresses r if it begins with
+// the LZ4 frame magic number. Otherwise r is assumed to be uncompressed and
+// its data is returned as-is. This allows mislabeled files to be read.
+//
+// The buffered & LZ4 readers are taken from a pool and are returned to it
+// once the stream reaches EOF or fails, so callers do not need to close it.
+func newDecompressReader(r io.Reader) io.Reader {
+	br := bufioReaderPool.Get().(*bufio.Reader)
+	br.Reset(r)
+
+	pr := &pooledDecompressReader{br: br}
+	if magic, err := br.Peek(len(lz4FrameMagic)); err == nil && isLZ4Magic(magic) {
+		pr.zr = lz4ReaderPool.Get().(*lz4.Reader)
+		pr.zr.Reset(br)
+	}
+	return pr
+}
+
+// Pools of readers used by newDecompressReader().
+var (
+	bufioReaderPool = sync.Pool{New: func() interface{} { return bufio.NewReader(nil) }}
+	lz4ReaderPool   = sync.Pool{New: func() interface{} { return lz4.NewReader(nil) }}
+)
+
+// pooledDecompressReader reads from a pooled buffered reader & an optional
+// pooled LZ4 reader. Both are released back to their pools on the first error,
+// including io.EOF, after which the same error is returned for every read.
+type pooledDecompressReader struct {
+	br  *bufio.Reader
+	zr  *lz4.Reader // nil if uncompressed
+	err error       // error returned once released
+}
+
+func (r *pooledDecompressReader) Read(p []byte) (n int, err error) {
+	if r.br == nil {
+		return 0, r.err
+	}
+
+	if r.zr != nil {
+		n, err = r.zr.Read(p)
+	} else {
+		n, err = r.br.Read(p)
+	}
+
+	if err != nil {
+		r.release(err)
+	}
+	return n, err
+}
+
+// WriteTo writes the remaining data to w. The LZ4 reader's WriteTo() is used,
+// when compressed, as it reports truncated streams which Read() does not.
+func (r *pooledDecompressReader) WriteTo(w io.Writer) (n int64, err error) {
+	if r.br == nil {
+		return 0, r.err
+	}
+
+	if r.zr != nil {
+		n, err = r.zr.WriteTo(w)
+	} else {
+		n, err = r.br.WriteTo(w)
+	}
+
+	if err != nil {
+		r.release(err)
+	} else {
+		r.release(io.EOF)
+	}
+	return n, err
+}
+
+// release returns the readers to their pools & records err for later reads.
+func (r *pooledDecompressReader) release(err error) {
+	if r.zr != nil {
+		r.zr.Reset(nil)
+		lz4ReaderPool.Put(r.zr)
+	}
+	r.br.Reset(nil)
+	bufioReaderPool.Put(r.br)
+
+	r.br, r.zr, r.err = nil, nil, err
+}
+
+// removeTmpFiles recursively finds and removes .tmp files. Each file is logged
+// with its size & age. If salvage is true, temp files that contain a complete
+// LZ4 stream are renamed into place instead, if the destination does not exist.
+func removeTmpFiles(root string, logger *log.Logger, salvage bool) error {
 	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil // skip errored files
@@ -487,10 +869,59 @@ func removeTmpFiles(root string) error {
 		} else if !strings.HasSuffix(path, ".tmp") {
 			return nil // skip non-temp files
 		}
+
+		age := time.Since(info.ModTime()).Truncate(time.Second)
+		if salvage {
+			if ok, err := salvageTmpFile(path); err != nil {
+				return fmt.Errorf("salvage %s: %w", path, err)
+			} else if ok {
+				logger.Printf("recovered orphaned temp file: path=%s size=%d age=%s", path, info.Size(), age)
+				return nil
+			}
+		}
+
+		logger.Printf("removing orphaned temp file: path=%s size=%d age=%s", path, info.Size(), age)
 		return os.Remove(path)
 	})
 }
 
+// salvageTmpFile renames a temp file to its final path if it is an LZ4 file
+// that decompresses fully. Returns false if the file cannot be salvaged.
+func salvageTmpFile(path string) (bool, error) {
+	dst := strings.TrimSuffix(path, ".tmp")
+	if !strings.HasSuffix(dst, ".lz4") {
+		return false, nil
+	} else if _, err := os.Stat(dst); err == nil {
+		return false, nil // never overwrite a finalized file
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if ok, err := isCompleteLZ4File(path); err != nil || !ok {
+		return false, err
+	}
+
+	if err := os.Rename(path, dst); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// isCompleteLZ4File returns true if the file at path decompresses fully.
+// Only complete streams with a valid end mark can be decompressed.
+func isCompleteLZ4File(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(io.Discard, lz4.NewReader(f)); err != nil {
+		return false, nil
+	}
+	return true, f.Close()
+}
+
 // IsGenerationName returns true if s is the correct length and is only lowercase hex characters.
 func IsGenerationName(s string) bool {
 	if len(s) != GenerationNameLen {
@@ -504,6 +935,29 @@ func IsGenerationName(s string) bool {
 	return true
 }
 
+// GenerationFormat determines which names are listed as generations on a
+// replica. This allows generations created outside of litestream to use a
+// different naming scheme.
+type GenerationFormat interface {
+	IsValid(name string) bool
+}
+
+// DefaultGenerationFormat accepts the hex generation names created by a DB.
+var DefaultGenerationFormat GenerationFormat = defaultGenerationFormat{}
+
+type defaultGenerationFormat struct{}
+
+func (defaultGenerationFormat) IsValid(name string) bool { return IsGenerationName(name) }
+
+// IsValidGenerationName returns true if name is a valid generation name for
+// format. DefaultGenerationFormat is used if format is nil.
+func IsValidGenerationName(format GenerationFormat, name string) bool {
+	if format == nil {
+		format = DefaultGenerationFormat
+	}
+	return format.IsValid(name)
+}
+
 // FormatIndex formats an index as a hex value.
 func FormatIndex(index int) string {
 	return fmt.Sprintf("%016x", index)
@@ -24,6 +24,8 @@ type ReplicaClient struct {
 
 func (c *ReplicaClient) Type() string { return "mock" }
 
+func (c *ReplicaClient) Location() string { return "" }
+
 func (c *ReplicaClient) Generations(ctx context.Context) ([]string, error) {
 	return c.GenerationsFunc(ctx)
 }
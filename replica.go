@@ -1,16 +1,26 @@
 package litestream
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc64"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"sort"
 	"sync"
 	"time"
 
+	"github.com/benbjohnson/litestream/internal"
 	"github.com/pierrec/lz4/v4"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -22,8 +32,75 @@ const (
 	DefaultSyncInterval           = 1 * time.Second
 	DefaultRetention              = 24 * time.Hour
 	DefaultRetentionCheckInterval = 1 * time.Hour
+	DefaultSyncRetryThreshold     = 5
+	DefaultSyncMaxBackoff         = 1 * time.Minute
+	DefaultWALFlushInterval       = 10 * time.Second
+	DefaultMaxDeltaSnapshots      = 10
+	DefaultSnapshotRetryBackoff   = 1 * time.Second
 )
 
+// SourceMissingPolicy determines replica behavior when the database file is missing.
+type SourceMissingPolicy int
+
+const (
+	// SourceMissingWait keeps the last replicated state and resumes
+	// replication once the database file reappears.
+	SourceMissingWait SourceMissingPolicy = iota
+
+	// SourceMissingStop stops the replica's monitor, retainer & snapshotter.
+	// The terminal error is available from Replica.Err().
+	SourceMissingStop
+)
+
+// TakeoverPolicy determines replica behavior when another writer, such as a
+// promoted standby, has advanced the replica's generation on the client.
+type TakeoverPolicy int
+
+const (
+	// TakeoverIgnore does not check the client for other writers.
+	TakeoverIgnore TakeoverPolicy = iota
+
+	// TakeoverStop stops the replica's background goroutines without writing
+	// to the generation. The terminal error, ErrGenerationTakeover, is
+	// available from Replica.Err().
+	TakeoverStop
+
+	// TakeoverNewGeneration clears the database's current generation so the
+	// next sync starts a new generation with a fresh snapshot. This affects
+	// all replicas of the database.
+	TakeoverNewGeneration
+)
+
+// Kinds of files reported by Replica.OnDelete.
+const (
+	DeleteKindSnapshot = "snapshot"
+	DeleteKindWAL      = "wal"
+)
+
+// ReplicaMode determines what data a replica copies to its client.
+type ReplicaMode int
+
+const (
+	// ReplicaModeContinuous replicates snapshots & every WAL segment.
+	ReplicaModeContinuous ReplicaMode = iota
+
+	// ReplicaModeSnapshotOnly replicates periodic snapshots only. WAL
+	// segments are never copied so restores are limited to snapshot points.
+	ReplicaModeSnapshotOnly
+)
+
+// ParseReplicaMode returns the replica mode for a config string.
+func ParseReplicaMode(s string) (ReplicaMode, error) {
+	switch s {
+	case "", "continuous":
+		return ReplicaModeContinuous, nil
+	case "snapshot-only":
+		return ReplicaModeSnapshotOnly, nil
+	default:
+		return 0, fmt.Errorf("invalid replica mode: %q", s)
+	}
+}
+
 // Replica connects a database to a replication destination via a ReplicaClient.
 // The replica manages periodic synchronization and maintaining the current
 // replica position.
@@ -31,39 +108,257 @@ type Replica struct {
 	db   *DB
 	name string
 
-	mu  sync.RWMutex
-	pos Pos // current replicated position
-	itr *FileWALSegmentIterator
+	// If true, the replica was opened without a source database & methods
+	// which modify the replica return ErrNoSource.
+	noSource bool
+
+	mu    sync.RWMutex
+	pos   Pos           // current replicated position
+	posCh chan struct{} // closed & replaced when pos changes
+	cfgCh chan struct{} // closed & replaced when reconfigured
+	err   error         // terminal error that stopped the monitor
+	itr   *FileWALSegmentIterator
+
+	// Segments read from itr but held back until MinWALBytes accumulate.
+	pending   []WALSegmentInfo
+	pendingAt time.Time // time the first pending segment was read
 
 	muf sync.Mutex
 	f   *os.File // long-running file descriptor to avoid non-OFD lock issues
 
+	// Page checksums of the last snapshot, used to write the next as a delta.
+	delta *snapshotDeltaBase
+
+	// Checksum chain at the end of the last segment written via WALTransform.
+	walTransform *walTransformState
+
+	// Shadow WAL segment which failed to be read on the last sync & the
+	// number of consecutive syncs it has failed.
+	failedSegment  Pos
+	segmentFailedN int
+
+	// Consecutive failures of syncs triggered by SyncOnCommit & the time
+	// before which further commit syncs are skipped. Only accessed by the
+	// database's monitor goroutine.
+	commitFailures int
+	commitRetryAt  time.Time
+
+	// Held while syncing so concurrent calls to Sync() run one at a time.
+	// Also guards the WAL iterator & pending segments read by the monitor.
+	mus sync.Mutex
+
+	// Held for reading while syncing & for writing while enforcing retention
+	// so files are not removed while sync is writing to the same generation.
+	mur sync.RWMutex
+
 	wg     sync.WaitGroup
 	cancel func()
 
 	// Client used to connect to the remote replica.
 	client ReplicaClient
 
-	// Time between syncs with the shadow WAL.
+	// Time between syncs with the shadow WAL. After a change notification, the
+	// monitor waits this long so further changes coalesce into a single sync.
+	// A zero interval syncs immediately on every notification.
 	SyncInterval time.Duration
 
-	// Frequency to create new snapshots.
+	// Number of consecutive sync failures before the monitor begins to back
+	// off exponentially from SyncInterval up to SyncMaxBackoff. Errors are
+	// only logged periodically while backing off. Disabled if zero. The
+	// backoff is not capped if SyncMaxBackoff is zero.
+	SyncRetryThreshold int
+	SyncMaxBackoff     time.Duration
+
+	// If set, the monitor waits a random delay after each failed sync instead
+	// of the threshold-based backoff above. The delay is chosen between
+	// RetryBaseDelay & a ceiling which doubles with each consecutive failure
+	// up to RetryMaxDelay. This avoids synchronized retries when many replicas
+	// fail at once. The delay resets after a successful sync. RetryMaxDelay
+	// uses SyncMaxBackoff if zero.
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// Number of times a sync retries writing the first snapshot of a
+	// generation after it fails. Retries wait SnapshotRetryBackoff, doubling
+	// after each attempt. Once retries are exhausted, Sync returns a
+	// *SnapshotFailedError & the monitor stops with it as its terminal error
+	// instead of attempting a new snapshot on every sync. Disabled if zero.
+	MaxSnapshotRetries   int
+	SnapshotRetryBackoff time.Duration
+
+	// Frequency to create new snapshots, independent of Retention. A snapshot
+	// is created whenever the newest snapshot is older than this interval so
+	// the schedule is preserved across restarts. Disabled if zero.
 	SnapshotInterval time.Duration
 
 	// Time to keep snapshots and related WAL files.
 	// Database is snapshotted after interval, if needed, and older WAL files are discarded.
 	Retention time.Duration
 
+	// Time to keep WAL files, if shorter than Retention. Older WAL files are
+	// discarded even if their snapshot is retained, which reduces restore
+	// granularity for older data. WAL files at or after the most recent
+	// snapshot in a generation are always kept. Disabled if zero.
+	WALRetention time.Duration
+
+	// If true, WAL segments superseded by a new snapshot are removed as soon
+	// as it is written instead of waiting for retention enforcement. WAL
+	// segments needed to restore from older snapshots that are still within
+	// Retention or kept by MinRetainedSnapshots are not removed, nor are
+	// segments within WALRetention. Snapshots outside the retention period
+	// can then only be restored up to their own index until they are removed.
+	PruneWALOnSnapshot bool
+
+	// Minimum number of snapshots to keep in each retained generation, even if
+	// they are older than Retention. Generations without any snapshots inside
+	// the retention period are still deleted. Disabled if zero.
+	MinRetainedSnapshots int
+
+	// Maximum number of generations to keep. The oldest generations, by the
+	// creation time of their first snapshot, are deleted by retention beyond
+	// this limit in addition to snapshot retention. The current generation &
+	// immutable generations are never deleted. Disabled if zero.
+	MaxGenerations int
+
 	// Time between checks for retention.
 	RetentionCheckInterval time.Duration
 
+	// Minimum number of WAL bytes to accumulate within an index before a WAL
+	// segment is written to the client. Pending data remains in the shadow WAL
+	// & is flushed once WALFlushInterval has elapsed or the index changes.
+	// Disabled if zero.
+	MinWALBytes      int64
+	WALFlushInterval time.Duration
+
+	// If true, the database's monitor syncs the replica synchronously as soon
+	// as each change notification has been copied to the shadow WAL. This
+	// bypasses SyncInterval, MinWALBytes & the database's MonitorDelayInterval
+	// so the replica lags by at most one commit. Every commit then incurs a
+	// client write, which can greatly increase IO & request costs.
+	//
+	// Syncs on commit run on the database's monitor goroutine so a slow
+	// client delays the processing of later changes. After a failed sync,
+	// commit syncs are skipped for the monitor's retry delay & they stop
+	// once the monitor has stopped with a terminal error.
+	SyncOnCommit bool
+
+	// Maximum number of uncompressed bytes written to a single WAL segment on
+	// the client. Larger writes within an index are split into multiple
+	// segments at increasing offsets. Disabled if zero.
+	MaxWALSegmentBytes int64
+
+	// If true, retention is enforced once when the replica starts instead of
+	// waiting for the first RetentionCheckInterval to elapse.
+	RunRetentionOnStart bool
+
+	// Compression codecs for snapshots & WAL segments written to the client.
+	// Defaults to CodecLZ4 if blank. CodecAuto chooses between CodecLZ4 &
+	// CodecNone for each file. Readers detect the codec from the data itself
+	// so it can be changed without affecting existing files. Uncompressed
+	// data which begins with an LZ4 magic number is always compressed so it
+	// cannot be mistaken for LZ4 data.
+	SnapshotCodec string
+	WALCodec      string
+
+	// If true, the creation time is embedded at the start of each LZ4 snapshot
+	// & WAL segment written to the client. SnapshotIndexAt() & restores by
+	// timestamp then prefer the embedded time over the file's modification
+	// time which may be reset when replica files are copied. Reading the
+	// embedded time requires opening every file in the generation. Not
+	// applied to uncompressed files.
+	EmbedTimestamps bool
+
+	// If true, snapshots after the first in a generation only contain the
+	// pages which changed since the previous snapshot written by this replica.
+	// A full snapshot is written on startup & after MaxDeltaSnapshots
+	// consecutive deltas, which defaults to DefaultMaxDeltaSnapshots if zero.
+	DeltaSnapshots    bool
+	MaxDeltaSnapshots int
+
+	// Paths of databases attached to the database, keyed by name. An image of
+	// each is captured while the read lock for every snapshot is held & is
+	// stored with the snapshot. Attached databases are not tracked between
+	// snapshots so they can only be restored to a snapshot position. SQLite
+	// does not commit atomically across attached databases in WAL mode so
+	// the images match the snapshot position as closely as possible but are
+	// not guaranteed to be transactionally consistent with it. Requires a
+	// client implementing AttachedClient.
+	Attached map[string]string
+
+	// If true, each WAL segment is read back from the client after it is
+	// written & compared against the source data before the position is
+	// advanced. This detects silent corruption but doubles the I/O per sync.
+	VerifyWrites bool
+
+	// Number of consecutive syncs that may fail to read the same shadow WAL
+	// segment before it is skipped. Segments preceding it are still written
+	// so the replica advances up to the gap. A skipped segment cannot be
+	// replicated so a new generation is started for the database, which
+	// affects all of its replicas, & Sync returns a *SkippedWALSegmentError.
+	// Disabled if zero.
+	MaxSegmentRetries int
+
+	// Size of the buffer used when copying snapshot & WAL data, in bytes.
+	// Larger buffers can improve throughput for large databases. Uses the
+	// io.Copy() default if zero.
+	CopyBufferSize int
+
+	// Fraction of an interval, between 0 and 1, used to randomize the timing
+	// of periodic retention & snapshot operations. The first operation is
+	// also delayed by a random amount. This spreads out load when many
+	// replicas start at the same time. Disabled if zero & treated as 1 if
+	// greater than 1.
+	Jitter float64
+
 	// Time between validation checks.
 	ValidationInterval time.Duration
 
+	// Optional hook invoked with each WAL frame, including its 24-byte frame
+	// header, before it is written to the client. The returned frame must be
+	// the same size as the original. Returning an error aborts the sync.
+	// Frame checksums are recalculated afterward so the checksum chain
+	// remains valid.
+	//
+	// Returning a nil frame drops it by writing a copy of the previous frame
+	// in the index in its place. Rewriting a page with its latest contents
+	// has no effect on restore but keeps replica segments the same size as
+	// the source WAL so positions remain exact. The first frame of an index
+	// has no previous frame & cannot be dropped.
+	//
+	// Restores from this replica only contain the transformed data. Dropping
+	// a commit frame merges the rest of its transaction into the next commit
+	// in the index.
+	WALTransform func(frame []byte) ([]byte, error)
+
+	// Optional callback invoked for each snapshot & WAL segment removed by
+	// retention. The kind is either DeleteKindSnapshot or DeleteKindWAL.
+	OnDelete func(kind string, generation string, index int, size int64)
+
+	// Optional callback invoked after each snapshot is written with the
+	// snapshot info & the wall-clock time taken to write it. The info size is
+	// the compressed size stored by the client.
+	OnSnapshot func(info SnapshotInfo, duration time.Duration)
+
+	// Determines how the monitor behaves when the database file is missing.
+	OnSourceMissing SourceMissingPolicy
+
+	// Determines how the replica behaves when the client holds WAL segments
+	// in the current generation which were not written by this replica.
+	// Checking requires listing the generation's WAL segments on each sync.
+	OnTakeover TakeoverPolicy
+
+	// Determines whether WAL segments are replicated in addition to snapshots.
+	// Snapshot-only replicas write snapshots on SnapshotInterval & retention.
+	Mode ReplicaMode
+
 	// If true, replica monitors database for changes automatically.
 	// Set to false if replica is being used synchronously (such as in tests).
 	MonitorEnabled bool
 
+	// Returns the current time when calculating snapshot age.
+	// Defaults to time.Now if nil.
+	Now func() time.Time
+
 	Logger *log.Logger
 }
 
@@ -73,10 +368,16 @@ func NewReplica(db *DB, name string, client ReplicaClient) *Replica {
 		name:   name,
 		client: client,
 		cancel: func() {},
+		posCh:  make(chan struct{}),
+		cfgCh:  make(chan struct{}),
 
 		SyncInterval:           DefaultSyncInterval,
+		SyncRetryThreshold:     DefaultSyncRetryThreshold,
+		SyncMaxBackoff:         DefaultSyncMaxBackoff,
+		SnapshotRetryBackoff:   DefaultSnapshotRetryBackoff,
 		Retention:              DefaultRetention,
 		RetentionCheckInterval: DefaultRetentionCheckInterval,
+		WALFlushInterval:       DefaultWALFlushInterval,
 		MonitorEnabled:         true,
 	}
 
@@ -89,6 +390,23 @@ func NewReplica(db *DB, name string, client ReplicaClient) *Replica {
 	return r
 }
 
+// OpenFileReplica returns a replica for an existing file replica directory
+// which is not attached to a source database. Listing & restore methods work
+// as normal while Start, Sync, Snapshot & any method which modifies the
+// replica directory, such as EnforceRetention, return ErrNoSource.
+func OpenFileReplica(path string) (*Replica, error) {
+	if fi, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("replica path is not a directory: %s", path)
+	}
+
+	r := NewReplica(nil, "", NewFileReplicaClient(path))
+	r.MonitorEnabled = false
+	r.noSource = true
+	return r, nil
+}
+
 // Name returns the name of the replica.
 func (r *Replica) Name() string {
 	if r.name == "" && r.client != nil {
@@ -103,16 +421,198 @@ func (r *Replica) DB() *DB { return r.db }
 // Client returns the client the replica was initialized with.
 func (r *Replica) Client() ReplicaClient { return r.client }
 
-// Starts replicating in a background goroutine.
+// Info returns descriptive metadata about the replica & its destination.
+func (r *Replica) Info() ReplicaInfo {
+	info := ReplicaInfo{Name: r.Name()}
+	if r.client != nil {
+		info.Type = r.client.Type()
+		info.Location = r.client.Location()
+	}
+	return info
+}
+
+// ReplicaInfo represents descriptive metadata about a replica.
+type ReplicaInfo struct {
+	Name     string // replica name
+	Type     string // client type (e.g. "file", "s3")
+	Location string // client-specific destination
+}
+
+// RetentionConfig returns the replica's retention settings independent of
+// the client type.
+func (r *Replica) RetentionConfig() RetentionConfig {
+	return RetentionConfig{
+		Retention:          r.Retention,
+		WALRetention:       r.WALRetention,
+		CheckInterval:      r.RetentionCheckInterval,
+		MinSnapshots:       r.MinRetainedSnapshots,
+		MaxGenerations:     r.MaxGenerations,
+		RunOnStart:         r.RunRetentionOnStart,
+		PruneWALOnSnapshot: r.PruneWALOnSnapshot,
+	}
+}
+
+// RetentionConfig represents the retention settings of a replica.
+type RetentionConfig struct {
+	Retention          time.Duration // time to keep snapshots & WAL
+	WALRetention       time.Duration // time to keep WAL, if shorter
+	CheckInterval      time.Duration // time between retention checks
+	MinSnapshots       int           // snapshots kept regardless of age
+	MaxGenerations     int           // generations kept, oldest deleted first
+	RunOnStart         bool          // enforce retention on startup
+	PruneWALOnSnapshot bool          // prune superseded WAL after snapshots
+}
+
+// Options returns the replica settings which can be changed by Reconfigure().
+func (r *Replica) Options() ReplicaOptions {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return ReplicaOptions{
+		Client:                 r.client,
+		SyncInterval:           r.SyncInterval,
+		SnapshotInterval:       r.SnapshotInterval,
+		Retention:              r.Retention,
+		WALRetention:           r.WALRetention,
+		RetentionCheckInterval: r.RetentionCheckInterval,
+		MinRetainedSnapshots:   r.MinRetainedSnapshots,
+		MaxGenerations:         r.MaxGenerations,
+		MinWALBytes:            r.MinWALBytes,
+		WALFlushInterval:       r.WALFlushInterval,
+		MaxWALSegmentBytes:     r.MaxWALSegmentBytes,
+		SyncRetryThreshold:     r.SyncRetryThreshold,
+		SyncMaxBackoff:         r.SyncMaxBackoff,
+		RetryBaseDelay:         r.RetryBaseDelay,
+		RetryMaxDelay:          r.RetryMaxDelay,
+		MaxSnapshotRetries:     r.MaxSnapshotRetries,
+		SnapshotRetryBackoff:   r.SnapshotRetryBackoff,
+	}
+}
+
+// Reconfigure updates the replica settings while it is running. It waits for
+// any in-progress sync, snapshot, or retention enforcement to finish and the
+// background goroutines pick up the new intervals without being restarted or
+// losing the replicated position.
+//
+// Every setting is replaced so opts should be obtained from Options() & then
+// modified. Returns an error if an interval is invalid.
+//
+// The client cannot be changed by Reconfigure(). Returns ErrDestinationChanged
+// if opts.Client refers to a different destination than the current client.
+func (r *Replica) Reconfigure(opts ReplicaOptions) error {
+	if c := opts.Client; c != nil && r.client != nil && (c.Type() != r.client.Type() || c.Location() != r.client.Location()) {
+		return ErrDestinationChanged
+	} else if err := opts.validate(); err != nil {
+		return err
+	}
+
+	// Acquire locks in the same order as Sync() so settings are never changed
+	// in the middle of an operation.
+	r.mus.Lock()
+	defer r.mus.Unlock()
+	r.mur.Lock()
+	defer r.mur.Unlock()
+	r.muf.Lock()
+	defer r.muf.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.SyncInterval = opts.SyncInterval
+	r.SnapshotInterval = opts.SnapshotInterval
+	r.Retention = opts.Retention
+	r.WALRetention = opts.WALRetention
+	r.RetentionCheckInterval = opts.RetentionCheckInterval
+	r.MinRetainedSnapshots = opts.MinRetainedSnapshots
+	r.MaxGenerations = opts.MaxGenerations
+	r.MinWALBytes = opts.MinWALBytes
+	r.WALFlushInterval = opts.WALFlushInterval
+	r.MaxWALSegmentBytes = opts.MaxWALSegmentBytes
+	r.SyncRetryThreshold = opts.SyncRetryThreshold
+	r.SyncMaxBackoff = opts.SyncMaxBackoff
+	r.RetryBaseDelay = opts.RetryBaseDelay
+	r.RetryMaxDelay = opts.RetryMaxDelay
+	r.MaxSnapshotRetries = opts.MaxSnapshotRetries
+	r.SnapshotRetryBackoff = opts.SnapshotRetryBackoff
+
+	// Notify background goroutines of the change.
+	close(r.cfgCh)
+	r.cfgCh = make(chan struct{})
+
+	return nil
+}
+
+// ReplicaOptions represents the replica settings which can be changed while
+// a replica is running. See the Replica fields of the same name.
+type ReplicaOptions struct {
+	// Current client. Only used to verify the destination is unchanged.
+	Client ReplicaClient
+
+	SyncInterval           time.Duration
+	SnapshotInterval       time.Duration
+	Retention              time.Duration
+	WALRetention           time.Duration
+	RetentionCheckInterval time.Duration
+	MinRetainedSnapshots   int
+	MaxGenerations         int
+	MinWALBytes            int64
+	WALFlushInterval       time.Duration
+	MaxWALSegmentBytes     int64
+	SyncRetryThreshold     int
+	SyncMaxBackoff         time.Duration
+	RetryBaseDelay         time.Duration
+	RetryMaxDelay          time.Duration
+	MaxSnapshotRetries     int
+	SnapshotRetryBackoff   time.Duration
+}
+
+// validate returns an error if an interval would cause a background goroutine
+// to run continuously. A zero SyncInterval is rejected, unlike on Replica, as
+// it usually indicates an unset field.
+func (opts ReplicaOptions) validate() error {
+	if opts.SyncInterval <= 0 {
+		return fmt.Errorf("sync interval must be positive: %s", opts.SyncInterval)
+	} else if opts.Retention > 0 && opts.RetentionCheckInterval <= 0 {
+		return fmt.Errorf("retention check interval must be positive: %s", opts.RetentionCheckInterval)
+	}
+	return nil
+}
+
+// Starts replicating in a background goroutine. This is a no-op if the client
+// is a ReadOnlyReplicaClient as every write would fail.
 func (r *Replica) Start(ctx context.Context) {
-	// Ignore if replica is being used sychronously.
+	// Record a terminal error if there is no database to replicate.
+	if r.db == nil {
+		r.mu.Lock()
+		r.err = ErrNoSource
+		r.mu.Unlock()
+		return
+	}
+
+	// Record a terminal error if a codec is invalid so that the replica does
+	// not fail on its first write instead.
+	for _, codec := range []string{r.SnapshotCodec, r.WALCodec} {
+		if err := ValidateCodec(codec); err != nil {
+			r.mu.Lock()
+			r.err = err
+			r.mu.Unlock()
+			return
+		}
+	}
+
+	// Ignore if replica is being used sychronously or cannot write.
 	if !r.MonitorEnabled {
 		return
+	} else if _, ok := r.client.(*ReadOnlyReplicaClient); ok {
+		return
 	}
 
 	// Stop previous replication.
 	r.Stop()
 
+	r.mu.Lock()
+	r.err = nil
+	r.mu.Unlock()
+
 	// Wrap context with cancelation.
 	ctx, r.cancel = context.WithCancel(ctx)
 
@@ -128,6 +628,8 @@ func (r *Replica) Stop() {
 	r.cancel()
 	r.wg.Wait()
 
+	r.mus.Lock()
+	defer r.mus.Unlock()
 	if r.itr != nil {
 		r.itr.Close()
 		r.itr = nil
@@ -147,14 +649,34 @@ func (r *Replica) Close() (err error) {
 	return err
 }
 
-// Sync copies new WAL frames from the shadow WAL to the replica client.
+// Sync copies new WAL frames from the shadow WAL to the replica client. It is
+// safe to call while the monitor is running; overlapping calls are serialized.
 func (r *Replica) Sync(ctx context.Context) (err error) {
-	// Clear last position if if an error occurs during sync.
+	if r.db == nil {
+		return ErrNoSource
+	}
+
+	r.mus.Lock()
+	defer r.mus.Unlock()
+
+	r.mur.RLock()
+	defer r.mur.RUnlock()
+
+	// Keep the last replicated position if the database file has been removed.
+	if _, err := os.Stat(r.db.Path()); os.IsNotExist(err) {
+		return ErrSourceMissing
+	}
+
+	// Clear last position if if an error occurs during sync. The iterator is
+	// also reset as segments read from it may not have been written, so the
+	// next sync recalculates the position from the client.
 	defer func() {
 		if err != nil {
-			r.mu.Lock()
-			r.pos = Pos{}
-			r.mu.Unlock()
+			r.setPos(Pos{})
+			if r.itr != nil {
+				_ = r.itr.Close()
+				r.itr = nil
+			}
 		}
 	}()
 
@@ -165,6 +687,11 @@ func (r *Replica) Sync(ctx context.Context) (err error) {
 	}
 	generation := dpos.Generation
 
+	// Only ensure a snapshot exists if WAL segments are not replicated.
+	if r.Mode == ReplicaModeSnapshotOnly {
+		return r.syncSnapshotOnly(ctx, generation)
+	}
+
 	// Close out iterator if the generation has changed.
 	if r.itr != nil && r.itr.Generation() != generation {
 		_ = r.itr.Close()
@@ -174,6 +701,8 @@ func (r *Replica) Sync(ctx context.Context) (err error) {
 	// Ensure we obtain a WAL iterator before we snapshot so we don't miss any segments.
 	resetItr := r.itr == nil
 	if resetItr {
+		r.pending, r.pendingAt = nil, time.Time{}
+
 		if r.itr, err = r.db.WALSegments(ctx, generation); err != nil {
 			return fmt.Errorf("wal segments: %w", err)
 		}
@@ -184,7 +713,7 @@ func (r *Replica) Sync(ctx context.Context) (err error) {
 	if err != nil {
 		return err
 	} else if snapshotN == 0 {
-		if info, err := r.Snapshot(ctx); err != nil {
+		if info, err := r.snapshotWithRetry(ctx); err != nil {
 			return err
 		} else if info.Generation != generation {
 			return fmt.Errorf("generation changed during snapshot, exiting sync")
@@ -200,9 +729,20 @@ func (r *Replica) Sync(ctx context.Context) (err error) {
 			return fmt.Errorf("cannot determine replica position: %s", err)
 		}
 
-		r.mu.Lock()
-		r.pos = pos
-		r.mu.Unlock()
+		// The client should never be ahead of the local shadow WAL.
+		if r.OnTakeover != TakeoverIgnore {
+			if cmp, err := ComparePos(pos, dpos); err != nil {
+				return err
+			} else if cmp > 0 {
+				return r.handleTakeover()
+			}
+		}
+
+		r.setPos(pos)
+	} else if r.OnTakeover != TakeoverIgnore {
+		if err := r.checkTakeover(ctx, generation); err != nil {
+			return err
+		}
 	}
 
 	// Read all WAL files since the last position.
@@ -210,20 +750,117 @@ func (r *Replica) Sync(ctx context.Context) (err error) {
 		return err
 	}
 
+	// Make written segments durable if the client batches fsyncs.
+	if err := flushClient(ctx, r.client); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+
+	return nil
+}
+
+// checkTakeover returns ErrGenerationTakeover, after applying OnTakeover, if
+// the client holds a WAL segment in generation which begins at or after the
+// replicated position. Segments written by this replica always begin before it.
+func (r *Replica) checkTakeover(ctx context.Context, generation string) error {
+	pos := r.Pos()
+	if pos.Generation != generation {
+		return nil
+	}
+
+	segment, err := r.maxWALSegment(ctx, generation)
+	if err != nil {
+		return fmt.Errorf("max wal segment: %w", err)
+	} else if segment == nil {
+		return nil
+	}
+
+	if cmp, err := ComparePos(segment.Pos(), pos); err != nil {
+		return err
+	} else if cmp >= 0 {
+		return r.handleTakeover()
+	}
 	return nil
 }
 
+// handleTakeover applies the OnTakeover policy & returns ErrGenerationTakeover.
+func (r *Replica) handleTakeover() error {
+	if r.OnTakeover == TakeoverNewGeneration {
+		r.Logger.Printf("generation advanced by another writer, starting new generation")
+		if err := r.db.resetGeneration(); err != nil {
+			return fmt.Errorf("reset generation: %w", err)
+		}
+	}
+	return ErrGenerationTakeover
+}
+
+// SnapshotFailedError is returned by Replica.Sync when the first snapshot of a
+// generation could not be written after MaxSnapshotRetries retries.
+type SnapshotFailedError struct {
+	Attempts int   // total number of attempts
+	Err      error // error from the last attempt
+}
+
+// Error returns the error string.
+func (e *SnapshotFailedError) Error() string {
+	return fmt.Sprintf("snapshot failed after %d attempts: %s", e.Attempts, e.Err)
+}
+
+// Unwrap returns the error from the last attempt.
+func (e *SnapshotFailedError) Unwrap() error { return e.Err }
+
+// snapshotWithRetry writes a snapshot, retrying up to MaxSnapshotRetries times
+// with exponential backoff. Returns a *SnapshotFailedError once retries are
+// exhausted.
+func (r *Replica) snapshotWithRetry(ctx context.Context) (info SnapshotInfo, err error) {
+	if r.MaxSnapshotRetries <= 0 {
+		return r.Snapshot(ctx)
+	}
+
+	backoff := r.SnapshotRetryBackoff
+	for i := 0; ; i++ {
+		if info, err = r.Snapshot(ctx); err == nil || err == ErrNoGeneration || ctx.Err() != nil {
+			return info, err
+		} else if i == r.MaxSnapshotRetries {
+			return info, &SnapshotFailedError{Attempts: i + 1, Err: err}
+		}
+
+		r.Logger.Printf("snapshot failed (attempt=%d), retrying in %s: %s", i+1, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return info, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// syncWAL writes all shadow WAL segments since the last replicated position
+// to the client. Contiguous segments within the same index are combined into
+// a single replica segment so many small writes do not produce many files.
 func (r *Replica) syncWAL(ctx context.Context) (err error) {
 	pos := r.Pos()
 
-	// Group segments by index.
-	var segments [][]WALSegmentInfo
+	// Read new segments onto the end of any segments held back previously.
 	for r.itr.Next() {
-		info := r.itr.WALSegment()
+		if len(r.pending) == 0 {
+			r.pendingAt = time.Now()
+		}
+		r.pending = append(r.pending, r.itr.WALSegment())
+	}
+	if r.holdWAL(pos) {
+		return nil
+	}
+	pending := r.pending
+	r.pending, r.pendingAt = nil, time.Time{}
 
+	// Group segments by index.
+	var segments [][]WALSegmentInfo
+	for i, info := range pending {
 		if cmp, err := ComparePos(pos, info.Pos()); err != nil {
 			return fmt.Errorf("compare pos: %w", err)
-		} else if cmp == 1 {
+		} else if cmp == 1 && !segmentContainsPos(pending, i, pos) {
 			continue // already processed, skip
 		}
 
@@ -240,356 +877,2614 @@ func (r *Replica) syncWAL(ctx context.Context) (err error) {
 	// Write out segments to replica by index so they can be combined.
 	for i := range segments {
 		if err := r.writeIndexSegments(ctx, segments[i]); err != nil {
-			return fmt.Errorf("write index segments: index=%d err=%w", segments[i][0].Index, err)
+			if err = r.handleWALSegmentError(ctx, segments[i], err); err != nil {
+				return fmt.Errorf("write index segments: index=%d err=%w", segments[i][0].Index, err)
+			}
 		}
 	}
+	r.failedSegment, r.segmentFailedN = Pos{}, 0
 
 	return nil
 }
 
-func (r *Replica) writeIndexSegments(ctx context.Context, segments []WALSegmentInfo) (err error) {
-	assert(len(segments) > 0, "segments required for replication")
-
-	// First segment position must be equal to last replica position or
-	// the start of the next index.
-	if pos := r.Pos(); pos != segments[0].Pos() {
-		nextIndexPos := pos.Truncate()
-		nextIndexPos.Index++
-		if nextIndexPos != segments[0].Pos() {
-			return fmt.Errorf("replica skipped position: replica=%s initial=%s", pos, segments[0].Pos())
-		}
-	}
-
-	pos := segments[0].Pos()
-	initialPos := pos
-
-	// Copy shadow WAL to client write via io.Pipe().
-	pr, pw := io.Pipe()
-	defer func() { _ = pw.CloseWithError(err) }()
+// SkippedWALSegmentError is returned by Replica.Sync when a shadow WAL segment
+// could not be read after MaxSegmentRetries attempts & a new generation was
+// started in its place.
+type SkippedWALSegmentError struct {
+	Pos Pos   // position of the skipped segment
+	Err error // last read error
+}
 
-	// Copy through pipe into client from the starting position.
-	var g errgroup.Group
-	g.Go(func() error {
-		_, err := r.client.WriteWALSegment(ctx, initialPos, pr)
-		return err
-	})
+// Error returns the error string.
+func (e *SkippedWALSegmentError) Error() string {
+	return fmt.Sprintf("wal segment skipped: pos=%s err=%s", e.Pos, e.Err)
+}
 
-	// Wrap writer to LZ4 compress.
-	zw := lz4.NewWriter(pw)
+// Unwrap returns the underlying read error.
+func (e *SkippedWALSegmentError) Unwrap() error { return e.Err }
 
-	// Write each segment out to the replica.
-	for i := range segments {
-		info := &segments[i]
+// shadowWALSegmentError is returned when a shadow WAL segment cannot be read.
+type shadowWALSegmentError struct {
+	pos Pos
+	err error
+}
 
-		if err := func() error {
-			// Ensure segments are in order and no bytes are skipped.
-			if pos != info.Pos() {
-				return fmt.Errorf("non-contiguous segment: expected=%s current=%s", pos, info.Pos())
-			}
+func (e *shadowWALSegmentError) Error() string {
+	return fmt.Sprintf("wal segment: pos=%s err=%s", e.pos, e.err)
+}
 
-			rc, err := r.db.WALSegmentReader(ctx, info.Pos())
-			if err != nil {
-				return err
-			}
-			defer rc.Close()
+func (e *shadowWALSegmentError) Unwrap() error { return e.err }
+
+// handleWALSegmentError isolates a failure to read a shadow WAL segment while
+// writing segments, which all belong to one index. If MaxSegmentRetries is
+// set, segments before the unreadable segment are written & the failure is
+// counted. Once the segment has failed more than MaxSegmentRetries syncs in a
+// row, a new generation is started & a *SkippedWALSegmentError is returned.
+// Other errors are returned unchanged.
+func (r *Replica) handleWALSegmentError(ctx context.Context, segments []WALSegmentInfo, err error) error {
+	var e *shadowWALSegmentError
+	if r.MaxSegmentRetries <= 0 || !errors.As(err, &e) {
+		return err
+	}
 
-			n, err := io.Copy(zw, lz4.NewReader(rc))
-			if err != nil {
-				return err
-			} else if err := rc.Close(); err != nil {
-				return err
+	// Write the segments preceding the failed segment, if not already
+	// written, but never advance past it.
+	if cmp, cerr := ComparePos(r.Pos(), e.pos); cerr != nil {
+		return cerr
+	} else if cmp < 0 {
+		for i := range segments {
+			if segments[i].Pos() != e.pos {
+				continue
+			} else if i > 0 {
+				if err := r.writeIndexSegments(ctx, segments[:i]); err != nil {
+					return err
+				}
 			}
-
-			// Track last position written.
-			pos = info.Pos()
-			pos.Offset += n
-
-			return nil
-		}(); err != nil {
-			return fmt.Errorf("wal segment: pos=%s err=%w", info.Pos(), err)
+			break
 		}
 	}
 
-	// Flush LZ4 writer, close pipe, and wait for write to finish.
-	if err := zw.Close(); err != nil {
-		return fmt.Errorf("lz4 writer close: %w", err)
-	} else if err := pw.Close(); err != nil {
-		return fmt.Errorf("pipe writer close: %w", err)
-	} else if err := g.Wait(); err != nil {
+	if r.failedSegment != e.pos {
+		r.failedSegment, r.segmentFailedN = e.pos, 0
+	}
+	if r.segmentFailedN++; r.segmentFailedN <= r.MaxSegmentRetries {
 		return err
 	}
 
-	// Save last replicated position.
-	r.mu.Lock()
-	r.pos = pos
-	r.mu.Unlock()
-
-	replicaWALBytesCounterVec.WithLabelValues(r.db.Path(), r.Name()).Add(float64(pos.Offset - initialPos.Offset))
-
-	// Track total WAL bytes written to replica client.
-	replicaWALIndexGaugeVec.WithLabelValues(r.db.Path(), r.Name()).Set(float64(pos.Index))
-	replicaWALOffsetGaugeVec.WithLabelValues(r.db.Path(), r.Name()).Set(float64(pos.Offset))
-
-	r.Logger.Printf("wal segment written: %s sz=%d", initialPos, pos.Offset-initialPos.Offset)
+	r.Logger.Printf("skipping unreadable wal segment %s after %d attempts, starting new generation", e.pos, r.segmentFailedN)
+	r.failedSegment, r.segmentFailedN = Pos{}, 0
+	if err := r.db.resetGeneration(); err != nil {
+		return fmt.Errorf("reset generation: %w", err)
+	}
+	return &SkippedWALSegmentError{Pos: e.pos, Err: e.err}
+}
 
-	return nil
+// segmentContainsPos returns true if pos falls after the start of segments[i]
+// but before the start of the next segment in the same index. This occurs when
+// only part of a shadow WAL segment has been written to the client because it
+// was split by MaxWALSegmentBytes.
+func segmentContainsPos(segments []WALSegmentInfo, i int, pos Pos) bool {
+	info := segments[i]
+	if info.Generation != pos.Generation || info.Index != pos.Index || info.Offset >= pos.Offset {
+		return false
+	} else if i+1 < len(segments) && segments[i+1].Index == info.Index && segments[i+1].Offset <= pos.Offset {
+		return false
+	}
+	return true
 }
 
-// snapshotN returns the number of snapshots for a generation.
-func (r *Replica) snapshotN(generation string) (int, error) {
-	itr, err := r.client.Snapshots(context.Background(), generation)
-	if err != nil {
-		return 0, err
+// holdWAL returns true if pending segments should not be written yet because
+// fewer than MinWALBytes have accumulated in the current index & the flush
+// interval has not elapsed.
+func (r *Replica) holdWAL(pos Pos) bool {
+	if r.MinWALBytes <= 0 || r.SyncOnCommit || len(r.pending) == 0 {
+		return false
+	} else if time.Since(r.pendingAt) >= r.WALFlushInterval {
+		return false
 	}
-	defer itr.Close()
 
-	var n int
-	for itr.Next() {
-		n++
+	// Always flush when the index changes so segments are not held across
+	// a checkpoint.
+	dpos := r.db.Pos()
+	if dpos.Generation != pos.Generation || dpos.Index != pos.Index {
+		return false
 	}
-	return n, itr.Close()
+	for _, info := range r.pending {
+		if info.Index != pos.Index {
+			return false
+		}
+	}
+	return dpos.Offset-pos.Offset < r.MinWALBytes
 }
 
-// calcPos returns the last position for the given generation.
-func (r *Replica) calcPos(ctx context.Context, generation string) (pos Pos, err error) {
-	// Fetch last snapshot. Return error if no snapshots exist.
-	snapshot, err := r.maxSnapshot(ctx, generation)
-	if err != nil {
-		return pos, fmt.Errorf("max snapshot: %w", err)
-	} else if snapshot == nil {
-		return pos, fmt.Errorf("no snapshot available: generation=%s", generation)
+// waitChs returns the WAL iterator's notification channel & a channel that
+// fires when pending segments are due to be flushed. The sync state is read
+// under the sync lock as Sync may also be called outside the monitor.
+// Returns nil channels if no iterator is open.
+func (r *Replica) waitChs() (notifyCh <-chan struct{}, flushCh <-chan time.Time) {
+	r.mus.Lock()
+	defer r.mus.Unlock()
+	if r.itr == nil {
+		return nil, nil
 	}
+	return r.itr.NotifyCh(), r.walFlushCh()
+}
 
-	// Determine last WAL segment available. Use snapshot if none exist.
-	segment, err := r.maxWALSegment(ctx, generation)
-	if err != nil {
-		return pos, fmt.Errorf("max wal segment: %w", err)
-	} else if segment == nil {
-		return Pos{Generation: snapshot.Generation, Index: snapshot.Index}, nil
+// walFlushCh returns a channel that fires when pending segments are due to be
+// flushed. Returns nil if no segments are pending. Must hold r.mus.
+func (r *Replica) walFlushCh() <-chan time.Time {
+	if len(r.pending) == 0 {
+		return nil
 	}
 
-	// Read segment to determine size to add to offset.
-	rd, err := r.client.WALSegmentReader(ctx, segment.Pos())
-	if err != nil {
-		return pos, fmt.Errorf("wal segment reader: %w", err)
-	}
-	defer rd.Close()
+	r.mu.RLock()
+	interval := r.WALFlushInterval
+	r.mu.RUnlock()
+	return time.After(time.Until(r.pendingAt.Add(interval)))
+}
 
-	n, err := io.Copy(ioutil.Discard, lz4.NewReader(rd))
-	if err != nil {
-		return pos, err
+// writeIndexSegments writes contiguous segments from a single index to the
+// client as one segment starting at the position of the first segment. If
+// MaxWALSegmentBytes is set, the data is split into multiple segments at
+// increasing offsets within the index.
+func (r *Replica) writeIndexSegments(ctx context.Context, segments []WALSegmentInfo) (err error) {
+	assert(len(segments) > 0, "segments required for replication")
+
+	// First segment position must be equal to last replica position or
+	// the start of the next index. The replica position may also fall within
+	// the first segment if only part of it was previously written.
+	initialPos := segments[0].Pos()
+	if pos := r.Pos(); pos != initialPos {
+		nextIndexPos := pos.Truncate()
+		nextIndexPos.Index++
+		if pos.Generation == initialPos.Generation && pos.Index == initialPos.Index && pos.Offset > initialPos.Offset {
+			initialPos = pos
+		} else if nextIndexPos != initialPos {
+			return fmt.Errorf("replica skipped position: replica=%s initial=%s", pos, initialPos)
+		}
 	}
 
-	// Return the position at the end of the last WAL segment.
-	return Pos{
-		Generation: segment.Generation,
-		Index:      segment.Index,
-		Offset:     segment.Offset + n,
-	}, nil
+	// Stream decompressed shadow WAL data through a pipe so it can be split
+	// into multiple client segments.
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	var rerr error
+	go func() {
+		defer close(done)
+		rerr = r.copyShadowWALSegments(ctx, pw, segments, initialPos.Offset-segments[0].Offset)
+		_ = pw.CloseWithError(rerr)
+	}()
+	defer func() {
+		_ = pr.Close()
+		<-done
+
+		// Report shadow WAL read failures directly as clients may not wrap
+		// errors from the reader.
+		var e *shadowWALSegmentError
+		if err != nil && errors.As(rerr, &e) {
+			err = rerr
+		}
+	}()
+
+	br := bufio.NewReader(pr)
+	for pos := initialPos; ; {
+		// Stop once all data has been written.
+		if _, err := br.Peek(1); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var rd io.Reader = br
+		if n := r.MaxWALSegmentBytes; n > 0 {
+			// Transformed segments must only contain whole frames.
+			if r.WALTransform != nil {
+				n = alignWALFrameLimit(pos.Offset, n, r.db.PageSize())
+			}
+			rd = io.LimitReader(br, n)
+		}
+
+		n, err := r.writeWALSegment(ctx, pos, rd)
+		if err != nil {
+			return err
+		}
+		pos.Offset += n
+	}
 }
 
-// maxSnapshot returns the last snapshot in a generation.
-func (r *Replica) maxSnapshot(ctx context.Context, generation string) (*SnapshotInfo, error) {
-	itr, err := r.client.Snapshots(ctx, generation)
+// alignWALFrameLimit returns the largest number of bytes, up to n, which can
+// be read from offset while ending on a WAL frame boundary. At least one frame,
+// or the WAL header at the start of an index, is always included.
+func alignWALFrameLimit(offset, n int64, pageSize int) int64 {
+	frameSize := int64(WALFrameHeaderSize + pageSize)
+	if offset < WALHeaderSize {
+		return WALHeaderSize - offset
+	}
+
+	end := WALHeaderSize + ((offset+n-WALHeaderSize)/frameSize)*frameSize
+	if end <= offset {
+		end = offset + frameSize
+	}
+	return end - offset
+}
+
+// walTransformState represents the WAL checksum chain at a position within
+// the transformed data written to the client.
+type walTransformState struct {
+	pos              Pos // position in the source WAL
+	order            binary.ByteOrder
+	pageSize         int
+	chksum0, chksum1 uint32
+	prev             []byte // last frame written in the index, if any
+}
+
+// newWALTransformWriter returns a writer which applies WALTransform to the
+// WAL data written to w starting at pos. Segments which do not begin the index
+// continue the checksum chain of the previously written segment, which is
+// read back from the client if it is not known.
+func (r *Replica) newWALTransformWriter(ctx context.Context, w io.Writer, pos Pos) (*walTransformWriter, error) {
+	tw := &walTransformWriter{w: w, fn: r.WALTransform}
+	if pos.Offset == 0 {
+		tw.hdr = true
+		return tw, nil
+	}
+
+	state := r.walTransform
+	if state == nil || state.pos != pos {
+		var err error
+		if state, err = r.readWALTransformState(ctx, pos); err != nil {
+			return nil, err
+		}
+	}
+	tw.order, tw.pageSize = state.order, state.pageSize
+	tw.chksum0, tw.chksum1 = state.chksum0, state.chksum1
+	tw.prev = state.prev
+	return tw, nil
+}
+
+// readWALTransformState reads the client's WAL data in the index before pos
+// & returns the checksum chain at the end of the last frame & the frame itself.
+func (r *Replica) readWALTransformState(ctx context.Context, pos Pos) (*walTransformState, error) {
+	itr, err := r.client.WALSegments(ctx, pos.Generation)
 	if err != nil {
 		return nil, err
 	}
 	defer itr.Close()
 
-	var max *SnapshotInfo
+	var a []Pos
 	for itr.Next() {
-		if info := itr.Snapshot(); max == nil || info.Index > max.Index {
-			max = &info
+		if info := itr.WALSegment(); info.Index == pos.Index && info.Offset < pos.Offset {
+			a = append(a, info.Pos())
 		}
 	}
-	return max, itr.Close()
-}
+	if err := itr.Close(); err != nil {
+		return nil, err
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].Offset < a[j].Offset })
 
-// maxWALSegment returns the highest WAL segment in a generation.
-func (r *Replica) maxWALSegment(ctx context.Context, generation string) (*WALSegmentInfo, error) {
-	itr, err := r.client.WALSegments(ctx, generation)
+	pr, pw := io.Pipe()
+	go func() { _ = pw.CloseWithError(r.copyWALSegments(ctx, pw, a)) }()
+	defer pr.Close()
+
+	hdr := make([]byte, WALHeaderSize)
+	if _, err := io.ReadFull(pr, hdr); err != nil {
+		return nil, fmt.Errorf("read wal header: %w", err)
+	}
+	order, err := headerByteOrder(hdr)
 	if err != nil {
 		return nil, err
 	}
-	defer itr.Close()
 
-	var max *WALSegmentInfo
-	for itr.Next() {
-		if info := itr.WALSegment(); max == nil || info.Index > max.Index || (info.Index == max.Index && info.Offset > max.Offset) {
-			max = &info
+	state := &walTransformState{
+		pos:      pos,
+		order:    order,
+		pageSize: int(binary.BigEndian.Uint32(hdr[8:])),
+		chksum0:  binary.BigEndian.Uint32(hdr[24:]),
+		chksum1:  binary.BigEndian.Uint32(hdr[28:]),
+	}
+
+	frame := make([]byte, WALFrameHeaderSize+state.pageSize)
+	for {
+		if _, err := io.ReadFull(pr, frame); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("read wal frame: %w", err)
 		}
+		state.chksum0 = binary.BigEndian.Uint32(frame[16:])
+		state.chksum1 = binary.BigEndian.Uint32(frame[20:])
+		state.prev = append(state.prev[:0], frame...)
 	}
-	return max, itr.Close()
+	return state, nil
 }
 
-// Pos returns the current replicated position.
-// Returns a zero value if the current position cannot be determined.
-func (r *Replica) Pos() Pos {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	return r.pos
+// walTransformWriter buffers WAL data into frames, passes each frame through
+// fn, & writes the result to w with recalculated checksums. The WAL header is
+// written unchanged. Dropped frames are replaced by a copy of the previous
+// frame so the output is always the same size as the input.
+type walTransformWriter struct {
+	w    io.Writer
+	fn   func(frame []byte) ([]byte, error)
+	buf  []byte
+	prev []byte // last frame written
+	hdr  bool   // true if the WAL header has not been read yet
+
+	order            binary.ByteOrder
+	pageSize         int
+	chksum0, chksum1 uint32
 }
 
-// Snapshots returns a list of all snapshots across all generations.
-func (r *Replica) Snapshots(ctx context.Context) ([]SnapshotInfo, error) {
-	generations, err := r.client.Generations(ctx)
+func (w *walTransformWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		size := WALFrameHeaderSize + w.pageSize
+		if w.hdr {
+			size = WALHeaderSize
+		}
+
+		sz := size - len(w.buf)
+		if sz > len(p) {
+			sz = len(p)
+		}
+		w.buf, p = append(w.buf, p[:sz]...), p[sz:]
+
+		if len(w.buf) == size {
+			if err := w.flush(); err != nil {
+				return 0, err
+			}
+			w.buf = w.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// flush writes the header or frame in buf to the underlying writer.
+func (w *walTransformWriter) flush() (err error) {
+	if w.hdr {
+		if w.order, err = headerByteOrder(w.buf); err != nil {
+			return err
+		}
+		w.pageSize = int(binary.BigEndian.Uint32(w.buf[8:]))
+		w.chksum0 = binary.BigEndian.Uint32(w.buf[24:])
+		w.chksum1 = binary.BigEndian.Uint32(w.buf[28:])
+		w.hdr = false
+		_, err := w.w.Write(w.buf)
+		return err
+	}
+
+	frame, err := w.fn(append([]byte(nil), w.buf...))
 	if err != nil {
-		return nil, fmt.Errorf("cannot fetch generations: %w", err)
+		return fmt.Errorf("wal transform: %w", err)
+	} else if frame == nil {
+		// Drop frame by rewriting the previous frame's page unchanged.
+		if w.prev == nil {
+			return fmt.Errorf("wal transform: cannot drop first frame of index")
+		}
+		frame = append([]byte(nil), w.prev...)
+	} else if len(frame) != len(w.buf) {
+		return fmt.Errorf("wal transform: frame size changed from %d to %d", len(w.buf), len(frame))
 	}
 
-	var a []SnapshotInfo
-	for _, generation := range generations {
+	w.chksum0, w.chksum1 = Checksum(w.order, w.chksum0, w.chksum1, frame[:8])
+	w.chksum0, w.chksum1 = Checksum(w.order, w.chksum0, w.chksum1, frame[WALFrameHeaderSize:])
+	binary.BigEndian.PutUint32(frame[16:], w.chksum0)
+	binary.BigEndian.PutUint32(frame[20:], w.chksum1)
+	w.prev = frame
+	_, err = w.w.Write(frame)
+	return err
+}
+
+// Close returns an error if a partial frame remains buffered.
+func (w *walTransformWriter) Close() error {
+	if len(w.buf) != 0 {
+		return fmt.Errorf("wal transform: partial frame of %d bytes", len(w.buf))
+	}
+	return nil
+}
+
+// copyShadowWALSegments writes the decompressed data of contiguous shadow WAL
+// segments to w, skipping the first skip bytes.
+func (r *Replica) copyShadowWALSegments(ctx context.Context, w io.Writer, segments []WALSegmentInfo, skip int64) error {
+	pos := segments[0].Pos()
+	for i := range segments {
+		info := &segments[i]
+
 		if err := func() error {
-			itr, err := r.client.Snapshots(ctx, generation)
+			// Ensure segments are in order and no bytes are skipped.
+			if pos != info.Pos() {
+				return fmt.Errorf("non-contiguous segment: expected=%s current=%s", pos, info.Pos())
+			}
+
+			rc, err := r.db.WALSegmentReader(ctx, info.Pos())
 			if err != nil {
 				return err
 			}
-			defer itr.Close()
+			defer rc.Close()
 
-			other, err := SliceSnapshotIterator(itr)
+			// Hide the reader's WriteTo() as it fails if the skipped bytes
+			// consumed the entire segment.
+			zr := struct{ io.Reader }{lz4.NewReader(rc)}
+			n, err := io.CopyN(ioutil.Discard, zr, skip)
+			if err == io.EOF {
+				err = nil
+			} else if err != nil {
+				return err
+			}
+			skip -= n
+
+			m, err := copyBuffer(w, zr, r.CopyBufferSize)
 			if err != nil {
 				return err
+			} else if err := rc.Close(); err != nil {
+				return err
 			}
-			a = append(a, other...)
 
-			return itr.Close()
-		}(); err != nil {
-			return a, err
+			// Track last position read.
+			pos = info.Pos()
+			pos.Offset += n + m
+
+			return nil
+		}(); err == io.ErrClosedPipe {
+			return err // reader stopped early
+		} else if err != nil {
+			return &shadowWALSegmentError{pos: info.Pos(), err: err}
+		}
+	}
+	return nil
+}
+
+// writeWALSegment compresses the data from rd & writes it to the client as
+// a single segment at initialPos. Returns the number of uncompressed bytes.
+func (r *Replica) writeWALSegment(ctx context.Context, initialPos Pos, rd io.Reader) (n int64, err error) {
+	// Copy shadow WAL to client write via io.Pipe().
+	pr, pw := io.Pipe()
+	defer func() { _ = pw.CloseWithError(err) }()
+
+	// Copy through pipe into client from the starting position. The reader is
+	// closed if the client fails, such as on a full disk, to unblock writes.
+	var g errgroup.Group
+	g.Go(func() error {
+		_, err := r.client.WriteWALSegment(ctx, initialPos, pr)
+		_ = pr.CloseWithError(err)
+		return err
+	})
+
+	// clientErr returns the client's error, if any, in place of err as it is
+	// the cause of any pipe write failure.
+	clientErr := func(err error) error {
+		_ = pw.CloseWithError(err)
+		if e := g.Wait(); e != nil {
+			return e
+		}
+		return err
+	}
+
+	// Wrap writer to compress with the configured codec.
+	zw, err := r.compressWriter(pw, r.WALCodec)
+	if err != nil {
+		return 0, clientErr(err)
+	}
+
+	// Checksum the uncompressed data if it will be read back for verification.
+	var w io.Writer = zw
+	h := crc64.New(crc64.MakeTable(crc64.ISO))
+	if r.VerifyWrites {
+		w = io.MultiWriter(zw, h)
+	}
+
+	// Pass each frame through the transform hook, if set.
+	var tw *walTransformWriter
+	if r.WALTransform != nil {
+		if tw, err = r.newWALTransformWriter(ctx, w, initialPos); err != nil {
+			return 0, clientErr(fmt.Errorf("wal transform: %w", err))
+		}
+		w = tw
+	}
+
+	// Hide the writer's ReadFrom() as the LZ4 writer cannot be closed after it.
+	if n, err = copyBuffer(struct{ io.Writer }{w}, rd, r.CopyBufferSize); err != nil {
+		return 0, clientErr(err)
+	}
+	pos := initialPos
+	pos.Offset += n
+
+	if tw != nil {
+		if err := tw.Close(); err != nil {
+			return 0, clientErr(err)
+		}
+	}
+
+	// Flush compression writer, close pipe, and wait for write to finish.
+	if err := zw.Close(); err != nil {
+		return 0, clientErr(fmt.Errorf("compression writer close: %w", err))
+	} else if err := pw.Close(); err != nil {
+		return 0, fmt.Errorf("pipe writer close: %w", err)
+	} else if err := g.Wait(); err != nil {
+		return 0, err
+	}
+
+	// Read back the written segment, if enabled, & remove it on a mismatch so
+	// it is rewritten on the next sync.
+	if r.VerifyWrites {
+		if err := r.verifyWALSegment(ctx, initialPos, n, h.Sum64()); err != nil {
+			if e := r.client.DeleteWALSegments(ctx, []Pos{initialPos}); e != nil {
+				r.Logger.Printf("cannot delete unverified wal segment: %s", e)
+			}
+			return 0, err
+		}
+	}
+
+	// Save last replicated position.
+	r.setPos(pos)
+	if tw != nil {
+		r.walTransform = &walTransformState{pos: pos, order: tw.order, pageSize: tw.pageSize, chksum0: tw.chksum0, chksum1: tw.chksum1, prev: tw.prev}
+	}
+
+	replicaWALBytesCounterVec.WithLabelValues(r.db.Path(), r.Name()).Add(float64(pos.Offset - initialPos.Offset))
+
+	// Track total WAL bytes written to replica client.
+	replicaWALIndexGaugeVec.WithLabelValues(r.db.Path(), r.Name()).Set(float64(pos.Index))
+	replicaWALOffsetGaugeVec.WithLabelValues(r.db.Path(), r.Name()).Set(float64(pos.Offset))
+
+	r.Logger.Printf("wal segment written: %s sz=%d", initialPos, pos.Offset-initialPos.Offset)
+
+	return n, nil
+}
+
+// verifyWALSegment reads a WAL segment from the client & returns
+// ErrChecksumMismatch if its uncompressed data does not match size & chksum.
+func (r *Replica) verifyWALSegment(ctx context.Context, pos Pos, size int64, chksum uint64) error {
+	rd, err := r.client.WALSegmentReader(ctx, pos)
+	if err != nil {
+		return fmt.Errorf("wal segment reader: %w", err)
+	}
+	defer rd.Close()
+
+	h := crc64.New(crc64.MakeTable(crc64.ISO))
+	if n, err := io.Copy(h, newDecompressReader(rd)); err != nil {
+		return fmt.Errorf("read back wal segment: %w", err)
+	} else if n != size || h.Sum64() != chksum {
+		return fmt.Errorf("read back wal segment: pos=%s: %w", pos, ErrChecksumMismatch)
+	}
+	return rd.Close()
+}
+
+// snapshotN returns the number of snapshots for a generation.
+func (r *Replica) snapshotN(generation string) (int, error) {
+	itr, err := r.client.Snapshots(context.Background(), generation)
+	if err != nil {
+		return 0, err
+	}
+	defer itr.Close()
+
+	var n int
+	for itr.Next() {
+		n++
+	}
+	return n, itr.Close()
+}
+
+// syncSnapshotOnly creates a snapshot if none exist for the generation and
+// sets the replica position to the latest snapshot.
+func (r *Replica) syncSnapshotOnly(ctx context.Context, generation string) error {
+	snapshot, err := r.maxSnapshot(ctx, generation)
+	if err != nil {
+		return fmt.Errorf("max snapshot: %w", err)
+	} else if snapshot == nil {
+		info, err := r.snapshotWithRetry(ctx)
+		if err != nil {
+			return err
+		} else if info.Generation != generation {
+			return fmt.Errorf("generation changed during snapshot, exiting sync")
+		}
+		snapshot = &info
+	}
+
+	snapshotN, err := r.snapshotN(generation)
+	if err != nil {
+		return err
+	}
+	replicaSnapshotTotalGaugeVec.WithLabelValues(r.db.Path(), r.Name()).Set(float64(snapshotN))
+
+	r.setPos(snapshot.Pos())
+	return nil
+}
+
+// calcPos returns the last position for the given generation.
+func (r *Replica) calcPos(ctx context.Context, generation string) (pos Pos, err error) {
+	// Fetch last snapshot. Return error if no snapshots exist.
+	snapshot, err := r.maxSnapshot(ctx, generation)
+	if err != nil {
+		return pos, fmt.Errorf("max snapshot: %w", err)
+	} else if snapshot == nil {
+		return pos, fmt.Errorf("no snapshot available: generation=%s", generation)
+	}
+
+	// Determine last WAL segment available. Use snapshot if none exist.
+	segment, err := r.maxWALSegment(ctx, generation)
+	if err != nil {
+		return pos, fmt.Errorf("max wal segment: %w", err)
+	} else if segment == nil {
+		return Pos{Generation: snapshot.Generation, Index: snapshot.Index}, nil
+	}
+
+	// Read segment to determine size to add to offset.
+	rd, err := r.client.WALSegmentReader(ctx, segment.Pos())
+	if err != nil {
+		return pos, fmt.Errorf("wal segment reader: %w", err)
+	}
+	defer rd.Close()
+
+	n, err := io.Copy(ioutil.Discard, newDecompressReader(rd))
+	if err != nil {
+		return pos, err
+	}
+
+	// Return the position at the end of the last WAL segment.
+	return Pos{
+		Generation: segment.Generation,
+		Index:      segment.Index,
+		Offset:     segment.Offset + n,
+	}, nil
+}
+
+// Chain represents the latest snapshot in a generation & the ordered WAL
+// segments which are applied on top of it to reach the head position.
+type Chain struct {
+	Generation    string
+	SnapshotIndex int
+	WALSegments   []Pos // WAL segment positions, in order
+
+	// WAL indexes missing between the snapshot & the last WAL segment.
+	Gaps []int
+
+	// Position at the end of the last WAL segment.
+	Pos Pos
+}
+
+// CalcChain returns the latest snapshot & the WAL segments following it for
+// a generation. Unlike calcPos(), the full list of segments is returned so
+// callers can verify the chain is complete before restoring.
+func (r *Replica) CalcChain(ctx context.Context, generation string) (Chain, error) {
+	chain := Chain{Generation: generation}
+
+	snapshot, err := r.maxSnapshot(ctx, generation)
+	if err != nil {
+		return chain, fmt.Errorf("max snapshot: %w", err)
+	} else if snapshot == nil {
+		return chain, ErrNoSnapshots
+	}
+	chain.SnapshotIndex = snapshot.Index
+	chain.Pos = Pos{Generation: generation, Index: snapshot.Index}
+
+	// Collect WAL segments at or after the snapshot index.
+	itr, err := r.client.WALSegments(ctx, generation)
+	if err != nil {
+		return chain, fmt.Errorf("wal segments: %w", err)
+	}
+	defer itr.Close()
+
+	var segments []WALSegmentInfo
+	for itr.Next() {
+		if info := itr.WALSegment(); info.Index >= snapshot.Index {
+			segments = append(segments, info)
+		}
+	}
+	if err := itr.Close(); err != nil {
+		return chain, fmt.Errorf("wal segments: %w", err)
+	}
+	sort.Sort(WALSegmentInfoSlice(segments))
+
+	for _, info := range segments {
+		chain.WALSegments = append(chain.WALSegments, info.Pos())
+	}
+	chain.Gaps = walIndexGaps(segments, snapshot.Index)
+
+	if len(segments) == 0 {
+		return chain, nil
+	}
+
+	// Read last segment to determine size to add to offset.
+	last := segments[len(segments)-1]
+	rd, err := r.client.WALSegmentReader(ctx, last.Pos())
+	if err != nil {
+		return chain, fmt.Errorf("wal segment reader: %w", err)
+	}
+	defer rd.Close()
+
+	n, err := io.Copy(ioutil.Discard, newDecompressReader(rd))
+	if err != nil {
+		return chain, err
+	}
+	chain.Pos = Pos{Generation: generation, Index: last.Index, Offset: last.Offset + n}
+
+	return chain, nil
+}
+
+// maxSnapshot returns the last snapshot in a generation.
+func (r *Replica) maxSnapshot(ctx context.Context, generation string) (*SnapshotInfo, error) {
+	itr, err := r.client.Snapshots(ctx, generation)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	var max *SnapshotInfo
+	for itr.Next() {
+		if info := itr.Snapshot(); max == nil || info.Index > max.Index {
+			max = &info
+		}
+	}
+	return max, itr.Close()
+}
+
+// maxWALSegment returns the highest WAL segment in a generation.
+func (r *Replica) maxWALSegment(ctx context.Context, generation string) (*WALSegmentInfo, error) {
+	itr, err := r.client.WALSegments(ctx, generation)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	var max *WALSegmentInfo
+	for itr.Next() {
+		if info := itr.WALSegment(); max == nil || info.Index > max.Index || (info.Index == max.Index && info.Offset > max.Offset) {
+			max = &info
+		}
+	}
+	return max, itr.Close()
+}
+
+// Pos returns the current replicated position.
+// Returns a zero value if the current position cannot be determined.
+func (r *Replica) Pos() Pos {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pos
+}
+
+// setPos updates the replicated position & notifies any waiters.
+func (r *Replica) setPos(pos Pos) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pos = pos
+	close(r.posCh)
+	r.posCh = make(chan struct{})
+}
+
+// WaitForPos blocks until the replicated position reaches or passes target
+// within the same generation. Returns immediately if it already has. If the
+// replica is on a different generation then it continues to wait until the
+// context is canceled.
+func (r *Replica) WaitForPos(ctx context.Context, target Pos) error {
+	for {
+		r.mu.RLock()
+		pos, ch := r.pos, r.posCh
+		r.mu.RUnlock()
+
+		if pos.Generation == target.Generation &&
+			(pos.Index > target.Index || (pos.Index == target.Index && pos.Offset >= target.Offset)) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+// Err returns the terminal error that stopped the replica, if any.
+func (r *Replica) Err() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.err
+}
+
+// ReplicationLag returns how far the replica position is behind the current
+// database position. The index lag is the difference in WAL index and the
+// byte lag is the number of shadow WAL bytes not yet replicated. If the
+// replica is on a different generation then the entire current generation
+// is reported as lag.
+func (r *Replica) ReplicationLag(ctx context.Context) (indexLag int, byteLag int64, err error) {
+	if r.db == nil {
+		return 0, 0, ErrNoSource
+	}
+
+	dpos := r.db.Pos()
+	if dpos.IsZero() {
+		return 0, 0, ErrNoGeneration
+	}
+
+	// Measure from the start of the generation if generations do not match.
+	pos := r.Pos()
+	if pos.Generation != dpos.Generation {
+		pos = Pos{Generation: dpos.Generation}
+	}
+
+	// Exit if the replica has caught up to the database.
+	if cmp, err := ComparePos(pos, dpos); err != nil {
+		return 0, 0, err
+	} else if cmp >= 0 {
+		return 0, 0, nil
+	}
+
+	// Only the offset differs if both positions are within the same index.
+	indexLag = dpos.Index - pos.Index
+	if indexLag == 0 {
+		return 0, dpos.Offset - pos.Offset, nil
+	}
+
+	// Otherwise add the remainder of the replica's index, all intervening
+	// indexes, and the current offset within the database's index.
+	for index := pos.Index; index < dpos.Index; index++ {
+		n, err := r.db.walIndexSize(ctx, dpos.Generation, index)
+		if err != nil {
+			return 0, 0, fmt.Errorf("wal index size: index=%s err=%w", FormatIndex(index), err)
+		}
+		if index == pos.Index {
+			n -= pos.Offset
+		}
+		byteLag += n
+	}
+	byteLag += dpos.Offset
+
+	return indexLag, byteLag, nil
+}
+
+// LatestSnapshot returns the most recently created snapshot across all
+// generations without collecting every snapshot into memory. Ties are broken
+// by the higher generation & then the higher index. Returns ErrNoSnapshots if
+// no snapshots exist.
+func (r *Replica) LatestSnapshot(ctx context.Context) (*SnapshotInfo, error) {
+	generations, err := r.client.Generations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch generations: %w", err)
+	}
+
+	var latest *SnapshotInfo
+	for _, generation := range generations {
+		if err := func() error {
+			itr, err := r.client.Snapshots(ctx, generation)
+			if err != nil {
+				return err
+			}
+			defer itr.Close()
+
+			for itr.Next() {
+				info := itr.Snapshot()
+				if latest == nil || isNewerSnapshot(info, *latest) {
+					latest = &info
+				}
+			}
+			return itr.Close()
+		}(); err != nil {
+			return nil, err
+		}
+	}
+
+	if latest == nil {
+		return nil, ErrNoSnapshots
+	}
+	return latest, nil
+}
+
+// NewestSnapshotAge returns the time since the most recently created snapshot
+// across all generations & reports the newest snapshot age & timestamp of each
+// generation & of the replica overall via metrics. Returns ErrNoSnapshots if
+// no snapshots exist.
+//
+// The age metrics are only refreshed when this is called, such as by each
+// retention check. The timestamp metrics are also set as snapshots are written
+// so alerts on staleness should compare them against the current time.
+func (r *Replica) NewestSnapshotAge(ctx context.Context) (time.Duration, error) {
+	generations, err := r.client.Generations(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cannot fetch generations: %w", err)
+	}
+
+	now := r.now()
+	var newest time.Time
+	for _, generation := range generations {
+		var createdAt time.Time
+		if err := func() error {
+			itr, err := r.client.Snapshots(ctx, generation)
+			if err != nil {
+				return err
+			}
+			defer itr.Close()
+
+			for itr.Next() {
+				if info := itr.Snapshot(); info.CreatedAt.After(createdAt) {
+					createdAt = info.CreatedAt
+				}
+			}
+			return itr.Close()
+		}(); err != nil {
+			return 0, err
+		} else if createdAt.IsZero() {
+			continue
+		}
+
+		if r.db != nil {
+			replicaGenerationSnapshotAgeGaugeVec.WithLabelValues(r.db.Path(), r.Name(), generation).Set(now.Sub(createdAt).Seconds())
+			replicaGenerationSnapshotTimestampGaugeVec.WithLabelValues(r.db.Path(), r.Name(), generation).Set(float64(createdAt.Unix()))
+		}
+		if createdAt.After(newest) {
+			newest = createdAt
+		}
+	}
+
+	if newest.IsZero() {
+		return 0, ErrNoSnapshots
+	}
+
+	age := now.Sub(newest)
+	if r.db != nil {
+		replicaSnapshotAgeGaugeVec.WithLabelValues(r.db.Path(), r.Name()).Set(age.Seconds())
+		replicaSnapshotTimestampGaugeVec.WithLabelValues(r.db.Path(), r.Name()).Set(float64(newest.Unix()))
+	}
+	return age, nil
+}
+
+// LatestSnapshotReader returns a reader for the highest index snapshot within
+// a generation along with its index. The data is the uncompressed database
+// image, reconstructed from its base if the snapshot is a delta. Returns
+// ErrNoSnapshots if the generation has no snapshots.
+func (r *Replica) LatestSnapshotReader(ctx context.Context, generation string) (io.ReadCloser, int, error) {
+	index, err := FindMaxSnapshotIndexByGeneration(ctx, r.client, generation)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rc, err := SnapshotReader(ctx, r.client, generation, index)
+	if err != nil {
+		return nil, 0, fmt.Errorf("snapshot reader: %w", err)
+	}
+	return rc, index, nil
+}
+
+// LatestSnapshotReaderAll returns a reader for the most recently created
+// snapshot across all generations, as determined by LatestSnapshot(), along
+// with its metadata. As with LatestSnapshotReader(), the data is the
+// uncompressed database image. Returns ErrNoSnapshots if no snapshots exist.
+func (r *Replica) LatestSnapshotReaderAll(ctx context.Context) (io.ReadCloser, SnapshotInfo, error) {
+	info, err := r.LatestSnapshot(ctx)
+	if err != nil {
+		return nil, SnapshotInfo{}, err
+	}
+
+	rc, err := SnapshotReader(ctx, r.client, info.Generation, info.Index)
+	if err != nil {
+		return nil, SnapshotInfo{}, fmt.Errorf("snapshot reader: %w", err)
+	}
+	return rc, *info, nil
+}
+
+// isNewerSnapshot returns true if a was created after b. Equal creation times
+// are ordered by generation & then index.
+func isNewerSnapshot(a, b SnapshotInfo) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	} else if a.Generation != b.Generation {
+		return a.Generation > b.Generation
+	}
+	return a.Index > b.Index
+}
+
+// Snapshots returns a list of all snapshots across all generations.
+func (r *Replica) Snapshots(ctx context.Context) ([]SnapshotInfo, error) {
+	generations, err := r.client.Generations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch generations: %w", err)
+	}
+
+	var a []SnapshotInfo
+	for _, generation := range generations {
+		if err := func() error {
+			itr, err := r.client.Snapshots(ctx, generation)
+			if err != nil {
+				return err
+			}
+			defer itr.Close()
+
+			other, err := SliceSnapshotIterator(itr)
+			if err != nil {
+				return err
+			}
+			a = append(a, other...)
+
+			return itr.Close()
+		}(); err != nil {
+			return a, err
+		}
+	}
+
+	sort.Sort(SnapshotInfoSlice(a))
+
+	return a, nil
+}
+
+// SnapshotsParallel returns a list of all snapshots across all generations,
+// like Snapshots(), but lists up to n generations concurrently. This bounds
+// the number of directories or requests open at once to n.
+func (r *Replica) SnapshotsParallel(ctx context.Context, n int) ([]SnapshotInfo, error) {
+	generations, err := r.client.Generations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch generations: %w", err)
+	}
+
+	var mu sync.Mutex
+	var a []SnapshotInfo
+	if err := forEachGeneration(ctx, generations, n, func(ctx context.Context, generation string) error {
+		itr, err := r.client.Snapshots(ctx, generation)
+		if err != nil {
+			return err
+		}
+		defer itr.Close()
+
+		other, err := SliceSnapshotIterator(itr)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		a = append(a, other...)
+		mu.Unlock()
+
+		return itr.Close()
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(SnapshotInfoSlice(a))
+
+	return a, nil
+}
+
+// WALsParallel returns a list of all WAL segments across all generations,
+// sorted by position. Up to n generations are listed concurrently.
+func (r *Replica) WALsParallel(ctx context.Context, n int) ([]WALSegmentInfo, error) {
+	generations, err := r.client.Generations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch generations: %w", err)
+	}
+
+	var mu sync.Mutex
+	var a []WALSegmentInfo
+	if err := forEachGeneration(ctx, generations, n, func(ctx context.Context, generation string) error {
+		itr, err := r.client.WALSegments(ctx, generation)
+		if err != nil {
+			return err
+		}
+		defer itr.Close()
+
+		other, err := SliceWALSegmentIterator(itr)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		a = append(a, other...)
+		mu.Unlock()
+
+		return itr.Close()
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(WALSegmentInfoSlice(a))
+
+	return a, nil
+}
+
+// SnapshotsChan streams all snapshots across all generations as they are
+// listed from the client so callers do not need to hold the full list in
+// memory. Snapshots are sent in generation order & then in the client's order
+// within each generation. Both channels are closed once listing completes,
+// fails, or ctx is canceled. At most one error is sent on the error channel.
+func (r *Replica) SnapshotsChan(ctx context.Context) (<-chan SnapshotInfo, <-chan error) {
+	ch, errCh := make(chan SnapshotInfo), make(chan error, 1)
+	go func() {
+		defer close(errCh)
+		defer close(ch)
+
+		if err := r.forEachGenerationSerial(ctx, func(generation string) error {
+			itr, err := r.client.Snapshots(ctx, generation)
+			if err != nil {
+				return err
+			}
+			defer itr.Close()
+
+			for itr.Next() {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case ch <- itr.Snapshot():
+				}
+			}
+			return itr.Close()
+		}); err != nil {
+			errCh <- err
+		}
+	}()
+	return ch, errCh
+}
+
+// WALsChan streams all WAL segments across all generations, like
+// SnapshotsChan(). Segments are sent in the client's order within each
+// generation.
+func (r *Replica) WALsChan(ctx context.Context) (<-chan WALSegmentInfo, <-chan error) {
+	ch, errCh := make(chan WALSegmentInfo), make(chan error, 1)
+	go func() {
+		defer close(errCh)
+		defer close(ch)
+
+		if err := r.forEachGenerationSerial(ctx, func(generation string) error {
+			itr, err := r.client.WALSegments(ctx, generation)
+			if err != nil {
+				return err
+			}
+			defer itr.Close()
+
+			for itr.Next() {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case ch <- itr.WALSegment():
+				}
+			}
+			return itr.Close()
+		}); err != nil {
+			errCh <- err
+		}
+	}()
+	return ch, errCh
+}
+
+// forEachGenerationSerial calls fn for each of the client's generations in
+// order. Stops at the first error or once ctx is canceled.
+func (r *Replica) forEachGenerationSerial(ctx context.Context, fn func(generation string) error) error {
+	generations, err := r.client.Generations(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot fetch generations: %w", err)
+	}
+
+	for _, generation := range generations {
+		if err := ctx.Err(); err != nil {
+			return err
+		} else if err := fn(generation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachGeneration calls fn for each generation from up to n concurrent
+// workers. Remaining generations are skipped once fn returns an error.
+func forEachGeneration(ctx context.Context, generations []string, n int, fn func(ctx context.Context, generation string) error) error {
+	if n < 1 {
+		n = 1
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	ch := make(chan string)
+	g.Go(func() error {
+		defer close(ch)
+		for _, generation := range generations {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ch <- generation:
+			}
+		}
+		return nil
+	})
+
+	for i := 0; i < n; i++ {
+		g.Go(func() error {
+			for generation := range ch {
+				if err := fn(ctx, generation); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// Snapshot copies the entire database to the replica path.
+func (r *Replica) Snapshot(ctx context.Context) (info SnapshotInfo, err error) {
+	if r.db == nil {
+		return info, ErrNoSource
+	} else if r.db.db == nil {
+		return info, ErrNoGeneration // database not initialized yet
+	}
+
+	r.muf.Lock()
+	defer r.muf.Unlock()
+
+	t := time.Now()
+
+	// Issue a passive checkpoint to flush any pages to disk before snapshotting.
+	// Read-only databases are checkpointed by their writer instead.
+	if !r.db.ReadOnly {
+		if _, err := r.db.db.ExecContext(ctx, `PRAGMA wal_checkpoint(PASSIVE);`); err != nil {
+			return info, fmt.Errorf("pre-snapshot checkpoint: %w", err)
+		}
+	}
+
+	// Acquire a read lock on the database during snapshot to prevent checkpoints.
+	tx, err := r.db.db.Begin()
+	if err != nil {
+		return info, err
+	} else if _, err := tx.ExecContext(ctx, r.db.readLockQuery()); err != nil {
+		_ = tx.Rollback()
+		return info, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Obtain current position.
+	pos := r.db.Pos()
+	if pos.IsZero() {
+		return info, ErrNoGeneration
+	}
+
+	// Skip the snapshot if one already exists for this position & neither the
+	// database file nor any attached database has changed since it was written.
+	if existing, err := r.findCurrentSnapshot(ctx, pos); err != nil {
+		return info, err
+	} else if existing != nil {
+		r.Logger.Printf("snapshot exists %s/%s, skipping", pos.Generation, FormatIndex(pos.Index))
+		return *existing, nil
+	}
+
+	// Open db file descriptor, if not already open, & position at beginning.
+	if r.f == nil {
+		if r.f, err = os.Open(r.db.Path()); err != nil {
+			return info, err
+		}
+	}
+	if _, err := r.f.Seek(0, io.SeekStart); err != nil {
+		return info, err
+	}
+
+	fi, err := r.f.Stat()
+	if err != nil {
+		return info, err
+	}
+
+	// Skip the snapshot if the destination cannot hold a full copy of the
+	// database rather than filling the disk with a partial file.
+	if free, err := freeSpace(ctx, r.client); err != nil {
+		return info, fmt.Errorf("free space: %w", err)
+	} else if free >= 0 && free < fi.Size() {
+		return info, fmt.Errorf("%w: free=%d size=%d", ErrInsufficientSpace, free, fi.Size())
+	}
+
+	// Capture attached databases before the snapshot is written so a snapshot
+	// never exists without its attached images.
+	if err := r.snapshotAttached(ctx, pos); err != nil {
+		return info, fmt.Errorf("attached snapshot: %w", err)
+	}
+
+	// Only write a delta if the previous snapshot can be used as its base.
+	pageSize := r.db.PageSize()
+	base := r.deltaSnapshotBase(pos, pageSize, fi.Size())
+	r.delta = nil
+
+	// Use a pipe to convert the compression writer to a reader.
+	pr, pw := io.Pipe()
+	zr, err := r.compressWriter(pw, r.SnapshotCodec)
+	if err != nil {
+		return info, err
+	}
+
+	// Copy the database file to the compression writer in a separate goroutine.
+	// Page checksums are recorded when delta snapshots are enabled.
+	var g errgroup.Group
+	var checksums []uint64
+	g.Go(func() (err error) {
+		defer zr.Close()
+
+		if base != nil {
+			checksums, err = writeDeltaSnapshot(zr, r.f, base, pageSize, fi.Size())
+		} else if r.DeltaSnapshots {
+			cw := &pageChecksumWriter{pageSize: pageSize}
+			if _, err = copyBuffer(io.MultiWriter(zr, cw), r.f, r.CopyBufferSize); err == nil && len(cw.buf) == 0 {
+				checksums = cw.checksums
+			}
+		} else {
+			_, err = copyBuffer(zr, r.f, r.CopyBufferSize)
+		}
+
+		if err != nil {
+			_ = pw.CloseWithError(err)
+			return err
+		} else if err := zr.Close(); err != nil {
+			_ = pw.CloseWithError(err)
+			return err
+		}
+		return pw.Close()
+	})
+
+	// Delegate write to client & wait for writer goroutine to finish.
+	if info, err = r.client.WriteSnapshot(ctx, pos.Generation, pos.Index, pr); err != nil {
+		return info, err
+	} else if err := g.Wait(); err != nil {
+		return info, err
+	}
+
+	elapsed := time.Since(t)
+	if base != nil {
+		r.Logger.Printf("delta snapshot written %s/%s base=%s sz=%d elapsed=%s", pos.Generation, FormatIndex(pos.Index), FormatIndex(base.index), info.Size, elapsed)
+	} else {
+		r.Logger.Printf("snapshot written %s/%s sz=%d elapsed=%s", pos.Generation, FormatIndex(pos.Index), info.Size, elapsed)
+	}
+
+	replicaSnapshotSecondsGaugeVec.WithLabelValues(r.db.Path(), r.Name()).Set(elapsed.Seconds())
+	replicaSnapshotBytesGaugeVec.WithLabelValues(r.db.Path(), r.Name()).Set(float64(info.Size))
+
+	// Record the newest snapshot time as the age gauges are only refreshed
+	// by retention checks.
+	createdAt := info.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = r.now()
+	}
+	replicaSnapshotTimestampGaugeVec.WithLabelValues(r.db.Path(), r.Name()).Set(float64(createdAt.Unix()))
+	replicaGenerationSnapshotTimestampGaugeVec.WithLabelValues(r.db.Path(), r.Name(), pos.Generation).Set(float64(createdAt.Unix()))
+
+	if r.OnSnapshot != nil {
+		r.OnSnapshot(info, elapsed)
+	}
+
+	// Record the snapshot as the base for the next delta.
+	if checksums != nil {
+		r.delta = &snapshotDeltaBase{generation: pos.Generation, index: pos.Index, pageSize: pageSize, checksums: checksums}
+		if base != nil {
+			r.delta.deltaN = base.deltaN + 1
+		}
+	}
+
+	if r.PruneWALOnSnapshot {
+		if err := r.pruneWAL(ctx, pos.Generation, pos.Index); err != nil {
+			return info, fmt.Errorf("prune wal: %w", err)
+		}
+	}
+
+	return info, nil
+}
+
+// snapshotDeltaBase records the page checksums of a snapshot written by the
+// replica so that the next snapshot can be written as a delta against it.
+type snapshotDeltaBase struct {
+	generation string
+	index      int
+	pageSize   int
+	checksums  []uint64 // CRC-64 of each page
+	deltaN     int      // consecutive deltas since the last full snapshot
+}
+
+// deltaSnapshotBase returns the base for a delta snapshot at pos of a database
+// with the given page size & file size. Returns nil if a full snapshot is needed.
+func (r *Replica) deltaSnapshotBase(pos Pos, pageSize int, size int64) *snapshotDeltaBase {
+	maxN := r.MaxDeltaSnapshots
+	if maxN <= 0 {
+		maxN = DefaultMaxDeltaSnapshots
+	}
+
+	base := r.delta
+	switch {
+	case !r.DeltaSnapshots, base == nil:
+		return nil
+	case base.generation != pos.Generation, base.index >= pos.Index:
+		return nil // base would be overwritten or belongs to another generation
+	case base.pageSize != pageSize, pageSize <= 0, size%int64(pageSize) != 0:
+		return nil
+	case base.deltaN >= maxN:
+		return nil // periodically write a full snapshot to bound the chain length
+	}
+	return base
+}
+
+// writeDeltaSnapshot writes the pages of f which differ from base to w, in the
+// delta snapshot format. Returns the checksums of every page in f.
+func writeDeltaSnapshot(w io.Writer, f io.Reader, base *snapshotDeltaBase, pageSize int, size int64) ([]uint64, error) {
+	pageN := int(size / int64(pageSize))
+	if _, err := w.Write(encodeDeltaSnapshotHeader(deltaSnapshotHeader{
+		BaseIndex: base.index,
+		PageSize:  pageSize,
+		PageN:     pageN,
+	})); err != nil {
+		return nil, err
+	}
+
+	tbl := crc64.MakeTable(crc64.ISO)
+	checksums := make([]uint64, 0, pageN)
+	page, buf := make([]byte, pageSize), make([]byte, 4)
+	for pgno := 1; pgno <= pageN; pgno++ {
+		if _, err := io.ReadFull(f, page); err != nil {
+			return nil, fmt.Errorf("read page %d: %w", pgno, err)
+		}
+
+		chksum := crc64.Checksum(page, tbl)
+		checksums = append(checksums, chksum)
+		if pgno <= len(base.checksums) && base.checksums[pgno-1] == chksum {
+			continue
+		}
+
+		binary.BigEndian.PutUint32(buf, uint32(pgno))
+		if _, err := w.Write(buf); err != nil {
+			return nil, err
+		} else if _, err := w.Write(page); err != nil {
+			return nil, err
+		}
+	}
+
+	// Terminate the page list with a zero page number.
+	binary.BigEndian.PutUint32(buf, 0)
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+	return checksums, nil
+}
+
+// pageChecksumWriter records the CRC-64 checksum of each page written to it.
+// A trailing partial page is left in buf.
+type pageChecksumWriter struct {
+	pageSize  int
+	buf       []byte
+	checksums []uint64
+}
+
+func (w *pageChecksumWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		sz := w.pageSize - len(w.buf)
+		if sz > len(p) {
+			sz = len(p)
+		}
+		w.buf, p = append(w.buf, p[:sz]...), p[sz:]
+
+		if len(w.buf) == w.pageSize {
+			w.checksums = append(w.checksums, crc64.Checksum(w.buf, crc64.MakeTable(crc64.ISO)))
+			w.buf = w.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// pruneWAL removes WAL segments in a generation which are superseded by the
+// snapshot at index. Segments after the earliest retained snapshot & those
+// within WALRetention are kept so that retained restore points still work.
+func (r *Replica) pruneWAL(ctx context.Context, generation string, index int) error {
+	if immutable, err := isGenerationImmutable(ctx, r.client, generation); err != nil {
+		return fmt.Errorf("is generation immutable: %w", err)
+	} else if immutable {
+		return nil
+	}
+
+	itr, err := r.client.Snapshots(ctx, generation)
+	if err != nil {
+		return fmt.Errorf("snapshots: %w", err)
+	}
+	snapshots, err := SliceSnapshotIterator(itr)
+	if err != nil {
+		return fmt.Errorf("snapshot iteration: %w", err)
+	}
+
+	// Determine the snapshots retention would keep. All snapshots are kept
+	// if retention is disabled.
+	retained := snapshots
+	if r.Retention > 0 {
+		retained = FilterSnapshotsAfter(snapshots, time.Now().UTC().Add(-r.Retention))
+		if r.MinRetainedSnapshots > 0 {
+			retained = retainMinSnapshots(snapshots, retained, r.MinRetainedSnapshots)
+		}
+	}
+
+	// Keep WAL needed to restore from the earliest retained snapshot.
+	if snapshot := FindMinSnapshotByGeneration(retained, generation); snapshot != nil && snapshot.Index < index {
+		index = snapshot.Index
+	}
+
+	if r.WALRetention > 0 {
+		return r.deleteWALSegmentsBeforeTime(ctx, generation, index, time.Now().UTC().Add(-r.WALRetention))
+	}
+	return r.deleteWALSegmentsBeforeIndex(ctx, generation, index)
+}
+
+// findCurrentSnapshot returns the snapshot at the position's index if it was
+// written after the database file & any attached databases were last
+// modified. Returns nil otherwise.
+func (r *Replica) findCurrentSnapshot(ctx context.Context, pos Pos) (*SnapshotInfo, error) {
+	fi, err := os.Stat(r.db.Path())
+	if err != nil {
+		return nil, err
+	}
+	modTime := fi.ModTime().UTC()
+
+	// Changes to attached databases are not reflected in the position so
+	// their files, including any WAL, must also be unchanged.
+	for _, name := range sortedKeys(r.Attached) {
+		for _, filename := range []string{r.Attached[name], r.Attached[name] + "-wal"} {
+			if fi, err := os.Stat(filename); os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			} else if fi.ModTime().UTC().After(modTime) {
+				modTime = fi.ModTime().UTC()
+			}
+		}
+	}
+
+	itr, err := r.client.Snapshots(ctx, pos.Generation)
+	if err != nil {
+		return nil, fmt.Errorf("snapshots: %w", err)
+	}
+	defer itr.Close()
+
+	for itr.Next() {
+		if info := itr.Snapshot(); info.Index == pos.Index && info.Size > 0 && info.CreatedAt.After(modTime) {
+			return &info, itr.Close()
+		}
+	}
+	return nil, itr.Close()
+}
+
+// EnforceRetention forces a new snapshot once the retention interval has passed.
+// Older snapshots and WAL files are then removed.
+func (r *Replica) EnforceRetention(ctx context.Context) (err error) {
+	if r.noSource {
+		return ErrNoSource
+	}
+
+	r.mur.Lock()
+	defer r.mur.Unlock()
+
+	// Obtain list of snapshots that are within the retention period.
+	snapshots, err := r.Snapshots(ctx)
+	if err != nil {
+		return fmt.Errorf("snapshots: %w", err)
+	}
+	retained := FilterSnapshotsAfter(snapshots, time.Now().UTC().Add(-r.Retention))
+
+	// If no retained snapshots exist or the newest snapshot is older than the
+	// snapshot interval, create a new snapshot.
+	if len(retained) == 0 || r.snapshotDue(snapshots) {
+		snapshot, err := r.Snapshot(ctx)
+		if err != nil {
+			return fmt.Errorf("snapshot: %w", err)
+		}
+		retained = append(retained, snapshot)
+	}
+
+	// Keep additional older snapshots in retained generations, if required.
+	if r.MinRetainedSnapshots > 0 {
+		retained = retainMinSnapshots(snapshots, retained, r.MinRetainedSnapshots)
+	}
+
+	// Loop over generations and delete unretained snapshots & WAL files.
+	generations, err := r.client.Generations(ctx)
+	if err != nil {
+		return fmt.Errorf("generations: %w", err)
+	}
+
+	// Determine the oldest generations beyond the generation limit, if any.
+	excess, err := r.generationsOverLimit(ctx, generations)
+	if err != nil {
+		return fmt.Errorf("generations over limit: %w", err)
+	}
+
+	for _, generation := range generations {
+		// Skip generations which have been protected from deletion.
+		if immutable, err := isGenerationImmutable(ctx, r.client, generation); err != nil {
+			return fmt.Errorf("is generation immutable: %w", err)
+		} else if immutable {
+			r.Logger.Printf("generation %q immutable, skipping retention", generation)
+			continue
+		}
+
+		// Delete entire generation if it exceeds the generation limit.
+		if _, ok := excess[generation]; ok {
+			r.Logger.Printf("generation %q exceeds max generations (%d), deleting", generation, r.MaxGenerations)
+			if err := r.deleteGeneration(ctx, generation); err != nil {
+				return fmt.Errorf("delete generation: %w", err)
+			}
+			continue
+		}
+
+		// Find earliest retained snapshot for this generation.
+		snapshot := FindMinSnapshotByGeneration(retained, generation)
+
+		// Delete entire generation if no snapshots are being retained.
+		if snapshot == nil {
+			if err := r.deleteGeneration(ctx, generation); err != nil {
+				return fmt.Errorf("delete generation: %w", err)
+			}
+			continue
+		}
+
+		// Keep the full snapshot & deltas the earliest snapshot is built on.
+		// A missing snapshot is reported when deleting earlier snapshots.
+		baseIndex, err := snapshotBaseIndex(ctx, r.client, generation, snapshot.Index)
+		if os.IsNotExist(err) {
+			baseIndex = snapshot.Index
+		} else if err != nil {
+			return fmt.Errorf("snapshot base index: %w", err)
+		}
+
+		// Otherwise remove all earlier snapshots & WAL segments.
+		if err := r.deleteSnapshotsBeforeIndex(ctx, generation, baseIndex); err != nil {
+			return fmt.Errorf("delete snapshots before index: %w", err)
+		} else if err := r.deleteWALSegmentsBeforeIndex(ctx, generation, snapshot.Index); err != nil {
+			return fmt.Errorf("delete wal segments before index: %w", err)
+		}
+
+		// Remove older WAL segments up to the latest snapshot, if enabled.
+		if r.WALRetention > 0 {
+			latest := FindMaxSnapshotByGeneration(retained, generation)
+			if err := r.deleteWALSegmentsBeforeTime(ctx, generation, latest.Index, time.Now().UTC().Add(-r.WALRetention)); err != nil {
+				return fmt.Errorf("delete wal segments before time: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// generationsOverLimit returns the oldest generations, by creation time, which
+// must be deleted to keep at most MaxGenerations. The current generation &
+// immutable generations count toward the limit but are never returned.
+func (r *Replica) generationsOverLimit(ctx context.Context, generations []string) (map[string]struct{}, error) {
+	n := len(generations) - r.MaxGenerations
+	if r.MaxGenerations <= 0 || n <= 0 {
+		return nil, nil
+	}
+
+	var current string
+	if r.db != nil {
+		current = r.db.Pos().Generation
+	}
+
+	type candidate struct {
+		generation string
+		createdAt  time.Time
+	}
+	var a []candidate
+	for _, generation := range generations {
+		if generation == current {
+			continue
+		} else if immutable, err := isGenerationImmutable(ctx, r.client, generation); err != nil {
+			return nil, fmt.Errorf("is generation immutable: %w", err)
+		} else if immutable {
+			continue
+		}
+
+		createdAt, err := r.GenerationCreatedAt(ctx, generation)
+		if err != nil {
+			return nil, fmt.Errorf("generation created at: %w", err)
+		}
+		a = append(a, candidate{generation: generation, createdAt: createdAt})
+	}
+
+	// Generations without snapshots have a zero creation time & sort first.
+	sort.Slice(a, func(i, j int) bool {
+		if !a[i].createdAt.Equal(a[j].createdAt) {
+			return a[i].createdAt.Before(a[j].createdAt)
+		}
+		return a[i].generation < a[j].generation
+	})
+
+	m := make(map[string]struct{})
+	for i := 0; i < n && i < len(a); i++ {
+		m[a[i].generation] = struct{}{}
+	}
+	return m, nil
+}
+
+// RetentionOverhang returns the number, total size & oldest creation time of
+// snapshots & WAL segments that are older than the retention period but have
+// not yet been removed. This is useful for sizing RetentionCheckInterval.
+// Returns zero values if retention is disabled.
+func (r *Replica) RetentionOverhang(ctx context.Context) (count int, bytes int64, oldest time.Time, err error) {
+	if r.Retention <= 0 {
+		return 0, 0, oldest, nil
+	}
+	cutoff := time.Now().UTC().Add(-r.Retention)
+
+	// add records a file if it was created before the retention cutoff.
+	add := func(size int64, createdAt time.Time) {
+		if !createdAt.Before(cutoff) {
+			return
+		}
+		count, bytes = count+1, bytes+size
+		if oldest.IsZero() || createdAt.Before(oldest) {
+			oldest = createdAt
+		}
+	}
+
+	generations, err := r.client.Generations(ctx)
+	if err != nil {
+		return 0, 0, oldest, fmt.Errorf("generations: %w", err)
+	}
+	for _, generation := range generations {
+		// Immutable generations are never removed so they are not overhang.
+		if immutable, err := isGenerationImmutable(ctx, r.client, generation); err != nil {
+			return 0, 0, oldest, fmt.Errorf("is generation immutable: %w", err)
+		} else if immutable {
+			continue
+		}
+
+		sitr, err := r.client.Snapshots(ctx, generation)
+		if err != nil {
+			return 0, 0, oldest, fmt.Errorf("snapshots: %w", err)
+		}
+		snapshots, err := SliceSnapshotIterator(sitr)
+		if err != nil {
+			return 0, 0, oldest, fmt.Errorf("snapshot iteration: %w", err)
+		}
+		for _, info := range snapshots {
+			add(info.Size, info.CreatedAt)
+		}
+
+		witr, err := r.client.WALSegments(ctx, generation)
+		if err != nil {
+			return 0, 0, oldest, fmt.Errorf("wal segments: %w", err)
+		}
+		segments, err := SliceWALSegmentIterator(witr)
+		if err != nil {
+			return 0, 0, oldest, fmt.Errorf("wal segment iteration: %w", err)
+		}
+		for _, info := range segments {
+			add(info.Size, info.CreatedAt)
+		}
+	}
+
+	return count, bytes, oldest, nil
+}
+
+// GenerationsOutsideWindow returns generations last updated before the restore
+// window, which ends window before now. These generations are entirely outside
+// the window & can be deleted wholesale. The database's current generation is
+// never returned. If the current generation is unknown, the most recently
+// updated generation is assumed to be current instead. Immutable generations
+// & generations without snapshots are also excluded.
+func (r *Replica) GenerationsOutsideWindow(ctx context.Context, window time.Duration) ([]string, error) {
+	cutoff := time.Now().UTC().Add(-window)
+
+	generations, err := r.client.Generations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("generations: %w", err)
+	}
+
+	var current string
+	if r.db != nil {
+		current = r.db.Pos().Generation
+	}
+
+	var a []string
+	var latest string
+	var latestAt time.Time
+	for _, generation := range generations {
+		if generation == current {
+			continue
+		}
+
+		_, updatedAt, err := GenerationTimeBounds(ctx, r.client, generation)
+		if err == ErrNoSnapshots {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("generation time bounds: %w", err)
+		}
+		if latest == "" || updatedAt.After(latestAt) {
+			latest, latestAt = generation, updatedAt
+		}
+
+		if !updatedAt.Before(cutoff) {
+			continue
+		} else if immutable, err := isGenerationImmutable(ctx, r.client, generation); err != nil {
+			return nil, fmt.Errorf("is generation immutable: %w", err)
+		} else if immutable {
+			continue
+		}
+		a = append(a, generation)
+	}
+
+	// Exclude the most recent generation if the current one is unknown.
+	if current == "" {
+		other := a[:0]
+		for _, generation := range a {
+			if generation != latest {
+				other = append(other, generation)
+			}
+		}
+		a = other
+	}
+
+	return a, nil
+}
+
+// GenerationsCovering returns generations which can be restored to timestamp.
+// A generation covers timestamp if it has a snapshot at or before timestamp
+// & its snapshots or WAL segments reach at least to timestamp. A timestamp
+// between the end of one generation & the first snapshot of the next is
+// covered by neither. Generations without snapshots are excluded.
+func (r *Replica) GenerationsCovering(ctx context.Context, timestamp time.Time) ([]string, error) {
+	timestamp = timestamp.UTC()
+
+	generations, err := r.client.Generations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("generations: %w", err)
+	}
+
+	var a []string
+	for _, generation := range generations {
+		createdAt, updatedAt, err := GenerationTimeBounds(ctx, r.client, generation)
+		if err == ErrNoSnapshots {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("generation time bounds: %w", err)
+		}
+
+		if !createdAt.After(timestamp) && !updatedAt.Before(timestamp) {
+			a = append(a, generation)
+		}
+	}
+	return a, nil
+}
+
+// Totals represents aggregate counts across all generations on a replica.
+type Totals struct {
+	GenerationN int
+	SnapshotN   int
+	WALSegmentN int
+	Size        int64 // total bytes of all snapshots & WAL segments
+}
+
+// Totals returns the number of generations, snapshots, & WAL segments on the
+// replica along with their total size. Each generation is listed once.
+func (r *Replica) Totals(ctx context.Context) (totals Totals, err error) {
+	generations, err := r.client.Generations(ctx)
+	if err != nil {
+		return totals, fmt.Errorf("generations: %w", err)
+	}
+	totals.GenerationN = len(generations)
+
+	for _, generation := range generations {
+		if err := func() error {
+			itr, err := r.client.Snapshots(ctx, generation)
+			if err != nil {
+				return fmt.Errorf("snapshots: %w", err)
+			}
+			defer itr.Close()
+
+			for itr.Next() {
+				totals.SnapshotN, totals.Size = totals.SnapshotN+1, totals.Size+itr.Snapshot().Size
+			}
+			if err := itr.Close(); err != nil {
+				return fmt.Errorf("snapshot iteration: %w", err)
+			}
+			return nil
+		}(); err != nil {
+			return totals, err
+		}
+
+		if err := func() error {
+			itr, err := r.client.WALSegments(ctx, generation)
+			if err != nil {
+				return fmt.Errorf("wal segments: %w", err)
+			}
+			defer itr.Close()
+
+			for itr.Next() {
+				totals.WALSegmentN, totals.Size = totals.WALSegmentN+1, totals.Size+itr.WALSegment().Size
+			}
+			if err := itr.Close(); err != nil {
+				return fmt.Errorf("wal segment iteration: %w", err)
+			}
+			return nil
+		}(); err != nil {
+			return totals, err
+		}
+	}
+
+	return totals, nil
+}
+
+// Fingerprint returns a hash of the latest snapshot & WAL segment in each
+// generation on the replica. It changes whenever new data is replicated and is
+// stable otherwise, so it can be polled to cheaply detect replication activity.
+// Only file metadata is used & timestamps are excluded so writing the same
+// position again produces the same fingerprint.
+func (r *Replica) Fingerprint(ctx context.Context) (string, error) {
+	generations, err := r.client.Generations(ctx)
+	if err != nil {
+		return "", fmt.Errorf("generations: %w", err)
+	}
+	sort.Strings(generations)
+
+	h := sha256.New()
+	for _, generation := range generations {
+		if err := func() error {
+			itr, err := r.client.Snapshots(ctx, generation)
+			if err != nil {
+				return fmt.Errorf("snapshots: %w", err)
+			}
+			defer itr.Close()
+
+			var latest *SnapshotInfo
+			for itr.Next() {
+				if info := itr.Snapshot(); latest == nil || info.Index > latest.Index {
+					latest = &info
+				}
+			}
+			if err := itr.Close(); err != nil {
+				return fmt.Errorf("snapshot iteration: %w", err)
+			} else if latest != nil {
+				fmt.Fprintf(h, "snapshot %s/%s %d\n", generation, FormatIndex(latest.Index), latest.Size)
+			}
+			return nil
+		}(); err != nil {
+			return "", err
+		}
+
+		if err := func() error {
+			itr, err := r.client.WALSegments(ctx, generation)
+			if err != nil {
+				return fmt.Errorf("wal segments: %w", err)
+			}
+			defer itr.Close()
+
+			// Segments are returned in order so the last one is the head.
+			var last *WALSegmentInfo
+			for itr.Next() {
+				info := itr.WALSegment()
+				last = &info
+			}
+			if err := itr.Close(); err != nil {
+				return fmt.Errorf("wal segment iteration: %w", err)
+			} else if last != nil {
+				fmt.Fprintf(h, "wal %s %d\n", last.Pos(), last.Size)
+			}
+			return nil
+		}(); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// TimelineEntry represents the activity of a single generation over time.
+type TimelineEntry struct {
+	Generation  string
+	StartedAt   time.Time // creation time of the oldest file
+	EndedAt     time.Time // creation time of the newest file
+	SnapshotN   int
+	WALSegmentN int
+
+	// Time between the end of the previous entry & the start of this entry.
+	// Zero for the first entry & for generations which overlap the previous.
+	GapBefore time.Duration
+}
+
+// GenerationTimeline returns one entry per generation, sorted by start time,
+// along with any coverage gap from the end of the previous generation.
+// Generations without any snapshots or WAL segments are excluded.
+func (r *Replica) GenerationTimeline(ctx context.Context) ([]TimelineEntry, error) {
+	generations, err := r.client.Generations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("generations: %w", err)
+	}
+
+	var entries []TimelineEntry
+	for _, generation := range generations {
+		entry := TimelineEntry{Generation: generation}
+
+		// add expands the entry's time bounds to include t.
+		add := func(t time.Time) {
+			if entry.StartedAt.IsZero() || t.Before(entry.StartedAt) {
+				entry.StartedAt = t
+			}
+			if entry.EndedAt.IsZero() || t.After(entry.EndedAt) {
+				entry.EndedAt = t
+			}
+		}
+
+		sitr, err := r.client.Snapshots(ctx, generation)
+		if err != nil {
+			return nil, fmt.Errorf("snapshots: %w", err)
+		}
+		for ; sitr.Next(); entry.SnapshotN++ {
+			add(sitr.Snapshot().CreatedAt)
+		}
+		if err := sitr.Close(); err != nil {
+			return nil, fmt.Errorf("snapshot iteration: %w", err)
+		}
+
+		witr, err := r.client.WALSegments(ctx, generation)
+		if err != nil {
+			return nil, fmt.Errorf("wal segments: %w", err)
+		}
+		for ; witr.Next(); entry.WALSegmentN++ {
+			add(witr.WALSegment().CreatedAt)
+		}
+		if err := witr.Close(); err != nil {
+			return nil, fmt.Errorf("wal segment iteration: %w", err)
+		}
+
+		if entry.SnapshotN+entry.WALSegmentN > 0 {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].StartedAt.Before(entries[j].StartedAt) })
+
+	// Compute gaps against the latest end time seen so far so a short
+	// generation within a longer one does not produce a false gap.
+	var end time.Time
+	for i := range entries {
+		if i > 0 && entries[i].StartedAt.After(end) {
+			entries[i].GapBefore = entries[i].StartedAt.Sub(end)
+		}
+		if entries[i].EndedAt.After(end) {
+			end = entries[i].EndedAt
+		}
+	}
+
+	return entries, nil
+}
+
+// Kinds of restore points returned by Replica.RestorePoints().
+const (
+	RestorePointSnapshot = "snapshot"
+	RestorePointWAL      = "wal"
+)
+
+// RestorePoint represents a moment within a generation which can be restored.
+type RestorePoint struct {
+	Kind      string    // RestorePointSnapshot or RestorePointWAL
+	Pos       Pos       // snapshot position or end of the WAL in the index
+	Timestamp time.Time // creation time reported by the client
+}
+
+// RestorePoints returns each snapshot & each WAL index in generation as a
+// point which can be restored, sorted chronologically. WAL indexes before the
+// first snapshot are excluded as there is no snapshot to apply them to. Each
+// WAL point refers to the end of the last segment of its index, which is read
+// to determine its size. Individual segments may end mid-transaction when
+// split by MaxWALSegmentBytes but every sync, & so the last segment written,
+// ends on a transaction boundary.
+func (r *Replica) RestorePoints(ctx context.Context, generation string) ([]RestorePoint, error) {
+	sitr, err := r.client.Snapshots(ctx, generation)
+	if err != nil {
+		return nil, fmt.Errorf("snapshots: %w", err)
+	}
+	snapshots, err := SliceSnapshotIterator(sitr)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot iteration: %w", err)
+	} else if len(snapshots) == 0 {
+		return nil, nil
+	}
+
+	minIndex := snapshots[0].Index
+	var points []RestorePoint
+	for _, info := range snapshots {
+		if info.Index < minIndex {
+			minIndex = info.Index
+		}
+		points = append(points, RestorePoint{
+			Kind:      RestorePointSnapshot,
+			Pos:       Pos{Generation: generation, Index: info.Index},
+			Timestamp: info.CreatedAt,
+		})
+	}
+
+	witr, err := r.client.WALSegments(ctx, generation)
+	if err != nil {
+		return nil, fmt.Errorf("wal segments: %w", err)
+	}
+	segments, err := SliceWALSegmentIterator(witr)
+	if err != nil {
+		return nil, fmt.Errorf("wal segment iteration: %w", err)
+	}
+	sort.Sort(WALSegmentInfoSlice(segments))
+
+	// Only the last segment of each index is used since the list is sorted.
+	for i, info := range segments {
+		if info.Index < minIndex {
+			continue
+		} else if i+1 < len(segments) && segments[i+1].Index == info.Index {
+			continue
+		}
+
+		n, err := walSegmentSize(ctx, r.client, info.Pos())
+		if err != nil {
+			return nil, fmt.Errorf("wal segment size %s: %w", info.Pos(), err)
+		}
+		pos := info.Pos()
+		pos.Offset += n
+
+		points = append(points, RestorePoint{
+			Kind:      RestorePointWAL,
+			Pos:       pos,
+			Timestamp: info.CreatedAt,
+		})
+	}
+
+	sort.SliceStable(points, func(i, j int) bool {
+		a, b := points[i], points[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		} else if a.Pos.Index != b.Pos.Index {
+			return a.Pos.Index < b.Pos.Index
+		}
+		return a.Kind == RestorePointSnapshot && b.Kind != RestorePointSnapshot
+	})
+
+	return points, nil
+}
+
+// SnapshotBoundary represents the range of WAL indexes which are restored from
+// a snapshot before a later snapshot takes over.
+type SnapshotBoundary struct {
+	Index    int  // snapshot index
+	EndIndex int  // exclusive end, the next snapshot's index or one past the head index
+	Head     bool // true if this is the latest snapshot in the generation
+}
+
+// SnapshotBoundaries returns the boundary of each snapshot in generation,
+// sorted by index. The boundaries partition the WAL index space from the first
+// snapshot to the generation's head: each snapshot covers WAL indexes up to
+// the next snapshot & the latest snapshot covers WAL indexes up to the head.
+func (r *Replica) SnapshotBoundaries(ctx context.Context, generation string) ([]SnapshotBoundary, error) {
+	sitr, err := r.client.Snapshots(ctx, generation)
+	if err != nil {
+		return nil, fmt.Errorf("snapshots: %w", err)
+	}
+	snapshots, err := SliceSnapshotIterator(sitr)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot iteration: %w", err)
+	} else if len(snapshots) == 0 {
+		return nil, nil
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Index < snapshots[j].Index })
+
+	// The head is the last snapshot or WAL index, whichever is higher.
+	head := snapshots[len(snapshots)-1].Index
+	if segment, err := r.maxWALSegment(ctx, generation); err != nil {
+		return nil, fmt.Errorf("max wal segment: %w", err)
+	} else if segment != nil && segment.Index > head {
+		head = segment.Index
+	}
+
+	a := make([]SnapshotBoundary, len(snapshots))
+	for i, info := range snapshots {
+		a[i] = SnapshotBoundary{Index: info.Index, EndIndex: head + 1}
+		if i+1 < len(snapshots) {
+			a[i].EndIndex = snapshots[i+1].Index
+		} else {
+			a[i].Head = true
+		}
+	}
+	return a, nil
+}
+
+// snapshotAttached writes an image of each attached database to the client
+// at pos. Images are created with "VACUUM INTO" so they include changes which
+// have not been checkpointed from the attached database's WAL.
+func (r *Replica) snapshotAttached(ctx context.Context, pos Pos) error {
+	if len(r.Attached) == 0 {
+		return nil
+	}
+
+	client, ok := r.client.(AttachedClient)
+	if !ok {
+		return fmt.Errorf("replica client does not support attached databases: %s", r.client.Type())
+	}
+
+	dir, err := ioutil.TempDir("", "litestream-attached-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	for _, name := range sortedKeys(r.Attached) {
+		filename := filepath.Join(dir, "db")
+		if err := vacuumInto(ctx, r.Attached[name], filename); err != nil {
+			return fmt.Errorf("%s: vacuum: %w", name, err)
+		} else if err := r.writeAttachedSnapshot(ctx, client, name, pos, filename); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		} else if err := os.Remove(filename); err != nil {
+			return err
+		}
+		r.Logger.Printf("attached snapshot written %s %s", name, pos)
+	}
+	return nil
+}
+
+// writeAttachedSnapshot compresses the database image at filename & writes
+// it to the client as the named attached database at pos.
+func (r *Replica) writeAttachedSnapshot(ctx context.Context, client AttachedClient, name string, pos Pos, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	zw, err := r.compressWriter(pw, r.SnapshotCodec)
+	if err != nil {
+		return err
+	}
+
+	var g errgroup.Group
+	g.Go(func() error {
+		if _, err := copyBuffer(zw, f, r.CopyBufferSize); err != nil {
+			_ = pw.CloseWithError(err)
+			return err
+		} else if err := zw.Close(); err != nil {
+			_ = pw.CloseWithError(err)
+			return err
+		}
+		return pw.Close()
+	})
+
+	if _, err := client.WriteAttachedSnapshot(ctx, name, pos, pr); err != nil {
+		_ = pr.CloseWithError(err)
+		_ = g.Wait()
+		return err
+	}
+	return g.Wait()
+}
+
+// SnapshotSchema returns the SQL of each table, index, view & trigger in the
+// snapshot at index, as stored in sqlite_master, without a full restore.
+// SQLite cannot read a compressed file so the database image is written to a
+// temporary file first. This requires local disk space & time proportional to
+// the database size. The file is removed before returning.
+func (r *Replica) SnapshotSchema(ctx context.Context, generation string, index int) ([]string, error) {
+	dir, err := ioutil.TempDir("", "litestream-schema-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	filename := filepath.Join(dir, "db")
+	if err := RestoreSnapshot(ctx, r.client, filename, generation, index, 0600, -1, -1); err != nil {
+		return nil, fmt.Errorf("restore snapshot: %w", err)
+	}
+	return readSchema(ctx, filename)
+}
+
+// ValidationReport represents the result of validating every generation on
+// a replica with Replica.Validate().
+type ValidationReport struct {
+	Generations []GenerationValidation
+}
+
+// OK returns true if no generation has any issues.
+func (r *ValidationReport) OK() bool {
+	for _, g := range r.Generations {
+		if len(g.Issues) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// GenerationValidation represents the validation result of a single generation.
+type GenerationValidation struct {
+	Generation  string
+	SnapshotN   int
+	WALSegmentN int
+	Issues      []string // human-readable descriptions of each problem
+}
+
+// Validate checks that every generation on the replica has at least one
+// snapshot & that no WAL indexes are missing after its first snapshot. If
+// verify is true, every snapshot & WAL segment is also fully read to validate
+// its checksum & WAL offsets are checked for continuity within each index.
+// Problems are reported per-generation while an error is only returned if
+// the replica cannot be listed.
+func (r *Replica) Validate(ctx context.Context, verify bool) (report ValidationReport, err error) {
+	generations, err := r.client.Generations(ctx)
+	if err != nil {
+		return report, fmt.Errorf("generations: %w", err)
+	}
+
+	for _, generation := range generations {
+		result, err := r.validateGeneration(ctx, generation, verify)
+		if err != nil {
+			return report, fmt.Errorf("validate generation %q: %w", generation, err)
+		}
+		report.Generations = append(report.Generations, result)
+	}
+	return report, nil
+}
+
+func (r *Replica) validateGeneration(ctx context.Context, generation string, verify bool) (result GenerationValidation, err error) {
+	result.Generation = generation
+
+	sitr, err := r.client.Snapshots(ctx, generation)
+	if err != nil {
+		return result, fmt.Errorf("snapshots: %w", err)
+	}
+	snapshots, err := SliceSnapshotIterator(sitr)
+	if err != nil {
+		return result, fmt.Errorf("snapshot iteration: %w", err)
+	}
+	result.SnapshotN = len(snapshots)
+
+	witr, err := r.client.WALSegments(ctx, generation)
+	if err != nil {
+		return result, fmt.Errorf("wal segments: %w", err)
+	}
+	segments, err := SliceWALSegmentIterator(witr)
+	if err != nil {
+		return result, fmt.Errorf("wal segment iteration: %w", err)
+	}
+	sort.Sort(WALSegmentInfoSlice(segments))
+	result.WALSegmentN = len(segments)
+
+	if len(snapshots) == 0 {
+		result.Issues = append(result.Issues, "no snapshots")
+	} else {
+		sort.Sort(SnapshotInfoSlice(snapshots))
+		for _, index := range walIndexGaps(segments, snapshots[0].Index) {
+			result.Issues = append(result.Issues, fmt.Sprintf("missing wal index %s", FormatIndex(index)))
+		}
+	}
+
+	if !verify {
+		return result, nil
+	}
+
+	for _, info := range snapshots {
+		if err := verifySnapshot(ctx, r.client, generation, info.Index); err != nil {
+			result.Issues = append(result.Issues, fmt.Sprintf("invalid snapshot %s: %s", FormatIndex(info.Index), err))
+		}
+	}
+
+	var next Pos // expected position of the next segment within an index
+	for _, info := range segments {
+		n, err := walSegmentSize(ctx, r.client, info.Pos())
+		if err != nil {
+			result.Issues = append(result.Issues, fmt.Sprintf("invalid wal segment %s: %s", info.Pos(), err))
+			next = Pos{}
+			continue
+		}
+
+		if next.Index == info.Index && !next.IsZero() && next != info.Pos() {
+			result.Issues = append(result.Issues, fmt.Sprintf("non-contiguous wal segment %s, expected offset %s", info.Pos(), FormatOffset(next.Offset)))
+		}
+		next = info.Pos()
+		next.Offset += n
+	}
+
+	return result, nil
+}
+
+// VerifyWALIntegrity reads all WAL segments for an index in a generation and
+// verifies that they form a valid WAL. This validates the header & frame
+// checksum chain and the frame salts, which catches corruption & truncation
+// that segment sizes alone do not. Returns ErrNoWALSegments if the index has
+// no segments.
+func (r *Replica) VerifyWALIntegrity(ctx context.Context, generation string, index int) error {
+	itr, err := r.client.WALSegments(ctx, generation)
+	if err != nil {
+		return fmt.Errorf("wal segments: %w", err)
+	}
+	infos, err := SliceWALSegmentIterator(itr)
+	if err != nil {
+		return fmt.Errorf("wal segment iteration: %w", err)
+	}
+	sort.Sort(WALSegmentInfoSlice(infos))
+
+	var a []Pos
+	for _, info := range infos {
+		if info.Index == index {
+			a = append(a, info.Pos())
 		}
 	}
-
-	sort.Sort(SnapshotInfoSlice(a))
-
-	return a, nil
-}
-
-// Snapshot copies the entire database to the replica path.
-func (r *Replica) Snapshot(ctx context.Context) (info SnapshotInfo, err error) {
-	if r.db == nil || r.db.db == nil {
-		return info, fmt.Errorf("no database available")
+	if len(a) == 0 {
+		return ErrNoWALSegments
 	}
 
-	r.muf.Lock()
-	defer r.muf.Unlock()
+	// Stream decompressed segments, in order, into the verifier.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(r.copyWALSegments(ctx, pw, a))
+	}()
+	defer pr.Close()
 
-	// Issue a passive checkpoint to flush any pages to disk before snapshotting.
-	if _, err := r.db.db.ExecContext(ctx, `PRAGMA wal_checkpoint(PASSIVE);`); err != nil {
-		return info, fmt.Errorf("pre-snapshot checkpoint: %w", err)
+	if err := verifyWAL(pr); err != nil {
+		return fmt.Errorf("verify wal index %s: %w", FormatIndex(index), err)
 	}
+	return nil
+}
 
-	// Acquire a read lock on the database during snapshot to prevent checkpoints.
-	tx, err := r.db.db.Begin()
+// GenerationWALReader returns a reader of the decompressed WAL data from every
+// segment in a generation, in order, starting at fromIndex through the last
+// index. Returns an error if any index in that range is missing or does not
+// begin at offset zero. Returns ErrNoWALSegments if no segments exist at or
+// after fromIndex.
+func (r *Replica) GenerationWALReader(ctx context.Context, generation string, fromIndex int) (io.ReadCloser, error) {
+	itr, err := r.client.WALSegments(ctx, generation)
 	if err != nil {
-		return info, err
-	} else if _, err := tx.ExecContext(ctx, `SELECT COUNT(1) FROM _litestream_seq;`); err != nil {
-		_ = tx.Rollback()
-		return info, err
+		return nil, fmt.Errorf("wal segments: %w", err)
 	}
-	defer func() { _ = tx.Rollback() }()
-
-	// Obtain current position.
-	pos := r.db.Pos()
-	if pos.IsZero() {
-		return info, ErrNoGeneration
+	infos, err := SliceWALSegmentIterator(itr)
+	if err != nil {
+		return nil, fmt.Errorf("wal segment iteration: %w", err)
 	}
+	sort.Sort(WALSegmentInfoSlice(infos))
 
-	// Open db file descriptor, if not already open, & position at beginning.
-	if r.f == nil {
-		if r.f, err = os.Open(r.db.Path()); err != nil {
-			return info, err
+	var segments []WALSegmentInfo
+	for _, info := range infos {
+		if info.Index >= fromIndex {
+			segments = append(segments, info)
 		}
 	}
-	if _, err := r.f.Seek(0, io.SeekStart); err != nil {
-		return info, err
+	if len(segments) == 0 {
+		return nil, ErrNoWALSegments
+	} else if gaps := walIndexGaps(segments, fromIndex); len(gaps) > 0 {
+		return nil, fmt.Errorf("missing wal index %s", FormatIndex(gaps[0]))
+	}
+
+	a := make([]Pos, len(segments))
+	for i := range segments {
+		a[i] = segments[i].Pos()
 	}
 
-	// Use a pipe to convert the LZ4 writer to a reader.
 	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(r.copyWALSegments(ctx, pw, a))
+	}()
+	return pr, nil
+}
 
-	// Copy the database file to the LZ4 writer in a separate goroutine.
-	var g errgroup.Group
-	g.Go(func() error {
-		zr := lz4.NewWriter(pw)
-		defer zr.Close()
+// copyWALSegments writes the decompressed data of each segment in a to w.
+func (r *Replica) copyWALSegments(ctx context.Context, w io.Writer, a []Pos) error {
+	for _, pos := range a {
+		if err := func() error {
+			rc, err := r.client.WALSegmentReader(ctx, pos)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
 
-		if _, err := io.Copy(zr, r.f); err != nil {
-			_ = pw.CloseWithError(err)
-			return err
-		} else if err := zr.Close(); err != nil {
-			_ = pw.CloseWithError(err)
-			return err
+			if _, err := io.Copy(w, newDecompressReader(rc)); err != nil {
+				return err
+			}
+			return rc.Close()
+		}(); err != nil {
+			return fmt.Errorf("wal segment %s: %w", pos, err)
 		}
-		return pw.Close()
-	})
+	}
+	return nil
+}
 
-	// Delegate write to client & wait for writer goroutine to finish.
-	if info, err = r.client.WriteSnapshot(ctx, pos.Generation, pos.Index, pr); err != nil {
-		return info, err
-	} else if err := g.Wait(); err != nil {
-		return info, err
+// compressWriter returns a writer which compresses to w with codec. If
+// EmbedTimestamps is enabled, the compressed data is preceded by a frame
+// containing the current time.
+func (r *Replica) compressWriter(w io.Writer, codec string) (io.WriteCloser, error) {
+	if r.EmbedTimestamps {
+		switch codec {
+		case "", CodecLZ4:
+			w = &prefixWriter{w: w, prefix: encodeTimestampFrame(time.Now())}
+		case CodecNone:
+			return &autoCompressWriter{w: w, prefix: encodeTimestampFrame(time.Now()), none: true}, nil
+		case CodecAuto:
+			return &autoCompressWriter{w: w, prefix: encodeTimestampFrame(time.Now())}, nil
+		}
 	}
+	return newCompressWriter(w, codec)
+}
 
-	r.Logger.Printf("snapshot written %s/%s", pos.Generation, FormatIndex(pos.Index))
+// walSegmentSize returns the decompressed size of the WAL segment at pos.
+// Reading the full segment validates the LZ4 checksum.
+func walSegmentSize(ctx context.Context, client ReplicaClient, pos Pos) (int64, error) {
+	rc, err := client.WALSegmentReader(ctx, pos)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
 
-	return info, nil
+	n, err := io.Copy(ioutil.Discard, newDecompressReader(rc))
+	if err != nil {
+		return n, err
+	}
+	return n, rc.Close()
 }
 
-// EnforceRetention forces a new snapshot once the retention interval has passed.
-// Older snapshots and WAL files are then removed.
-func (r *Replica) EnforceRetention(ctx context.Context) (err error) {
-	// Obtain list of snapshots that are within the retention period.
-	snapshots, err := r.Snapshots(ctx)
-	if err != nil {
-		return fmt.Errorf("snapshots: %w", err)
+// retainMinSnapshots returns retained with the newest expired snapshots from
+// each retained generation added until each generation has at least n snapshots.
+func retainMinSnapshots(snapshots, retained []SnapshotInfo, n int) []SnapshotInfo {
+	counts := make(map[string]int)
+	m := make(map[SnapshotInfo]struct{})
+	for _, snapshot := range retained {
+		counts[snapshot.Generation]++
+		m[snapshot] = struct{}{}
 	}
-	retained := FilterSnapshotsAfter(snapshots, time.Now().Add(-r.Retention))
 
-	// If no retained snapshots exist, create a new snapshot.
-	if len(retained) == 0 {
-		snapshot, err := r.Snapshot(ctx)
-		if err != nil {
-			return fmt.Errorf("snapshot: %w", err)
+	// Iterate from newest to oldest so the most recent expired snapshots are kept.
+	other := make([]SnapshotInfo, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if _, ok := m[snapshot]; !ok {
+			other = append(other, snapshot)
+		}
+	}
+	sort.Slice(other, func(i, j int) bool { return other[i].Index > other[j].Index })
+
+	for _, snapshot := range other {
+		// Ignore generations that are not retained as they will be deleted.
+		if count, ok := counts[snapshot.Generation]; !ok || count >= n {
+			continue
 		}
 		retained = append(retained, snapshot)
+		counts[snapshot.Generation]++
 	}
+	return retained
+}
 
-	// Loop over generations and delete unretained snapshots & WAL files.
-	generations, err := r.client.Generations(ctx)
+// deleteWALSegmentsBeforeTime deletes all WAL indexes before maxIndex that
+// were created before t. Indexes are only removed as a whole & in order so the
+// remaining WAL files are always contiguous.
+func (r *Replica) deleteWALSegmentsBeforeTime(ctx context.Context, generation string, maxIndex int, t time.Time) error {
+	itr, err := r.client.WALSegments(ctx, generation)
 	if err != nil {
-		return fmt.Errorf("generations: %w", err)
+		return fmt.Errorf("fetch wal segments: %w", err)
 	}
-	for _, generation := range generations {
-		// Find earliest retained snapshot for this generation.
-		snapshot := FindMinSnapshotByGeneration(retained, generation)
-
-		// Delete entire generation if no snapshots are being retained.
-		if snapshot == nil {
-			if err := r.client.DeleteGeneration(ctx, generation); err != nil {
-				return fmt.Errorf("delete generation: %w", err)
-			}
-			continue
-		}
+	defer itr.Close()
 
-		// Otherwise remove all earlier snapshots & WAL segments.
-		if err := r.deleteSnapshotsBeforeIndex(ctx, generation, snapshot.Index); err != nil {
-			return fmt.Errorf("delete snapshots before index: %w", err)
-		} else if err := r.deleteWALSegmentsBeforeIndex(ctx, generation, snapshot.Index); err != nil {
-			return fmt.Errorf("delete wal segments before index: %w", err)
+	// Find the first index that has a segment created on or after t.
+	index := maxIndex
+	for itr.Next() {
+		info := itr.WALSegment()
+		if info.Index >= maxIndex {
+			break
+		} else if !info.CreatedAt.Before(t) {
+			index = info.Index
+			break
 		}
 	}
+	if err := itr.Close(); err != nil {
+		return err
+	}
 
-	return nil
+	return r.deleteWALSegmentsBeforeIndex(ctx, generation, index)
 }
 
+// deleteSnapshotsBeforeIndex deletes all snapshots in a generation before
+// index. Nothing is deleted if no snapshot exists at index as the remaining
+// WAL segments would not be restorable without it.
 func (r *Replica) deleteSnapshotsBeforeIndex(ctx context.Context, generation string, index int) error {
+	if r.noSource {
+		return ErrNoSource
+	}
+
 	itr, err := r.client.Snapshots(ctx, generation)
 	if err != nil {
 		return fmt.Errorf("fetch snapshots: %w", err)
 	}
-	defer itr.Close()
+	snapshots, err := SliceSnapshotIterator(itr)
+	if err != nil {
+		return fmt.Errorf("snapshot iteration: %w", err)
+	}
 
-	for itr.Next() {
-		info := itr.Snapshot()
+	// Ensure the snapshot being retained still exists before removing others.
+	var found bool
+	for _, info := range snapshots {
+		found = found || info.Index == index
+	}
+	if !found {
+		return fmt.Errorf("retained snapshot not found: %s/%s", generation, FormatIndex(index))
+	}
+
+	for _, info := range snapshots {
 		if info.Index >= index {
 			continue
 		}
@@ -597,13 +3492,18 @@ func (r *Replica) deleteSnapshotsBeforeIndex(ctx context.Context, generation str
 		if err := r.client.DeleteSnapshot(ctx, info.Generation, info.Index); err != nil {
 			return fmt.Errorf("delete snapshot %s/%s: %w", info.Generation, FormatIndex(info.Index), err)
 		}
-		r.Logger.Printf("snapshot deleted %s/%s", generation, FormatIndex(index))
+		r.Logger.Printf("snapshot deleted %s/%s", generation, FormatIndex(info.Index))
+		r.notifyDelete(DeleteKindSnapshot, info.Generation, info.Index, info.Size)
 	}
 
-	return itr.Close()
+	return nil
 }
 
 func (r *Replica) deleteWALSegmentsBeforeIndex(ctx context.Context, generation string, index int) error {
+	if r.noSource {
+		return ErrNoSource
+	}
+
 	itr, err := r.client.WALSegments(ctx, generation)
 	if err != nil {
 		return fmt.Errorf("fetch wal segments: %w", err)
@@ -611,12 +3511,14 @@ func (r *Replica) deleteWALSegmentsBeforeIndex(ctx context.Context, generation s
 	defer itr.Close()
 
 	var a []Pos
+	var infos []WALSegmentInfo
 	for itr.Next() {
 		info := itr.WALSegment()
 		if info.Index >= index {
 			continue
 		}
 		a = append(a, info.Pos())
+		infos = append(infos, info)
 	}
 	if err := itr.Close(); err != nil {
 		return err
@@ -626,40 +3528,143 @@ func (r *Replica) deleteWALSegmentsBeforeIndex(ctx context.Context, generation s
 		return nil
 	}
 
+	// Remove all segments with a single call so clients can batch deletions.
+	// A single summary is logged rather than a line per segment.
 	if err := r.client.DeleteWALSegments(ctx, a); err != nil {
 		return fmt.Errorf("delete wal segments: %w", err)
 	}
 
-	for _, pos := range a {
-		r.Logger.Printf("wal segmented deleted: %s", pos)
+	var size int64
+	for _, info := range infos {
+		size += info.Size
+		r.notifyDelete(DeleteKindWAL, info.Generation, info.Index, info.Size)
+	}
+	r.Logger.Printf("wal segments deleted %s/%s-%s n=%d sz=%d", generation, FormatIndex(infos[0].Index), FormatIndex(infos[len(infos)-1].Index), len(infos), size)
+
+	return nil
+}
+
+// SetGenerationImmutable marks a generation so that it is never removed by
+// retention enforcement. Returns an error if the client does not support it.
+func (r *Replica) SetGenerationImmutable(ctx context.Context, generation string, immutable bool) error {
+	if r.noSource {
+		return ErrNoSource
+	}
+
+	c, ok := r.client.(ImmutableGenerationClient)
+	if !ok {
+		return fmt.Errorf("replica client does not support immutable generations: %s", r.client.Type())
+	}
+	return c.SetGenerationImmutable(ctx, generation, immutable)
+}
+
+// deleteGeneration removes an entire generation from the client. If OnDelete
+// is set, files are listed beforehand so each deletion can be reported.
+func (r *Replica) deleteGeneration(ctx context.Context, generation string) error {
+	if r.noSource {
+		return ErrNoSource
+	}
+
+	var snapshots []SnapshotInfo
+	var segments []WALSegmentInfo
+	if r.OnDelete != nil {
+		sitr, err := r.client.Snapshots(ctx, generation)
+		if err != nil {
+			return fmt.Errorf("fetch snapshots: %w", err)
+		} else if snapshots, err = SliceSnapshotIterator(sitr); err != nil {
+			return fmt.Errorf("snapshot iteration: %w", err)
+		}
+
+		witr, err := r.client.WALSegments(ctx, generation)
+		if err != nil {
+			return fmt.Errorf("fetch wal segments: %w", err)
+		} else if segments, err = SliceWALSegmentIterator(witr); err != nil {
+			return fmt.Errorf("wal segment iteration: %w", err)
+		}
+	}
+
+	if err := r.client.DeleteGeneration(ctx, generation); err != nil {
+		return err
+	}
+	if r.db != nil {
+		replicaGenerationSnapshotAgeGaugeVec.DeleteLabelValues(r.db.Path(), r.Name(), generation)
+		replicaGenerationSnapshotTimestampGaugeVec.DeleteLabelValues(r.db.Path(), r.Name(), generation)
 	}
 
+	for _, info := range snapshots {
+		r.notifyDelete(DeleteKindSnapshot, info.Generation, info.Index, info.Size)
+	}
+	for _, info := range segments {
+		r.notifyDelete(DeleteKindWAL, info.Generation, info.Index, info.Size)
+	}
 	return nil
 }
 
+// notifyDelete invokes the OnDelete callback, if set.
+func (r *Replica) notifyDelete(kind, generation string, index int, size int64) {
+	if r.OnDelete != nil {
+		r.OnDelete(kind, generation, index, size)
+	}
+}
+
 // monitor runs in a separate goroutine and continuously replicates the DB.
 func (r *Replica) monitor(ctx context.Context) {
-	timer := time.NewTimer(r.SyncInterval)
+	timer := time.NewTimer(r.syncDelay(0))
 	defer timer.Stop()
 
+	var missing bool
+	var failures int
 	for {
 		if err := r.Sync(ctx); ctx.Err() != nil {
 			return
+		} else if err == ErrSourceMissing {
+			if r.OnSourceMissing == SourceMissingStop {
+				r.Logger.Printf("source database missing, stopping replica")
+				r.fail(err)
+				return
+			} else if !missing {
+				r.Logger.Printf("source database missing, waiting for it to reappear")
+			}
+			missing = true
+		} else if errors.As(err, new(*SnapshotFailedError)) {
+			r.Logger.Printf("snapshot retries exhausted, stopping replica: %s", err)
+			r.fail(err)
+			return
+		} else if err == ErrGenerationTakeover && r.OnTakeover == TakeoverStop {
+			r.Logger.Printf("generation advanced by another writer, stopping replica")
+			r.fail(err)
+			return
 		} else if err != nil && err != ErrNoGeneration {
-			r.Logger.Printf("monitor error: %s", err)
+			// Reduce log verbosity to powers of two once backing off.
+			if failures++; !r.backingOff(failures) || failures&(failures-1) == 0 {
+				r.Logger.Printf("monitor error (failures=%d): %s", failures, err)
+			}
+		} else {
+			if r.backingOff(failures) {
+				r.Logger.Printf("sync recovered after %d failures", failures)
+			}
+			failures = 0
+
+			if missing {
+				r.Logger.Printf("source database found, resuming replication")
+				missing = false
+			}
 		}
 
-		// Wait for a change to the WAL iterator.
-		if r.itr != nil {
+		// Wait for a change to the WAL iterator or for held back segments
+		// to be due for flushing.
+		notifyCh, flushCh := r.waitChs()
+		if notifyCh != nil {
 			select {
 			case <-ctx.Done():
 				return
-			case <-r.itr.NotifyCh():
+			case <-notifyCh:
+			case <-flushCh:
 			}
 		}
 
 		// Wait for the sync interval to collect additional changes.
-		timer.Reset(r.SyncInterval)
+		timer.Reset(r.syncDelay(failures))
 		select {
 		case <-ctx.Done():
 			return
@@ -667,58 +3672,163 @@ func (r *Replica) monitor(ctx context.Context) {
 		}
 
 		// Flush any additional notifications from the WAL iterator.
-		if r.itr != nil {
+		if notifyCh, _ := r.waitChs(); notifyCh != nil {
 			select {
-			case <-r.itr.NotifyCh():
+			case <-notifyCh:
 			default:
 			}
 		}
 	}
 }
 
+// fail records err as the terminal error & cancels the replica's context so
+// the retainer & snapshotter stop along with the monitor.
+func (r *Replica) fail(err error) {
+	r.mu.Lock()
+	r.err = err
+	r.mu.Unlock()
+	r.cancel()
+}
+
+// backingOff returns true if the number of consecutive sync failures has
+// reached the retry threshold.
+func (r *Replica) backingOff(failures int) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.SyncRetryThreshold > 0 && failures >= r.SyncRetryThreshold
+}
+
+// syncDelay returns the time to wait before the next sync. This is normally
+// the sync interval but it doubles with each failure past the retry threshold.
+// A jittered delay is used after failures instead if RetryBaseDelay is set.
+func (r *Replica) syncDelay(failures int) time.Duration {
+	r.mu.RLock()
+	interval, threshold, maxBackoff := r.SyncInterval, r.SyncRetryThreshold, r.SyncMaxBackoff
+	baseDelay, maxDelay := r.RetryBaseDelay, r.RetryMaxDelay
+	r.mu.RUnlock()
+
+	if baseDelay > 0 && failures > 0 {
+		if maxDelay <= 0 {
+			maxDelay = maxBackoff
+		}
+		return internal.FullJitterBackoff(baseDelay, maxDelay, failures, rand.Float64())
+	} else if !r.backingOff(failures) {
+		return interval
+	}
+
+	// Double the delay for each failure past the threshold. A zero maximum
+	// leaves the delay uncapped, short of overflowing.
+	d := interval
+	if d <= 0 {
+		d = DefaultSyncInterval
+	}
+	for i := threshold; i <= failures && (maxBackoff <= 0 || d < maxBackoff) && d <= math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if maxBackoff > 0 && d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
 // retainer runs in a separate goroutine and handles retention.
 func (r *Replica) retainer(ctx context.Context) {
-	// Disable retention enforcement if retention period is non-positive.
-	if r.Retention <= 0 {
-		return
-	}
+	checkInterval, enabled, cfgCh := r.retentionCheckInterval()
 
-	// Ensure check interval is not longer than retention period.
-	checkInterval := r.RetentionCheckInterval
-	if checkInterval > r.Retention {
-		checkInterval = r.Retention
+	// Remove expired files immediately, if requested. The database may not
+	// have a generation yet so that error is ignored.
+	if enabled && r.RunRetentionOnStart {
+		if err := r.EnforceRetention(ctx); err != nil && !errors.Is(err, ErrNoGeneration) && ctx.Err() == nil {
+			r.Logger.Printf("retainer error: %s", err)
+		}
 	}
 
-	ticker := time.NewTicker(checkInterval)
-	defer ticker.Stop()
+	timer := time.NewTimer(r.jitterDelay(checkInterval) + r.jitterDuration(checkInterval))
+	defer timer.Stop()
+	if !enabled {
+		stopTimer(timer)
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-cfgCh:
+			// Restart the schedule using the new interval.
+			checkInterval, enabled, cfgCh = r.retentionCheckInterval()
+			stopTimer(timer)
+			if enabled {
+				timer.Reset(r.jitterDuration(checkInterval))
+			}
+		case <-timer.C:
+			timer.Reset(r.jitterDuration(checkInterval))
 			if err := r.EnforceRetention(ctx); err != nil {
 				r.Logger.Printf("retainer error: %s", err)
 				continue
 			}
+
+			// Refresh snapshot age metrics after expired snapshots are removed.
+			if _, err := r.NewestSnapshotAge(ctx); err != nil && !errors.Is(err, ErrNoSnapshots) {
+				r.Logger.Printf("snapshot age error: %s", err)
+			}
+		}
+	}
+}
+
+// retentionCheckInterval returns the time between retention checks, which is
+// never longer than the retention period, & a channel that is closed when the
+// replica is next reconfigured. Retention enforcement is disabled if the
+// retention period is non-positive.
+func (r *Replica) retentionCheckInterval() (d time.Duration, enabled bool, cfgCh <-chan struct{}) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	d = r.RetentionCheckInterval
+	if d > r.Retention {
+		d = r.Retention
+	}
+	return d, r.Retention > 0, r.cfgCh
+}
+
+// stopTimer stops timer & drains its channel so it can be safely reset.
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
 		}
 	}
 }
 
 // snapshotter runs in a separate goroutine and handles snapshotting.
 func (r *Replica) snapshotter(ctx context.Context) {
-	if r.SnapshotInterval <= 0 {
-		return
-	}
+	r.mu.RLock()
+	interval, cfgCh := r.SnapshotInterval, r.cfgCh
+	r.mu.RUnlock()
 
-	ticker := time.NewTicker(r.SnapshotInterval)
-	defer ticker.Stop()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	stopTimer(timer)
+	if interval > 0 {
+		timer.Reset(r.jitterDelay(interval) + r.jitterDuration(r.snapshotDelay(ctx, interval)))
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-cfgCh:
+			// Restart the schedule using the new interval.
+			r.mu.RLock()
+			interval, cfgCh = r.SnapshotInterval, r.cfgCh
+			r.mu.RUnlock()
+
+			stopTimer(timer)
+			if interval > 0 {
+				timer.Reset(r.jitterDuration(r.snapshotDelay(ctx, interval)))
+			}
+		case <-timer.C:
+			timer.Reset(r.jitterDuration(interval))
 			if _, err := r.Snapshot(ctx); err != nil && err != ErrNoGeneration {
 				r.Logger.Printf("snapshotter error: %s", err)
 				continue
@@ -727,6 +3837,52 @@ func (r *Replica) snapshotter(ctx context.Context) {
 	}
 }
 
+// snapshotDelay returns the time until the newest existing snapshot is due to
+// be replaced, given the snapshot interval.
+func (r *Replica) snapshotDelay(ctx context.Context, interval time.Duration) time.Duration {
+	delay := interval
+	if info, err := r.LatestSnapshot(ctx); err == nil {
+		if delay -= time.Since(info.CreatedAt); delay < 0 {
+			delay = 0
+		}
+	}
+	return delay
+}
+
+// snapshotDue returns true if SnapshotInterval is set & the newest snapshot in
+// snapshots is older than the interval.
+func (r *Replica) snapshotDue(snapshots []SnapshotInfo) bool {
+	if r.SnapshotInterval <= 0 || len(snapshots) == 0 {
+		return false
+	}
+
+	var newest time.Time
+	for _, info := range snapshots {
+		if info.CreatedAt.After(newest) {
+			newest = info.CreatedAt
+		}
+	}
+	return time.Since(newest) >= r.SnapshotInterval
+}
+
+// now returns the current time from Now, if set, or from the system clock.
+func (r *Replica) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
+
+// jitterDuration returns d randomly adjusted by the replica's jitter fraction.
+func (r *Replica) jitterDuration(d time.Duration) time.Duration {
+	return internal.JitterDuration(d, r.Jitter, rand.Float64())
+}
+
+// jitterDelay returns a random initial delay based on the replica's jitter fraction.
+func (r *Replica) jitterDelay(d time.Duration) time.Duration {
+	return internal.JitterDelay(d, r.Jitter, rand.Float64())
+}
+
 // GenerationCreatedAt returns the earliest creation time of any snapshot.
 // Returns zero time if no snapshots exist.
 func (r *Replica) GenerationCreatedAt(ctx context.Context, generation string) (time.Time, error) {
@@ -748,7 +3904,11 @@ func (r *Replica) GenerationCreatedAt(ctx context.Context, generation string) (t
 
 // SnapshotIndexAt returns the highest index for a snapshot within a generation
 // that occurs before timestamp. If timestamp is zero, returns the latest snapshot.
+// If EmbedTimestamps is enabled, embedded creation times are used in place of
+// CreatedAt, when present, which requires reading each snapshot.
 func (r *Replica) SnapshotIndexAt(ctx context.Context, generation string, timestamp time.Time) (int, error) {
+	timestamp = timestamp.UTC()
+
 	itr, err := r.client.Snapshots(ctx, generation)
 	if err != nil {
 		return 0, err
@@ -759,13 +3919,21 @@ func (r *Replica) SnapshotIndexAt(ctx context.Context, generation string, timest
 	var max time.Time
 	for itr.Next() {
 		snapshot := itr.Snapshot()
-		if !timestamp.IsZero() && snapshot.CreatedAt.After(timestamp) {
+
+		createdAt := snapshot.CreatedAt
+		if r.EmbedTimestamps {
+			if createdAt, err = snapshotCreatedAt(ctx, r.client, snapshot); err != nil {
+				return 0, err
+			}
+		}
+
+		if !timestamp.IsZero() && createdAt.After(timestamp) {
 			continue // after timestamp, skip
 		}
 
 		// Use snapshot if it newer.
-		if max.IsZero() || snapshot.CreatedAt.After(max) {
-			snapshotIndex, max = snapshot.Index, snapshot.CreatedAt
+		if max.IsZero() || createdAt.After(max) {
+			snapshotIndex, max = snapshot.Index, createdAt
 		}
 	}
 	if err := itr.Close(); err != nil {
@@ -800,6 +3968,48 @@ var (
 		Help:      "The current number of snapshots",
 	}, []string{"db", "name"})
 
+	replicaSnapshotSecondsGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "snapshot_seconds",
+		Help:      "The time taken to write the last snapshot",
+	}, []string{"db", "name"})
+
+	replicaSnapshotBytesGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "snapshot_bytes",
+		Help:      "The compressed size of the last snapshot",
+	}, []string{"db", "name"})
+
+	replicaSnapshotAgeGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "snapshot_age_seconds",
+		Help:      "The time since the newest snapshot was created, as of the last retention check",
+	}, []string{"db", "name"})
+
+	replicaGenerationSnapshotAgeGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "generation_snapshot_age_seconds",
+		Help:      "The time since the newest snapshot in a generation was created, as of the last retention check",
+	}, []string{"db", "name", "generation"})
+
+	replicaSnapshotTimestampGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "snapshot_timestamp_seconds",
+		Help:      "The Unix time the newest snapshot was created",
+	}, []string{"db", "name"})
+
+	replicaGenerationSnapshotTimestampGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "generation_snapshot_timestamp_seconds",
+		Help:      "The Unix time the newest snapshot in a generation was created",
+	}, []string{"db", "name", "generation"})
+
 	replicaWALBytesCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "litestream",
 		Subsystem: "replica",
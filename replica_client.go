@@ -1,15 +1,28 @@
 package litestream
 
 import (
+	"archive/tar"
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/benbjohnson/litestream/internal"
-	"github.com/pierrec/lz4/v4"
+	"github.com/mattn/go-sqlite3"
 )
 
 // DefaultRestoreParallelism is the default parallelism when downloading WAL files.
@@ -20,6 +33,9 @@ type ReplicaClient interface {
 	// Returns the type of client.
 	Type() string
 
+	// Returns a human-readable description of the destination location.
+	Location() string
+
 	// Returns a list of available generations.
 	Generations(ctx context.Context) ([]string, error)
 
@@ -57,6 +73,335 @@ type ReplicaClient interface {
 	WALSegmentReader(ctx context.Context, pos Pos) (io.ReadCloser, error)
 }
 
+// ImmutableGenerationClient represents a client which can protect individual
+// generations from deletion by retention enforcement. The flag persists on
+// the replica so it survives restarts.
+type ImmutableGenerationClient interface {
+	// Marks or unmarks a generation as immutable.
+	SetGenerationImmutable(ctx context.Context, generation string, immutable bool) error
+
+	// Returns true if the generation has been marked as immutable.
+	IsGenerationImmutable(ctx context.Context, generation string) (bool, error)
+}
+
+// FlushClient represents a client which defers durability work, such as
+// fsyncs, until Flush() is called at the end of each replica sync.
+type FlushClient interface {
+	Flush(ctx context.Context) error
+}
+
+// flushClient calls Flush() on client if it implements FlushClient.
+func flushClient(ctx context.Context, client ReplicaClient) error {
+	if c, ok := client.(FlushClient); ok {
+		return c.Flush(ctx)
+	}
+	return nil
+}
+
+// FreeSpaceClient represents a client which can report the space available
+// at its destination before a snapshot is written.
+type FreeSpaceClient interface {
+	// Returns the number of bytes available for writing. Returns -1 if the
+	// free space cannot be determined.
+	FreeSpace(ctx context.Context) (int64, error)
+}
+
+// freeSpace returns the space available to client. Returns -1 if the client
+// does not implement FreeSpaceClient.
+func freeSpace(ctx context.Context, client ReplicaClient) (int64, error) {
+	if c, ok := client.(FreeSpaceClient); ok {
+		return c.FreeSpace(ctx)
+	}
+	return -1, nil
+}
+
+// GenerationFormatClient represents a client which lists generations using a
+// configurable generation name format.
+type GenerationFormatClient interface {
+	IsValidGenerationName(name string) bool
+}
+
+// isValidClientGenerationName returns true if name is a valid generation name
+// for client. Uses DefaultGenerationFormat if the client does not implement
+// GenerationFormatClient.
+func isValidClientGenerationName(client ReplicaClient, name string) bool {
+	if c, ok := client.(GenerationFormatClient); ok {
+		return c.IsValidGenerationName(name)
+	}
+	return IsValidGenerationName(nil, name)
+}
+
+// AttachedClient represents a client which can store images of databases
+// attached to the replicated database. Each image is stored within the
+// generation next to the snapshot it was captured with & is keyed by the
+// position of the main database at the time of capture.
+type AttachedClient interface {
+	// Writes an image of the named attached database captured at pos.
+	// Replaces any existing image for the same index.
+	WriteAttachedSnapshot(ctx context.Context, name string, pos Pos, rd io.Reader) (SnapshotInfo, error)
+
+	// Returns the position of the image of the named attached database which
+	// was captured with the snapshot at index. Returns os.ErrNotExist if none.
+	AttachedSnapshotPos(ctx context.Context, generation, name string, index int) (Pos, error)
+
+	// Returns a reader for the image of the named attached database at pos.
+	AttachedSnapshotReader(ctx context.Context, name string, pos Pos) (io.ReadCloser, error)
+
+	// Returns the names of attached databases with images in a generation.
+	AttachedNames(ctx context.Context, generation string) ([]string, error)
+}
+
+// InfoClient represents a client which can look up the metadata of a single
+// snapshot or WAL segment without listing the generation.
+type InfoClient interface {
+	// Returns metadata for the snapshot at index. Returns os.ErrNotExist if
+	// the snapshot does not exist.
+	SnapshotInfoAt(ctx context.Context, generation string, index int) (*SnapshotInfo, error)
+
+	// Returns metadata for the WAL segment at pos. Returns os.ErrNotExist if
+	// the WAL segment does not exist.
+	WALInfoAt(ctx context.Context, pos Pos) (*WALSegmentInfo, error)
+}
+
+// SnapshotInfoAt returns metadata for the snapshot at index in a generation.
+// Clients which implement InfoClient are queried directly; otherwise the
+// generation's snapshots are listed. Returns os.ErrNotExist if not found.
+func SnapshotInfoAt(ctx context.Context, client ReplicaClient, generation string, index int) (*SnapshotInfo, error) {
+	if c, ok := client.(InfoClient); ok {
+		return c.SnapshotInfoAt(ctx, generation, index)
+	}
+
+	itr, err := client.Snapshots(ctx, generation)
+	if err != nil {
+		return nil, fmt.Errorf("snapshots: %w", err)
+	}
+	defer func() { _ = itr.Close() }()
+
+	for itr.Next() {
+		if info := itr.Snapshot(); info.Index == index {
+			return &info, itr.Close()
+		}
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("snapshot iteration: %w", err)
+	}
+	return nil, os.ErrNotExist
+}
+
+// WALInfoAt returns metadata for the WAL segment at pos. Clients which
+// implement InfoClient are queried directly; otherwise the generation's WAL
+// segments are listed. Returns os.ErrNotExist if not found.
+func WALInfoAt(ctx context.Context, client ReplicaClient, pos Pos) (*WALSegmentInfo, error) {
+	if c, ok := client.(InfoClient); ok {
+		return c.WALInfoAt(ctx, pos)
+	}
+
+	itr, err := client.WALSegments(ctx, pos.Generation)
+	if err != nil {
+		return nil, fmt.Errorf("wal segments: %w", err)
+	}
+	defer func() { _ = itr.Close() }()
+
+	for itr.Next() {
+		if info := itr.WALSegment(); info.Pos() == pos {
+			return &info, itr.Close()
+		}
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("wal segment iteration: %w", err)
+	}
+	return nil, os.ErrNotExist
+}
+
+// WALIndexClient represents a client which can read all WAL segments within an
+// index in a single pass, such as a client storing each index as one archive.
+type WALIndexClient interface {
+	// Calls fn in offset order with a reader for each WAL segment at offsets
+	// within index. Returns os.ErrNotExist if a segment does not exist.
+	ReadWALIndex(ctx context.Context, generation string, index int, offsets []int64, fn func(offset int64, rd io.Reader) error) error
+}
+
+// readWALIndex calls fn in offset order with a reader for each WAL segment at
+// offsets within index. Clients which implement WALIndexClient read the index
+// in a single pass; otherwise each segment is read separately.
+func readWALIndex(ctx context.Context, client ReplicaClient, generation string, index int, offsets []int64, fn func(offset int64, rd io.Reader) error) error {
+	if c, ok := client.(WALIndexClient); ok {
+		return c.ReadWALIndex(ctx, generation, index, offsets, fn)
+	}
+	return readWALSegments(ctx, client, generation, index, offsets, fn)
+}
+
+// readWALSegments calls fn with a reader for each WAL segment at offsets
+// within index, opening each segment separately.
+func readWALSegments(ctx context.Context, client ReplicaClient, generation string, index int, offsets []int64, fn func(offset int64, rd io.Reader) error) error {
+	for _, offset := range offsets {
+		if err := func() error {
+			rd, err := client.WALSegmentReader(ctx, Pos{Generation: generation, Index: index, Offset: offset})
+			if err != nil {
+				return err
+			}
+			defer rd.Close()
+
+			return fn(offset, rd)
+		}(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isGenerationImmutable returns true if client supports immutable generations
+// & the generation has been marked as immutable.
+func isGenerationImmutable(ctx context.Context, client ReplicaClient, generation string) (bool, error) {
+	c, ok := client.(ImmutableGenerationClient)
+	if !ok {
+		return false, nil
+	}
+	return c.IsGenerationImmutable(ctx, generation)
+}
+
+var _ ReplicaClient = (*ReadOnlyReplicaClient)(nil)
+var _ ImmutableGenerationClient = (*ReadOnlyReplicaClient)(nil)
+var _ AttachedClient = (*ReadOnlyReplicaClient)(nil)
+var _ InfoClient = (*ReadOnlyReplicaClient)(nil)
+var _ WALIndexClient = (*ReadOnlyReplicaClient)(nil)
+
+// ReadOnlyReplicaClient wraps a client so that all read methods pass through
+// while all methods that write or delete data return ErrReadOnly. A replica
+// using this client can be used for restores but cannot snapshot, sync, or
+// enforce retention. Replica.Start is a no-op for such a replica.
+type ReadOnlyReplicaClient struct {
+	client ReplicaClient
+}
+
+// NewReadOnlyReplicaClient returns a read-only wrapper for client.
+func NewReadOnlyReplicaClient(client ReplicaClient) *ReadOnlyReplicaClient {
+	return &ReadOnlyReplicaClient{client: client}
+}
+
+// Type returns the type of the underlying client.
+func (c *ReadOnlyReplicaClient) Type() string { return c.client.Type() }
+
+// Location returns the location of the underlying client.
+func (c *ReadOnlyReplicaClient) Location() string { return c.client.Location() }
+
+// Generations returns a list of available generations from the underlying client.
+func (c *ReadOnlyReplicaClient) Generations(ctx context.Context) ([]string, error) {
+	return c.client.Generations(ctx)
+}
+
+// DeleteGeneration always returns ErrReadOnly.
+func (c *ReadOnlyReplicaClient) DeleteGeneration(ctx context.Context, generation string) error {
+	return ErrReadOnly
+}
+
+// Snapshots returns an iterator of snapshots from the underlying client.
+func (c *ReadOnlyReplicaClient) Snapshots(ctx context.Context, generation string) (SnapshotIterator, error) {
+	return c.client.Snapshots(ctx, generation)
+}
+
+// WriteSnapshot always returns ErrReadOnly.
+func (c *ReadOnlyReplicaClient) WriteSnapshot(ctx context.Context, generation string, index int, r io.Reader) (SnapshotInfo, error) {
+	return SnapshotInfo{}, ErrReadOnly
+}
+
+// DeleteSnapshot always returns ErrReadOnly.
+func (c *ReadOnlyReplicaClient) DeleteSnapshot(ctx context.Context, generation string, index int) error {
+	return ErrReadOnly
+}
+
+// SnapshotReader returns a snapshot reader from the underlying client.
+func (c *ReadOnlyReplicaClient) SnapshotReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	return c.client.SnapshotReader(ctx, generation, index)
+}
+
+// WALSegments returns an iterator of WAL segments from the underlying client.
+func (c *ReadOnlyReplicaClient) WALSegments(ctx context.Context, generation string) (WALSegmentIterator, error) {
+	return c.client.WALSegments(ctx, generation)
+}
+
+// WriteWALSegment always returns ErrReadOnly.
+func (c *ReadOnlyReplicaClient) WriteWALSegment(ctx context.Context, pos Pos, r io.Reader) (WALSegmentInfo, error) {
+	return WALSegmentInfo{}, ErrReadOnly
+}
+
+// DeleteWALSegments always returns ErrReadOnly.
+func (c *ReadOnlyReplicaClient) DeleteWALSegments(ctx context.Context, a []Pos) error {
+	return ErrReadOnly
+}
+
+// WALSegmentReader returns a WAL segment reader from the underlying client.
+func (c *ReadOnlyReplicaClient) WALSegmentReader(ctx context.Context, pos Pos) (io.ReadCloser, error) {
+	return c.client.WALSegmentReader(ctx, pos)
+}
+
+// IsValidGenerationName returns true if name is a valid generation name for
+// the underlying client.
+func (c *ReadOnlyReplicaClient) IsValidGenerationName(name string) bool {
+	return isValidClientGenerationName(c.client, name)
+}
+
+// SetGenerationImmutable always returns ErrReadOnly.
+func (c *ReadOnlyReplicaClient) SetGenerationImmutable(ctx context.Context, generation string, immutable bool) error {
+	return ErrReadOnly
+}
+
+// IsGenerationImmutable returns true if the generation has been marked as
+// immutable on the underlying client.
+func (c *ReadOnlyReplicaClient) IsGenerationImmutable(ctx context.Context, generation string) (bool, error) {
+	return isGenerationImmutable(ctx, c.client, generation)
+}
+
+// WriteAttachedSnapshot always returns ErrReadOnly.
+func (c *ReadOnlyReplicaClient) WriteAttachedSnapshot(ctx context.Context, name string, pos Pos, rd io.Reader) (SnapshotInfo, error) {
+	return SnapshotInfo{}, ErrReadOnly
+}
+
+// AttachedSnapshotPos returns the position of an attached database image from
+// the underlying client.
+func (c *ReadOnlyReplicaClient) AttachedSnapshotPos(ctx context.Context, generation, name string, index int) (Pos, error) {
+	client, ok := c.client.(AttachedClient)
+	if !ok {
+		return Pos{}, fmt.Errorf("replica client does not support attached databases: %s", c.client.Type())
+	}
+	return client.AttachedSnapshotPos(ctx, generation, name, index)
+}
+
+// AttachedSnapshotReader returns a reader for an attached database image from
+// the underlying client.
+func (c *ReadOnlyReplicaClient) AttachedSnapshotReader(ctx context.Context, name string, pos Pos) (io.ReadCloser, error) {
+	client, ok := c.client.(AttachedClient)
+	if !ok {
+		return nil, fmt.Errorf("replica client does not support attached databases: %s", c.client.Type())
+	}
+	return client.AttachedSnapshotReader(ctx, name, pos)
+}
+
+// AttachedNames returns the names of attached databases with images in a
+// generation from the underlying client.
+func (c *ReadOnlyReplicaClient) AttachedNames(ctx context.Context, generation string) ([]string, error) {
+	client, ok := c.client.(AttachedClient)
+	if !ok {
+		return nil, fmt.Errorf("replica client does not support attached databases: %s", c.client.Type())
+	}
+	return client.AttachedNames(ctx, generation)
+}
+
+// SnapshotInfoAt returns metadata for a snapshot from the underlying client.
+func (c *ReadOnlyReplicaClient) SnapshotInfoAt(ctx context.Context, generation string, index int) (*SnapshotInfo, error) {
+	return SnapshotInfoAt(ctx, c.client, generation, index)
+}
+
+// WALInfoAt returns metadata for a WAL segment from the underlying client.
+func (c *ReadOnlyReplicaClient) WALInfoAt(ctx context.Context, pos Pos) (*WALSegmentInfo, error) {
+	return WALInfoAt(ctx, c.client, pos)
+}
+
+// ReadWALIndex reads the WAL segments within an index from the underlying client.
+func (c *ReadOnlyReplicaClient) ReadWALIndex(ctx context.Context, generation string, index int, offsets []int64, fn func(offset int64, rd io.Reader) error) error {
+	return readWALIndex(ctx, c.client, generation, index, offsets, fn)
+}
+
 // FindSnapshotForIndex returns the highest index for a snapshot within a
 // generation that occurs before a given index.
 func FindSnapshotForIndex(ctx context.Context, client ReplicaClient, generation string, index int) (int, error) {
@@ -144,8 +489,10 @@ func SnapshotTimeBounds(ctx context.Context, client ReplicaClient, generation st
 	return min, max, nil
 }
 
-// WALTimeBounds returns the minimum and maximum snapshot timestamps.
-// Returns ErrNoWALSegments if no data exists for the generation.
+// WALTimeBounds returns the minimum and maximum WAL segment timestamps within
+// a generation. Snapshot times are excluded so the bounds represent the
+// point-in-time restore window for the generation. Returns zero times &
+// ErrNoWALSegments if the generation has no WAL segments.
 func WALTimeBounds(ctx context.Context, client ReplicaClient, generation string) (min, max time.Time, err error) {
 	itr, err := client.WALSegments(ctx, generation)
 	if err != nil {
@@ -174,7 +521,9 @@ func WALTimeBounds(ctx context.Context, client ReplicaClient, generation string)
 	return min, max, nil
 }
 
-// FindLatestGeneration returns the most recent generation for a client.
+// FindLatestGeneration returns the most recent generation for a client. If
+// multiple generations were last updated at the same time then the one with
+// the latest WAL segment is used.
 func FindLatestGeneration(ctx context.Context, client ReplicaClient) (generation string, err error) {
 	generations, err := client.Generations(ctx)
 	if err != nil {
@@ -194,6 +543,21 @@ func FindLatestGeneration(ctx context.Context, client ReplicaClient) (generation
 		if updatedAt.After(maxTime) {
 			maxTime = updatedAt
 			generation = generations[i]
+			continue
+		} else if !updatedAt.Equal(maxTime) || generation == "" {
+			continue
+		}
+
+		// Break ties by using the generation with the strictly latest WAL.
+		_, walTime, err := WALTimeBounds(ctx, client, generation)
+		if err != nil && err != ErrNoWALSegments {
+			return "", fmt.Errorf("wal time bounds: %w", err)
+		}
+		_, otherWALTime, err := WALTimeBounds(ctx, client, generations[i])
+		if err != nil && err != ErrNoWALSegments {
+			return "", fmt.Errorf("wal time bounds: %w", err)
+		} else if otherWALTime.After(walTime) {
+			generation = generations[i]
 		}
 	}
 
@@ -238,7 +602,21 @@ func ReplicaClientTimeBounds(ctx context.Context, client ReplicaClient) (min, ma
 // within a generation. Returns ErrNoSnapshots if no index exists on the replica
 // for the generation.
 func FindIndexByTimestamp(ctx context.Context, client ReplicaClient, generation string, timestamp time.Time) (index int, err error) {
-	snapshotIndex, err := FindSnapshotIndexByTimestamp(ctx, client, generation, timestamp)
+	return findIndexByTimestamp(ctx, client, generation, timestamp, false)
+}
+
+// FindIndexByEmbeddedTimestamp is like FindIndexByTimestamp except that the
+// creation time embedded in each snapshot & WAL segment by a replica with
+// EmbedTimestamps enabled is used in place of CreatedAt, when present. Every
+// file in the generation is opened so this requires one read per file.
+func FindIndexByEmbeddedTimestamp(ctx context.Context, client ReplicaClient, generation string, timestamp time.Time) (index int, err error) {
+	return findIndexByTimestamp(ctx, client, generation, timestamp, true)
+}
+
+func findIndexByTimestamp(ctx context.Context, client ReplicaClient, generation string, timestamp time.Time, embedded bool) (index int, err error) {
+	timestamp = timestamp.UTC()
+
+	snapshotIndex, err := findSnapshotIndexByTimestamp(ctx, client, generation, timestamp, embedded)
 	if err == ErrNoSnapshots {
 		return 0, err
 	} else if err != nil {
@@ -246,7 +624,7 @@ func FindIndexByTimestamp(ctx context.Context, client ReplicaClient, generation
 	}
 
 	// Determine the highest available WAL index.
-	walIndex, err := FindWALIndexByTimestamp(ctx, client, generation, timestamp)
+	walIndex, err := findWALIndexByTimestamp(ctx, client, generation, timestamp, embedded)
 	if err != nil && err != ErrNoWALSegments {
 		return 0, fmt.Errorf("max wal index: %w", err)
 	}
@@ -261,6 +639,13 @@ func FindIndexByTimestamp(ctx context.Context, client ReplicaClient, generation
 // FindSnapshotIndexByTimestamp returns the highest snapshot index before timestamp.
 // Returns ErrNoSnapshots if no snapshots exist for the generation on the replica.
 func FindSnapshotIndexByTimestamp(ctx context.Context, client ReplicaClient, generation string, timestamp time.Time) (index int, err error) {
+	return findSnapshotIndexByTimestamp(ctx, client, generation, timestamp, false)
+}
+
+// findSnapshotIndexByTimestamp returns the highest snapshot index before
+// timestamp. If embedded is true, embedded creation times are used in place of
+// CreatedAt, when present.
+func findSnapshotIndexByTimestamp(ctx context.Context, client ReplicaClient, generation string, timestamp time.Time, embedded bool) (index int, err error) {
 	itr, err := client.Snapshots(ctx, generation)
 	if err != nil {
 		return 0, fmt.Errorf("snapshots: %w", err)
@@ -270,7 +655,16 @@ func FindSnapshotIndexByTimestamp(ctx context.Context, client ReplicaClient, gen
 	// Iterate over snapshots to find the highest index.
 	var n int
 	for ; itr.Next(); n++ {
-		if info := itr.Snapshot(); info.CreatedAt.After(timestamp) {
+		info := itr.Snapshot()
+
+		createdAt := info.CreatedAt
+		if embedded {
+			if createdAt, err = snapshotCreatedAt(ctx, client, info); err != nil {
+				return 0, err
+			}
+		}
+
+		if createdAt.After(timestamp) {
 			continue
 		} else if info.Index > index {
 			index = info.Index
@@ -290,6 +684,13 @@ func FindSnapshotIndexByTimestamp(ctx context.Context, client ReplicaClient, gen
 // FindWALIndexByTimestamp returns the highest WAL index before timestamp.
 // Returns ErrNoWALSegments if no segments exist for the generation on the replica.
 func FindWALIndexByTimestamp(ctx context.Context, client ReplicaClient, generation string, timestamp time.Time) (index int, err error) {
+	return findWALIndexByTimestamp(ctx, client, generation, timestamp, false)
+}
+
+// findWALIndexByTimestamp returns the highest WAL index before timestamp. If
+// embedded is true, embedded creation times are used in place of CreatedAt,
+// when present.
+func findWALIndexByTimestamp(ctx context.Context, client ReplicaClient, generation string, timestamp time.Time, embedded bool) (index int, err error) {
 	itr, err := client.WALSegments(ctx, generation)
 	if err != nil {
 		return 0, fmt.Errorf("wal segments: %w", err)
@@ -299,7 +700,16 @@ func FindWALIndexByTimestamp(ctx context.Context, client ReplicaClient, generati
 	// Iterate over WAL segments to find the highest index.
 	var n int
 	for ; itr.Next(); n++ {
-		if info := itr.WALSegment(); info.CreatedAt.After(timestamp) {
+		info := itr.WALSegment()
+
+		createdAt := info.CreatedAt
+		if embedded {
+			if createdAt, err = walSegmentCreatedAt(ctx, client, info); err != nil {
+				return 0, err
+			}
+		}
+
+		if createdAt.After(timestamp) {
 			continue
 		} else if info.Index > index {
 			index = info.Index
@@ -316,6 +726,40 @@ func FindWALIndexByTimestamp(ctx context.Context, client ReplicaClient, generati
 	return index, nil
 }
 
+// snapshotCreatedAt returns the creation time embedded in the snapshot, if
+// available. Otherwise returns the CreatedAt reported by the client.
+func snapshotCreatedAt(ctx context.Context, client ReplicaClient, info SnapshotInfo) (time.Time, error) {
+	rc, err := client.SnapshotReader(ctx, info.Generation, info.Index)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("snapshot reader: %w", err)
+	}
+	defer rc.Close()
+
+	if t, ok, err := readTimestampFrame(rc); err != nil {
+		return time.Time{}, fmt.Errorf("read snapshot timestamp: %w", err)
+	} else if ok {
+		return t, nil
+	}
+	return info.CreatedAt, nil
+}
+
+// walSegmentCreatedAt returns the creation time embedded in the WAL segment,
+// if available. Otherwise returns the CreatedAt reported by the client.
+func walSegmentCreatedAt(ctx context.Context, client ReplicaClient, info WALSegmentInfo) (time.Time, error) {
+	rc, err := client.WALSegmentReader(ctx, info.Pos())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("wal segment reader: %w", err)
+	}
+	defer rc.Close()
+
+	if t, ok, err := readTimestampFrame(rc); err != nil {
+		return time.Time{}, fmt.Errorf("read wal segment timestamp: %w", err)
+	} else if ok {
+		return t, nil
+	}
+	return info.CreatedAt, nil
+}
+
 // FindMaxIndexByGeneration returns the last index within a generation.
 // Returns ErrNoSnapshots if no index exists on the replica for the generation.
 func FindMaxIndexByGeneration(ctx context.Context, client ReplicaClient, generation string) (index int, err error) {
@@ -395,125 +839,1721 @@ func FindMaxWALIndexByGeneration(ctx context.Context, client ReplicaClient, gene
 	return index, nil
 }
 
-// Restore restores the database to the given index on a generation.
-func Restore(ctx context.Context, client ReplicaClient, filename, generation string, snapshotIndex, targetIndex int, opt RestoreOptions) (err error) {
-	// Validate options.
-	if filename == "" {
-		return fmt.Errorf("restore path required")
-	} else if generation == "" {
-		return fmt.Errorf("generation required")
-	} else if snapshotIndex < 0 {
-		return fmt.Errorf("snapshot index required")
-	} else if targetIndex < 0 {
-		return fmt.Errorf("target index required")
+// IsRestorable returns true if the client still holds the data required to
+// restore to pos. This requires a snapshot at or before pos.Index and every
+// WAL segment from that snapshot up to pos. Each segment is read to ensure the
+// segments within an index are contiguous. Returns false if the generation no
+// longer exists.
+func IsRestorable(ctx context.Context, client ReplicaClient, pos Pos) (bool, error) {
+	generations, err := client.Generations(ctx)
+	if err != nil {
+		return false, fmt.Errorf("generations: %w", err)
+	} else if !containsString(generations, pos.Generation) {
+		return false, nil
 	}
 
-	// Require a default level of parallelism.
-	if opt.Parallelism < 1 {
-		opt.Parallelism = DefaultRestoreParallelism
+	// Find the most recent snapshot at or before the position.
+	snapshotIndex := -1
+	sitr, err := client.Snapshots(ctx, pos.Generation)
+	if err != nil {
+		return false, fmt.Errorf("snapshots: %w", err)
 	}
+	defer func() { _ = sitr.Close() }()
 
-	// Ensure logger exists.
-	logger := opt.Logger
-	if logger == nil {
-		logger = log.New(io.Discard, "", 0)
+	for sitr.Next() {
+		if info := sitr.Snapshot(); info.Index <= pos.Index && info.Index > snapshotIndex {
+			snapshotIndex = info.Index
+		}
 	}
-
-	// Ensure output path does not already exist.
-	// If doesn't exist, also remove the journal, shm, & wal if left behind.
-	if _, err := os.Stat(filename); err == nil {
-		return fmt.Errorf("cannot restore, output path already exists: %s", filename)
-	} else if err != nil && !os.IsNotExist(err) {
-		return err
-	} else if err := removeDBFiles(filename); err != nil {
-		return err
+	if err := sitr.Close(); err != nil {
+		return false, fmt.Errorf("snapshot iteration: %w", err)
+	} else if snapshotIndex == -1 {
+		return false, nil
+	} else if snapshotIndex == pos.Index && pos.Offset == 0 {
+		return true, nil // snapshot only
 	}
 
-	// Copy snapshot to output path.
-	tmpPath := filename + ".tmp"
-	logger.Printf("%srestoring snapshot %s/%s to %s", opt.LogPrefix, generation, FormatIndex(snapshotIndex), tmpPath)
-	if err := RestoreSnapshot(ctx, client, tmpPath, generation, snapshotIndex, opt.Mode, opt.Uid, opt.Gid); err != nil {
-		return fmt.Errorf("cannot restore snapshot: %w", err)
+	// Ensure every WAL index is available from the snapshot to the position.
+	// Track the last segment before the position's offset in its own index.
+	witr, err := client.WALSegments(ctx, pos.Generation)
+	if err != nil {
+		return false, fmt.Errorf("wal segments: %w", err)
 	}
+	defer func() { _ = witr.Close() }()
 
-	// Download & apply all WAL files between the snapshot & the target index.
-	d := NewWALDownloader(client, tmpPath, generation, snapshotIndex, targetIndex)
-	d.Parallelism = opt.Parallelism
-	d.Mode = opt.Mode
-	d.Uid, d.Gid = opt.Uid, opt.Gid
-
-	for {
-		// Read next WAL file from downloader.
-		walIndex, walPath, err := d.Next(ctx)
-		if err == io.EOF {
+	var segments []WALSegmentInfo
+	var last *WALSegmentInfo
+	for witr.Next() {
+		info := witr.WALSegment()
+		if info.Index < snapshotIndex {
+			continue
+		} else if info.Index > pos.Index || (info.Index == pos.Index && info.Offset >= pos.Offset) {
 			break
 		}
+		segments = append(segments, info)
 
-		// If we are only reading a single index, a WAL file may not be found.
-		if _, ok := err.(*WALNotFoundError); ok && snapshotIndex == targetIndex {
-			logger.Printf("%sno wal files found, snapshot only", opt.LogPrefix)
-			break
-		} else if err != nil {
-			return fmt.Errorf("cannot download WAL: %w", err)
+		if info.Index == pos.Index {
+			last = &info
+		}
+	}
+	if err := witr.Close(); err != nil {
+		return false, fmt.Errorf("wal segment iteration: %w", err)
+	} else if len(walIndexGaps(segments, snapshotIndex)) > 0 {
+		return false, nil // missing index
+	}
+
+	// Determine the next index after the available WAL segments.
+	index := snapshotIndex
+	if len(segments) > 0 {
+		index = segments[len(segments)-1].Index + 1
+	}
+
+	// Indexes before the position must be present. If the position is at the
+	// start of an index then no segments are required from it.
+	if pos.Offset == 0 && index != pos.Index {
+		return false, nil
+	} else if pos.Offset != 0 && (index != pos.Index+1 || last == nil) {
+		return false, nil
+	}
+
+	// Offsets are positions within the uncompressed WAL so each segment must
+	// be read to ensure it ends where the next segment in its index begins.
+	var end int64
+	for i, info := range segments {
+		if i > 0 && info.Index == segments[i-1].Index && info.Offset != end {
+			return false, nil // missing segment
 		}
 
-		// Apply WAL file.
-		startTime := time.Now()
-		if err = ApplyWAL(ctx, tmpPath, walPath); err != nil {
-			return fmt.Errorf("cannot apply wal: %w", err)
+		n, err := walSegmentSize(ctx, client, info.Pos())
+		if err != nil {
+			return false, fmt.Errorf("read wal segment: %w", err)
 		}
-		logger.Printf("%sapplied wal %s/%s elapsed=%s", opt.LogPrefix, generation, FormatIndex(walIndex), time.Since(startTime).String())
+		end = info.Offset + n
 	}
 
-	// Copy file to final location.
-	logger.Printf("%srenaming database from temporary location", opt.LogPrefix)
-	if err := os.Rename(tmpPath, filename); err != nil {
-		return err
+	// Ensure the last segment extends to the position's offset.
+	return pos.Offset == 0 || end >= pos.Offset, nil
+}
+
+// walIndexGaps returns the indexes from index through the last index in
+// segments that do not begin with a segment at offset zero. Segments must be
+// sorted by position. Gaps between segments within an index are not detected
+// as that requires reading each segment to determine where it ends.
+func walIndexGaps(segments []WALSegmentInfo, index int) []int {
+	var gaps []int
+	for _, info := range segments {
+		if info.Index < index || info.Offset != 0 {
+			continue
+		}
+		for ; index < info.Index; index++ {
+			gaps = append(gaps, index)
+		}
+		index++
 	}
 
-	return nil
+	// Include the last index if it is missing its initial segment.
+	if n := len(segments); n > 0 && segments[n-1].Index >= index {
+		for ; index <= segments[n-1].Index; index++ {
+			gaps = append(gaps, index)
+		}
+	}
+	return gaps
 }
 
-// RestoreOptions represents options for DB.Restore().
-type RestoreOptions struct {
-	// File info used for restored snapshot & WAL files.
-	Mode     os.FileMode
-	Uid, Gid int
+// GenerationDescription represents the layout of a generation on a replica.
+type GenerationDescription struct {
+	Generation  string
+	Snapshots   []SnapshotDescription
+	WALSegments []WALSegmentDescription
 
-	// Specifies how many WAL files are downloaded in parallel during restore.
-	Parallelism int
+	// WAL indexes missing between the first snapshot & the last WAL segment.
+	Gaps []int
 
-	// Logging settings.
-	Logger    *log.Logger
-	LogPrefix string
+	// Position derived from the latest snapshot & WAL segment.
+	Pos Pos
 }
 
-// NewRestoreOptions returns a new instance of RestoreOptions with defaults.
-func NewRestoreOptions() RestoreOptions {
-	return RestoreOptions{
-		Mode:        0600,
-		Parallelism: DefaultRestoreParallelism,
-	}
+// SnapshotDescription represents a snapshot within a GenerationDescription.
+// The codec is detected from the file contents as every file uses the same
+// extension regardless of the codec it was written with.
+type SnapshotDescription struct {
+	SnapshotInfo
+	Codec      string // CodecLZ4 or CodecNone
+	Compressed bool
 }
 
-// RestoreSnapshot copies a snapshot from the replica client to a file.
-func RestoreSnapshot(ctx context.Context, client ReplicaClient, filename, generation string, index int, mode os.FileMode, uid, gid int) error {
-	f, err := internal.CreateFile(filename, mode, uid, gid)
+// WALSegmentDescription represents a WAL segment within a GenerationDescription.
+type WALSegmentDescription struct {
+	WALSegmentInfo
+	Codec      string // CodecLZ4 or CodecNone
+	Compressed bool
+}
+
+// DescribeGeneration returns a listing of every snapshot & WAL segment in a
+// generation along with any gaps in the WAL & the derived replica position.
+// Each file is opened to determine if it is compressed so this is intended for
+// diagnostics only. Returns ErrNoSnapshots if the generation has no snapshots.
+func DescribeGeneration(ctx context.Context, client ReplicaClient, generation string) (desc GenerationDescription, err error) {
+	desc.Generation = generation
+
+	sitr, err := client.Snapshots(ctx, generation)
 	if err != nil {
-		return err
+		return desc, fmt.Errorf("snapshots: %w", err)
 	}
+	snapshots, err := SliceSnapshotIterator(sitr)
+	if err != nil {
+		return desc, fmt.Errorf("snapshot iteration: %w", err)
+	} else if len(snapshots) == 0 {
+		return desc, ErrNoSnapshots
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Index < snapshots[j].Index })
+
+	for _, info := range snapshots {
+		rd, err := client.SnapshotReader(ctx, generation, info.Index)
+		if err != nil {
+			return desc, fmt.Errorf("snapshot reader: %w", err)
+		}
+		codec, err := detectCodec(rd)
+		if err != nil {
+			return desc, fmt.Errorf("read snapshot: index=%s err=%w", FormatIndex(info.Index), err)
+		}
+		desc.Snapshots = append(desc.Snapshots, SnapshotDescription{SnapshotInfo: info, Codec: codec, Compressed: codec != CodecNone})
+	}
+
+	witr, err := client.WALSegments(ctx, generation)
+	if err != nil {
+		return desc, fmt.Errorf("wal segments: %w", err)
+	}
+	segments, err := SliceWALSegmentIterator(witr)
+	if err != nil {
+		return desc, fmt.Errorf("wal segment iteration: %w", err)
+	}
+
+	for _, info := range segments {
+		rd, err := client.WALSegmentReader(ctx, info.Pos())
+		if err != nil {
+			return desc, fmt.Errorf("wal segment reader: %w", err)
+		}
+		codec, err := detectCodec(rd)
+		if err != nil {
+			return desc, fmt.Errorf("read wal segment: pos=%s err=%w", info.Pos(), err)
+		}
+		desc.WALSegments = append(desc.WALSegments, WALSegmentDescription{WALSegmentInfo: info, Codec: codec, Compressed: codec != CodecNone})
+	}
+	desc.Gaps = walIndexGaps(segments, snapshots[0].Index)
+
+	// Derive position from the end of the last WAL segment after the latest
+	// snapshot. Otherwise use the position of the latest snapshot.
+	desc.Pos = snapshots[len(snapshots)-1].Pos()
+	if n := len(segments); n > 0 && segments[n-1].Index >= desc.Pos.Index {
+		last := segments[n-1]
+		rd, err := client.WALSegmentReader(ctx, last.Pos())
+		if err != nil {
+			return desc, fmt.Errorf("wal segment reader: %w", err)
+		}
+		defer rd.Close()
+
+		sz, err := io.Copy(io.Discard, newDecompressReader(rd))
+		if err != nil {
+			return desc, fmt.Errorf("read wal segment: %w", err)
+		}
+		desc.Pos = Pos{Generation: generation, Index: last.Index, Offset: last.Offset + sz}
+	}
+
+	return desc, nil
+}
+
+// detectCodec returns CodecLZ4 if rc begins with the LZ4 frame magic number.
+// Otherwise returns CodecNone. The reader is closed before returning.
+func detectCodec(rc io.ReadCloser) (string, error) {
+	defer rc.Close()
+
+	magic := make([]byte, len(lz4FrameMagic))
+	if _, err := io.ReadFull(rc, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return CodecNone, rc.Close()
+	} else if err != nil {
+		return "", err
+	} else if isLZ4Magic(magic) {
+		return CodecLZ4, rc.Close()
+	}
+	return CodecNone, rc.Close()
+}
+
+// containsString returns true if a contains s.
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportGeneration writes all snapshots & WAL segments within a generation to
+// w as a tar archive. Entries are stored with their LZ4 compressed contents
+// using the layout "<generation>/snapshots/<index>.snapshot.lz4" and
+// "<generation>/wal/<index>/<offset>.wal.lz4". Entry sizes are taken from
+// the client listing so they must be accurate.
+//
+// If the client implements AttachedClient, the images of attached databases
+// are also stored as "<generation>/attached/<name>/<index>/<offset>.snapshot.lz4".
+func ExportGeneration(ctx context.Context, client ReplicaClient, generation string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	sitr, err := client.Snapshots(ctx, generation)
+	if err != nil {
+		return fmt.Errorf("snapshots: %w", err)
+	}
+	defer func() { _ = sitr.Close() }()
+
+	var snapshots []SnapshotInfo
+	for sitr.Next() {
+		info := sitr.Snapshot()
+		name := path.Join(generation, "snapshots", FormatIndex(info.Index)+SnapshotExt)
+		if err := exportEntry(tw, name, info.Size, info.CreatedAt, func() (io.ReadCloser, error) {
+			return client.SnapshotReader(ctx, generation, info.Index)
+		}); err != nil {
+			return fmt.Errorf("export snapshot: %w", err)
+		}
+		snapshots = append(snapshots, info)
+	}
+	if err := sitr.Close(); err != nil {
+		return fmt.Errorf("snapshot iterator: %w", err)
+	}
+
+	if c, ok := client.(AttachedClient); ok {
+		if err := exportAttached(ctx, tw, c, generation, snapshots); err != nil {
+			return fmt.Errorf("export attached snapshot: %w", err)
+		}
+	}
+
+	witr, err := client.WALSegments(ctx, generation)
+	if err != nil {
+		return fmt.Errorf("wal segments: %w", err)
+	}
+	defer func() { _ = witr.Close() }()
+
+	for witr.Next() {
+		info := witr.WALSegment()
+		name := path.Join(generation, WALDirName, FormatIndex(info.Index), FormatOffset(info.Offset)+WALSegmentExt)
+		if err := exportEntry(tw, name, info.Size, info.CreatedAt, func() (io.ReadCloser, error) {
+			return client.WALSegmentReader(ctx, info.Pos())
+		}); err != nil {
+			return fmt.Errorf("export wal segment: %w", err)
+		}
+	}
+	if err := witr.Close(); err != nil {
+		return fmt.Errorf("wal segment iterator: %w", err)
+	}
+
+	return tw.Close()
+}
+
+// exportAttached writes the image of each attached database captured with
+// each of the snapshots to the tar archive.
+func exportAttached(ctx context.Context, tw *tar.Writer, client AttachedClient, generation string, snapshots []SnapshotInfo) error {
+	names, err := client.AttachedNames(ctx, generation)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		for _, info := range snapshots {
+			pos, err := client.AttachedSnapshotPos(ctx, generation, name, info.Index)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			entryName := path.Join(generation, "attached", name, FormatIndex(pos.Index), FormatOffset(pos.Offset)+SnapshotExt)
+			if err := exportSpooledEntry(tw, entryName, info.CreatedAt, func() (io.ReadCloser, error) {
+				return client.AttachedSnapshotReader(ctx, name, pos)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportSpooledEntry writes a single file entry to the tar archive from the
+// reader returned by fn. The data is copied to a temporary file first as the
+// client does not report its size.
+func exportSpooledEntry(tw *tar.Writer, name string, modTime time.Time, fn func() (io.ReadCloser, error)) error {
+	f, err := ioutil.TempFile("", "litestream-export-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
 	defer f.Close()
 
-	rd, err := client.SnapshotReader(ctx, generation, index)
+	rd, err := fn()
 	if err != nil {
 		return err
 	}
 	defer rd.Close()
 
-	if _, err := io.Copy(f, lz4.NewReader(rd)); err != nil {
+	n, err := io.Copy(f, rd)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	} else if err := rd.Close(); err != nil {
 		return err
-	} else if err := f.Sync(); err != nil {
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return exportEntry(tw, name, n, modTime, func() (io.ReadCloser, error) { return f, nil })
+}
+
+// exportEntry writes a single file entry to the tar archive from the reader
+// returned by fn.
+func exportEntry(tw *tar.Writer, name string, size int64, modTime time.Time, fn func() (io.ReadCloser, error)) error {
+	rd, err := fn()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0600,
+		ModTime:  modTime,
+	}); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(tw, rd); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return rd.Close()
+}
+
+// ImportGeneration reads a tar archive created by ExportGeneration from r and
+// writes its snapshots, WAL segments & attached database images to the client. Returns
+// ErrGenerationExists if the generation already exists on the client unless
+// overwrite is set, in which case the existing generation is deleted first.
+//
+// The archive is staged in a temporary directory & each entry is validated
+// before the client is modified so a truncated or corrupt archive does not
+// destroy an existing generation.
+func ImportGeneration(ctx context.Context, client ReplicaClient, r io.Reader, overwrite bool) error {
+	dir, err := ioutil.TempDir("", "litestream-import-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	generation, entries, err := stageImportArchive(client, r, dir)
+	if err != nil {
+		return err
+	} else if generation == "" {
+		return nil // empty archive
+	}
+
+	// Check for an existing generation on the client before writing anything.
+	if err := prepareImportGeneration(ctx, client, generation, overwrite); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := entry.write(ctx, client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importEntry represents a snapshot, WAL segment, or attached database image
+// staged from an archive.
+type importEntry struct {
+	filename string // staged file path
+	snapshot bool   // true if snapshot, false if WAL segment
+	attached string // name of attached database, if an attached image
+	pos      Pos    // snapshot uses generation & index only
+}
+
+// write copies the staged entry to the client.
+func (e *importEntry) write(ctx context.Context, client ReplicaClient) error {
+	f, err := os.Open(e.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch {
+	case e.attached != "":
+		if _, err := client.(AttachedClient).WriteAttachedSnapshot(ctx, e.attached, e.pos, f); err != nil {
+			return fmt.Errorf("write attached snapshot: %w", err)
+		}
+	case e.snapshot:
+		if _, err := client.WriteSnapshot(ctx, e.pos.Generation, e.pos.Index, f); err != nil {
+			return fmt.Errorf("write snapshot: %w", err)
+		}
+	default:
+		if _, err := client.WriteWALSegment(ctx, e.pos, f); err != nil {
+			return fmt.Errorf("write wal segment: %w", err)
+		}
+	}
+	return f.Close()
+}
+
+// stageImportArchive reads each entry of a tar archive into dir & verifies
+// that it can be decompressed. Returns the archive's generation & its entries
+// in archive order. Returns a blank generation if the archive is empty.
+func stageImportArchive(client ReplicaClient, r io.Reader, dir string) (generation string, entries []importEntry, err error) {
+	zr := &zeroSuffixReader{r: r}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			// The tar reader also returns EOF if the data ends between
+			// entries so require the two zero blocks ending the archive.
+			if zr.n < 2*512 {
+				return "", nil, fmt.Errorf("archive truncated: %w", io.ErrUnexpectedEOF)
+			}
+			break
+		} else if err != nil {
+			return "", nil, err
+		} else if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// Split generation from the remaining path within the archive.
+		a := strings.SplitN(hdr.Name, "/", 3)
+		if len(a) != 3 || !isValidClientGenerationName(client, a[0]) {
+			return "", nil, fmt.Errorf("invalid archive path: %q", hdr.Name)
+		}
+
+		// Ensure the archive only holds a single generation.
+		if generation == "" {
+			generation = a[0]
+		} else if a[0] != generation {
+			return "", nil, fmt.Errorf("multiple generations in archive: %s, %s", generation, a[0])
+		}
+
+		entry := importEntry{
+			filename: filepath.Join(dir, strconv.Itoa(len(entries))),
+			pos:      Pos{Generation: generation},
+		}
+		switch a[1] {
+		case "snapshots":
+			index, err := internal.ParseSnapshotPath(a[2])
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid snapshot path: %q", hdr.Name)
+			}
+			entry.snapshot, entry.pos.Index = true, index
+
+		case WALDirName:
+			index, offset, err := internal.ParseWALSegmentPath(a[2])
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid wal segment path: %q", hdr.Name)
+			}
+			entry.pos.Index, entry.pos.Offset = index, offset
+
+		case "attached":
+			name, pos, err := parseAttachedSnapshotPath(a[2])
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid attached snapshot path: %q", hdr.Name)
+			} else if _, ok := client.(AttachedClient); !ok {
+				return "", nil, fmt.Errorf("replica client does not support attached databases: %s", client.Type())
+			}
+			entry.attached, entry.pos.Index, entry.pos.Offset = name, pos.Index, pos.Offset
+
+		default:
+			return "", nil, fmt.Errorf("invalid archive path: %q", hdr.Name)
+		}
+
+		if err := stageImportEntry(entry.filename, tr); err != nil {
+			return "", nil, fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return generation, entries, nil
+}
+
+// parseAttachedSnapshotPath parses the name, index & offset of an attached
+// database image from a path of the form "<name>/<index>/<offset>.snapshot.lz4".
+func parseAttachedSnapshotPath(s string) (name string, pos Pos, err error) {
+	a := strings.Split(s, "/")
+	if len(a) != 3 || a[0] == "" || a[0] == "." || a[0] == ".." || !strings.HasSuffix(a[2], SnapshotExt) {
+		return "", pos, fmt.Errorf("invalid attached snapshot path")
+	}
+
+	if pos.Index, err = ParseIndex(a[1]); err != nil {
+		return "", pos, err
+	} else if pos.Offset, err = ParseOffset(strings.TrimSuffix(a[2], SnapshotExt)); err != nil {
+		return "", pos, err
+	}
+	return a[0], pos, nil
+}
+
+// zeroSuffixReader wraps a reader & tracks the number of consecutive zero
+// bytes at the end of the data read so far.
+type zeroSuffixReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *zeroSuffixReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for _, b := range p[:n] {
+		if b == 0 {
+			r.n++
+		} else {
+			r.n = 0
+		}
+	}
+	return n, err
+}
+
+// stageImportEntry writes the data from r to filename & verifies the data
+// can be fully decompressed.
+func stageImportEntry(filename string, r io.Reader) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
 		return err
+	} else if _, err := io.Copy(ioutil.Discard, newDecompressReader(f)); err != nil {
+		return fmt.Errorf("decompress: %w", err)
 	}
 	return f.Close()
 }
+
+// prepareImportGeneration returns ErrGenerationExists if generation exists on
+// the client. If overwrite is set then the existing generation is removed.
+func prepareImportGeneration(ctx context.Context, client ReplicaClient, generation string, overwrite bool) error {
+	generations, err := client.Generations(ctx)
+	if err != nil {
+		return fmt.Errorf("generations: %w", err)
+	}
+
+	for _, g := range generations {
+		if g != generation {
+			continue
+		} else if !overwrite {
+			return ErrGenerationExists
+		}
+
+		if err := client.DeleteGeneration(ctx, generation); err != nil {
+			return fmt.Errorf("delete generation: %w", err)
+		}
+	}
+	return nil
+}
+
+// Restore restores the database to the given index on a generation.
+//
+// Each WAL file is applied with a truncating checkpoint and the emptied WAL &
+// shared memory files are removed. The output is a single consolidated file
+// with no pending WAL so it can be opened directly without SQLite performing
+// WAL recovery.
+func Restore(ctx context.Context, client ReplicaClient, filename, generation string, snapshotIndex, targetIndex int, opt RestoreOptions) (err error) {
+	// Verify-only restores write to a temporary directory that is discarded.
+	if opt.VerifyOnly {
+		dir, err := ioutil.TempDir("", "litestream-verify-")
+		if err != nil {
+			return err
+		}
+		defer func() { _ = os.RemoveAll(dir) }()
+		filename = filepath.Join(dir, "db")
+	}
+
+	// Validate options.
+	if filename == "" {
+		return fmt.Errorf("restore path required")
+	} else if generation == "" {
+		return fmt.Errorf("generation required")
+	} else if snapshotIndex < 0 {
+		return fmt.Errorf("snapshot index required")
+	} else if targetIndex < 0 {
+		return fmt.Errorf("target index required")
+	} else if pos := opt.TargetPos; !pos.IsZero() && (pos.Generation != generation || pos.Index != targetIndex) {
+		return fmt.Errorf("target position %s must be within target index %s/%s", pos, generation, FormatIndex(targetIndex))
+	}
+
+	// Restore the main database to the position the attached databases were
+	// captured at so that every restored file reflects the same point.
+	var attached AttachedClient
+	if len(opt.Attached) > 0 && !opt.VerifyOnly {
+		var ok bool
+		if attached, ok = client.(AttachedClient); !ok {
+			return fmt.Errorf("replica client does not support attached databases: %s", client.Type())
+		} else if targetIndex != snapshotIndex {
+			return fmt.Errorf("attached databases can only be restored to a snapshot index")
+		}
+
+		pos, err := attachedSnapshotPos(ctx, attached, generation, snapshotIndex, opt.Attached)
+		if err != nil {
+			return err
+		} else if !opt.TargetPos.IsZero() && opt.TargetPos != pos {
+			return fmt.Errorf("target position %s does not match attached snapshot position %s", opt.TargetPos, pos)
+		}
+		opt.TargetPos = pos
+
+		for _, name := range sortedKeys(opt.Attached) {
+			if _, err := os.Stat(opt.Attached[name]); err == nil {
+				return fmt.Errorf("cannot restore, attached output path already exists: %s", opt.Attached[name])
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	// Require a default level of parallelism.
+	if opt.Parallelism < 1 {
+		opt.Parallelism = DefaultRestoreParallelism
+	}
+
+	// Ensure logger exists.
+	logger := opt.Logger
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+
+	// Ensure output path does not already exist.
+	// If doesn't exist, also remove the journal, shm, & wal if left behind.
+	if _, err := os.Stat(filename); err == nil {
+		return fmt.Errorf("cannot restore, output path already exists: %s", filename)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err := removeDBFiles(filename); err != nil {
+		return err
+	}
+
+	// Determine total bytes to restore & build a thread-safe progress reporter.
+	var progress func(n int64)
+	if opt.Progress != nil {
+		total, err := restoreSize(ctx, client, generation, snapshotIndex, targetIndex)
+		if err != nil {
+			return fmt.Errorf("cannot determine restore size: %w", err)
+		}
+
+		var mu sync.Mutex
+		var done int64
+		progress = func(n int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			done += n
+			opt.Progress(done, total)
+		}
+	}
+
+	// Fully read the snapshot to validate its checksum before writing anything.
+	if opt.VerifySnapshot {
+		logger.Printf("%sverifying snapshot %s/%s", opt.LogPrefix, generation, FormatIndex(snapshotIndex))
+		if err := verifySnapshot(ctx, client, generation, snapshotIndex); err != nil {
+			return fmt.Errorf("cannot verify snapshot: %w", err)
+		}
+	}
+
+	// Copy snapshot to output path.
+	tmpPath := filename + ".tmp"
+	logger.Printf("%srestoring snapshot %s/%s to %s", opt.LogPrefix, generation, FormatIndex(snapshotIndex), tmpPath)
+	if err := restoreSnapshot(ctx, client, tmpPath, generation, snapshotIndex, opt.Mode, opt.Uid, opt.Gid, progress); err != nil {
+		return fmt.Errorf("cannot restore snapshot: %w", err)
+	}
+
+	// Download & apply all WAL files between the snapshot & the target index.
+	d := NewWALDownloader(client, tmpPath, generation, snapshotIndex, targetIndex)
+	d.Parallelism = opt.Parallelism
+	d.Mode = opt.Mode
+	d.Uid, d.Gid = opt.Uid, opt.Gid
+	d.Progress = progress
+
+	pos := Pos{Generation: generation, Index: snapshotIndex}
+	for {
+		// Read next WAL file from downloader.
+		walIndex, walPath, err := d.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+
+		// If we are only reading a single index, a WAL file may not be found.
+		if _, ok := err.(*WALNotFoundError); ok && snapshotIndex == targetIndex {
+			logger.Printf("%sno wal files found, snapshot only", opt.LogPrefix)
+			break
+		} else if err != nil {
+			return fmt.Errorf("cannot download WAL: %w", err)
+		}
+
+		// Drop frames past the target position in the last index. The WAL is
+		// cut at a commit frame so a partial transaction is never applied.
+		if !opt.TargetPos.IsZero() && walIndex == opt.TargetPos.Index {
+			offset, err := truncateWALAtCommit(walPath, opt.TargetPos.Offset)
+			if err != nil {
+				return fmt.Errorf("cannot truncate wal: %w", err)
+			}
+
+			pos := Pos{Generation: generation, Index: walIndex, Offset: offset}
+			logger.Printf("%struncated wal at %s, target=%s", opt.LogPrefix, pos, opt.TargetPos)
+			if opt.OnTargetPos != nil {
+				opt.OnTargetPos(pos)
+			}
+		}
+
+		// Track the position at the end of the WAL file before applying it.
+		fi, err := os.Stat(walPath)
+		if err != nil {
+			return err
+		}
+		pos = Pos{Generation: generation, Index: walIndex, Offset: fi.Size()}
+
+		// Apply WAL file.
+		startTime := time.Now()
+		if err = ApplyWAL(ctx, tmpPath, walPath); err != nil {
+			return fmt.Errorf("cannot apply wal: %w", err)
+		}
+		logger.Printf("%sapplied wal %s/%s elapsed=%s", opt.LogPrefix, generation, FormatIndex(walIndex), time.Since(startTime).String())
+	}
+
+	// Remove the empty WAL & stale shared memory file left by checkpointing.
+	// SQLite regenerates the shared memory index when the database is opened.
+	// The shared memory file is not replicated as it only indexes WAL frames
+	// & every frame has been checkpointed into the database by this point.
+	if err := os.Remove(tmpPath + "-wal"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove wal: %w", err)
+	} else if err := os.Remove(tmpPath + "-shm"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove shared memory: %w", err)
+	}
+
+	// Copy file to final location.
+	logger.Printf("%srenaming database from temporary location", opt.LogPrefix)
+	if err := os.Rename(tmpPath, filename); err != nil {
+		return err
+	}
+
+	if attached != nil {
+		if err := restoreAttached(ctx, attached, opt.TargetPos, opt, logger); err != nil {
+			return fmt.Errorf("cannot restore attached database: %w", err)
+		}
+	}
+
+	if opt.VerifyOnly {
+		result, err := readIntegrityCheck(ctx, filename)
+		if err != nil {
+			return fmt.Errorf("integrity check: %w", err)
+		}
+		logger.Printf("%sverified restore at %s, integrity=%s", opt.LogPrefix, pos, result)
+
+		if opt.OnVerify != nil {
+			opt.OnVerify(RestoreVerification{Pos: pos, Integrity: result})
+		}
+		if result != "ok" {
+			return fmt.Errorf("database corrupt: %s", result)
+		}
+	}
+
+	return nil
+}
+
+// attachedSnapshotPos returns the position the named attached databases were
+// captured at with the snapshot at index. Returns an error if any image is
+// missing or if the images were not all captured at the same position.
+func attachedSnapshotPos(ctx context.Context, client AttachedClient, generation string, index int, attached map[string]string) (pos Pos, err error) {
+	for _, name := range sortedKeys(attached) {
+		p, err := client.AttachedSnapshotPos(ctx, generation, name, index)
+		if os.IsNotExist(err) {
+			return pos, fmt.Errorf("no attached snapshot for %q at %s/%s", name, generation, FormatIndex(index))
+		} else if err != nil {
+			return pos, fmt.Errorf("attached snapshot position: %w", err)
+		} else if !pos.IsZero() && p != pos {
+			return pos, fmt.Errorf("attached snapshot positions do not match: %s, %s", pos, p)
+		}
+		pos = p
+	}
+	return pos, nil
+}
+
+// restoreAttached restores the image of each attached database captured at
+// pos to its output path.
+func restoreAttached(ctx context.Context, client AttachedClient, pos Pos, opt RestoreOptions, logger *log.Logger) error {
+	for _, name := range sortedKeys(opt.Attached) {
+		filename := opt.Attached[name]
+		if err := restoreAttachedFile(ctx, client, name, pos, filename, opt); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		logger.Printf("%srestored attached database %s at %s to %s", opt.LogPrefix, name, pos, filename)
+	}
+	return nil
+}
+
+// restoreAttachedFile writes the image of an attached database to filename.
+// The image is written to a temporary file first so a partial file is never
+// left at the output path.
+func restoreAttachedFile(ctx context.Context, client AttachedClient, name string, pos Pos, filename string, opt RestoreOptions) error {
+	if err := removeDBFiles(filename); err != nil {
+		return err
+	}
+
+	rc, err := client.AttachedSnapshotReader(ctx, name, pos)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := internal.CreateFile(filename+".tmp", opt.Mode, opt.Uid, opt.Gid)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, struct{ io.Reader }{newDecompressReader(rc)}); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	} else if err := rc.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]string) []string {
+	a := make([]string, 0, len(m))
+	for k := range m {
+		a = append(a, k)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// vacuumInto writes a consistent copy of the database at src to dst using
+// "VACUUM INTO". Unlike copying the file, this includes changes which are
+// still in the WAL. The source database is not modified.
+func vacuumInto(ctx context.Context, src, dst string) error {
+	db, err := sql.Open("sqlite3", src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+
+	if _, err := db.ExecContext(ctx, `VACUUM INTO ?`, dst); err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// RestoreOptions represents options for DB.Restore().
+type RestoreOptions struct {
+	// File info used for restored snapshot & WAL files.
+	Mode     os.FileMode
+	Uid, Gid int
+
+	// Specifies how many WAL files are downloaded in parallel during restore.
+	Parallelism int
+
+	// Optional callback invoked as snapshot & WAL bytes are read from the
+	// replica client. The total is the sum of the snapshot & WAL segment
+	// sizes reported by the client, or -1 if any size is unavailable.
+	Progress func(done, total int64)
+
+	// If true, the snapshot is fully decompressed & its LZ4 checksum and
+	// SQLite header are validated before the output file is created.
+	VerifySnapshot bool
+
+	// Optional position within the target index to stop applying WAL data.
+	// WAL frames are only applied through the last commit frame which ends
+	// at or before the offset. OnTargetPos, if set, receives the position
+	// where restore actually stopped.
+	TargetPos   Pos
+	OnTargetPos func(pos Pos)
+
+	// If true, the database is restored to a temporary file which is checked
+	// with "PRAGMA integrity_check" & then removed. The output filename is
+	// not written. OnVerify, if set, receives the result of the check.
+	VerifyOnly bool
+	OnVerify   func(v RestoreVerification)
+
+	// Output paths of attached databases to restore, keyed by name. Attached
+	// databases are only captured with snapshots so the target index must be
+	// the snapshot index. The main database is then restored to the position
+	// the attached images were captured at so that all files match. Ignored
+	// for verify-only restores. Requires a client implementing AttachedClient.
+	Attached map[string]string
+
+	// Logging settings.
+	Logger    *log.Logger
+	LogPrefix string
+}
+
+// RestoreVerification represents the result of a verify-only restore.
+type RestoreVerification struct {
+	Pos       Pos    // position the database was restored to
+	Integrity string // result of the integrity check, "ok" if valid
+}
+
+// truncateWALAtCommit truncates the WAL file at filename so it ends after the
+// last commit frame which ends at or before offset. Returns the new size, which
+// is the WAL header size if no commit frames exist before offset.
+func truncateWALAtCommit(filename string, offset int64) (int64, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, WALHeaderSize)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return 0, fmt.Errorf("short wal header: %w", err)
+	}
+	frameSize := int64(WALFrameHeaderSize) + int64(binary.BigEndian.Uint32(hdr[8:]))
+
+	// Commit frames store the database size, in pages, after the commit.
+	end := int64(WALHeaderSize)
+	frameHdr := make([]byte, WALFrameHeaderSize)
+	for pos := int64(WALHeaderSize); pos+frameSize <= offset; pos += frameSize {
+		if _, err := f.ReadAt(frameHdr, pos); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return 0, err
+		} else if binary.BigEndian.Uint32(frameHdr[4:]) != 0 {
+			end = pos + frameSize
+		}
+	}
+
+	if err := f.Truncate(end); err != nil {
+		return 0, err
+	}
+	return end, f.Close()
+}
+
+// RestoreReader restores the database to the given index on a generation and
+// returns a reader of the restored database file. The database is staged in
+// a temporary file so memory use does not grow with the database size. The
+// temporary file is removed when the reader is closed.
+func RestoreReader(ctx context.Context, client ReplicaClient, generation string, snapshotIndex, targetIndex int, opt RestoreOptions) (io.ReadCloser, error) {
+	dir, err := ioutil.TempDir("", "litestream-restore-")
+	if err != nil {
+		return nil, err
+	}
+
+	filename := filepath.Join(dir, "db")
+	if err := Restore(ctx, client, filename, generation, snapshotIndex, targetIndex, opt); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	return &restoreReader{File: f, dir: dir}, nil
+}
+
+// restoreReader reads a restored database & removes its directory on close.
+type restoreReader struct {
+	*os.File
+	dir string
+}
+
+// Close closes the file & removes the temporary restore directory.
+func (r *restoreReader) Close() error {
+	err := r.File.Close()
+	if e := os.RemoveAll(r.dir); err == nil {
+		err = e
+	}
+	return err
+}
+
+// RestoreLatest restores the most recent state available on the client to
+// filename. The latest generation is determined by FindLatestGeneration() and
+// it is restored from its latest snapshot through its last WAL segment.
+// Returns ErrNoGeneration if the client has no generations.
+func RestoreLatest(ctx context.Context, client ReplicaClient, filename string, opt RestoreOptions) error {
+	generation, err := FindLatestGeneration(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	targetIndex, err := FindMaxIndexByGeneration(ctx, client, generation)
+	if err != nil {
+		return fmt.Errorf("cannot determine latest index in generation %q: %w", generation, err)
+	}
+
+	snapshotIndex, err := FindSnapshotForIndex(ctx, client, generation, targetIndex)
+	if err != nil {
+		return fmt.Errorf("cannot find snapshot index: %w", err)
+	}
+
+	return Restore(ctx, client, filename, generation, snapshotIndex, targetIndex, opt)
+}
+
+// RestoreInto restores the most recent state available on the client into an
+// open database connection pool. The database is first restored to a temporary
+// file by RestoreLatest() and then copied into the "main" schema of db using the
+// SQLite online backup API so the connection is never left partially written.
+// The db must be opened with the mattn/go-sqlite3 driver.
+func RestoreInto(ctx context.Context, client ReplicaClient, db *sql.DB, opt RestoreOptions) error {
+	dir, err := ioutil.TempDir("", "litestream-restore-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	filename := filepath.Join(dir, "db")
+	if err := RestoreLatest(ctx, client, filename, opt); err != nil {
+		return err
+	}
+
+	if err := backupInto(ctx, db, filename); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	return nil
+}
+
+// AtomicRestore restores the most recent state available on the client to
+// targetPath without disturbing an existing database at that path until the
+// restore is complete. The database is restored to targetPath+".restoring",
+// verified with an integrity check, and then renamed over targetPath. On any
+// failure, the original database is left untouched.
+//
+// Returns an error if the existing database has a non-empty WAL, such as when
+// it is open or was not checkpointed, as those pages would otherwise be
+// applied on top of the restored database. Connections already open to the
+// original database continue to read the replaced file.
+func AtomicRestore(ctx context.Context, client ReplicaClient, targetPath string, opt RestoreOptions) (err error) {
+	if targetPath == "" {
+		return fmt.Errorf("restore path required")
+	}
+
+	// Clear out files left by a previous failed attempt.
+	tmpPath := targetPath + ".restoring"
+	if err := removeFilesWithPrefix(tmpPath); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = removeFilesWithPrefix(tmpPath)
+		}
+	}()
+
+	if err := RestoreLatest(ctx, client, tmpPath, opt); err != nil {
+		return err
+	} else if err := integrityCheck(ctx, tmpPath); err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	} else if err := os.Remove(tmpPath + "-wal"); err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err := os.Remove(tmpPath + "-shm"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Refuse to replace a database whose WAL still holds pages.
+	if fi, err := os.Stat(targetPath + "-wal"); err == nil && fi.Size() > 0 {
+		return fmt.Errorf("cannot replace database with non-empty wal: %s", targetPath)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Remove the stale WAL & shared memory of the original before swapping.
+	if err := os.Remove(targetPath + "-wal"); err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err := os.Remove(targetPath + "-shm"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(tmpPath, targetPath)
+}
+
+// removeFilesWithPrefix removes all files in the directory of prefix whose
+// name begins with the base of prefix. This includes the staging files &
+// downloaded WAL files that Restore() creates alongside its output path.
+func removeFilesWithPrefix(prefix string) error {
+	dir, base := filepath.Split(prefix)
+	ents, err := os.ReadDir(filepath.Clean(dir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		if !ent.IsDir() && strings.HasPrefix(ent.Name(), base) {
+			if err := os.Remove(filepath.Join(dir, ent.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// integrityCheck runs "PRAGMA integrity_check" against the database at
+// filename & returns an error if any problems are reported.
+func integrityCheck(ctx context.Context, filename string) error {
+	if result, err := readIntegrityCheck(ctx, filename); err != nil {
+		return err
+	} else if result != "ok" {
+		return fmt.Errorf("database corrupt: %s", result)
+	}
+	return nil
+}
+
+// readIntegrityCheck returns the result of "PRAGMA integrity_check" against
+// the database at filename. Returns "ok" if no problems are found.
+func readIntegrityCheck(ctx context.Context, filename string) (string, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = db.Close() }()
+
+	var result string
+	if err := db.QueryRowContext(ctx, `PRAGMA integrity_check;`).Scan(&result); err != nil {
+		return "", err
+	}
+	return result, db.Close()
+}
+
+// readSchema returns the SQL of every schema object in the database at
+// filename. The database is opened read-only & is never modified. Objects
+// without SQL, such as automatic indexes, are skipped.
+func readSchema(ctx context.Context, filename string) ([]string, error) {
+	db, err := sql.Open("sqlite3", "file:"+filename+"?mode=ro&immutable=1")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = db.Close() }()
+
+	rows, err := db.QueryContext(ctx, `SELECT sql FROM sqlite_master WHERE sql IS NOT NULL ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var a []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		a = append(a, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	} else if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	return a, db.Close()
+}
+
+// SelfTest verifies the full replication pipeline against client. A scratch
+// database is created in a temporary directory, written to, snapshotted and
+// synced to the client, and then restored to a separate file whose rows are
+// compared against the source. The scratch generation is deleted from the
+// client & all local files are removed before returning.
+func SelfTest(ctx context.Context, client ReplicaClient) (err error) {
+	dir, err := ioutil.TempDir("", "litestream-selftest-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	// Remove the scratch generation once the database has been closed.
+	var generation string
+	defer func() {
+		if generation == "" {
+			return
+		}
+		if e := client.DeleteGeneration(context.Background(), generation); e != nil && err == nil {
+			err = fmt.Errorf("delete generation: %w", e)
+		}
+	}()
+
+	db := NewDB(filepath.Join(dir, "db"))
+	r := NewReplica(db, "selftest", client)
+	r.MonitorEnabled = false
+	db.Replicas = []*Replica{r}
+	if err := db.Open(); err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	defer func() {
+		if e := db.Close(); e != nil && err == nil {
+			err = fmt.Errorf("close db: %w", e)
+		}
+	}()
+
+	sqldb, err := sql.Open("sqlite3", db.Path())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = sqldb.Close() }()
+
+	if _, err := sqldb.ExecContext(ctx, `PRAGMA journal_mode = wal;`); err != nil {
+		return fmt.Errorf("enable wal: %w", err)
+	} else if _, err := sqldb.ExecContext(ctx, `CREATE TABLE selftest (id INTEGER PRIMARY KEY, value TEXT);`); err != nil {
+		return fmt.Errorf("create table: %w", err)
+	}
+
+	// Write rows before & after the snapshot so both the snapshot and the
+	// WAL segments which follow it are exercised by the restore.
+	insert := func(n int) error {
+		for i := 0; i < n; i++ {
+			if _, err := sqldb.ExecContext(ctx, `INSERT INTO selftest (value) VALUES (hex(randomblob(64)));`); err != nil {
+				return fmt.Errorf("insert: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if err := insert(10); err != nil {
+		return err
+	} else if err := db.Sync(ctx); err != nil {
+		return fmt.Errorf("db sync: %w", err)
+	}
+	if generation, err = db.CurrentGeneration(); err != nil {
+		return fmt.Errorf("current generation: %w", err)
+	}
+
+	if err := r.Sync(ctx); err != nil {
+		return fmt.Errorf("replica sync: %w", err)
+	} else if _, err := r.Snapshot(ctx); err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+
+	if err := insert(10); err != nil {
+		return err
+	} else if err := db.Sync(ctx); err != nil {
+		return fmt.Errorf("db sync: %w", err)
+	} else if err := r.Sync(ctx); err != nil {
+		return fmt.Errorf("replica sync: %w", err)
+	}
+
+	want, err := selfTestChecksum(ctx, sqldb)
+	if err != nil {
+		return err
+	}
+
+	// Restore the scratch generation & compare its contents.
+	snapshotIndex, err := FindMaxSnapshotIndexByGeneration(ctx, client, generation)
+	if err != nil {
+		return fmt.Errorf("find snapshot index: %w", err)
+	}
+	targetIndex, err := FindMaxIndexByGeneration(ctx, client, generation)
+	if err != nil {
+		return fmt.Errorf("find max index: %w", err)
+	}
+
+	restorePath := filepath.Join(dir, "restored")
+	if err := Restore(ctx, client, restorePath, generation, snapshotIndex, targetIndex, NewRestoreOptions()); err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+
+	rdb, err := sql.Open("sqlite3", restorePath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rdb.Close() }()
+
+	got, err := selfTestChecksum(ctx, rdb)
+	if err != nil {
+		return fmt.Errorf("restored: %w", err)
+	} else if got != want {
+		return fmt.Errorf("restored data mismatch: got %q, want %q", got, want)
+	}
+	return rdb.Close()
+}
+
+// selfTestChecksum returns a summary of the rows in the self-test table.
+func selfTestChecksum(ctx context.Context, db *sql.DB) (string, error) {
+	var n int
+	var s string
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(group_concat(id || ':' || value, ','), '') FROM (SELECT * FROM selftest ORDER BY id);`).Scan(&n, &s); err != nil {
+		return "", fmt.Errorf("read rows: %w", err)
+	}
+	return fmt.Sprintf("%d/%x", n, sha256.Sum256([]byte(s))), nil
+}
+
+// backupInto copies the database at filename into the main schema of db.
+func backupInto(ctx context.Context, db *sql.DB, filename string) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		dst, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unsupported driver connection: %T", driverConn)
+		}
+
+		c, err := (&sqlite3.SQLiteDriver{}).Open(filename)
+		if err != nil {
+			return fmt.Errorf("open restored database: %w", err)
+		}
+		src := c.(*sqlite3.SQLiteConn)
+		defer src.Close()
+
+		b, err := dst.Backup("main", src, "main")
+		if err != nil {
+			return err
+		}
+		defer b.Finish()
+
+		for done := false; !done; {
+			if err := ctx.Err(); err != nil {
+				return err
+			} else if done, err = b.Step(-1); err != nil {
+				return err
+			}
+		}
+		return b.Finish()
+	})
+}
+
+// NewRestoreOptions returns a new instance of RestoreOptions with defaults.
+func NewRestoreOptions() RestoreOptions {
+	return RestoreOptions{
+		Mode:        0600,
+		Parallelism: DefaultRestoreParallelism,
+	}
+}
+
+// SnapshotMeta represents database information read from a snapshot header.
+type SnapshotMeta struct {
+	PageSize int   // database page size, in bytes
+	PageN    int   // number of pages in the database
+	Size     int64 // uncompressed database size, in bytes
+}
+
+// SnapshotMetadata returns the page size, page count & uncompressed size of a
+// snapshot. Only the SQLite header at the start of the snapshot is read so the
+// full snapshot does not need to be downloaded.
+func SnapshotMetadata(ctx context.Context, client ReplicaClient, generation string, index int) (meta SnapshotMeta, err error) {
+	rc, err := client.SnapshotReader(ctx, generation, index)
+	if err != nil {
+		return meta, err
+	}
+	defer rc.Close()
+
+	// Delta snapshots record the database dimensions in their own header.
+	rd := bufio.NewReader(newDecompressReader(rc))
+	if dhdr, ok, err := readDeltaSnapshotHeader(rd); err != nil {
+		return meta, err
+	} else if ok {
+		meta.PageSize, meta.PageN = dhdr.PageSize, dhdr.PageN
+		meta.Size = int64(meta.PageSize) * int64(meta.PageN)
+		return meta, rc.Close()
+	}
+
+	hdr := make([]byte, sqliteHeaderSize)
+	if _, err := io.ReadFull(rd, hdr); err != nil {
+		return meta, fmt.Errorf("read header: %w", err)
+	} else if string(hdr[:len(sqliteHeaderMagic)]) != sqliteHeaderMagic {
+		return meta, fmt.Errorf("invalid database header")
+	}
+
+	// A page size of 1 represents 65536 as it cannot fit in two bytes.
+	meta.PageSize = int(binary.BigEndian.Uint16(hdr[16:18]))
+	if meta.PageSize == 1 {
+		meta.PageSize = 65536
+	}
+	meta.PageN = int(binary.BigEndian.Uint32(hdr[28:32]))
+	meta.Size = int64(meta.PageSize) * int64(meta.PageN)
+
+	return meta, rc.Close()
+}
+
+// verifySnapshot reads an entire snapshot from the client and returns an error
+// if it cannot be decompressed or does not begin with a SQLite database header
+// or a delta snapshot header.
+func verifySnapshot(ctx context.Context, client ReplicaClient, generation string, index int) error {
+	rc, err := client.SnapshotReader(ctx, generation, index)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	zr := newDecompressReader(rc)
+
+	hdr := make([]byte, len(sqliteHeaderMagic))
+	if _, err := io.ReadFull(zr, hdr); err != nil {
+		return fmt.Errorf("read header: %w", err)
+	} else if string(hdr) != sqliteHeaderMagic && string(hdr) != deltaSnapshotMagic {
+		return fmt.Errorf("invalid database header")
+	}
+
+	// Read via Read() as the LZ4 reader's WriteTo() cannot resume mid-stream.
+	if _, err := io.Copy(io.Discard, io.LimitReader(zr, math.MaxInt64)); err != nil {
+		return fmt.Errorf("decompress: %w", err)
+	}
+	return rc.Close()
+}
+
+// sqliteHeaderMagic is the string every SQLite database file begins with.
+const sqliteHeaderMagic = "SQLite format 3\x00"
+
+// sqliteHeaderSize is the size of the SQLite database header, in bytes.
+const sqliteHeaderSize = 100
+
+// RestoreSnapshot copies a snapshot from the replica client to a file.
+func RestoreSnapshot(ctx context.Context, client ReplicaClient, filename, generation string, index int, mode os.FileMode, uid, gid int) error {
+	return restoreSnapshot(ctx, client, filename, generation, index, mode, uid, gid, nil)
+}
+
+func restoreSnapshot(ctx context.Context, client ReplicaClient, filename, generation string, index int, mode os.FileMode, uid, gid int, progress func(n int64)) error {
+	f, err := internal.CreateFile(filename, mode, uid, gid)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := writeSnapshotImage(ctx, client, f, generation, index, progress); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// SnapshotReader returns a reader for the full, uncompressed database image
+// of a snapshot. Unlike the client's SnapshotReader(), delta snapshots are
+// reconstructed by applying each delta in the chain to its full base snapshot.
+func SnapshotReader(ctx context.Context, client ReplicaClient, generation string, index int) (io.ReadCloser, error) {
+	rd, rc, err := openSnapshot(ctx, client, generation, index, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Full snapshots are streamed directly from the client.
+	if _, ok, err := readDeltaSnapshotHeader(rd); err != nil {
+		_ = rc.Close()
+		return nil, err
+	} else if !ok {
+		return internal.NewReadCloser(rd, rc), nil
+	} else if err := rc.Close(); err != nil {
+		return nil, err
+	}
+
+	// Delta snapshots are reconstructed into a temporary file which is
+	// removed once the reader is closed.
+	f, err := ioutil.TempFile("", "litestream-snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(f.Name())
+
+	if err := writeSnapshotImage(ctx, client, f, generation, index, nil); err != nil {
+		_ = f.Close()
+		return nil, err
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// openSnapshot returns a reader for the decompressed contents of a snapshot
+// along with the underlying client reader, which must be closed by the caller.
+func openSnapshot(ctx context.Context, client ReplicaClient, generation string, index int, progress func(n int64)) (*bufio.Reader, io.ReadCloser, error) {
+	rc, err := client.SnapshotReader(ctx, generation, index)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rd io.Reader = rc
+	if progress != nil {
+		rd = &progressReader{r: rc, fn: progress}
+	}
+
+	// Hide the LZ4 reader's WriteTo() as it cannot resume once peeked.
+	return bufio.NewReader(struct{ io.Reader }{newDecompressReader(rd)}), rc, nil
+}
+
+// writeSnapshotImage writes the full database image of a snapshot to f. If the
+// snapshot is a delta, the chain is followed back to its full snapshot which
+// is written first & each delta is then applied from oldest to newest.
+func writeSnapshotImage(ctx context.Context, client ReplicaClient, f *os.File, generation string, index int, progress func(n int64)) error {
+	var chain []int
+	for {
+		rd, rc, err := openSnapshot(ctx, client, generation, index, progress)
+		if err != nil {
+			return err
+		}
+
+		hdr, ok, err := readDeltaSnapshotHeader(rd)
+		if err != nil {
+			_ = rc.Close()
+			return fmt.Errorf("snapshot %s: %w", FormatIndex(index), err)
+		} else if !ok {
+			if _, err := io.Copy(f, rd); err != nil {
+				_ = rc.Close()
+				return err
+			}
+			if err := rc.Close(); err != nil {
+				return err
+			}
+			break
+		}
+
+		if err := rc.Close(); err != nil {
+			return err
+		} else if hdr.BaseIndex >= index {
+			return fmt.Errorf("snapshot %s: invalid delta base index: %s", FormatIndex(index), FormatIndex(hdr.BaseIndex))
+		}
+		chain, index = append(chain, index), hdr.BaseIndex
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		if err := applySnapshotDelta(ctx, client, f, generation, chain[i], progress); err != nil {
+			return fmt.Errorf("apply delta snapshot %s: %w", FormatIndex(chain[i]), err)
+		}
+	}
+	return nil
+}
+
+// applySnapshotDelta writes the pages of a delta snapshot to f & truncates f
+// to the database size recorded in the delta.
+func applySnapshotDelta(ctx context.Context, client ReplicaClient, f *os.File, generation string, index int, progress func(n int64)) error {
+	rd, rc, err := openSnapshot(ctx, client, generation, index, progress)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	hdr, ok, err := readDeltaSnapshotHeader(rd)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("not a delta snapshot")
+	}
+
+	page := make([]byte, hdr.PageSize)
+	buf := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return fmt.Errorf("read page number: %w", err)
+		}
+
+		pgno := binary.BigEndian.Uint32(buf)
+		if pgno == 0 {
+			break
+		} else if int(pgno) > hdr.PageN {
+			return fmt.Errorf("page number out of range: %d", pgno)
+		}
+
+		if _, err := io.ReadFull(rd, page); err != nil {
+			return fmt.Errorf("read page %d: %w", pgno, err)
+		} else if _, err := f.WriteAt(page, int64(pgno-1)*int64(hdr.PageSize)); err != nil {
+			return err
+		}
+	}
+
+	if err := f.Truncate(int64(hdr.PageN) * int64(hdr.PageSize)); err != nil {
+		return err
+	}
+	return rc.Close()
+}
+
+// snapshotBaseIndex returns the index of the full snapshot which the snapshot
+// at index is built on. Returns index if the snapshot is not a delta.
+func snapshotBaseIndex(ctx context.Context, client ReplicaClient, generation string, index int) (int, error) {
+	for {
+		rd, rc, err := openSnapshot(ctx, client, generation, index, nil)
+		if err != nil {
+			return 0, err
+		}
+		hdr, ok, err := readDeltaSnapshotHeader(rd)
+		_ = rc.Close()
+		if err != nil {
+			return 0, fmt.Errorf("snapshot %s: %w", FormatIndex(index), err)
+		} else if !ok {
+			return index, nil
+		} else if hdr.BaseIndex >= index {
+			return 0, fmt.Errorf("snapshot %s: invalid delta base index: %s", FormatIndex(index), FormatIndex(hdr.BaseIndex))
+		}
+		index = hdr.BaseIndex
+	}
+}
+
+// RestoreEstimate represents the amount of data downloaded during a restore.
+type RestoreEstimate struct {
+	Bytes       int64 // total compressed size; -1 if any size is unknown
+	SnapshotN   int   // number of snapshots
+	WALSegmentN int   // number of WAL segments
+}
+
+// EstimateRestore returns the number & total compressed size of the snapshot
+// & WAL segments used to restore a generation from snapshotIndex to
+// targetIndex. Returns ErrNoSnapshots if the snapshot cannot be found.
+func EstimateRestore(ctx context.Context, client ReplicaClient, generation string, snapshotIndex, targetIndex int) (est RestoreEstimate, err error) {
+	itr, err := client.Snapshots(ctx, generation)
+	if err != nil {
+		return est, fmt.Errorf("snapshots: %w", err)
+	}
+	defer func() { _ = itr.Close() }()
+
+	for itr.Next() {
+		if info := itr.Snapshot(); info.Index == snapshotIndex {
+			est.SnapshotN, est.Bytes = 1, info.Size
+		}
+	}
+	if err := itr.Close(); err != nil {
+		return est, fmt.Errorf("snapshot iteration: %w", err)
+	} else if est.SnapshotN == 0 {
+		return est, ErrNoSnapshots
+	}
+
+	// Sum all WAL segments between the snapshot & the target index.
+	witr, err := client.WALSegments(ctx, generation)
+	if err != nil {
+		return est, fmt.Errorf("wal segments: %w", err)
+	}
+	defer func() { _ = witr.Close() }()
+
+	unknown := est.Bytes <= 0
+	for witr.Next() {
+		info := witr.WALSegment()
+		if info.Index < snapshotIndex || info.Index > targetIndex {
+			continue
+		} else if info.Size <= 0 {
+			unknown = true
+		}
+		est.WALSegmentN++
+		est.Bytes += info.Size
+	}
+	if err := witr.Close(); err != nil {
+		return est, fmt.Errorf("wal segment iteration: %w", err)
+	}
+
+	if unknown {
+		est.Bytes = -1
+	}
+	return est, nil
+}
+
+// restoreSize returns the total compressed size of the snapshot & WAL segments
+// used to restore a generation from snapshotIndex to targetIndex. Returns -1
+// if the snapshot cannot be found or if the client does not report sizes.
+func restoreSize(ctx context.Context, client ReplicaClient, generation string, snapshotIndex, targetIndex int) (int64, error) {
+	est, err := EstimateRestore(ctx, client, generation, snapshotIndex, targetIndex)
+	if err == ErrNoSnapshots {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return est.Bytes, nil
+}
+
+// progressReader wraps a reader and reports the number of bytes read to fn.
+type progressReader struct {
+	r  io.Reader
+	fn func(n int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.fn(int64(n))
+	}
+	return n, err
+}
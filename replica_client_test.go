@@ -1,18 +1,170 @@
 package litestream_test
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/benbjohnson/litestream"
 	"github.com/benbjohnson/litestream/mock"
+	"github.com/pierrec/lz4/v4"
+	"golang.org/x/sync/errgroup"
 )
 
+func TestReadOnlyReplicaClient(t *testing.T) {
+	t.Run("Read", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		client := litestream.NewReadOnlyReplicaClient(litestream.NewFileReplicaClient(testDir))
+
+		if generations, err := client.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := generations, []string{"0000000000000000"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Generations()=%v, want %v", got, want)
+		}
+
+		filename := filepath.Join(t.TempDir(), "db")
+		if err := litestream.Restore(context.Background(), client, filename, "0000000000000000", 0, 2, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), filename) {
+			t.Fatalf("file mismatch")
+		}
+	})
+
+	t.Run("ErrReadOnly", func(t *testing.T) {
+		client := litestream.NewReadOnlyReplicaClient(litestream.NewFileReplicaClient(t.TempDir()))
+		ctx := context.Background()
+		pos := litestream.Pos{Generation: "0000000000000000"}
+
+		if err := client.DeleteGeneration(ctx, "0000000000000000"); err != litestream.ErrReadOnly {
+			t.Fatalf("DeleteGeneration(): unexpected error: %v", err)
+		} else if _, err := client.WriteSnapshot(ctx, "0000000000000000", 0, strings.NewReader("")); err != litestream.ErrReadOnly {
+			t.Fatalf("WriteSnapshot(): unexpected error: %v", err)
+		} else if err := client.DeleteSnapshot(ctx, "0000000000000000", 0); err != litestream.ErrReadOnly {
+			t.Fatalf("DeleteSnapshot(): unexpected error: %v", err)
+		} else if _, err := client.WriteWALSegment(ctx, pos, strings.NewReader("")); err != litestream.ErrReadOnly {
+			t.Fatalf("WriteWALSegment(): unexpected error: %v", err)
+		} else if err := client.DeleteWALSegments(ctx, []litestream.Pos{pos}); err != litestream.ErrReadOnly {
+			t.Fatalf("DeleteWALSegments(): unexpected error: %v", err)
+		} else if err := client.SetGenerationImmutable(ctx, "0000000000000000", true); err != litestream.ErrReadOnly {
+			t.Fatalf("SetGenerationImmutable(): unexpected error: %v", err)
+		} else if _, err := client.WriteAttachedSnapshot(ctx, "aux", pos, strings.NewReader("")); err != litestream.ErrReadOnly {
+			t.Fatalf("WriteAttachedSnapshot(): unexpected error: %v", err)
+		}
+	})
+
+	// Ensure optional read methods of the underlying client pass through.
+	t.Run("Optional", func(t *testing.T) {
+		fc := litestream.NewFileReplicaClient(t.TempDir())
+		client := litestream.NewReadOnlyReplicaClient(fc)
+		ctx := context.Background()
+		pos := litestream.Pos{Generation: "0000000000000000", Index: 1, Offset: 32}
+
+		if _, err := fc.WriteSnapshot(ctx, pos.Generation, pos.Index, strings.NewReader("snapshot")); err != nil {
+			t.Fatal(err)
+		} else if err := fc.SetGenerationImmutable(ctx, pos.Generation, true); err != nil {
+			t.Fatal(err)
+		} else if _, err := fc.WriteAttachedSnapshot(ctx, "aux", pos, strings.NewReader("attached")); err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, err := client.IsGenerationImmutable(ctx, pos.Generation); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatal("expected immutable")
+		} else if got, err := client.AttachedSnapshotPos(ctx, pos.Generation, "aux", pos.Index); err != nil {
+			t.Fatal(err)
+		} else if got != pos {
+			t.Fatalf("pos=%s, want %s", got, pos)
+		} else if info, err := client.SnapshotInfoAt(ctx, pos.Generation, pos.Index); err != nil {
+			t.Fatal(err)
+		} else if got, want := info.Index, pos.Index; got != want {
+			t.Fatalf("Index=%d, want %d", got, want)
+		}
+
+		rc, err := client.AttachedSnapshotReader(ctx, "aux", pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		if buf, err := io.ReadAll(rc); err != nil {
+			t.Fatal(err)
+		} else if got, want := string(buf), "attached"; got != want {
+			t.Fatalf("data=%q, want %q", got, want)
+		}
+
+		fc.GenerationFormat = ulidGenerationFormat{}
+		if !client.IsValidGenerationName("01ARZ3NDEKTSV4RRFFQ69G5FAV") {
+			t.Fatal("expected generation name to be valid")
+		}
+	})
+
+	t.Run("Replica", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		r := litestream.NewReplica(db, "", litestream.NewReadOnlyReplicaClient(litestream.NewFileReplicaClient(t.TempDir())))
+		if _, err := r.Snapshot(context.Background()); !errors.Is(err, litestream.ErrReadOnly) {
+			t.Fatalf("Snapshot(): unexpected error: %v", err)
+		}
+	})
+
+	// Ensure a replica using a read-only client does not start replicating.
+	t.Run("Start", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		var n int32
+		fc := litestream.NewFileReplicaClient(t.TempDir())
+		c := &mock.ReplicaClient{
+			GenerationsFunc: func(ctx context.Context) ([]string, error) {
+				atomic.AddInt32(&n, 1)
+				return fc.Generations(ctx)
+			},
+			SnapshotsFunc: func(ctx context.Context, generation string) (litestream.SnapshotIterator, error) {
+				atomic.AddInt32(&n, 1)
+				return fc.Snapshots(ctx, generation)
+			},
+			WALSegmentsFunc: func(ctx context.Context, generation string) (litestream.WALSegmentIterator, error) {
+				atomic.AddInt32(&n, 1)
+				return fc.WALSegments(ctx, generation)
+			},
+		}
+
+		r := litestream.NewReplica(db, "", litestream.NewReadOnlyReplicaClient(c))
+		r.SyncInterval = time.Millisecond
+		r.Start(context.Background())
+		time.Sleep(20 * time.Millisecond)
+		r.Stop()
+		if got := atomic.LoadInt32(&n); got != 0 {
+			t.Fatalf("client calls=%d, want 0", got)
+		}
+	})
+}
+
 func TestFindSnapshotForIndex(t *testing.T) {
 	t.Run("BeforeIndex", func(t *testing.T) {
 		client := litestream.NewFileReplicaClient(filepath.Join("testdata", "find-snapshot-for-index", "ok"))
@@ -136,6 +288,34 @@ func TestWALTimeBounds(t *testing.T) {
 		}
 	})
 
+	// Ensure snapshot times are excluded from the bounds.
+	t.Run("ExcludeSnapshots", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		mustCopyReplicaClient(t, c, litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")), "0000000000000000")
+
+		// Backdate the snapshot before all WAL segments.
+		if filename, err := c.SnapshotPath("0000000000000000", 0); err != nil {
+			t.Fatal(err)
+		} else {
+			mustChtimes(t, filename, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+		}
+		for i, pos := range mustWALSegmentPositions(t, c, "0000000000000000") {
+			filename, err := c.WALSegmentPath(pos.Generation, pos.Index, pos.Offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mustChtimes(t, filename, time.Date(2000, 1, 2+i, 0, 0, 0, 0, time.UTC))
+		}
+
+		if min, max, err := litestream.WALTimeBounds(context.Background(), c, "0000000000000000"); err != nil {
+			t.Fatal(err)
+		} else if got, want := min, time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+			t.Fatalf("min=%s, want %s", got, want)
+		} else if got, want := max, time.Date(2000, 1, 7, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+			t.Fatalf("max=%s, want %s", got, want)
+		}
+	})
+
 	t.Run("ErrNoWALSegments", func(t *testing.T) {
 		client := litestream.NewFileReplicaClient(filepath.Join("testdata", "wal-time-bounds", "no-wal-segments"))
 		if _, _, err := litestream.WALTimeBounds(context.Background(), client, "0000000000000000"); err != litestream.ErrNoWALSegments {
@@ -143,6 +323,16 @@ func TestWALTimeBounds(t *testing.T) {
 		}
 	})
 
+	// Ensure a generation with only snapshots returns zero times.
+	t.Run("SnapshotsOnly", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(filepath.Join("testdata", "generation-time-bounds", "snapshots-only"))
+		if min, max, err := litestream.WALTimeBounds(context.Background(), client, "0000000000000000"); err != litestream.ErrNoWALSegments {
+			t.Fatalf("unexpected error: %#v", err)
+		} else if !min.IsZero() || !max.IsZero() {
+			t.Fatalf("expected zero times, got min=%s, max=%s", min, max)
+		}
+	})
+
 	t.Run("ErrWALSegments", func(t *testing.T) {
 		var client mock.ReplicaClient
 		client.WALSegmentsFunc = func(ctx context.Context, generation string) (litestream.WALSegmentIterator, error) {
@@ -585,6 +775,37 @@ func TestFindWALIndexByTimestamp(t *testing.T) {
 	})
 }
 
+func TestSnapshotInfoAt(t *testing.T) {
+	client := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+
+	// The read-only wrapper does not implement InfoClient so the snapshots
+	// are listed instead.
+	for _, c := range []litestream.ReplicaClient{client, litestream.NewReadOnlyReplicaClient(client)} {
+		if info, err := litestream.SnapshotInfoAt(context.Background(), c, "0000000000000000", 0); err != nil {
+			t.Fatal(err)
+		} else if info.Index != 0 || info.Size == 0 {
+			t.Fatalf("unexpected info: %#v", info)
+		} else if _, err := litestream.SnapshotInfoAt(context.Background(), c, "0000000000000000", 1); err != os.ErrNotExist {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestWALInfoAt(t *testing.T) {
+	client := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+
+	for _, c := range []litestream.ReplicaClient{client, litestream.NewReadOnlyReplicaClient(client)} {
+		pos := litestream.Pos{Generation: "0000000000000000", Index: 1}
+		if info, err := litestream.WALInfoAt(context.Background(), c, pos); err != nil {
+			t.Fatal(err)
+		} else if info.Pos() != pos || info.Size == 0 {
+			t.Fatalf("unexpected info: %#v", info)
+		} else if _, err := litestream.WALInfoAt(context.Background(), c, litestream.Pos{Generation: "0000000000000000", Index: 1, Offset: 1}); err != os.ErrNotExist {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
 func TestFindIndexByTimestamp(t *testing.T) {
 	t.Run("OK", func(t *testing.T) {
 		client := litestream.NewFileReplicaClient(filepath.Join("testdata", "index-by-timestamp", "ok"))
@@ -639,6 +860,9 @@ func TestFindIndexByTimestamp(t *testing.T) {
 		client.SnapshotsFunc = func(ctx context.Context, generation string) (litestream.SnapshotIterator, error) {
 			return litestream.NewSnapshotInfoSliceIterator([]litestream.SnapshotInfo{{Index: 0x00000001}}), nil
 		}
+		client.SnapshotReaderFunc = func(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
 		client.WALSegmentsFunc = func(ctx context.Context, generation string) (litestream.WALSegmentIterator, error) {
 			return nil, fmt.Errorf("marker")
 		}
@@ -650,6 +874,787 @@ func TestFindIndexByTimestamp(t *testing.T) {
 	})
 }
 
+func TestIsRestorable(t *testing.T) {
+	client := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+
+	t.Run("OK", func(t *testing.T) {
+		for _, pos := range []litestream.Pos{
+			{Generation: "0000000000000000", Index: 0, Offset: 0},
+			{Generation: "0000000000000000", Index: 0, Offset: 0x2050},
+			{Generation: "0000000000000000", Index: 2, Offset: 0},
+			{Generation: "0000000000000000", Index: 2, Offset: 0x1038},
+		} {
+			if ok, err := litestream.IsRestorable(context.Background(), client, pos); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Fatalf("expected %s to be restorable", pos)
+			}
+		}
+	})
+
+	t.Run("PastEnd", func(t *testing.T) {
+		for _, pos := range []litestream.Pos{
+			{Generation: "0000000000000000", Index: 2, Offset: 0x100000},
+			{Generation: "0000000000000000", Index: 4, Offset: 0},
+		} {
+			if ok, err := litestream.IsRestorable(context.Background(), client, pos); err != nil {
+				t.Fatal(err)
+			} else if ok {
+				t.Fatalf("expected %s to not be restorable", pos)
+			}
+		}
+	})
+
+	t.Run("Pruned", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		mustCopyReplicaClient(t, c, client, "0000000000000000")
+		if err := c.DeleteWALSegments(context.Background(), []litestream.Pos{
+			{Generation: "0000000000000000", Index: 0, Offset: 0},
+			{Generation: "0000000000000000", Index: 0, Offset: 0x2050},
+			{Generation: "0000000000000000", Index: 0, Offset: 0x3068},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, err := litestream.IsRestorable(context.Background(), c, litestream.Pos{Generation: "0000000000000000", Index: 2, Offset: 0}); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Fatal("expected position to not be restorable")
+		}
+	})
+
+	// Ensure a segment missing from the middle of an index is detected.
+	t.Run("MissingSegment", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		mustCopyReplicaClient(t, c, client, "0000000000000000")
+		if err := c.DeleteWALSegments(context.Background(), []litestream.Pos{
+			{Generation: "0000000000000000", Index: 0, Offset: 0x2050},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, err := litestream.IsRestorable(context.Background(), c, litestream.Pos{Generation: "0000000000000000", Index: 2, Offset: 0}); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Fatal("expected position to not be restorable")
+		}
+	})
+
+	t.Run("NoGeneration", func(t *testing.T) {
+		if ok, err := litestream.IsRestorable(context.Background(), client, litestream.Pos{Generation: "0000000000000001"}); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Fatal("expected position to not be restorable")
+		}
+	})
+}
+
+func TestRestoreReader(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		client := litestream.NewFileReplicaClient(testDir)
+
+		rc, err := litestream.RestoreReader(context.Background(), client, "0000000000000000", 0, 2, litestream.NewRestoreOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+
+		buf, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := rc.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if want, err := os.ReadFile(filepath.Join(testDir, "0000000000000002.db")); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, want) {
+			t.Fatalf("database mismatch: len(%d), len(%d)", len(buf), len(want))
+		}
+	})
+
+	t.Run("ErrNoSnapshot", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		if _, err := litestream.RestoreReader(context.Background(), client, "0000000000000000", 0, 0, litestream.NewRestoreOptions()); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestRestoreInto(t *testing.T) {
+	// openMemDB returns an in-memory database with a single connection so
+	// every query sees the same database.
+	openMemDB := func(tb testing.TB) *sql.DB {
+		tb.Helper()
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { _ = db.Close() })
+		db.SetMaxOpenConns(1)
+
+		if _, err := db.Exec(`CREATE TABLE junk (x); INSERT INTO junk VALUES (1)`); err != nil {
+			tb.Fatal(err)
+		}
+		return db
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		db := openMemDB(t)
+		client := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+		if err := litestream.RestoreInto(context.Background(), client, db, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		}
+
+		var n, max int
+		if err := db.QueryRow(`SELECT COUNT(*), MAX(x) FROM t`).Scan(&n, &max); err != nil {
+			t.Fatal(err)
+		} else if n != 5 || max != 5 {
+			t.Fatalf("count=%d, max=%d, want 5", n, max)
+		}
+
+		if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'junk'`).Scan(&n); err != nil {
+			t.Fatal(err)
+		} else if n != 0 {
+			t.Fatal("expected existing table to be replaced")
+		}
+	})
+
+	t.Run("ErrNoGeneration", func(t *testing.T) {
+		db := openMemDB(t)
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		if err := litestream.RestoreInto(context.Background(), client, db, litestream.NewRestoreOptions()); err != litestream.ErrNoGeneration {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM junk`).Scan(&n); err != nil {
+			t.Fatal(err)
+		} else if n != 1 {
+			t.Fatalf("count=%d, want 1", n)
+		}
+	})
+}
+
+func TestSelfTest(t *testing.T) {
+	// mustNoScratchFiles asserts that no self-test directories remain.
+	mustNoScratchFiles := func(tb testing.TB) {
+		tb.Helper()
+		if a, err := filepath.Glob(filepath.Join(os.TempDir(), "litestream-selftest-*")); err != nil {
+			tb.Fatal(err)
+		} else if len(a) != 0 {
+			tb.Fatalf("scratch files remain: %v", a)
+		}
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		if err := litestream.SelfTest(context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+
+		if generations, err := c.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if len(generations) != 0 {
+			t.Fatalf("generations remain: %v", generations)
+		}
+		mustNoScratchFiles(t)
+	})
+
+	t.Run("ErrEmptyWALSegment", func(t *testing.T) {
+		fc := litestream.NewFileReplicaClient(t.TempDir())
+
+		// Drop all WAL data read back from the client so the restore cannot
+		// replay the rows written to the scratch database.
+		c := &mock.ReplicaClient{
+			GenerationsFunc:       fc.Generations,
+			DeleteGenerationFunc:  fc.DeleteGeneration,
+			SnapshotsFunc:         fc.Snapshots,
+			WriteSnapshotFunc:     fc.WriteSnapshot,
+			DeleteSnapshotFunc:    fc.DeleteSnapshot,
+			SnapshotReaderFunc:    fc.SnapshotReader,
+			WALSegmentsFunc:       fc.WALSegments,
+			WriteWALSegmentFunc:   fc.WriteWALSegment,
+			DeleteWALSegmentsFunc: fc.DeleteWALSegments,
+			WALSegmentReaderFunc: func(ctx context.Context, pos litestream.Pos) (io.ReadCloser, error) {
+				var buf bytes.Buffer
+				zw := lz4.NewWriter(&buf)
+				if err := zw.Close(); err != nil {
+					return nil, err
+				}
+				return io.NopCloser(&buf), nil
+			},
+		}
+
+		if err := litestream.SelfTest(context.Background(), c); err == nil || !strings.HasPrefix(err.Error(), `restore: `) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if generations, err := fc.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if len(generations) != 0 {
+			t.Fatalf("generations remain: %v", generations)
+		}
+		mustNoScratchFiles(t)
+	})
+}
+
+func TestAtomicRestore(t *testing.T) {
+	testDir := filepath.Join("testdata", "restore", "ok")
+	src := litestream.NewFileReplicaClient(testDir)
+
+	// mustWriteTarget writes placeholder data to a target path.
+	mustWriteTarget := func(tb testing.TB) string {
+		tb.Helper()
+		filename := filepath.Join(tb.TempDir(), "db")
+		if err := os.WriteFile(filename, []byte("original"), 0600); err != nil {
+			tb.Fatal(err)
+		}
+		return filename
+	}
+
+	// mustTargetUntouched fails if the original file was changed or if
+	// temporary restore files were left behind.
+	mustTargetUntouched := func(tb testing.TB, filename string) {
+		tb.Helper()
+		if buf, err := os.ReadFile(filename); err != nil {
+			tb.Fatal(err)
+		} else if string(buf) != "original" {
+			tb.Fatal("original database modified")
+		}
+		ents, err := os.ReadDir(filepath.Dir(filename))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		for _, ent := range ents {
+			if strings.Contains(ent.Name(), ".restoring") {
+				tb.Fatalf("expected temporary restore file to be removed: %s", ent.Name())
+			}
+		}
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		filename := mustWriteTarget(t)
+		if err := litestream.AtomicRestore(context.Background(), src, filename, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), filename) {
+			t.Fatal("file mismatch")
+		}
+
+		if ents, err := os.ReadDir(filepath.Dir(filename)); err != nil {
+			t.Fatal(err)
+		} else if len(ents) != 1 {
+			t.Fatalf("unexpected files: %v", ents)
+		}
+	})
+
+	// Truncate the compressed WAL segment in a middle index so the restore
+	// fails after the snapshot has already been written.
+	t.Run("ErrMidRestore", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		mustCopyReplicaClient(t, client, src, "0000000000000000")
+
+		pos := litestream.Pos{Generation: "0000000000000000", Index: 1}
+		rd, err := src.WALSegmentReader(context.Background(), pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rd.Close()
+		if buf, err := io.ReadAll(rd); err != nil {
+			t.Fatal(err)
+		} else if _, err := client.WriteWALSegment(context.Background(), pos, bytes.NewReader(buf[:len(buf)/2])); err != nil {
+			t.Fatal(err)
+		}
+
+		filename := mustWriteTarget(t)
+		if err := litestream.AtomicRestore(context.Background(), client, filename, litestream.NewRestoreOptions()); err == nil {
+			t.Fatal("expected error")
+		}
+		mustTargetUntouched(t, filename)
+	})
+
+	t.Run("ErrNonEmptyWAL", func(t *testing.T) {
+		filename := mustWriteTarget(t)
+		if err := os.WriteFile(filename+"-wal", []byte("wal"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := litestream.AtomicRestore(context.Background(), src, filename, litestream.NewRestoreOptions()); err == nil || !strings.Contains(err.Error(), "non-empty wal") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		mustTargetUntouched(t, filename)
+	})
+}
+
+func TestRestoreLatest(t *testing.T) {
+	testDir := filepath.Join("testdata", "restore", "ok")
+	src := litestream.NewFileReplicaClient(testDir)
+
+	// copyGeneration copies the test generation into generation on dst and
+	// sets the time of every snapshot & WAL file to t.
+	copyGeneration := func(tb testing.TB, dst *litestream.FileReplicaClient, generation string, walN int, t time.Time) {
+		tb.Helper()
+		ctx := context.Background()
+
+		rd, err := src.SnapshotReader(ctx, "0000000000000000", 0)
+		if err != nil {
+			tb.Fatal(err)
+		} else if _, err := dst.WriteSnapshot(ctx, generation, 0, rd); err != nil {
+			tb.Fatal(err)
+		} else if err := rd.Close(); err != nil {
+			tb.Fatal(err)
+		}
+		if filename, err := dst.SnapshotPath(generation, 0); err != nil {
+			tb.Fatal(err)
+		} else {
+			mustChtimes(tb, filename, t)
+		}
+
+		positions := mustWALSegmentPositions(tb, src, "0000000000000000")
+		for _, pos := range positions[:walN] {
+			rd, err := src.WALSegmentReader(ctx, pos)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			pos.Generation = generation
+			if _, err := dst.WriteWALSegment(ctx, pos, rd); err != nil {
+				tb.Fatal(err)
+			} else if err := rd.Close(); err != nil {
+				tb.Fatal(err)
+			}
+
+			filename, err := dst.WALSegmentPath(pos.Generation, pos.Index, pos.Offset)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			mustChtimes(tb, filename, t)
+		}
+	}
+
+	// snapshotOnlyDB returns the path to the database restored from the snapshot alone.
+	snapshotOnlyDB := func(tb testing.TB) string {
+		tb.Helper()
+		filename := filepath.Join(tb.TempDir(), "db")
+		if err := litestream.RestoreSnapshot(context.Background(), src, filename, "0000000000000000", 0, 0600, -1, -1); err != nil {
+			tb.Fatal(err)
+		}
+		return filename
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		copyGeneration(t, client, "0000000000000000", 6, time.Now().Add(-time.Hour))
+		copyGeneration(t, client, "0000000000000001", 0, time.Now())
+
+		filename := filepath.Join(t.TempDir(), "db")
+		if err := litestream.RestoreLatest(context.Background(), client, filename, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		} else if !fileEqual(t, snapshotOnlyDB(t), filename) {
+			t.Fatal("expected newest generation to be restored")
+		}
+	})
+
+	t.Run("LatestWAL", func(t *testing.T) {
+		// Both generations are last updated at the same time but only the
+		// second generation has WAL segments at that time.
+		updatedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		copyGeneration(t, client, "0000000000000000", 0, updatedAt)
+		copyGeneration(t, client, "0000000000000001", 6, updatedAt)
+
+		filename := filepath.Join(t.TempDir(), "db")
+		if err := litestream.RestoreLatest(context.Background(), client, filename, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), filename) {
+			t.Fatal("expected generation with latest WAL to be restored")
+		}
+	})
+
+	t.Run("ErrNoGeneration", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		if err := litestream.RestoreLatest(context.Background(), client, filepath.Join(t.TempDir(), "db"), litestream.NewRestoreOptions()); err != litestream.ErrNoGeneration {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestEstimateRestore(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		client := litestream.NewFileReplicaClient(testDir)
+
+		// Sum the sizes of the snapshot & all WAL files in the generation.
+		var want int64
+		if err := filepath.Walk(filepath.Join(testDir, "generations", "0000000000000000"), func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			} else if fi.Mode().IsRegular() {
+				want += fi.Size()
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		est, err := litestream.EstimateRestore(context.Background(), client, "0000000000000000", 0, 2)
+		if err != nil {
+			t.Fatal(err)
+		} else if got := est.Bytes; got != want {
+			t.Fatalf("Bytes=%d, want %d", got, want)
+		} else if got, want := est.SnapshotN, 1; got != want {
+			t.Fatalf("SnapshotN=%d, want %d", got, want)
+		} else if got, want := est.WALSegmentN, 6; got != want {
+			t.Fatalf("WALSegmentN=%d, want %d", got, want)
+		}
+	})
+
+	t.Run("TargetIndex", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+		if est, err := litestream.EstimateRestore(context.Background(), client, "0000000000000000", 0, 0); err != nil {
+			t.Fatal(err)
+		} else if got, want := est.WALSegmentN, 3; got != want {
+			t.Fatalf("WALSegmentN=%d, want %d", got, want)
+		}
+	})
+
+	t.Run("ErrNoSnapshots", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+		if _, err := litestream.EstimateRestore(context.Background(), client, "0000000000000000", 1, 2); err != litestream.ErrNoSnapshots {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestSnapshotMetadata(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES (randomblob(10000));`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		r := litestream.NewReplica(db, "", c)
+		info, err := r.Snapshot(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Compare against the header of the source database file.
+		hdr := make([]byte, 100)
+		if f, err := os.Open(db.Path()); err != nil {
+			t.Fatal(err)
+		} else if _, err := io.ReadFull(f, hdr); err != nil {
+			t.Fatal(err)
+		} else if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		pageSize, pageN := int(binary.BigEndian.Uint16(hdr[16:18])), int(binary.BigEndian.Uint32(hdr[28:32]))
+
+		meta, err := litestream.SnapshotMetadata(context.Background(), c, info.Generation, info.Index)
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := meta, (litestream.SnapshotMeta{PageSize: pageSize, PageN: pageN, Size: int64(pageSize * pageN)}); got != want {
+			t.Fatalf("SnapshotMetadata()=%#v, want %#v", got, want)
+		} else if meta.PageN < 3 {
+			t.Fatalf("unexpected page count: %d", meta.PageN)
+		}
+	})
+
+	t.Run("ErrNotExist", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		if _, err := litestream.SnapshotMetadata(context.Background(), c, "0000000000000000", 0); !os.IsNotExist(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDescribeGeneration(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+		desc, err := litestream.DescribeGeneration(context.Background(), client, "0000000000000000")
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := desc.Generation, "0000000000000000"; got != want {
+			t.Fatalf("Generation=%s, want %s", got, want)
+		} else if got, want := len(desc.Snapshots), 1; got != want {
+			t.Fatalf("len(Snapshots)=%d, want %d", got, want)
+		} else if s := desc.Snapshots[0]; s.Index != 0 || s.Size != 93 || !s.Compressed || s.Codec != litestream.CodecLZ4 {
+			t.Fatalf("unexpected snapshot: %#v", s)
+		} else if got, want := len(desc.Gaps), 0; got != want {
+			t.Fatalf("len(Gaps)=%d, want %d", got, want)
+		} else if got, want := desc.Pos, (litestream.Pos{Generation: "0000000000000000", Index: 2, Offset: 0x2050}); got != want {
+			t.Fatalf("Pos=%s, want %s", got, want)
+		}
+
+		var positions []litestream.Pos
+		for _, s := range desc.WALSegments {
+			if !s.Compressed || s.Codec != litestream.CodecLZ4 || s.Size == 0 {
+				t.Fatalf("unexpected wal segment: %#v", s)
+			}
+			positions = append(positions, s.Pos())
+		}
+		if got, want := positions, []litestream.Pos{
+			{Generation: "0000000000000000", Index: 0, Offset: 0},
+			{Generation: "0000000000000000", Index: 0, Offset: 0x2050},
+			{Generation: "0000000000000000", Index: 0, Offset: 0x3068},
+			{Generation: "0000000000000000", Index: 1, Offset: 0},
+			{Generation: "0000000000000000", Index: 2, Offset: 0},
+			{Generation: "0000000000000000", Index: 2, Offset: 0x1038},
+		}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("WALSegments=%v, want %v", got, want)
+		}
+	})
+
+	t.Run("Gaps", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		mustCopyReplicaClient(t, client, litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")), "0000000000000000")
+
+		// Remove WAL index 1 & decompress the first segment of index 2.
+		if err := client.DeleteWALSegments(context.Background(), []litestream.Pos{{Generation: "0000000000000000", Index: 1, Offset: 0}}); err != nil {
+			t.Fatal(err)
+		}
+		if filename, err := client.WALSegmentPath("0000000000000000", 2, 0); err != nil {
+			t.Fatal(err)
+		} else {
+			mustDecompressFile(t, filename)
+		}
+
+		desc, err := litestream.DescribeGeneration(context.Background(), client, "0000000000000000")
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := desc.Gaps, []int{1}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Gaps=%v, want %v", got, want)
+		} else if got, want := len(desc.WALSegments), 5; got != want {
+			t.Fatalf("len(WALSegments)=%d, want %d", got, want)
+		} else if s := desc.WALSegments[3]; s.Index != 2 || s.Offset != 0 || s.Compressed {
+			t.Fatalf("unexpected wal segment: %#v", s)
+		} else if got, want := desc.Pos, (litestream.Pos{Generation: "0000000000000000", Index: 2, Offset: 0x2050}); got != want {
+			t.Fatalf("Pos=%s, want %s", got, want)
+		}
+	})
+
+	t.Run("MixedCodecs", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		mustCopyReplicaClient(t, client, litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")), "0000000000000000")
+
+		// Decompress the snapshot & every WAL segment in index 0, as if
+		// written before the codec was changed.
+		if filename, err := client.SnapshotPath("0000000000000000", 0); err != nil {
+			t.Fatal(err)
+		} else {
+			mustDecompressFile(t, filename)
+		}
+		for _, offset := range []int64{0, 0x2050, 0x3068} {
+			filename, err := client.WALSegmentPath("0000000000000000", 0, offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mustDecompressFile(t, filename)
+		}
+
+		desc, err := litestream.DescribeGeneration(context.Background(), client, "0000000000000000")
+		if err != nil {
+			t.Fatal(err)
+		} else if s := desc.Snapshots[0]; s.Codec != litestream.CodecNone || s.Compressed {
+			t.Fatalf("unexpected snapshot: %#v", s)
+		}
+		for _, s := range desc.WALSegments {
+			if want := s.Index != 0; s.Compressed != want {
+				t.Fatalf("unexpected wal segment: %#v", s)
+			} else if want && s.Codec != litestream.CodecLZ4 {
+				t.Fatalf("unexpected codec: %#v", s)
+			} else if !want && s.Codec != litestream.CodecNone {
+				t.Fatalf("unexpected codec: %#v", s)
+			}
+		}
+
+		// Mixed codecs should still restore.
+		filename := filepath.Join(t.TempDir(), "db")
+		if err := litestream.Restore(context.Background(), client, filename, "0000000000000000", 0, 2, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		} else if !fileEqual(t, filepath.Join("testdata", "restore", "ok", "0000000000000002.db"), filename) {
+			t.Fatal("file mismatch")
+		}
+	})
+
+	t.Run("ErrNoSnapshots", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		if _, err := litestream.DescribeGeneration(context.Background(), client, "0000000000000000"); err != litestream.ErrNoSnapshots {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestExportGeneration(t *testing.T) {
+	t.Run("RoundTrip", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		src := litestream.NewFileReplicaClient(testDir)
+
+		var buf bytes.Buffer
+		if err := litestream.ExportGeneration(context.Background(), src, "0000000000000000", &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		dst := litestream.NewFileReplicaClient(t.TempDir())
+		if err := litestream.ImportGeneration(context.Background(), dst, bytes.NewReader(buf.Bytes()), false); err != nil {
+			t.Fatal(err)
+		}
+
+		filename := filepath.Join(t.TempDir(), "db")
+		if err := litestream.Restore(context.Background(), dst, filename, "0000000000000000", 0, 2, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), filename) {
+			t.Fatalf("file mismatch")
+		}
+	})
+
+	t.Run("ErrGenerationExists", func(t *testing.T) {
+		src := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+
+		var buf bytes.Buffer
+		if err := litestream.ExportGeneration(context.Background(), src, "0000000000000000", &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		dst := litestream.NewFileReplicaClient(t.TempDir())
+		if err := litestream.ImportGeneration(context.Background(), dst, bytes.NewReader(buf.Bytes()), false); err != nil {
+			t.Fatal(err)
+		} else if err := litestream.ImportGeneration(context.Background(), dst, bytes.NewReader(buf.Bytes()), false); err != litestream.ErrGenerationExists {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := litestream.ImportGeneration(context.Background(), dst, bytes.NewReader(buf.Bytes()), true); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure a truncated archive does not replace an existing generation.
+	t.Run("Truncated", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		src := litestream.NewFileReplicaClient(testDir)
+
+		var buf bytes.Buffer
+		if err := litestream.ExportGeneration(context.Background(), src, "0000000000000000", &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		dst := litestream.NewFileReplicaClient(t.TempDir())
+		if err := litestream.ImportGeneration(context.Background(), dst, bytes.NewReader(buf.Bytes()), false); err != nil {
+			t.Fatal(err)
+		}
+
+		// Truncate between entries, within an entry, & within the trailer.
+		for _, n := range []int{buf.Len() / 2, buf.Len()/2 + 100, buf.Len() - 512} {
+			if err := litestream.ImportGeneration(context.Background(), dst, bytes.NewReader(buf.Bytes()[:n]), true); err == nil {
+				t.Fatalf("expected error: n=%d", n)
+			}
+		}
+
+		filename := filepath.Join(t.TempDir(), "db")
+		if err := litestream.Restore(context.Background(), dst, filename, "0000000000000000", 0, 2, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), filename) {
+			t.Fatalf("file mismatch")
+		}
+	})
+
+	// Ensure images of attached databases are carried with the generation.
+	t.Run("Attached", func(t *testing.T) {
+		ctx := context.Background()
+		src := litestream.NewFileReplicaClient(t.TempDir())
+		pos := litestream.Pos{Generation: "0000000000000000", Index: 1, Offset: 4096}
+		if _, err := src.WriteSnapshot(ctx, pos.Generation, pos.Index, strings.NewReader("snapshot")); err != nil {
+			t.Fatal(err)
+		} else if _, err := src.WriteAttachedSnapshot(ctx, "aux", pos, strings.NewReader("attached")); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := litestream.ExportGeneration(ctx, src, pos.Generation, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		dst := litestream.NewFileReplicaClient(t.TempDir())
+		if err := litestream.ImportGeneration(ctx, dst, bytes.NewReader(buf.Bytes()), false); err != nil {
+			t.Fatal(err)
+		}
+
+		if names, err := dst.AttachedNames(ctx, pos.Generation); err != nil {
+			t.Fatal(err)
+		} else if got, want := names, []string{"aux"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("AttachedNames()=%v, want %v", got, want)
+		}
+
+		if got, err := dst.AttachedSnapshotPos(ctx, pos.Generation, "aux", pos.Index); err != nil {
+			t.Fatal(err)
+		} else if got != pos {
+			t.Fatalf("AttachedSnapshotPos()=%s, want %s", got, pos)
+		}
+
+		rd, err := dst.AttachedSnapshotReader(ctx, "aux", pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rd.Close()
+		if b, err := io.ReadAll(rd); err != nil {
+			t.Fatal(err)
+		} else if got, want := string(b), "attached"; got != want {
+			t.Fatalf("data=%q, want %q", got, want)
+		}
+	})
+
+	// Ensure an attached image with a malformed path is rejected.
+	t.Run("ErrInvalidAttachedPath", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(&tar.Header{Name: "0000000000000000/attached/aux/xyz.snapshot.lz4", Mode: 0600, Size: 0}); err != nil {
+			t.Fatal(err)
+		} else if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		dst := litestream.NewFileReplicaClient(t.TempDir())
+		if err := litestream.ImportGeneration(context.Background(), dst, &buf, false); err == nil || !strings.Contains(err.Error(), "invalid attached snapshot path") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure generations are validated with the destination's generation format.
+	t.Run("GenerationFormat", func(t *testing.T) {
+		const generation = "01ARZ3NDEKTSV4RRFFQ69G5FAV"
+		src := litestream.NewFileReplicaClient(t.TempDir())
+		src.GenerationFormat = ulidGenerationFormat{}
+		if _, err := src.WriteSnapshot(context.Background(), generation, 0, strings.NewReader("snapshot")); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := litestream.ExportGeneration(context.Background(), src, generation, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		// The default format rejects the generation name.
+		if err := litestream.ImportGeneration(context.Background(), litestream.NewFileReplicaClient(t.TempDir()), bytes.NewReader(buf.Bytes()), false); err == nil {
+			t.Fatal("expected error")
+		}
+
+		dst := litestream.NewFileReplicaClient(t.TempDir())
+		dst.GenerationFormat = ulidGenerationFormat{}
+		if err := litestream.ImportGeneration(context.Background(), dst, bytes.NewReader(buf.Bytes()), false); err != nil {
+			t.Fatal(err)
+		} else if generations, err := dst.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := generations, []string{generation}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Generations()=%v, want %v", got, want)
+		}
+	})
+}
+
 func TestRestore(t *testing.T) {
 	t.Run("OK", func(t *testing.T) {
 		testDir := filepath.Join("testdata", "restore", "ok")
@@ -663,6 +1668,229 @@ func TestRestore(t *testing.T) {
 		}
 	})
 
+	t.Run("NoWALRecovery", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		tempDir := t.TempDir()
+
+		client := litestream.NewFileReplicaClient(testDir)
+		if err := litestream.Restore(context.Background(), client, filepath.Join(tempDir, "db"), "0000000000000000", 0, 2, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the database file should exist, without a WAL or SHM to recover.
+		if ents, err := os.ReadDir(tempDir); err != nil {
+			t.Fatal(err)
+		} else if len(ents) != 1 || ents[0].Name() != "db" {
+			t.Fatalf("unexpected files: %v", ents)
+		}
+
+		sqldb := MustOpenSQLDB(t, filepath.Join(tempDir, "db"))
+		defer MustCloseSQLDB(t, sqldb)
+		var s string
+		if err := sqldb.QueryRow(`PRAGMA integrity_check;`).Scan(&s); err != nil {
+			t.Fatal(err)
+		} else if s != "ok" {
+			t.Fatalf("integrity check failed: %s", s)
+		}
+	})
+
+	// Ensure the restored database is a single consolidated file.
+	t.Run("Checkpoint", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		tempDir := t.TempDir()
+
+		client := litestream.NewFileReplicaClient(testDir)
+		if err := litestream.Restore(context.Background(), client, filepath.Join(tempDir, "db"), "0000000000000000", 0, 2, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), filepath.Join(tempDir, "db")) {
+			t.Fatalf("file mismatch")
+		}
+
+		if fi, err := os.Stat(filepath.Join(tempDir, "db-wal")); err == nil && fi.Size() != 0 {
+			t.Fatalf("unexpected wal size: %d", fi.Size())
+		} else if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("TargetPos", func(t *testing.T) {
+		// queryValues returns the values of the test table in the restored database.
+		queryValues := func(tb testing.TB, filename string) []int {
+			tb.Helper()
+			sqldb := MustOpenSQLDB(tb, filename)
+			defer MustCloseSQLDB(tb, sqldb)
+
+			rows, err := sqldb.Query(`SELECT x FROM t ORDER BY x`)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			defer rows.Close()
+
+			var a []int
+			for rows.Next() {
+				var x int
+				if err := rows.Scan(&x); err != nil {
+					tb.Fatal(err)
+				}
+				a = append(a, x)
+			}
+			if err := rows.Err(); err != nil {
+				tb.Fatal(err)
+			}
+			return a
+		}
+
+		for _, tt := range []struct {
+			name   string
+			offset int64
+			stop   int64
+			values []int
+		}{
+			{"Header", 0x20, 0x20, []int{1, 2, 3}},
+			{"FrameBoundary", 0x1038, 0x1038, []int{1, 2, 3, 4}},
+			{"MidFrame", 0x1038 + 100, 0x1038, []int{1, 2, 3, 4}},
+			{"End", 0x2050, 0x2050, []int{1, 2, 3, 4, 5}},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				client := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+				filename := filepath.Join(t.TempDir(), "db")
+
+				var stop litestream.Pos
+				opt := litestream.NewRestoreOptions()
+				opt.TargetPos = litestream.Pos{Generation: "0000000000000000", Index: 2, Offset: tt.offset}
+				opt.OnTargetPos = func(pos litestream.Pos) { stop = pos }
+				if err := litestream.Restore(context.Background(), client, filename, "0000000000000000", 0, 2, opt); err != nil {
+					t.Fatal(err)
+				} else if got, want := stop, (litestream.Pos{Generation: "0000000000000000", Index: 2, Offset: tt.stop}); got != want {
+					t.Fatalf("stop=%s, want %s", got, want)
+				} else if got, want := queryValues(t, filename), tt.values; !reflect.DeepEqual(got, want) {
+					t.Fatalf("values=%v, want %v", got, want)
+				}
+			})
+		}
+	})
+
+	t.Run("ErrTargetPosIndexMismatch", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+		opt := litestream.NewRestoreOptions()
+		opt.TargetPos = litestream.Pos{Generation: "0000000000000000", Index: 1, Offset: 0x20}
+		if err := litestream.Restore(context.Background(), client, filepath.Join(t.TempDir(), "db"), "0000000000000000", 0, 2, opt); err == nil || !strings.Contains(err.Error(), "must be within target index") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("VerifySnapshot", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		tempDir := t.TempDir()
+
+		client := litestream.NewFileReplicaClient(testDir)
+		opt := litestream.NewRestoreOptions()
+		opt.VerifySnapshot = true
+		if err := litestream.Restore(context.Background(), client, filepath.Join(tempDir, "db"), "0000000000000000", 0, 2, opt); err != nil {
+			t.Fatal(err)
+		} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), filepath.Join(tempDir, "db")) {
+			t.Fatalf("file mismatch")
+		}
+	})
+
+	t.Run("ErrVerifySnapshot", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		mustCopyReplicaClient(t, client, litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")), "0000000000000000")
+
+		// Corrupt a byte in the middle of the compressed snapshot.
+		snapshotPath, err := client.SnapshotPath("0000000000000000", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := os.ReadFile(snapshotPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf[len(buf)/2] ^= 0xFF
+		if err := os.WriteFile(snapshotPath, buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		filename := filepath.Join(t.TempDir(), "db")
+		opt := litestream.NewRestoreOptions()
+		opt.VerifySnapshot = true
+		if err := litestream.Restore(context.Background(), client, filename, "0000000000000000", 0, 2, opt); err == nil || !strings.Contains(err.Error(), `cannot verify snapshot`) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Ensure no output was written.
+		for _, name := range []string{filename, filename + ".tmp"} {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Fatalf("expected %s to not exist: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("VerifyOnly", func(t *testing.T) {
+		client := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+
+		var results []litestream.RestoreVerification
+		filename := filepath.Join(t.TempDir(), "db")
+		opt := litestream.NewRestoreOptions()
+		opt.VerifyOnly = true
+		opt.OnVerify = func(v litestream.RestoreVerification) { results = append(results, v) }
+		if err := litestream.Restore(context.Background(), client, filename, "0000000000000000", 0, 2, opt); err != nil {
+			t.Fatal(err)
+		} else if got, want := results, []litestream.RestoreVerification{{
+			Pos:       litestream.Pos{Generation: "0000000000000000", Index: 2, Offset: 8272},
+			Integrity: "ok",
+		}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("results=%#v, want %#v", got, want)
+		}
+
+		// Ensure no output was written.
+		if ents, err := os.ReadDir(filepath.Dir(filename)); err != nil {
+			t.Fatal(err)
+		} else if len(ents) != 0 {
+			t.Fatalf("unexpected files: %v", ents)
+		}
+	})
+
+	t.Run("UncompressedSnapshot", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		mustCopyReplicaClient(t, client, litestream.NewFileReplicaClient(testDir), "0000000000000000")
+
+		// Replace the snapshot with uncompressed data under the same name.
+		filename, err := client.SnapshotPath("0000000000000000", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustDecompressFile(t, filename)
+
+		outputPath := filepath.Join(t.TempDir(), "db")
+		if err := litestream.Restore(context.Background(), client, outputPath, "0000000000000000", 0, 2, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), outputPath) {
+			t.Fatalf("file mismatch")
+		}
+	})
+
+	t.Run("UncompressedWALSegment", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		client := litestream.NewFileReplicaClient(t.TempDir())
+		mustCopyReplicaClient(t, client, litestream.NewFileReplicaClient(testDir), "0000000000000000")
+
+		// Replace a WAL segment with uncompressed data under the same name.
+		filename, err := client.WALSegmentPath("0000000000000000", 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustDecompressFile(t, filename)
+
+		outputPath := filepath.Join(t.TempDir(), "db")
+		if err := litestream.Restore(context.Background(), client, outputPath, "0000000000000000", 0, 2, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), outputPath) {
+			t.Fatalf("file mismatch")
+		}
+	})
+
 	t.Run("SnapshotOnly", func(t *testing.T) {
 		testDir := filepath.Join("testdata", "restore", "snapshot-only")
 		tempDir := t.TempDir()
@@ -689,6 +1917,72 @@ func TestRestore(t *testing.T) {
 		}
 	})
 
+	t.Run("Progress", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		tempDir := t.TempDir()
+
+		// Compute expected total from the on-disk sizes of the snapshot & WAL segments.
+		var want int64
+		if err := filepath.Walk(filepath.Join(testDir, "generations"), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				want += info.Size()
+			}
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		var done, total int64
+		opt := litestream.NewRestoreOptions()
+		opt.Progress = func(d, tot int64) { done, total = d, tot }
+
+		client := litestream.NewFileReplicaClient(testDir)
+		if err := litestream.Restore(context.Background(), client, filepath.Join(tempDir, "db"), "0000000000000000", 0, 2, opt); err != nil {
+			t.Fatal(err)
+		} else if total != want {
+			t.Fatalf("total=%d, want %d", total, want)
+		} else if done != want {
+			t.Fatalf("done=%d, want %d", done, want)
+		}
+	})
+
+	t.Run("ProgressUnknownTotal", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		tempDir := t.TempDir()
+
+		// Wrap the file client so it does not report snapshot sizes.
+		fc := litestream.NewFileReplicaClient(testDir)
+		client := mock.ReplicaClient{
+			SnapshotsFunc: func(ctx context.Context, generation string) (litestream.SnapshotIterator, error) {
+				itr, err := fc.Snapshots(ctx, generation)
+				if err != nil {
+					return nil, err
+				}
+				infos, err := litestream.SliceSnapshotIterator(itr)
+				for i := range infos {
+					infos[i].Size = 0
+				}
+				return litestream.NewSnapshotInfoSliceIterator(infos), err
+			},
+			SnapshotReaderFunc:   fc.SnapshotReader,
+			WALSegmentsFunc:      fc.WALSegments,
+			WALSegmentReaderFunc: fc.WALSegmentReader,
+		}
+
+		var n int
+		opt := litestream.NewRestoreOptions()
+		opt.Progress = func(done, total int64) {
+			if n++; total != -1 {
+				t.Fatalf("total=%d, want -1", total)
+			}
+		}
+		if err := litestream.Restore(context.Background(), &client, filepath.Join(tempDir, "db"), "0000000000000000", 0, 2, opt); err != nil {
+			t.Fatal(err)
+		} else if n == 0 {
+			t.Fatal("expected progress callback")
+		}
+	})
+
 	t.Run("ErrPathRequired", func(t *testing.T) {
 		var client mock.ReplicaClient
 		if err := litestream.Restore(context.Background(), &client, "", "0000000000000000", 0, 0, litestream.NewRestoreOptions()); err == nil || err.Error() != `restore path required` {
@@ -740,3 +2034,93 @@ func TestRestore(t *testing.T) {
 		}
 	})
 }
+
+// mustDecompressFile replaces an LZ4 compressed file with its uncompressed contents.
+func mustDecompressFile(tb testing.TB, filename string) {
+	tb.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	buf, err := io.ReadAll(lz4.NewReader(f))
+	if err != nil {
+		tb.Fatal(err)
+	} else if err := os.WriteFile(filename, buf, 0600); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestSnapshotReader_Reuse(t *testing.T) {
+	client := litestream.NewFileReplicaClient(t.TempDir())
+
+	// Write compressed & uncompressed snapshots of differing sizes.
+	data := make([][]byte, 3)
+	for i := range data {
+		data[i] = append([]byte("SQLite format 3\x00"), bytes.Repeat([]byte{byte(i + 1)}, (i+1)*100000)...)
+
+		b := data[i]
+		if i != 1 {
+			b = mustCompressLZ4(t, b)
+		}
+		if _, err := client.WriteSnapshot(context.Background(), "0000000000000000", i, bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Read concurrently so pooled readers are reused across snapshots. Some
+	// readers are abandoned before EOF to ensure they do not affect others.
+	var g errgroup.Group
+	for i := 0; i < 4; i++ {
+		i := i
+		g.Go(func() error {
+			for j := 0; j < 50; j++ {
+				index := (i + j) % len(data)
+				rc, err := litestream.SnapshotReader(context.Background(), client, "0000000000000000", index)
+				if err != nil {
+					return err
+				}
+
+				if j%5 == 0 {
+					if _, err := io.ReadFull(rc, make([]byte, 100)); err != nil {
+						return err
+					}
+				} else if buf, err := io.ReadAll(rc); err != nil {
+					return err
+				} else if !bytes.Equal(buf, data[index]) {
+					return fmt.Errorf("snapshot %d mismatch on read %d: len=%d, want %d", index, j, len(buf), len(data[index]))
+				}
+
+				if err := rc.Close(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkSnapshotReader(b *testing.B) {
+	client := litestream.NewFileReplicaClient(b.TempDir())
+	data := append([]byte("SQLite format 3\x00"), bytes.Repeat([]byte("x"), 4096)...)
+	if _, err := client.WriteSnapshot(context.Background(), "0000000000000000", 0, bytes.NewReader(mustCompressLZ4(b, data))); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rc, err := litestream.SnapshotReader(context.Background(), client, "0000000000000000", 0)
+		if err != nil {
+			b.Fatal(err)
+		} else if _, err := io.Copy(io.Discard, rc); err != nil {
+			b.Fatal(err)
+		} else if err := rc.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -3,13 +3,25 @@ package litestream_test
 import (
 	"bytes"
 	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/benbjohnson/litestream"
 	"github.com/benbjohnson/litestream/mock"
 	"github.com/pierrec/lz4/v4"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestReplica_Name(t *testing.T) {
@@ -26,6 +38,155 @@ func TestReplica_Name(t *testing.T) {
 	})
 }
 
+func TestReplica_Info(t *testing.T) {
+	t.Run("File", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "NAME", litestream.NewFileReplicaClient("/foo/bar"))
+		if got, want := r.Info(), (litestream.ReplicaInfo{Name: "NAME", Type: "file", Location: "/foo/bar"}); got != want {
+			t.Fatalf("Info()=%#v, want %#v", got, want)
+		}
+	})
+}
+
+func TestReplica_RetentionConfig(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", litestream.NewFileReplicaClient(t.TempDir()))
+		if got, want := r.RetentionConfig(), (litestream.RetentionConfig{
+			Retention:     litestream.DefaultRetention,
+			CheckInterval: litestream.DefaultRetentionCheckInterval,
+		}); got != want {
+			t.Fatalf("RetentionConfig()=%#v, want %#v", got, want)
+		}
+	})
+
+	t.Run("Configured", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", litestream.NewFileReplicaClient(t.TempDir()))
+		r.Retention = 48 * time.Hour
+		r.WALRetention = 6 * time.Hour
+		r.RetentionCheckInterval = 10 * time.Minute
+		r.MinRetainedSnapshots = 3
+		r.MaxGenerations = 4
+		r.RunRetentionOnStart = true
+		r.PruneWALOnSnapshot = true
+
+		if got, want := r.RetentionConfig(), (litestream.RetentionConfig{
+			Retention:          48 * time.Hour,
+			WALRetention:       6 * time.Hour,
+			CheckInterval:      10 * time.Minute,
+			MinSnapshots:       3,
+			MaxGenerations:     4,
+			RunOnStart:         true,
+			PruneWALOnSnapshot: true,
+		}); got != want {
+			t.Fatalf("RetentionConfig()=%#v, want %#v", got, want)
+		}
+	})
+}
+
+func TestReplica_Reconfigure(t *testing.T) {
+	t.Run("Retention", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		deleted := make(chan int, 10)
+		r := litestream.NewReplica(db, "", litestream.NewFileReplicaClient(t.TempDir()))
+		r.SyncInterval = 10 * time.Millisecond
+		r.Retention = time.Hour
+		r.RetentionCheckInterval = time.Hour
+		r.OnDelete = func(kind, generation string, index int, size int64) {
+			if kind == litestream.DeleteKindSnapshot {
+				deleted <- index
+			}
+		}
+		db.Replicas = []*litestream.Replica{r}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// Replicate an initial snapshot & then move to a new index.
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.WaitForPos(ctx, db.Pos()); err != nil {
+			t.Fatal(err)
+		} else if err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
+			t.Fatal(err)
+		}
+		generation := r.Pos().Generation
+
+		// Shorten retention so the retainer replaces the first snapshot.
+		time.Sleep(20 * time.Millisecond)
+		opts := r.Options()
+		opts.Retention = 10 * time.Millisecond
+		opts.RetentionCheckInterval = 10 * time.Millisecond
+		if err := r.Reconfigure(opts); err != nil {
+			t.Fatal(err)
+		} else if got, want := r.Retention, 10*time.Millisecond; got != want {
+			t.Fatalf("Retention=%s, want %s", got, want)
+		}
+
+		select {
+		case index := <-deleted:
+			if index != 0 {
+				t.Fatalf("deleted index=%d, want 0", index)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for retention")
+		}
+
+		// The replica should continue from its existing position.
+		if got := r.Pos().Generation; got != generation {
+			t.Fatalf("generation=%s, want %s", got, generation)
+		}
+	})
+
+	t.Run("RetrySettings", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", litestream.NewFileReplicaClient(t.TempDir()))
+		opts := r.Options()
+		opts.SyncRetryThreshold = 2
+		opts.SyncMaxBackoff = time.Second
+		opts.RetryBaseDelay = 10 * time.Millisecond
+		opts.RetryMaxDelay = 100 * time.Millisecond
+		opts.MaxSnapshotRetries = 3
+		opts.SnapshotRetryBackoff = 20 * time.Millisecond
+		if err := r.Reconfigure(opts); err != nil {
+			t.Fatal(err)
+		} else if got := r.Options(); !reflect.DeepEqual(got, opts) {
+			t.Fatalf("Options()=%#v, want %#v", got, opts)
+		}
+	})
+
+	// Ensure zero or negative intervals are rejected & settings are unchanged.
+	t.Run("ErrInvalidInterval", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", litestream.NewFileReplicaClient(t.TempDir()))
+		if err := r.Reconfigure(litestream.ReplicaOptions{Retention: time.Minute}); err == nil || err.Error() != `sync interval must be positive: 0s` {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := r.Retention, litestream.DefaultRetention; got != want {
+			t.Fatalf("Retention=%s, want %s", got, want)
+		}
+
+		opts := r.Options()
+		opts.RetentionCheckInterval = 0
+		if err := r.Reconfigure(opts); err == nil || err.Error() != `retention check interval must be positive: 0s` {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := r.RetentionCheckInterval, litestream.DefaultRetentionCheckInterval; got != want {
+			t.Fatalf("RetentionCheckInterval=%s, want %s", got, want)
+		}
+	})
+
+	t.Run("ErrDestinationChanged", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", litestream.NewFileReplicaClient(t.TempDir()))
+		opts := r.Options()
+		opts.Client = litestream.NewFileReplicaClient(t.TempDir())
+		opts.Retention = time.Minute
+		if err := r.Reconfigure(opts); err != litestream.ErrDestinationChanged {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := r.Retention, litestream.DefaultRetention; got != want {
+			t.Fatalf("Retention=%s, want %s", got, want)
+		}
+	})
+}
+
 func TestReplica_Sync(t *testing.T) {
 	db, sqldb := MustOpenDBs(t)
 	defer MustCloseDBs(t, db, sqldb)
@@ -74,14 +235,460 @@ func TestReplica_Sync(t *testing.T) {
 	}
 }
 
-func TestReplica_Snapshot(t *testing.T) {
+func TestReplica_Sync_Concurrent(t *testing.T) {
+	// Write & sync the database while many goroutines sync the replica,
+	// optionally alongside the replica's own monitor.
+	run := func(t *testing.T, monitor bool) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		r := litestream.NewReplica(db, "", c)
+		r.MonitorEnabled = monitor
+		r.SyncInterval = time.Millisecond
+		r.Start(context.Background())
+		defer r.Stop()
+
+		var g errgroup.Group
+		for i := 0; i < 8; i++ {
+			g.Go(func() error {
+				for j := 0; j < 20; j++ {
+					if err := r.Sync(context.Background()); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		for i := 0; i < 20; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		r.Stop()
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Replica position should match the database & WAL segments should be
+		// contiguous & restorable.
+		if got, want := r.Pos(), db.Pos(); got != want {
+			t.Fatalf("Pos()=%s, want %s", got, want)
+		}
+
+		filename := filepath.Join(t.TempDir(), "db")
+		if err := litestream.RestoreLatest(context.Background(), c, filename, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		}
+		rdb := MustOpenSQLDB(t, filename)
+		defer MustCloseSQLDB(t, rdb)
+
+		var n int
+		if err := rdb.QueryRow(`SELECT COUNT(*) FROM foo`).Scan(&n); err != nil {
+			t.Fatal(err)
+		} else if n != 20 {
+			t.Fatalf("n=%d, want %d", n, 20)
+		}
+	}
+
+	t.Run("NoMonitor", func(t *testing.T) { run(t, false) })
+	t.Run("Monitor", func(t *testing.T) { run(t, true) })
+}
+
+// syncNotifyReplicaClient wraps a client & signals ch on every flush, which
+// occurs at the end of each successful sync.
+type syncNotifyReplicaClient struct {
+	litestream.ReplicaClient
+	ch chan struct{}
+}
+
+func (c *syncNotifyReplicaClient) Flush(ctx context.Context) error {
+	select {
+	case c.ch <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// wait blocks until the next sync completes.
+func (c *syncNotifyReplicaClient) wait(tb testing.TB) {
+	tb.Helper()
+	select {
+	case <-c.ch:
+	case <-time.After(10 * time.Second):
+		tb.Fatal("timeout waiting for sync")
+	}
+}
+
+func TestReplica_Monitor(t *testing.T) {
+	t.Run("CoalesceNotifications", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Count the number of WAL segment writes issued by the replica.
+		var mu sync.Mutex
+		var n int
+		fc := litestream.NewFileReplicaClient(t.TempDir())
+		c := &syncNotifyReplicaClient{
+			ReplicaClient: &mock.ReplicaClient{
+				GenerationsFunc:      fc.Generations,
+				SnapshotsFunc:        fc.Snapshots,
+				WriteSnapshotFunc:    fc.WriteSnapshot,
+				SnapshotReaderFunc:   fc.SnapshotReader,
+				WALSegmentsFunc:      fc.WALSegments,
+				WALSegmentReaderFunc: fc.WALSegmentReader,
+				WriteWALSegmentFunc: func(ctx context.Context, pos litestream.Pos, rd io.Reader) (litestream.WALSegmentInfo, error) {
+					mu.Lock()
+					n++
+					mu.Unlock()
+					return fc.WriteWALSegment(ctx, pos, rd)
+				},
+			},
+			ch: make(chan struct{}, 16),
+		}
+
+		r := litestream.NewReplica(db, "", c)
+		r.SyncInterval = time.Second
+		r.Start(context.Background())
+		defer r.Stop()
+
+		// Wait for the monitor to complete its initial sync before writing.
+		c.wait(t)
+		mu.Lock()
+		n0 := n
+		mu.Unlock()
+
+		// Issue several writes in rapid succession within a single sync interval.
+		for i := 0; i < 5; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The next sync should replicate every write at once.
+		c.wait(t)
+		mu.Lock()
+		defer mu.Unlock()
+		if got, want := n-n0, 1; got != want {
+			t.Fatalf("WriteWALSegment() calls=%d, want %d", got, want)
+		} else if got, want := r.Pos(), db.Pos(); got != want {
+			t.Fatalf("Pos()=%s, want %s", got, want)
+		}
+	})
+
+	t.Run("Backoff", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Record the time of every sync attempt against a permanently failing client.
+		var mu sync.Mutex
+		var attempts []time.Time
+		c := &mock.ReplicaClient{
+			SnapshotsFunc: func(ctx context.Context, generation string) (litestream.SnapshotIterator, error) {
+				return litestream.NewSnapshotInfoSliceIterator(nil), nil
+			},
+			WriteSnapshotFunc: func(ctx context.Context, generation string, index int, rd io.Reader) (litestream.SnapshotInfo, error) {
+				mu.Lock()
+				attempts = append(attempts, time.Now())
+				mu.Unlock()
+				_, _ = io.Copy(io.Discard, rd)
+				return litestream.SnapshotInfo{}, fmt.Errorf("marker")
+			},
+		}
+
+		r := litestream.NewReplica(db, "", c)
+		r.SyncInterval = 10 * time.Millisecond
+		r.SyncRetryThreshold = 1
+		r.SyncMaxBackoff = time.Second
+		r.Start(context.Background())
+		defer r.Stop()
+
+		// Continuously write to the database to generate notifications.
+		ctx, cancel := context.WithTimeout(context.Background(), 700*time.Millisecond)
+		defer cancel()
+		for ctx.Err() == nil {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+
+		// Without backoff this would be roughly one attempt per sync interval.
+		mu.Lock()
+		defer mu.Unlock()
+		if n := len(attempts); n < 3 || n > 10 {
+			t.Fatalf("unexpected attempt count: %d", n)
+		} else if first, last := attempts[1].Sub(attempts[0]), attempts[n-1].Sub(attempts[n-2]); last < 4*first {
+			t.Fatalf("expected attempt rate to decay: first=%s last=%s", first, last)
+		}
+	})
+
+	// Ensure the backoff still grows when no maximum is set.
+	t.Run("NoMaxBackoff", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Record the time of every sync attempt against a permanently failing client.
+		var mu sync.Mutex
+		var attempts []time.Time
+		c := &mock.ReplicaClient{
+			SnapshotsFunc: func(ctx context.Context, generation string) (litestream.SnapshotIterator, error) {
+				return litestream.NewSnapshotInfoSliceIterator(nil), nil
+			},
+			WriteSnapshotFunc: func(ctx context.Context, generation string, index int, rd io.Reader) (litestream.SnapshotInfo, error) {
+				mu.Lock()
+				attempts = append(attempts, time.Now())
+				mu.Unlock()
+				_, _ = io.Copy(io.Discard, rd)
+				return litestream.SnapshotInfo{}, fmt.Errorf("marker")
+			},
+		}
+
+		r := litestream.NewReplica(db, "", c)
+		r.SyncInterval = 10 * time.Millisecond
+		r.SyncRetryThreshold = 1
+		r.SyncMaxBackoff = 0
+		r.Start(context.Background())
+		defer r.Stop()
+
+		// Continuously write to the database to generate notifications.
+		ctx, cancel := context.WithTimeout(context.Background(), 700*time.Millisecond)
+		defer cancel()
+		for ctx.Err() == nil {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+
+		// Without backoff this would be roughly one attempt per sync interval.
+		mu.Lock()
+		defer mu.Unlock()
+		if n := len(attempts); n < 3 || n > 10 {
+			t.Fatalf("unexpected attempt count: %d", n)
+		} else if first, last := attempts[1].Sub(attempts[0]), attempts[n-1].Sub(attempts[n-2]); last < 4*first {
+			t.Fatalf("expected attempt rate to decay: first=%s last=%s", first, last)
+		}
+	})
+
+	// Ensure delays after failures stay within the jittered bounds & that the
+	// monitor returns to the sync interval once a sync succeeds.
+	t.Run("JitterBackoff", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Fail the first few snapshot writes & record the time of each attempt.
+		const failN = 4
+		var mu sync.Mutex
+		var attempts []time.Time
+		fc := litestream.NewFileReplicaClient(t.TempDir())
+		c := &mock.ReplicaClient{
+			GenerationsFunc:     fc.Generations,
+			SnapshotsFunc:       fc.Snapshots,
+			WALSegmentsFunc:     fc.WALSegments,
+			WriteWALSegmentFunc: fc.WriteWALSegment,
+			WriteSnapshotFunc: func(ctx context.Context, generation string, index int, rd io.Reader) (litestream.SnapshotInfo, error) {
+				mu.Lock()
+				attempts = append(attempts, time.Now())
+				n := len(attempts)
+				mu.Unlock()
+				if n > failN {
+					return fc.WriteSnapshot(ctx, generation, index, rd)
+				}
+				_, _ = io.Copy(io.Discard, rd)
+				return litestream.SnapshotInfo{}, fmt.Errorf("marker")
+			},
+		}
+
+		r := litestream.NewReplica(db, "", c)
+		r.SyncInterval = time.Millisecond
+		r.RetryBaseDelay = 200 * time.Millisecond
+		r.RetryMaxDelay = 400 * time.Millisecond
+		r.Start(context.Background())
+		defer r.Stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := r.WaitForPos(ctx, db.Pos()); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		for i := 1; i <= failN; i++ {
+			if d := attempts[i].Sub(attempts[i-1]); d < r.RetryBaseDelay || d > r.RetryMaxDelay+200*time.Millisecond {
+				t.Fatalf("attempt %d delay=%s, want within [%s, %s]", i, d, r.RetryBaseDelay, r.RetryMaxDelay)
+			}
+		}
+		mu.Unlock()
+
+		// Once recovered, changes replicate without waiting for a retry delay.
+		start := time.Now()
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.WaitForPos(ctx, db.Pos()); err != nil {
+			t.Fatal(err)
+		} else if d := time.Since(start); d >= r.RetryBaseDelay {
+			t.Fatalf("expected delay to reset after success: %s", d)
+		}
+	})
+}
+
+func TestReplica_OnTakeover(t *testing.T) {
+	// mustTakeover writes a WAL segment to the generation after the replica's
+	// position as if another writer had continued the generation.
+	mustTakeover := func(tb testing.TB, c litestream.ReplicaClient, pos litestream.Pos) litestream.Pos {
+		tb.Helper()
+		other := litestream.Pos{Generation: pos.Generation, Index: pos.Index + 1}
+		if _, err := c.WriteWALSegment(context.Background(), other, bytes.NewReader(mustCompressLZ4(tb, make([]byte, litestream.WALHeaderSize)))); err != nil {
+			tb.Fatal(err)
+		}
+		return other
+	}
+
+	t.Run("Stop", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseSQLDB(t, sqldb)
+
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		r := litestream.NewReplica(db, "", c)
+		r.SyncInterval = 10 * time.Millisecond
+		r.OnTakeover = litestream.TakeoverStop
+		db.Replicas = []*litestream.Replica{r}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.WaitForPos(ctx, db.Pos()); err != nil {
+			t.Fatal(err)
+		}
+		other := mustTakeover(t, c, r.Pos())
+
+		// The monitor should stop instead of writing the new transaction.
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for r.Err() == nil {
+			if ctx.Err() != nil {
+				t.Fatal("timeout waiting for replica to stop")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := r.Err(); err != litestream.ErrGenerationTakeover {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// The final sync on close also refuses to write to the generation.
+		if err := db.Close(); err != litestream.ErrGenerationTakeover {
+			t.Fatalf("unexpected close error: %v", err)
+		}
+
+		positions := mustWALSegmentPositions(t, c, other.Generation)
+		if got, want := positions[len(positions)-1], other; got != want {
+			t.Fatalf("last segment=%s, want %s", got, want)
+		}
+	})
+
+	t.Run("NewGeneration", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		r := litestream.NewReplica(db, "", c)
+		r.MonitorEnabled = false
+		r.OnTakeover = litestream.TakeoverNewGeneration
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		generation := r.Pos().Generation
+		other := mustTakeover(t, c, r.Pos())
+
+		if err := r.Sync(context.Background()); err != litestream.ErrGenerationTakeover {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// The next sync replicates a fresh snapshot in a new generation.
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got := r.Pos().Generation; got == generation || got != db.Pos().Generation {
+			t.Fatalf("generation=%s, want new generation %s", got, db.Pos().Generation)
+		} else if got, want := len(mustSnapshotInfos(t, c, got)), 1; got != want {
+			t.Fatalf("snapshots=%d, want %d", got, want)
+		}
+
+		positions := mustWALSegmentPositions(t, c, generation)
+		if got, want := positions[len(positions)-1], other; got != want {
+			t.Fatalf("last segment=%s, want %s", got, want)
+		}
+	})
+}
+
+func TestReplica_MaxSegmentRetries(t *testing.T) {
 	db, sqldb := MustOpenDBs(t)
 	defer MustCloseDBs(t, db, sqldb)
 
 	c := litestream.NewFileReplicaClient(t.TempDir())
 	r := litestream.NewReplica(db, "", c)
+	r.MonitorEnabled = false
+	r.MaxSegmentRetries = 2
 
-	// Execute a query to force a write to the WAL.
 	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
 		t.Fatal(err)
 	} else if err := db.Sync(context.Background()); err != nil {
@@ -89,45 +696,4117 @@ func TestReplica_Snapshot(t *testing.T) {
 	} else if err := r.Sync(context.Background()); err != nil {
 		t.Fatal(err)
 	}
+	generation := r.Pos().Generation
 
-	// Fetch current database position & snapshot.
-	pos0 := db.Pos()
-	if info, err := r.Snapshot(context.Background()); err != nil {
+	// Write three shadow WAL segments & corrupt the middle one.
+	var positions []litestream.Pos
+	for i := 0; i < 3; i++ {
+		positions = append(positions, db.Pos())
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bad := positions[1]
+	if err := os.WriteFile(filepath.Join(db.ShadowWALDir(generation), litestream.FormatIndex(bad.Index), litestream.FormatOffset(bad.Offset)+".wal.lz4"), []byte("corrupt"), 0600); err != nil {
 		t.Fatal(err)
-	} else if got, want := info.Pos(), pos0.Truncate(); got != want {
-		t.Fatalf("pos=%s, want %s", got, want)
 	}
 
-	// Sync database and then replica.
+	// Syncs fail while retrying but the segment before the gap is written.
+	for i := 0; i < r.MaxSegmentRetries; i++ {
+		var e *litestream.SkippedWALSegmentError
+		if err := r.Sync(context.Background()); err == nil || errors.As(err, &e) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		a := mustWALSegmentPositions(t, c, generation)
+		if got, want := a[len(a)-1], positions[0]; got != want {
+			t.Fatalf("last segment=%s, want %s", got, want)
+		}
+	}
+
+	// The segment is skipped by starting a new generation.
+	var e *litestream.SkippedWALSegmentError
+	if err := r.Sync(context.Background()); !errors.As(err, &e) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if got, want := e.Pos, bad; got != want {
+		t.Fatalf("Pos=%s, want %s", got, want)
+	}
+	if a := mustWALSegmentPositions(t, c, generation); a[len(a)-1] != positions[0] {
+		t.Fatalf("segment written past gap: %s", a[len(a)-1])
+	}
+
 	if err := db.Sync(context.Background()); err != nil {
 		t.Fatal(err)
 	} else if err := r.Sync(context.Background()); err != nil {
 		t.Fatal(err)
+	} else if got := r.Pos(); got.Generation == generation || got != db.Pos() {
+		t.Fatalf("Pos=%s, want new generation at %s", got, db.Pos())
 	}
+}
 
-	// Execute a query to force a write to the WAL & truncate to start new index.
+func TestReplica_MinWALBytes(t *testing.T) {
+	// newReplica returns a synced replica which holds back WAL segments.
+	newReplica := func(tb testing.TB, db *litestream.DB, sqldb *sql.DB, c litestream.ReplicaClient) *litestream.Replica {
+		tb.Helper()
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			tb.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+
+		r := litestream.NewReplica(db, "", c)
+		r.MonitorEnabled = false
+		r.MinWALBytes = 64 * 1024
+		r.WALFlushInterval = time.Hour
+		if err := r.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+		return r
+	}
+
+	// insert issues a small write & syncs the database & replica.
+	insert := func(tb testing.TB, db *litestream.DB, sqldb *sql.DB, r *litestream.Replica) {
+		tb.Helper()
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			tb.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	t.Run("Threshold", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		r := newReplica(t, db, sqldb, c)
+		pos0 := r.Pos()
+		n0 := len(mustWALSegmentPositions(t, c, pos0.Generation))
+
+		// Each write is much smaller than the threshold so nothing is written.
+		for i := 0; i < 5; i++ {
+			insert(t, db, sqldb, r)
+		}
+		if got := len(mustWALSegmentPositions(t, c, pos0.Generation)); got != n0 {
+			t.Fatalf("WAL segments=%d, want %d", got, n0)
+		} else if got, want := r.Pos(), pos0; got != want {
+			t.Fatalf("Pos()=%v, want %v", got, want)
+		}
+
+		// Continue writing until the threshold is crossed. All held back
+		// writes should be combined into a single segment.
+		for r.Pos() == pos0 {
+			insert(t, db, sqldb, r)
+		}
+		if got, want := len(mustWALSegmentPositions(t, c, pos0.Generation)), n0+1; got != want {
+			t.Fatalf("WAL segments=%d, want %d", got, want)
+		} else if got, want := r.Pos(), db.Pos(); got != want {
+			t.Fatalf("Pos()=%v, want %v", got, want)
+		} else if got := r.Pos().Offset - pos0.Offset; got < r.MinWALBytes {
+			t.Fatalf("unexpected bytes written: %d", got)
+		}
+	})
+
+	t.Run("FlushInterval", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		r := newReplica(t, db, sqldb, litestream.NewFileReplicaClient(t.TempDir()))
+		r.WALFlushInterval = 50 * time.Millisecond
+		insert(t, db, sqldb, r)
+		if r.Pos() == db.Pos() {
+			t.Fatal("expected segment to be held back")
+		}
+
+		// Pending segments are flushed once the interval elapses.
+		time.Sleep(r.WALFlushInterval)
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := r.Pos(), db.Pos(); got != want {
+			t.Fatalf("Pos()=%v, want %v", got, want)
+		}
+	})
+}
+
+func TestReplica_SyncOnCommit(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	// The replica's own monitor is disabled & the sync interval would delay
+	// any other sync well past the end of the test.
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	r := litestream.NewReplica(db, "", c)
+	r.MonitorEnabled = false
+	r.SyncInterval = time.Hour
+	r.MinWALBytes, r.WALFlushInterval = 1<<20, time.Hour
+	r.SyncOnCommit = true
+	db.Replicas = []*litestream.Replica{r}
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	prev := r.Pos()
+
+	// Notify the database of the commit & wait for the replica to catch up.
 	if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
 		t.Fatal(err)
-	} else if err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
+	}
+	db.NotifyCh() <- struct{}{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for r.Pos() == prev {
+		if ctx.Err() != nil {
+			t.Fatal("timeout waiting for commit to replicate")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := r.WaitForPos(ctx, db.Pos()); err != nil {
 		t.Fatal(err)
 	}
 
-	// Fetch current database position & snapshot.
-	pos1 := db.Pos()
-	if info, err := r.Snapshot(context.Background()); err != nil {
+	positions := mustWALSegmentPositions(t, c, prev.Generation)
+	if got, want := positions[len(positions)-1], prev; got != want {
+		t.Fatalf("last segment=%s, want %s", got, want)
+	}
+}
+
+// Ensure commit syncs from the database monitor can run alongside the
+// replica's own monitor.
+func TestReplica_SyncOnCommit_Monitor(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	r := litestream.NewReplica(db, "", c)
+	r.SyncInterval = time.Millisecond
+	r.SyncOnCommit = true
+	db.Replicas = []*litestream.Replica{r}
+
+	// The replica's monitor is started when the database is initialized.
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
 		t.Fatal(err)
-	} else if got, want := info.Pos(), pos1.Truncate(); got != want {
-		t.Fatalf("pos=%v, want %v", got, want)
 	}
 
-	// Verify two snapshots exist.
-	if infos, err := r.Snapshots(context.Background()); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 20; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		db.NotifyCh() <- struct{}{}
+	}
+	if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.WaitForPos(ctx, db.Pos()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure a failing commit sync is not retried on every commit.
+func TestReplica_SyncOnCommit_Backoff(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	var mu sync.Mutex
+	var fail bool
+	var writeN int
+	fc := litestream.NewFileReplicaClient(t.TempDir())
+	c := &mock.ReplicaClient{
+		GenerationsFunc:      fc.Generations,
+		SnapshotsFunc:        fc.Snapshots,
+		WriteSnapshotFunc:    fc.WriteSnapshot,
+		SnapshotReaderFunc:   fc.SnapshotReader,
+		WALSegmentsFunc:      fc.WALSegments,
+		WALSegmentReaderFunc: fc.WALSegmentReader,
+		WriteWALSegmentFunc: func(ctx context.Context, pos litestream.Pos, r io.Reader) (litestream.WALSegmentInfo, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !fail {
+				return fc.WriteWALSegment(ctx, pos, r)
+			}
+			writeN++
+			return litestream.WALSegmentInfo{}, errors.New("marker")
+		},
+	}
+
+	r := litestream.NewReplica(db, "", c)
+	r.MonitorEnabled = false
+	r.SyncInterval = time.Hour
+	r.SyncOnCommit = true
+	db.Replicas = []*litestream.Replica{r}
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
 		t.Fatal(err)
-	} else if got, want := len(infos), 2; got != want {
-		t.Fatalf("len=%v, want %v", got, want)
-	} else if got, want := infos[0].Pos(), pos0.Truncate(); got != want {
-		t.Fatalf("info[0]=%s, want %s", got, want)
-	} else if got, want := infos[1].Pos(), pos1.Truncate(); got != want {
-		t.Fatalf("info[1]=%s, want %s", got, want)
 	}
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+
+	// Each commit is synced by the database monitor before it handles the
+	// next change so wait for the database position to move on each time.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 4; i++ {
+		prev := db.Pos()
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		}
+		db.NotifyCh() <- struct{}{}
+		for db.Pos() == prev {
+			if ctx.Err() != nil {
+				t.Fatal("timeout waiting for database sync")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Only the first failed write is attempted within the retry delay.
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := writeN, 1; got != want {
+		t.Fatalf("writes=%d, want %d", got, want)
+	}
+
+	// Allow the final sync when the database is closed.
+	fail = false
+}
+
+func TestReplica_MaxWALSegmentBytes(t *testing.T) {
+	const maxWALSegmentBytes = 16 * 1024
+
+	// walSegmentSizes returns the uncompressed size of each WAL segment in
+	// the index, by offset.
+	walSegmentSizes := func(tb testing.TB, c litestream.ReplicaClient, generation string, index int) (positions []litestream.Pos, sizes []int64) {
+		tb.Helper()
+		for _, pos := range mustWALSegmentPositions(tb, c, generation) {
+			if pos.Index != index {
+				continue
+			}
+			rc, err := c.WALSegmentReader(context.Background(), pos)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			n, err := io.Copy(io.Discard, lz4.NewReader(rc))
+			if err != nil {
+				tb.Fatal(err)
+			} else if err := rc.Close(); err != nil {
+				tb.Fatal(err)
+			}
+			positions, sizes = append(positions, pos), append(sizes, n)
+		}
+		return positions, sizes
+	}
+
+	// mustRestoreBlobSize restores the client & returns the length of the blob.
+	mustRestoreBlobSize := func(tb testing.TB, c litestream.ReplicaClient) int {
+		tb.Helper()
+		filename := filepath.Join(tb.TempDir(), "db")
+		if err := litestream.RestoreLatest(context.Background(), c, filename, litestream.NewRestoreOptions()); err != nil {
+			tb.Fatal(err)
+		}
+		sqldb := MustOpenSQLDB(tb, filename)
+		defer MustCloseSQLDB(tb, sqldb)
+
+		var n int
+		if err := sqldb.QueryRow(`SELECT LENGTH(bar) FROM foo`).Scan(&n); err != nil {
+			tb.Fatal(err)
+		}
+		return n
+	}
+
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar BLOB);`); err != nil {
+		t.Fatal(err)
+	} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES (randomblob(100000));`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	r := litestream.NewReplica(db, "", c)
+	r.MonitorEnabled = false
+	r.MaxWALSegmentBytes = maxWALSegmentBytes
+	if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Capped", func(t *testing.T) {
+		generation := r.Pos().Generation
+		positions, sizes := walSegmentSizes(t, c, generation, 0)
+		if len(positions) < 2 {
+			t.Fatalf("expected multiple segments, got %d", len(positions))
+		}
+
+		// Segments must be capped & form a continuous stream.
+		offset := int64(0)
+		for i := range positions {
+			if sizes[i] > maxWALSegmentBytes {
+				t.Fatalf("segment %s size=%d, exceeds max", positions[i], sizes[i])
+			} else if positions[i].Offset != offset {
+				t.Fatalf("segment %s, expected offset %d", positions[i], offset)
+			}
+			offset += sizes[i]
+		}
+		if got, want := r.Pos(), (litestream.Pos{Generation: generation, Offset: offset}); got != want {
+			t.Fatalf("Pos()=%s, want %s", got, want)
+		}
+
+		if got, want := mustRestoreBlobSize(t, c), 100000; got != want {
+			t.Fatalf("blob size=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure a replica resumes from a position within a shadow WAL segment
+	// when only some of its capped segments were written.
+	t.Run("Resume", func(t *testing.T) {
+		generation := r.Pos().Generation
+		positions, _ := walSegmentSizes(t, c, generation, 0)
+		if err := c.DeleteWALSegments(context.Background(), positions[len(positions)-2:]); err != nil {
+			t.Fatal(err)
+		}
+
+		r2 := litestream.NewReplica(db, "", c)
+		r2.MonitorEnabled = false
+		r2.MaxWALSegmentBytes = maxWALSegmentBytes
+		if err := r2.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := r2.Pos(), r.Pos(); got != want {
+			t.Fatalf("Pos()=%s, want %s", got, want)
+		}
+
+		if got, want := mustWALSegmentPositions(t, c, generation), positions; !reflect.DeepEqual(got, want) {
+			t.Fatalf("positions=%v, want %v", got, want)
+		} else if got, want := mustRestoreBlobSize(t, c), 100000; got != want {
+			t.Fatalf("blob size=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestReplica_OnSourceMissing(t *testing.T) {
+	// newReplica returns a synced replica whose database file has been moved away.
+	newReplica := func(tb testing.TB, db *litestream.DB, sqldb *sql.DB, client litestream.ReplicaClient) *litestream.Replica {
+		tb.Helper()
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			tb.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+
+		r := litestream.NewReplica(db, "", client)
+		r.MonitorEnabled = false
+		if err := r.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		} else if err := os.Rename(db.Path(), db.Path()+".bak"); err != nil {
+			tb.Fatal(err)
+		}
+		return r
+	}
+
+	t.Run("Wait", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := newReplica(t, db, sqldb, litestream.NewFileReplicaClient(t.TempDir()))
+
+		// Position should be retained while the source is missing.
+		pos := r.Pos()
+		if err := r.Sync(context.Background()); err != litestream.ErrSourceMissing {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := r.Pos(), pos; got != want {
+			t.Fatalf("Pos()=%v, want %v", got, want)
+		}
+
+		// Replication should resume once the file reappears.
+		if err := os.Rename(db.Path()+".bak", db.Path()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Stop", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		// Count client listings made by the retainer & snapshotter.
+		var mu sync.Mutex
+		var listN int
+		fc := litestream.NewFileReplicaClient(t.TempDir())
+		c := &mock.ReplicaClient{
+			GenerationsFunc: func(ctx context.Context) ([]string, error) {
+				mu.Lock()
+				listN++
+				mu.Unlock()
+				return fc.Generations(ctx)
+			},
+			SnapshotsFunc:       fc.Snapshots,
+			WriteSnapshotFunc:   fc.WriteSnapshot,
+			WALSegmentsFunc:     fc.WALSegments,
+			WriteWALSegmentFunc: fc.WriteWALSegment,
+		}
+
+		r := newReplica(t, db, sqldb, c)
+		defer func() { _ = os.Rename(db.Path()+".bak", db.Path()) }()
+
+		r.MonitorEnabled = true
+		r.OnSourceMissing = litestream.SourceMissingStop
+		r.RetentionCheckInterval = 10 * time.Millisecond
+		r.SnapshotInterval = 10 * time.Millisecond
+		r.Start(context.Background())
+		defer r.Stop()
+
+		// Wait for the monitor to exit with a terminal error.
+		for i := 0; r.Err() == nil; i++ {
+			if i > 100 {
+				t.Fatal("timeout waiting for replica to stop")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := r.Err(); err != litestream.ErrSourceMissing {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// The retainer & snapshotter should stop along with the monitor.
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		n := listN
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		if listN != n {
+			t.Fatalf("client listed after stop: %d -> %d", n, listN)
+		}
+	})
+}
+
+func TestReplica_Jitter(t *testing.T) {
+	// mustTickSpread starts a replica whose client records the time of each
+	// listing & returns the spread between the shortest & longest time
+	// between ticks. Calls less than 8ms apart belong to one tick.
+	mustTickSpread := func(tb testing.TB, configure func(r *litestream.Replica), record func(c *mock.ReplicaClient, fn func())) time.Duration {
+		tb.Helper()
+		db, sqldb := MustOpenDBs(tb)
+		defer MustCloseDBs(tb, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			tb.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+
+		var mu sync.Mutex
+		var ticks []time.Time
+		fc := litestream.NewFileReplicaClient(tb.TempDir())
+		c := &mock.ReplicaClient{
+			GenerationsFunc:       fc.Generations,
+			DeleteGenerationFunc:  fc.DeleteGeneration,
+			SnapshotsFunc:         fc.Snapshots,
+			WriteSnapshotFunc:     fc.WriteSnapshot,
+			DeleteSnapshotFunc:    fc.DeleteSnapshot,
+			SnapshotReaderFunc:    fc.SnapshotReader,
+			WALSegmentsFunc:       fc.WALSegments,
+			WriteWALSegmentFunc:   fc.WriteWALSegment,
+			DeleteWALSegmentsFunc: fc.DeleteWALSegments,
+			WALSegmentReaderFunc:  fc.WALSegmentReader,
+		}
+
+		r := litestream.NewReplica(db, "", c)
+		r.MonitorEnabled = false
+		if err := r.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+
+		record(c, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if now := time.Now(); len(ticks) == 0 || now.Sub(ticks[len(ticks)-1]) > 8*time.Millisecond {
+				ticks = append(ticks, now)
+			} else {
+				ticks[len(ticks)-1] = now
+			}
+		})
+
+		r.MonitorEnabled = true
+		r.Jitter = 0.9
+		configure(r)
+		r.Start(context.Background())
+		time.Sleep(500 * time.Millisecond)
+		r.Stop()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(ticks) < 6 {
+			tb.Fatalf("unexpected tick count: %d", len(ticks))
+		}
+		// Skip the first interval as it may include a listing made on startup.
+		var min, max time.Duration
+		for i := 2; i < len(ticks); i++ {
+			d := ticks[i].Sub(ticks[i-1])
+			if i == 2 || d < min {
+				min = d
+			}
+			if d > max {
+				max = d
+			}
+		}
+		return max - min
+	}
+
+	// Intervals of 20ms vary between 2ms & 38ms with a jitter fraction of 0.9.
+	t.Run("Retainer", func(t *testing.T) {
+		spread := mustTickSpread(t, func(r *litestream.Replica) {
+			r.RetentionCheckInterval = 20 * time.Millisecond
+		}, func(c *mock.ReplicaClient, fn func()) {
+			generations := c.GenerationsFunc
+			c.GenerationsFunc = func(ctx context.Context) ([]string, error) {
+				fn()
+				return generations(ctx)
+			}
+		})
+		if spread < 15*time.Millisecond {
+			t.Fatalf("expected jittered retention checks, spread=%s", spread)
+		}
+	})
+
+	t.Run("Snapshotter", func(t *testing.T) {
+		spread := mustTickSpread(t, func(r *litestream.Replica) {
+			r.SnapshotInterval = 20 * time.Millisecond
+		}, func(c *mock.ReplicaClient, fn func()) {
+			snapshots := c.SnapshotsFunc
+			c.SnapshotsFunc = func(ctx context.Context, generation string) (litestream.SnapshotIterator, error) {
+				fn()
+				return snapshots(ctx, generation)
+			}
+		})
+		if spread < 15*time.Millisecond {
+			t.Fatalf("expected jittered snapshots, spread=%s", spread)
+		}
+	})
+}
+
+func TestReplica_Codec(t *testing.T) {
+	t.Run("UncompressedWAL", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		r := litestream.NewReplica(db, "", c)
+		r.SnapshotCodec = litestream.CodecLZ4
+		r.WALCodec = litestream.CodecNone
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Snapshot should be compressed while WAL segments are stored as-is.
+		generation := db.Pos().Generation
+		if filename, err := c.SnapshotPath(generation, 0); err != nil {
+			t.Fatal(err)
+		} else if buf, err := os.ReadFile(filename); err != nil {
+			t.Fatal(err)
+		} else if !bytes.HasPrefix(buf, []byte{0x04, 0x22, 0x4D, 0x18}) {
+			t.Fatal("expected compressed snapshot")
+		}
+		if filename, err := c.WALSegmentPath(generation, 0, 0); err != nil {
+			t.Fatal(err)
+		} else if buf, err := os.ReadFile(filename); err != nil {
+			t.Fatal(err)
+		} else if b, err := os.ReadFile(db.WALPath()); err != nil {
+			t.Fatal(err)
+		} else if !bytes.HasPrefix(b, buf) {
+			t.Fatal("expected uncompressed wal segment")
+		}
+
+		// Restore & verify the inserted row exists.
+		index, err := litestream.FindMaxIndexByGeneration(context.Background(), c, generation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(t.TempDir(), "db")
+		if err := litestream.Restore(context.Background(), c, filename, generation, 0, index, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		}
+
+		restored := MustOpenSQLDB(t, filename)
+		defer MustCloseSQLDB(t, restored)
+
+		var n int
+		if err := restored.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&n); err != nil {
+			t.Fatal(err)
+		} else if got, want := n, 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	t.Run("Auto", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar BLOB);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		r := litestream.NewReplica(db, "", c)
+		r.SnapshotCodec = litestream.CodecAuto
+		r.WALCodec = litestream.CodecAuto
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Write random data, which is incompressible, in a separate segment.
+		pos := db.Pos()
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES (randomblob(262144));`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// The mostly empty snapshot & schema segment should be compressed.
+		generation := pos.Generation
+		for _, fn := range []func() (string, error){
+			func() (string, error) { return c.SnapshotPath(generation, 0) },
+			func() (string, error) { return c.WALSegmentPath(generation, 0, 0) },
+		} {
+			if filename, err := fn(); err != nil {
+				t.Fatal(err)
+			} else if buf, err := os.ReadFile(filename); err != nil {
+				t.Fatal(err)
+			} else if !bytes.HasPrefix(buf, []byte{0x04, 0x22, 0x4D, 0x18}) {
+				t.Fatalf("expected compressed file: %s", filename)
+			}
+		}
+
+		// The random data should be stored as-is.
+		if filename, err := c.WALSegmentPath(generation, pos.Index, pos.Offset); err != nil {
+			t.Fatal(err)
+		} else if buf, err := os.ReadFile(filename); err != nil {
+			t.Fatal(err)
+		} else if b, err := os.ReadFile(db.WALPath()); err != nil {
+			t.Fatal(err)
+		} else if len(buf) < 262144 || !bytes.Equal(b[pos.Offset:pos.Offset+int64(len(buf))], buf) {
+			t.Fatal("expected uncompressed wal segment")
+		}
+
+		// Restore & verify the inserted row exists.
+		filename := filepath.Join(t.TempDir(), "db")
+		if err := litestream.Restore(context.Background(), c, filename, generation, 0, pos.Index, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		}
+
+		restored := MustOpenSQLDB(t, filename)
+		defer MustCloseSQLDB(t, restored)
+
+		var n int
+		if err := restored.QueryRow(`SELECT LENGTH(bar) FROM foo`).Scan(&n); err != nil {
+			t.Fatal(err)
+		} else if got, want := n, 262144; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	t.Run("ErrUnsupportedCodec", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		r := litestream.NewReplica(db, "", litestream.NewFileReplicaClient(t.TempDir()))
+		r.SnapshotCodec = "zstd"
+		if _, err := r.Snapshot(context.Background()); err == nil || err.Error() != `unsupported codec: "zstd"` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Starting the replica should record the error before any write.
+		r.Start(context.Background())
+		defer r.Stop()
+		if err := r.Err(); err == nil || err.Error() != `unsupported codec: "zstd"` {
+			t.Fatalf("unexpected start error: %v", err)
+		}
+	})
+}
+
+func TestReplica_WaitForPos(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		r := litestream.NewReplica(db, "", litestream.NewFileReplicaClient(t.TempDir()))
+		r.SyncInterval = 10 * time.Millisecond
+		r.Start(context.Background())
+		defer r.Stop()
+
+		// Write data & wait for the replica to reach the database position.
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		target := db.Pos()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := r.WaitForPos(ctx, target); err != nil {
+			t.Fatal(err)
+		} else if got := r.Pos(); got.Generation != target.Generation || got.Index < target.Index || (got.Index == target.Index && got.Offset < target.Offset) {
+			t.Fatalf("Pos()=%s, want at least %s", got, target)
+		}
+	})
+
+	t.Run("Behind", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		r := litestream.NewReplica(db, "", litestream.NewFileReplicaClient(t.TempDir()))
+		r.MonitorEnabled = false
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// A target behind the current position should return immediately.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := r.WaitForPos(ctx, litestream.Pos{Generation: r.Pos().Generation}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("ContextCanceled", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", litestream.NewFileReplicaClient(t.TempDir()))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := r.WaitForPos(ctx, litestream.Pos{Generation: "0000000000000000", Index: 1}); err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestReplica_Totals(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		mustCopyReplicaClient(t, c, litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")), "0000000000000000")
+		if _, err := c.WriteSnapshot(context.Background(), "0000000000000001", 0, strings.NewReader("data")); err != nil {
+			t.Fatal(err)
+		} else if _, err := c.WriteWALSegment(context.Background(), litestream.Pos{Generation: "0000000000000001"}, strings.NewReader("wal")); err != nil {
+			t.Fatal(err)
+		}
+
+		totals, err := litestream.NewReplica(nil, "", c).Totals(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Sum each generation individually.
+		want := litestream.Totals{GenerationN: 2}
+		for _, generation := range []string{"0000000000000000", "0000000000000001"} {
+			for _, info := range mustSnapshotInfos(t, c, generation) {
+				want.SnapshotN, want.Size = want.SnapshotN+1, want.Size+info.Size
+			}
+			itr, err := c.WALSegments(context.Background(), generation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			infos, err := litestream.SliceWALSegmentIterator(itr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, info := range infos {
+				want.WALSegmentN, want.Size = want.WALSegmentN+1, want.Size+info.Size
+			}
+		}
+
+		if totals != want {
+			t.Fatalf("Totals()=%#v, want %#v", totals, want)
+		} else if totals.SnapshotN != 2 || totals.WALSegmentN != 7 {
+			t.Fatalf("unexpected totals: %#v", totals)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		if totals, err := litestream.NewReplica(nil, "", litestream.NewFileReplicaClient(t.TempDir())).Totals(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if totals != (litestream.Totals{}) {
+			t.Fatalf("unexpected totals: %#v", totals)
+		}
+	})
+}
+
+func TestReplica_Fingerprint(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	r := litestream.NewReplica(db, "", c)
+
+	mustFingerprint := func(tb testing.TB, r *litestream.Replica) string {
+		tb.Helper()
+		fp, err := r.Fingerprint(context.Background())
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return fp
+	}
+	fp0 := mustFingerprint(t, r)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fp1 := mustFingerprint(t, r)
+	if fp1 == fp0 {
+		t.Fatal("expected fingerprint to change after sync")
+	}
+
+	// Syncing again without changes should produce the same fingerprint, as
+	// should another replica reading the same client.
+	if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if got := mustFingerprint(t, r); got != fp1 {
+		t.Fatalf("fingerprint=%s, want %s", got, fp1)
+	} else if got := mustFingerprint(t, litestream.NewReplica(nil, "", litestream.NewFileReplicaClient(c.Path()))); got != fp1 {
+		t.Fatalf("fingerprint=%s, want %s", got, fp1)
+	}
+
+	if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if got := mustFingerprint(t, r); got == fp1 {
+		t.Fatal("expected fingerprint to change after second sync")
+	}
+}
+
+func TestReplica_Validate(t *testing.T) {
+	// newClient returns a client with a healthy generation & a generation
+	// which is missing WAL index 1.
+	newClient := func(tb testing.TB) *litestream.FileReplicaClient {
+		tb.Helper()
+		c := litestream.NewFileReplicaClient(tb.TempDir())
+		src := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+		mustCopyReplicaClient(tb, c, src, "0000000000000000")
+
+		// Copy the same files into a second generation, skipping index 1.
+		rd, err := src.SnapshotReader(context.Background(), "0000000000000000", 0)
+		if err != nil {
+			tb.Fatal(err)
+		} else if _, err := c.WriteSnapshot(context.Background(), "0000000000000001", 0, rd); err != nil {
+			tb.Fatal(err)
+		} else if err := rd.Close(); err != nil {
+			tb.Fatal(err)
+		}
+		for _, pos := range mustWALSegmentPositions(tb, src, "0000000000000000") {
+			if pos.Index == 1 {
+				continue
+			}
+			rd, err := src.WALSegmentReader(context.Background(), pos)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			pos.Generation = "0000000000000001"
+			if _, err := c.WriteWALSegment(context.Background(), pos, rd); err != nil {
+				tb.Fatal(err)
+			} else if err := rd.Close(); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		return c
+	}
+
+	t.Run("Gaps", func(t *testing.T) {
+		report, err := litestream.NewReplica(nil, "", newClient(t)).Validate(context.Background(), false)
+		if err != nil {
+			t.Fatal(err)
+		} else if report.OK() {
+			t.Fatal("expected issues")
+		} else if got, want := len(report.Generations), 2; got != want {
+			t.Fatalf("len=%d, want %d", got, want)
+		}
+
+		if g := report.Generations[0]; g.Generation != "0000000000000000" || len(g.Issues) != 0 || g.SnapshotN != 1 || g.WALSegmentN != 6 {
+			t.Fatalf("unexpected result: %#v", g)
+		}
+		if g := report.Generations[1]; g.Generation != "0000000000000001" {
+			t.Fatalf("unexpected generation: %s", g.Generation)
+		} else if got, want := g.Issues, []string{"missing wal index 0000000000000001"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Issues=%v, want %v", got, want)
+		}
+	})
+
+	t.Run("NoSnapshots", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		if _, err := c.WriteWALSegment(context.Background(), litestream.Pos{Generation: "0000000000000000"}, strings.NewReader("wal")); err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := litestream.NewReplica(nil, "", c).Validate(context.Background(), false)
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := report.Generations[0].Issues, []string{"no snapshots"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Issues=%v, want %v", got, want)
+		}
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		c := newClient(t)
+
+		// Truncate a compressed WAL segment in the healthy generation.
+		filename, err := c.WALSegmentPath("0000000000000000", 2, 0x1038)
+		if err != nil {
+			t.Fatal(err)
+		} else if fi, err := os.Stat(filename); err != nil {
+			t.Fatal(err)
+		} else if err := os.Truncate(filename, fi.Size()/2); err != nil {
+			t.Fatal(err)
+		}
+
+		// Structural checks alone do not detect the corruption.
+		r := litestream.NewReplica(nil, "", c)
+		if report, err := r.Validate(context.Background(), false); err != nil {
+			t.Fatal(err)
+		} else if len(report.Generations[0].Issues) != 0 {
+			t.Fatalf("unexpected issues: %v", report.Generations[0].Issues)
+		}
+
+		report, err := r.Validate(context.Background(), true)
+		if err != nil {
+			t.Fatal(err)
+		} else if issues := report.Generations[0].Issues; len(issues) != 1 || !strings.HasPrefix(issues[0], "invalid wal segment 0000000000000000/0000000000000002:0000000000001038") {
+			t.Fatalf("unexpected issues: %v", issues)
+		} else if got, want := len(report.Generations[1].Issues), 1; got != want {
+			t.Fatalf("len(issues)=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestReplica_RestorePoints(t *testing.T) {
+	t0 := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	const generation = "0000000000000000"
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	for _, tt := range []struct {
+		index int
+		at    time.Time
+	}{{1, t0.Add(1 * time.Hour)}, {3, t0.Add(5 * time.Hour)}} {
+		if _, err := c.WriteSnapshot(context.Background(), generation, tt.index, strings.NewReader("data")); err != nil {
+			t.Fatal(err)
+		} else if filename, err := c.SnapshotPath(generation, tt.index); err != nil {
+			t.Fatal(err)
+		} else {
+			mustChtimes(t, filename, tt.at)
+		}
+	}
+	for _, tt := range []struct {
+		pos litestream.Pos
+		at  time.Time
+	}{
+		{litestream.Pos{Generation: generation, Index: 0, Offset: 0}, t0}, // before first snapshot
+		{litestream.Pos{Generation: generation, Index: 1, Offset: 0}, t0.Add(1 * time.Hour)},
+		{litestream.Pos{Generation: generation, Index: 1, Offset: 32}, t0.Add(2 * time.Hour)},
+		{litestream.Pos{Generation: generation, Index: 2, Offset: 0}, t0.Add(3 * time.Hour)},
+		{litestream.Pos{Generation: generation, Index: 3, Offset: 0}, t0.Add(6 * time.Hour)},
+	} {
+		if _, err := c.WriteWALSegment(context.Background(), tt.pos, strings.NewReader("wal")); err != nil {
+			t.Fatal(err)
+		} else if filename, err := c.WALSegmentPath(generation, tt.pos.Index, tt.pos.Offset); err != nil {
+			t.Fatal(err)
+		} else {
+			mustChtimes(t, filename, tt.at)
+		}
+	}
+
+	r := litestream.NewReplica(nil, "", c)
+	t.Run("OK", func(t *testing.T) {
+		points, err := r.RestorePoints(context.Background(), generation)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := points, []litestream.RestorePoint{
+			{Kind: litestream.RestorePointSnapshot, Pos: litestream.Pos{Generation: generation, Index: 1}, Timestamp: t0.Add(1 * time.Hour)},
+			{Kind: litestream.RestorePointWAL, Pos: litestream.Pos{Generation: generation, Index: 1, Offset: 35}, Timestamp: t0.Add(2 * time.Hour)},
+			{Kind: litestream.RestorePointWAL, Pos: litestream.Pos{Generation: generation, Index: 2, Offset: 3}, Timestamp: t0.Add(3 * time.Hour)},
+			{Kind: litestream.RestorePointSnapshot, Pos: litestream.Pos{Generation: generation, Index: 3}, Timestamp: t0.Add(5 * time.Hour)},
+			{Kind: litestream.RestorePointWAL, Pos: litestream.Pos{Generation: generation, Index: 3, Offset: 3}, Timestamp: t0.Add(6 * time.Hour)},
+		}; len(got) != len(want) {
+			t.Fatalf("len=%d, want %d", len(got), len(want))
+		} else {
+			for i := range want {
+				if got[i].Kind != want[i].Kind || got[i].Pos != want[i].Pos || !got[i].Timestamp.Equal(want[i].Timestamp) {
+					t.Fatalf("points[%d]=%#v, want %#v", i, got[i], want[i])
+				}
+			}
+		}
+	})
+
+	t.Run("NoSnapshots", func(t *testing.T) {
+		if points, err := r.RestorePoints(context.Background(), "0000000000000001"); err != nil {
+			t.Fatal(err)
+		} else if len(points) != 0 {
+			t.Fatalf("unexpected points: %v", points)
+		}
+	})
+}
+
+func TestReplica_SnapshotBoundaries(t *testing.T) {
+	const generation = "0000000000000000"
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	for _, index := range []int{4, 1, 2} {
+		if _, err := c.WriteSnapshot(context.Background(), generation, index, strings.NewReader("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, pos := range []litestream.Pos{
+		{Generation: generation, Index: 1},
+		{Generation: generation, Index: 2},
+		{Generation: generation, Index: 3},
+		{Generation: generation, Index: 4},
+		{Generation: generation, Index: 6},
+		{Generation: generation, Index: 6, Offset: 32},
+	} {
+		if _, err := c.WriteWALSegment(context.Background(), pos, strings.NewReader("wal")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := litestream.NewReplica(nil, "", c)
+	t.Run("OK", func(t *testing.T) {
+		a, err := r.SnapshotBoundaries(context.Background(), generation)
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := a, []litestream.SnapshotBoundary{
+			{Index: 1, EndIndex: 2},
+			{Index: 2, EndIndex: 4},
+			{Index: 4, EndIndex: 7, Head: true},
+		}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("boundaries=%#v, want %#v", got, want)
+		}
+
+		// Every WAL index from the first snapshot to the head is covered once.
+		for index := 1; index <= 6; index++ {
+			var n int
+			for _, b := range a {
+				if index >= b.Index && index < b.EndIndex {
+					n++
+				}
+			}
+			if n != 1 {
+				t.Fatalf("index %d covered by %d snapshots", index, n)
+			}
+		}
+	})
+
+	t.Run("NoSnapshots", func(t *testing.T) {
+		if a, err := r.SnapshotBoundaries(context.Background(), "0000000000000001"); err != nil {
+			t.Fatal(err)
+		} else if len(a) != 0 {
+			t.Fatalf("unexpected boundaries: %#v", a)
+		}
+	})
+}
+
+func TestReplica_SnapshotSchema(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	r := litestream.NewReplica(db, "", litestream.NewFileReplicaClient(t.TempDir()))
+	r.MonitorEnabled = false
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT UNIQUE)`); err != nil {
+		t.Fatal(err)
+	} else if _, err := sqldb.Exec(`CREATE INDEX foo_bar ON foo (bar)`); err != nil {
+		t.Fatal(err)
+	} else if _, err := sqldb.Exec(`CREATE VIEW baz AS SELECT bar FROM foo`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Checkpoint so the schema is in the database file when it is snapshotted.
+	if err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := r.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read expected schema from the source database.
+	var want []string
+	rows, err := sqldb.Query(`SELECT sql FROM sqlite_master WHERE sql IS NOT NULL ORDER BY rowid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, s)
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	} else if len(want) < 3 {
+		t.Fatalf("unexpected source schema: %v", want)
+	}
+
+	if got, err := r.SnapshotSchema(context.Background(), info.Generation, info.Index); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Fatalf("schema=%v, want %v", got, want)
+	}
+
+	if _, err := r.SnapshotSchema(context.Background(), info.Generation, info.Index+1); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestReplica_Attached(t *testing.T) {
+	// count returns the number of rows in table foo.
+	count := func(tb testing.TB, d *sql.DB) (n int) {
+		tb.Helper()
+		if err := d.QueryRow(`SELECT COUNT(*) FROM foo`).Scan(&n); err != nil {
+			tb.Fatal(err)
+		}
+		return n
+	}
+
+	// insert inserts n rows into table foo.
+	insert := func(tb testing.TB, d *sql.DB, n int) {
+		tb.Helper()
+		for i := 0; i < n; i++ {
+			if _, err := d.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		// The attached database uses WAL mode so its image has to include
+		// changes which have not been checkpointed.
+		auxPath := filepath.Join(t.TempDir(), "aux")
+		auxdb := MustOpenSQLDB(t, auxPath)
+		defer MustCloseSQLDB(t, auxdb)
+
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		r := litestream.NewReplica(db, "", c)
+		r.MonitorEnabled = false
+		r.Attached = map[string]string{"aux": auxPath}
+
+		for _, d := range []*sql.DB{sqldb, auxdb} {
+			if _, err := d.Exec(`CREATE TABLE foo (bar TEXT)`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		insert(t, sqldb, 3)
+		insert(t, auxdb, 2)
+		if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Write to both databases after the snapshot. These changes must not
+		// be restored to either database.
+		insert(t, sqldb, 5)
+		insert(t, auxdb, 5)
+		if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		dir := t.TempDir()
+		opt := litestream.NewRestoreOptions()
+		opt.Attached = map[string]string{"aux": filepath.Join(dir, "aux")}
+		if err := litestream.Restore(context.Background(), c, filepath.Join(dir, "db"), r.Pos().Generation, 0, 0, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		restored := MustOpenSQLDB(t, filepath.Join(dir, "db"))
+		defer MustCloseSQLDB(t, restored)
+		restoredAux := MustOpenSQLDB(t, filepath.Join(dir, "aux"))
+		defer MustCloseSQLDB(t, restoredAux)
+		if got, want := count(t, restored), 3; got != want {
+			t.Fatalf("main rows=%d, want %d", got, want)
+		} else if got, want := count(t, restoredAux), 2; got != want {
+			t.Fatalf("attached rows=%d, want %d", got, want)
+		}
+
+		// Attached images are removed with their snapshot.
+		if err := c.DeleteSnapshot(context.Background(), r.Pos().Generation, 0); err != nil {
+			t.Fatal(err)
+		} else if _, err := c.AttachedSnapshotPos(context.Background(), r.Pos().Generation, "aux", 0); !os.IsNotExist(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure a snapshot is retaken if only an attached database has changed.
+	t.Run("AttachedChanged", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		auxPath := filepath.Join(t.TempDir(), "aux")
+		auxdb := MustOpenSQLDB(t, auxPath)
+		defer MustCloseSQLDB(t, auxdb)
+
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		r := litestream.NewReplica(db, "", c)
+		r.MonitorEnabled = false
+		r.Attached = map[string]string{"aux": auxPath}
+
+		for _, d := range []*sql.DB{sqldb, auxdb} {
+			if _, err := d.Exec(`CREATE TABLE foo (bar TEXT)`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		insert(t, auxdb, 2)
+		if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only change the attached database before snapshotting again.
+		insert(t, auxdb, 3)
+		if _, err := r.Snapshot(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		dir := t.TempDir()
+		opt := litestream.NewRestoreOptions()
+		opt.Attached = map[string]string{"aux": filepath.Join(dir, "aux")}
+		if err := litestream.Restore(context.Background(), c, filepath.Join(dir, "db"), r.Pos().Generation, r.Pos().Index, r.Pos().Index, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		restoredAux := MustOpenSQLDB(t, filepath.Join(dir, "aux"))
+		defer MustCloseSQLDB(t, restoredAux)
+		if got, want := count(t, restoredAux), 5; got != want {
+			t.Fatalf("attached rows=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure attached databases cannot be restored past a snapshot.
+	t.Run("ErrTargetIndex", func(t *testing.T) {
+		opt := litestream.NewRestoreOptions()
+		opt.Attached = map[string]string{"aux": filepath.Join(t.TempDir(), "aux")}
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		if err := litestream.Restore(context.Background(), c, filepath.Join(t.TempDir(), "db"), "0000000000000000", 0, 1, opt); err == nil || err.Error() != `attached databases can only be restored to a snapshot index` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestReplica_GenerationTimeline(t *testing.T) {
+	t0 := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	// write writes a snapshot & a WAL segment to a generation with the given
+	// creation times.
+	write := func(tb testing.TB, c *litestream.FileReplicaClient, generation string, snapshotAt, walAt time.Time) {
+		tb.Helper()
+		if _, err := c.WriteSnapshot(context.Background(), generation, 0, strings.NewReader("data")); err != nil {
+			tb.Fatal(err)
+		} else if _, err := c.WriteWALSegment(context.Background(), litestream.Pos{Generation: generation}, strings.NewReader("wal")); err != nil {
+			tb.Fatal(err)
+		}
+
+		if filename, err := c.SnapshotPath(generation, 0); err != nil {
+			tb.Fatal(err)
+		} else {
+			mustChtimes(tb, filename, snapshotAt)
+		}
+		if filename, err := c.WALSegmentPath(generation, 0, 0); err != nil {
+			tb.Fatal(err)
+		} else {
+			mustChtimes(tb, filename, walAt)
+		}
+	}
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	write(t, c, "0000000000000002", t0.Add(10*time.Hour), t0.Add(11*time.Hour))
+	write(t, c, "0000000000000000", t0, t0.Add(2*time.Hour))
+	write(t, c, "0000000000000001", t0.Add(2*time.Hour), t0.Add(4*time.Hour))
+
+	entries, err := litestream.NewReplica(nil, "", c).GenerationTimeline(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if got, want := len(entries), 3; got != want {
+		t.Fatalf("len=%d, want %d", got, want)
+	}
+
+	for i, want := range []litestream.TimelineEntry{
+		{Generation: "0000000000000000", StartedAt: t0, EndedAt: t0.Add(2 * time.Hour), SnapshotN: 1, WALSegmentN: 1},
+		{Generation: "0000000000000001", StartedAt: t0.Add(2 * time.Hour), EndedAt: t0.Add(4 * time.Hour), SnapshotN: 1, WALSegmentN: 1},
+		{Generation: "0000000000000002", StartedAt: t0.Add(10 * time.Hour), EndedAt: t0.Add(11 * time.Hour), SnapshotN: 1, WALSegmentN: 1, GapBefore: 6 * time.Hour},
+	} {
+		got := entries[i]
+		if got.Generation != want.Generation || !got.StartedAt.Equal(want.StartedAt) || !got.EndedAt.Equal(want.EndedAt) ||
+			got.SnapshotN != want.SnapshotN || got.WALSegmentN != want.WALSegmentN || got.GapBefore != want.GapBefore {
+			t.Fatalf("entries[%d]=%#v, want %#v", i, got, want)
+		}
+	}
+}
+
+func TestReplica_GenerationsOutsideWindow(t *testing.T) {
+	// write writes a snapshot & a WAL segment to a generation which were last
+	// updated at the given time.
+	write := func(tb testing.TB, c *litestream.FileReplicaClient, generation string, updatedAt time.Time) {
+		tb.Helper()
+		if _, err := c.WriteSnapshot(context.Background(), generation, 0, strings.NewReader("data")); err != nil {
+			tb.Fatal(err)
+		} else if _, err := c.WriteWALSegment(context.Background(), litestream.Pos{Generation: generation}, strings.NewReader("wal")); err != nil {
+			tb.Fatal(err)
+		}
+
+		if filename, err := c.SnapshotPath(generation, 0); err != nil {
+			tb.Fatal(err)
+		} else {
+			mustChtimes(tb, filename, updatedAt.Add(-time.Hour))
+		}
+		if filename, err := c.WALSegmentPath(generation, 0, 0); err != nil {
+			tb.Fatal(err)
+		} else {
+			mustChtimes(tb, filename, updatedAt)
+		}
+	}
+
+	now := time.Now()
+
+	t.Run("OK", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		write(t, c, "0000000000000000", now.Add(-72*time.Hour))
+		write(t, c, "0000000000000001", now.Add(-48*time.Hour))
+		write(t, c, "0000000000000002", now.Add(-12*time.Hour)) // inside window
+		write(t, c, "0000000000000003", now.Add(-1*time.Hour))
+
+		if a, err := litestream.NewReplica(nil, "", c).GenerationsOutsideWindow(context.Background(), 24*time.Hour); err != nil {
+			t.Fatal(err)
+		} else if got, want := a, []string{"0000000000000000", "0000000000000001"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("generations=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure the most recent generation is kept if all generations have expired.
+	t.Run("AllExpired", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		write(t, c, "0000000000000000", now.Add(-49*time.Hour))
+		write(t, c, "0000000000000001", now.Add(-72*time.Hour))
+
+		if a, err := litestream.NewReplica(nil, "", c).GenerationsOutsideWindow(context.Background(), 24*time.Hour); err != nil {
+			t.Fatal(err)
+		} else if got, want := a, []string{"0000000000000001"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("generations=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure the database's current generation is never returned, even if it
+	// has not been updated within the window.
+	t.Run("Current", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		r := litestream.NewReplica(db, "", c)
+		r.MonitorEnabled = false
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		current := r.Pos().Generation
+		write(t, c, current, now.Add(-48*time.Hour))
+		write(t, c, "0000000000000000", now.Add(-72*time.Hour))
+
+		if a, err := r.GenerationsOutsideWindow(context.Background(), 24*time.Hour); err != nil {
+			t.Fatal(err)
+		} else if got, want := a, []string{"0000000000000000"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("generations=%v, want %v", got, want)
+		}
+	})
+}
+
+func TestReplica_GenerationsCovering(t *testing.T) {
+	// write writes a snapshot created at createdAt & a WAL segment created at
+	// updatedAt to a generation.
+	write := func(tb testing.TB, c *litestream.FileReplicaClient, generation string, createdAt, updatedAt time.Time) {
+		tb.Helper()
+		if _, err := c.WriteSnapshot(context.Background(), generation, 0, strings.NewReader("data")); err != nil {
+			tb.Fatal(err)
+		} else if _, err := c.WriteWALSegment(context.Background(), litestream.Pos{Generation: generation}, strings.NewReader("wal")); err != nil {
+			tb.Fatal(err)
+		}
+
+		if filename, err := c.SnapshotPath(generation, 0); err != nil {
+			tb.Fatal(err)
+		} else {
+			mustChtimes(tb, filename, createdAt)
+		}
+		if filename, err := c.WALSegmentPath(generation, 0, 0); err != nil {
+			tb.Fatal(err)
+		} else {
+			mustChtimes(tb, filename, updatedAt)
+		}
+	}
+
+	t0 := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	newReplica := func(tb testing.TB) *litestream.Replica {
+		c := litestream.NewFileReplicaClient(tb.TempDir())
+		write(tb, c, "0000000000000000", t0, t0.Add(2*time.Hour))
+		write(tb, c, "0000000000000001", t0.Add(3*time.Hour), t0.Add(5*time.Hour))
+		write(tb, c, "0000000000000002", t0.Add(4*time.Hour), t0.Add(6*time.Hour))
+		return litestream.NewReplica(nil, "", c)
+	}
+
+	t.Run("Covered", func(t *testing.T) {
+		if a, err := newReplica(t).GenerationsCovering(context.Background(), t0.Add(1*time.Hour)); err != nil {
+			t.Fatal(err)
+		} else if got, want := a, []string{"0000000000000000"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("generations=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure a timestamp after one generation ends but before the next begins
+	// is not covered by either.
+	t.Run("Gap", func(t *testing.T) {
+		if a, err := newReplica(t).GenerationsCovering(context.Background(), t0.Add(150*time.Minute)); err != nil {
+			t.Fatal(err)
+		} else if len(a) != 0 {
+			t.Fatalf("unexpected generations: %v", a)
+		}
+	})
+
+	t.Run("Multiple", func(t *testing.T) {
+		if a, err := newReplica(t).GenerationsCovering(context.Background(), t0.Add(4*time.Hour).In(time.FixedZone("X", 3600))); err != nil {
+			t.Fatal(err)
+		} else if got, want := a, []string{"0000000000000001", "0000000000000002"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("generations=%v, want %v", got, want)
+		}
+	})
+}
+
+func TestReplica_LatestSnapshot(t *testing.T) {
+	// writeSnapshot writes a placeholder snapshot with the given creation time.
+	writeSnapshot := func(tb testing.TB, c *litestream.FileReplicaClient, generation string, index int, createdAt time.Time) {
+		tb.Helper()
+		if _, err := c.WriteSnapshot(context.Background(), generation, index, strings.NewReader("data")); err != nil {
+			tb.Fatal(err)
+		}
+		filename, err := c.SnapshotPath(generation, index)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		mustChtimes(tb, filename, createdAt)
+	}
+
+	t0 := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("OK", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		writeSnapshot(t, c, "0000000000000000", 0, t0)
+		writeSnapshot(t, c, "0000000000000000", 1, t0.Add(3*time.Hour))
+		writeSnapshot(t, c, "0000000000000001", 0, t0.Add(2*time.Hour))
+		writeSnapshot(t, c, "0000000000000002", 0, t0.Add(1*time.Hour))
+
+		if info, err := litestream.NewReplica(nil, "", c).LatestSnapshot(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := info.Generation, "0000000000000000"; got != want {
+			t.Fatalf("Generation=%s, want %s", got, want)
+		} else if got, want := info.Index, 1; got != want {
+			t.Fatalf("Index=%d, want %d", got, want)
+		} else if got, want := info.CreatedAt, t0.Add(3*time.Hour); !got.Equal(want) {
+			t.Fatalf("CreatedAt=%s, want %s", got, want)
+		}
+	})
+
+	// Ensure the higher generation is returned when creation times are equal.
+	t.Run("Tie", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		writeSnapshot(t, c, "0000000000000000", 0, t0)
+		writeSnapshot(t, c, "0000000000000002", 0, t0)
+		writeSnapshot(t, c, "0000000000000001", 0, t0)
+
+		if info, err := litestream.NewReplica(nil, "", c).LatestSnapshot(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := info.Generation, "0000000000000002"; got != want {
+			t.Fatalf("Generation=%s, want %s", got, want)
+		}
+	})
+
+	t.Run("ErrNoSnapshots", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", litestream.NewFileReplicaClient(t.TempDir()))
+		if _, err := r.LatestSnapshot(context.Background()); err != litestream.ErrNoSnapshots {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestReplica_PruneWALOnSnapshot(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	r := litestream.NewReplica(db, "", c)
+	r.MonitorEnabled = false
+	r.Retention = time.Hour
+	r.PruneWALOnSnapshot = true
+	if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	generation := r.Pos().Generation
+
+	// advance writes a row, moves to the next index, and replicates it.
+	advance := func(tb testing.TB) {
+		tb.Helper()
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			tb.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		} else if err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
+			tb.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	// minWALIndex returns the lowest WAL index on the client.
+	minWALIndex := func(tb testing.TB) int {
+		tb.Helper()
+		positions := mustWALSegmentPositions(tb, c, generation)
+		if len(positions) == 0 {
+			tb.Fatal("expected wal segments")
+		}
+		return positions[0].Index
+	}
+
+	advance(t)
+	advance(t)
+	snapshot, err := r.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// WAL segments are kept while the index 0 snapshot is retained.
+	if got, want := minWALIndex(t), 0; got != want {
+		t.Fatalf("min wal index=%d, want %d", got, want)
+	}
+
+	// Once the older snapshot falls outside retention, the next snapshot
+	// prunes WAL segments that no retained snapshot needs. The expired
+	// snapshot itself is left for retention enforcement to remove.
+	if filename, err := c.SnapshotPath(generation, 0); err != nil {
+		t.Fatal(err)
+	} else {
+		mustChtimes(t, filename, time.Now().Add(-2*time.Hour))
+	}
+	advance(t)
+	if _, err := r.Snapshot(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if got, want := minWALIndex(t), snapshot.Index; got != want {
+		t.Fatalf("min wal index=%d, want %d", got, want)
+	} else if got, want := len(mustSnapshotInfos(t, c, generation)), 3; got != want {
+		t.Fatalf("len(snapshots)=%d, want %d", got, want)
+	}
+
+	// Restoring from the remaining older snapshot must still succeed.
+	targetIndex, err := litestream.FindMaxIndexByGeneration(context.Background(), c, generation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "db")
+	if err := litestream.Restore(context.Background(), c, filename, generation, snapshot.Index, targetIndex, litestream.NewRestoreOptions()); err != nil {
+		t.Fatal(err)
+	}
+	restored := MustOpenSQLDB(t, filename)
+	defer MustCloseSQLDB(t, restored)
+
+	var n int
+	if err := restored.QueryRow(`SELECT COUNT(*) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatalf("count=%d, want 3", n)
+	}
+}
+
+func TestReplica_SnapshotInterval(t *testing.T) {
+	t.Run("Accumulate", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		r := litestream.NewReplica(db, "", litestream.NewFileReplicaClient(t.TempDir()))
+		r.SyncInterval = 10 * time.Millisecond
+		r.SnapshotInterval = 50 * time.Millisecond
+		r.Retention = 24 * time.Hour
+		r.Start(context.Background())
+		defer r.Stop()
+
+		// Keep writing & checkpointing so each snapshot is taken at a new
+		// index rather than replacing the previous snapshot.
+		for i := 0; i < 30; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			} else if err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if snapshots, err := r.Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if len(snapshots) < 3 {
+			t.Fatalf("expected snapshots to accumulate, got %d", len(snapshots))
+		}
+	})
+
+	t.Run("EnforceRetention", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		r := litestream.NewReplica(db, "", c)
+		r.MonitorEnabled = false
+		r.SnapshotInterval = 30 * time.Minute
+		r.Retention = 24 * time.Hour
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Backdate the initial snapshot so it is past the snapshot interval
+		// but still within the retention period.
+		pos := r.Pos()
+		if filename, err := c.SnapshotPath(pos.Generation, 0); err != nil {
+			t.Fatal(err)
+		} else {
+			mustChtimes(t, filename, time.Now().Add(-time.Hour))
+		}
+
+		// Move to a new WAL index so the next snapshot does not replace it.
+		if err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// A new snapshot is created & the old one is retained.
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if snapshots, err := r.Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(snapshots), 2; got != want {
+			t.Fatalf("len(snapshots)=%d, want %d", got, want)
+		}
+
+		// No additional snapshot is needed until the interval elapses again.
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if snapshots, err := r.Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(snapshots), 2; got != want {
+			t.Fatalf("len(snapshots)=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestReplica_ListParallel(t *testing.T) {
+	const generationN, workerN = 20, 4
+
+	fc := litestream.NewFileReplicaClient(t.TempDir())
+	for i := 0; i < generationN; i++ {
+		generation := fmt.Sprintf("%016x", i)
+		if _, err := fc.WriteSnapshot(context.Background(), generation, 0, strings.NewReader("snapshot")); err != nil {
+			t.Fatal(err)
+		}
+		for _, offset := range []int64{0, 32} {
+			if _, err := fc.WriteWALSegment(context.Background(), litestream.Pos{Generation: generation, Offset: offset}, strings.NewReader("wal")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// newReplica returns a replica whose client records the maximum number
+	// of concurrent listing calls.
+	newReplica := func(tb testing.TB) (*litestream.Replica, func() int) {
+		var mu sync.Mutex
+		var active, max int
+		track := func() func() {
+			mu.Lock()
+			if active++; active > max {
+				max = active
+			}
+			mu.Unlock()
+			time.Sleep(2 * time.Millisecond)
+			return func() { mu.Lock(); active--; mu.Unlock() }
+		}
+
+		c := &mock.ReplicaClient{
+			GenerationsFunc: fc.Generations,
+			SnapshotsFunc: func(ctx context.Context, generation string) (litestream.SnapshotIterator, error) {
+				defer track()()
+				return fc.Snapshots(ctx, generation)
+			},
+			WALSegmentsFunc: func(ctx context.Context, generation string) (litestream.WALSegmentIterator, error) {
+				defer track()()
+				return fc.WALSegments(ctx, generation)
+			},
+		}
+		return litestream.NewReplica(nil, "", c), func() int { mu.Lock(); defer mu.Unlock(); return max }
+	}
+
+	t.Run("Snapshots", func(t *testing.T) {
+		r, maxActive := newReplica(t)
+		got, err := r.SnapshotsParallel(context.Background(), workerN)
+		if err != nil {
+			t.Fatal(err)
+		} else if n := maxActive(); n > workerN {
+			t.Fatalf("concurrency=%d, exceeds %d", n, workerN)
+		}
+
+		if want, err := litestream.NewReplica(nil, "", fc).Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if len(got) != generationN || !reflect.DeepEqual(got, want) {
+			t.Fatalf("SnapshotsParallel()=%v, want %v", got, want)
+		}
+	})
+
+	t.Run("WALs", func(t *testing.T) {
+		r, maxActive := newReplica(t)
+		got, err := r.WALsParallel(context.Background(), workerN)
+		if err != nil {
+			t.Fatal(err)
+		} else if n := maxActive(); n > workerN {
+			t.Fatalf("concurrency=%d, exceeds %d", n, workerN)
+		}
+
+		var want []litestream.WALSegmentInfo
+		generations, err := fc.Generations(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, generation := range generations {
+			itr, err := fc.WALSegments(context.Background(), generation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			infos, err := litestream.SliceWALSegmentIterator(itr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, infos...)
+		}
+		if len(got) != 2*generationN || !reflect.DeepEqual(got, want) {
+			t.Fatalf("WALsParallel()=%v, want %v", got, want)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		c := &mock.ReplicaClient{
+			GenerationsFunc: fc.Generations,
+			SnapshotsFunc: func(ctx context.Context, generation string) (litestream.SnapshotIterator, error) {
+				return nil, fmt.Errorf("marker")
+			},
+		}
+		if _, err := litestream.NewReplica(nil, "", c).SnapshotsParallel(context.Background(), workerN); err == nil || err.Error() != `marker` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestReplica_ListChan(t *testing.T) {
+	fc := litestream.NewFileReplicaClient(t.TempDir())
+	for i := 0; i < 3; i++ {
+		generation := fmt.Sprintf("%016x", i)
+		for _, index := range []int{0, 1} {
+			if _, err := fc.WriteSnapshot(context.Background(), generation, index, strings.NewReader("snapshot")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, offset := range []int64{0, 32} {
+			if _, err := fc.WriteWALSegment(context.Background(), litestream.Pos{Generation: generation, Offset: offset}, strings.NewReader("wal")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	r := litestream.NewReplica(nil, "", fc)
+
+	t.Run("Snapshots", func(t *testing.T) {
+		ch, errCh := r.SnapshotsChan(context.Background())
+		var got []litestream.SnapshotInfo
+		for info := range ch {
+			got = append(got, info)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+
+		if want, err := r.Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Fatalf("SnapshotsChan()=%v, want %v", got, want)
+		}
+	})
+
+	t.Run("WALs", func(t *testing.T) {
+		ch, errCh := r.WALsChan(context.Background())
+		var got []litestream.WALSegmentInfo
+		for info := range ch {
+			got = append(got, info)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+
+		if want, err := r.WALsParallel(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Fatalf("WALsChan()=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure the listing stops soon after cancellation even if the client
+	// has an unbounded number of snapshots.
+	t.Run("Cancel", func(t *testing.T) {
+		var mu sync.Mutex
+		var nextN, listN int
+		c := &mock.ReplicaClient{
+			GenerationsFunc: func(ctx context.Context) ([]string, error) {
+				return []string{"0000000000000000", "0000000000000001"}, nil
+			},
+			SnapshotsFunc: func(ctx context.Context, generation string) (litestream.SnapshotIterator, error) {
+				mu.Lock()
+				listN++
+				mu.Unlock()
+
+				return &mock.SnapshotIterator{
+					NextFunc: func() bool {
+						mu.Lock()
+						defer mu.Unlock()
+						nextN++
+						return true
+					},
+					SnapshotFunc: func() litestream.SnapshotInfo {
+						return litestream.SnapshotInfo{Generation: generation}
+					},
+					CloseFunc: func() error { return nil },
+				}, nil
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		ch, errCh := litestream.NewReplica(nil, "", c).SnapshotsChan(ctx)
+		for i := 0; i < 10; i++ {
+			<-ch
+		}
+		cancel()
+
+		select {
+		case err := <-errCh:
+			if err != context.Canceled {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for listing to stop")
+		}
+		if _, ok := <-ch; ok {
+			t.Fatal("expected snapshot channel to be closed")
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if nextN > 11 {
+			t.Fatalf("Next() called %d times after cancel", nextN-10)
+		} else if listN != 1 {
+			t.Fatalf("listed %d generations, want 1", listN)
+		}
+	})
+}
+
+func TestReplica_NewestSnapshotAge(t *testing.T) {
+	t0 := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("OK", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		for _, tt := range []struct {
+			generation string
+			index      int
+			at         time.Time
+		}{
+			{"0000000000000000", 0, t0},
+			{"0000000000000000", 1, t0.Add(2 * time.Hour)},
+			{"0000000000000001", 0, t0.Add(1 * time.Hour)},
+		} {
+			if _, err := c.WriteSnapshot(context.Background(), tt.generation, tt.index, strings.NewReader("data")); err != nil {
+				t.Fatal(err)
+			}
+			filename, err := c.SnapshotPath(tt.generation, tt.index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mustChtimes(t, filename, tt.at)
+		}
+
+		r := litestream.NewReplica(nil, "", c)
+		r.Now = func() time.Time { return t0.Add(5 * time.Hour) }
+		if age, err := r.NewestSnapshotAge(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := age, 3*time.Hour; got != want {
+			t.Fatalf("age=%s, want %s", got, want)
+		}
+	})
+
+	t.Run("ErrNoSnapshots", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", litestream.NewFileReplicaClient(t.TempDir()))
+		if _, err := r.NewestSnapshotAge(context.Background()); err != litestream.ErrNoSnapshots {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestReplica_LatestSnapshotReader(t *testing.T) {
+	// newClient returns a client with snapshots in two generations. The most
+	// recently created snapshot is in the lower generation.
+	newClient := func(tb testing.TB) *litestream.FileReplicaClient {
+		tb.Helper()
+		c := litestream.NewFileReplicaClient(tb.TempDir())
+		for _, tt := range []struct {
+			generation string
+			index      int
+			age        time.Duration
+		}{
+			{"0000000000000000", 1, 3 * time.Hour},
+			{"0000000000000000", 4, 1 * time.Hour},
+			{"0000000000000001", 2, 2 * time.Hour},
+		} {
+			if _, err := c.WriteSnapshot(context.Background(), tt.generation, tt.index, strings.NewReader(tt.generation+litestream.FormatIndex(tt.index))); err != nil {
+				tb.Fatal(err)
+			} else if filename, err := c.SnapshotPath(tt.generation, tt.index); err != nil {
+				tb.Fatal(err)
+			} else {
+				mustChtimes(tb, filename, time.Now().Add(-tt.age))
+			}
+		}
+		return c
+	}
+
+	// readAll reads & closes rc.
+	readAll := func(tb testing.TB, rc io.ReadCloser) string {
+		tb.Helper()
+		defer rc.Close()
+		buf, err := io.ReadAll(rc)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return string(buf)
+	}
+
+	t.Run("Generation", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", newClient(t))
+		rc, index, err := r.LatestSnapshotReader(context.Background(), "0000000000000001")
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := index, 2; got != want {
+			t.Fatalf("index=%d, want %d", got, want)
+		} else if got, want := readAll(t, rc), "00000000000000010000000000000002"; got != want {
+			t.Fatalf("data=%q, want %q", got, want)
+		}
+	})
+
+	t.Run("All", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", newClient(t))
+		rc, info, err := r.LatestSnapshotReaderAll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		} else if info.Generation != "0000000000000000" || info.Index != 4 {
+			t.Fatalf("unexpected snapshot: %#v", info)
+		} else if got, want := readAll(t, rc), "00000000000000000000000000000004"; got != want {
+			t.Fatalf("data=%q, want %q", got, want)
+		}
+	})
+
+	t.Run("ErrNoSnapshots", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", litestream.NewFileReplicaClient(t.TempDir()))
+		if _, _, err := r.LatestSnapshotReader(context.Background(), "0000000000000000"); err != litestream.ErrNoSnapshots {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, _, err := r.LatestSnapshotReaderAll(context.Background()); err != litestream.ErrNoSnapshots {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestReplica_DeltaSnapshots(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	insert := func(tb testing.TB, n int) {
+		tb.Helper()
+		for i := 0; i < n; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO t (v) VALUES (hex(randomblob(200)));`); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+
+	if _, err := sqldb.Exec(`CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	insert(t, 200)
+	if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	r := litestream.NewReplica(db, "", c)
+	r.MonitorEnabled = false
+	r.DeltaSnapshots = true
+	r.MaxDeltaSnapshots = 2
+	if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	generation := r.Pos().Generation
+
+	// Write several snapshots at increasing indexes & record the row count
+	// each one should contain.
+	var snapshots []litestream.SnapshotInfo
+	rowN := make(map[int]int)
+	for i := 0; i < 5; i++ {
+		insert(t, 5)
+		if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := r.Snapshot(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, info)
+
+		var n int
+		if err := sqldb.QueryRow(`SELECT COUNT(*) FROM t`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		rowN[info.Index] = n
+	}
+
+	// countRows returns the number of rows in the database image read from rd.
+	countRows := func(tb testing.TB, rd io.Reader) int {
+		tb.Helper()
+		filename := filepath.Join(tb.TempDir(), "db")
+		if b, err := io.ReadAll(rd); err != nil {
+			tb.Fatal(err)
+		} else if err := os.WriteFile(filename, b, 0600); err != nil {
+			tb.Fatal(err)
+		}
+
+		sqldb := MustOpenSQLDB(tb, filename)
+		defer MustCloseSQLDB(tb, sqldb)
+
+		var n int
+		if err := sqldb.QueryRow(`SELECT COUNT(*) FROM t`).Scan(&n); err != nil {
+			tb.Fatal(err)
+		}
+		return n
+	}
+
+	t.Run("Chain", func(t *testing.T) {
+		// A full snapshot is forced after every two deltas.
+		var got []bool
+		for _, info := range snapshots {
+			rc, err := c.SnapshotReader(context.Background(), generation, info.Index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 16)
+			if _, err := io.ReadFull(lz4.NewReader(rc), b); err != nil {
+				t.Fatal(err)
+			} else if err := rc.Close(); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, string(b) == "litestream delta")
+		}
+		if want := []bool{true, true, false, true, true}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("delta=%v, want %v", got, want)
+		}
+
+		// Deltas only contain changed pages so are smaller than full snapshots.
+		if snapshots[0].Size >= snapshots[2].Size {
+			t.Fatalf("delta size %d not smaller than full size %d", snapshots[0].Size, snapshots[2].Size)
+		}
+	})
+
+	t.Run("SnapshotReader", func(t *testing.T) {
+		for _, info := range snapshots {
+			rc, err := litestream.SnapshotReader(context.Background(), c, generation, info.Index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := countRows(t, rc), rowN[info.Index]; got != want {
+				t.Fatalf("index %d: rows=%d, want %d", info.Index, got, want)
+			} else if err := rc.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("SnapshotReaderAt", func(t *testing.T) {
+		info := snapshots[len(snapshots)-1]
+		ra, n, err := c.SnapshotReaderAt(context.Background(), generation, info.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ra.(io.Closer).Close()
+		if got, want := countRows(t, io.NewSectionReader(ra, 0, n)), rowN[info.Index]; got != want {
+			t.Fatalf("rows=%d, want %d", got, want)
+		}
+	})
+
+	t.Run("LatestSnapshotReader", func(t *testing.T) {
+		info := snapshots[len(snapshots)-1]
+		rc, index, err := r.LatestSnapshotReader(context.Background(), generation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		if index != info.Index {
+			t.Fatalf("index=%d, want %d", index, info.Index)
+		} else if got, want := countRows(t, rc), rowN[info.Index]; got != want {
+			t.Fatalf("rows=%d, want %d", got, want)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		info := snapshots[len(snapshots)-1]
+		filename := filepath.Join(t.TempDir(), "db")
+		if err := litestream.Restore(context.Background(), c, filename, generation, info.Index, info.Index, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if got, want := countRows(t, f), rowN[info.Index]; got != want {
+			t.Fatalf("rows=%d, want %d", got, want)
+		}
+	})
+
+	t.Run("EnforceRetention", func(t *testing.T) {
+		// Expire all but the newest delta, including the initial snapshot
+		// written by the first sync. The newest delta's base chain must be kept.
+		indexes := []int{0}
+		for _, info := range snapshots[:len(snapshots)-1] {
+			indexes = append(indexes, info.Index)
+		}
+		for _, index := range indexes {
+			filename, err := c.SnapshotPath(generation, index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mustChtimes(t, filename, time.Now().Add(-48*time.Hour))
+		}
+
+		r.Retention = 24 * time.Hour
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		info := snapshots[len(snapshots)-1]
+		rc, err := litestream.SnapshotReader(context.Background(), c, generation, info.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		if got, want := countRows(t, rc), rowN[info.Index]; got != want {
+			t.Fatalf("rows=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestReplica_EmbedTimestamps(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	r := litestream.NewReplica(db, "", c)
+	r.MonitorEnabled = false
+	r.EmbedTimestamps = true
+
+	// Write index 0, wait, and then write index 1 with its own snapshot.
+	if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	mid := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if _, err := r.Snapshot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Scramble mtimes so the index 0 files appear newer than index 1 files.
+	generation := r.Pos().Generation
+	for _, index := range []int{0, 1} {
+		mtime := time.Now().Add(time.Hour)
+		if index == 1 {
+			mtime = time.Now().Add(-time.Hour)
+		}
+
+		if filename, err := c.SnapshotPath(generation, index); err != nil {
+			t.Fatal(err)
+		} else {
+			mustChtimes(t, filename, mtime)
+		}
+		for _, pos := range mustWALSegmentPositions(t, c, generation) {
+			if pos.Index != index {
+				continue
+			} else if filename, err := c.WALSegmentPath(pos.Generation, pos.Index, pos.Offset); err != nil {
+				t.Fatal(err)
+			} else {
+				mustChtimes(t, filename, mtime)
+			}
+		}
+	}
+
+	if index, err := litestream.FindIndexByEmbeddedTimestamp(context.Background(), c, generation, mid); err != nil {
+		t.Fatal(err)
+	} else if index != 0 {
+		t.Fatalf("index=%d, want 0", index)
+	}
+	if index, err := r.SnapshotIndexAt(context.Background(), generation, mid); err != nil {
+		t.Fatal(err)
+	} else if index != 0 {
+		t.Fatalf("SnapshotIndexAt()=%d, want 0", index)
+	}
+
+	// Embedded times are only read when requested.
+	if index, err := litestream.FindIndexByTimestamp(context.Background(), c, generation, mid); err != nil {
+		t.Fatal(err)
+	} else if index != 1 {
+		t.Fatalf("index=%d, want 1", index)
+	}
+	r.EmbedTimestamps = false
+	if index, err := r.SnapshotIndexAt(context.Background(), generation, mid); err != nil {
+		t.Fatal(err)
+	} else if index != 1 {
+		t.Fatalf("SnapshotIndexAt()=%d, want 1", index)
+	}
+
+	// Ensure files with embedded timestamps can still be restored.
+	filename := filepath.Join(t.TempDir(), "db")
+	if err := litestream.RestoreLatest(context.Background(), c, filename, litestream.NewRestoreOptions()); err != nil {
+		t.Fatal(err)
+	}
+	restored := MustOpenSQLDB(t, filename)
+	defer MustCloseSQLDB(t, restored)
+
+	var n int
+	if err := restored.QueryRow(`SELECT COUNT(*) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("count=%d, want 1", n)
+	}
+}
+
+func TestReplica_GenerationWALReader(t *testing.T) {
+	src := litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok"))
+
+	// concatSegments returns the decompressed data of all segments in src
+	// from fromIndex onward.
+	concatSegments := func(tb testing.TB, fromIndex int) []byte {
+		tb.Helper()
+		var buf bytes.Buffer
+		for _, pos := range mustWALSegmentPositions(tb, src, "0000000000000000") {
+			if pos.Index < fromIndex {
+				continue
+			}
+			rc, err := src.WALSegmentReader(context.Background(), pos)
+			if err != nil {
+				tb.Fatal(err)
+			} else if _, err := io.Copy(&buf, lz4.NewReader(rc)); err != nil {
+				tb.Fatal(err)
+			} else if err := rc.Close(); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		return buf.Bytes()
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", src)
+		for _, fromIndex := range []int{0, 1, 2} {
+			rc, err := r.GenerationWALReader(context.Background(), "0000000000000000", fromIndex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			} else if err := rc.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if want := concatSegments(t, fromIndex); !bytes.Equal(buf, want) {
+				t.Fatalf("fromIndex=%d: data mismatch: len(%d), len(%d)", fromIndex, len(buf), len(want))
+			}
+		}
+	})
+
+	t.Run("ErrMissingIndex", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		for _, pos := range mustWALSegmentPositions(t, src, "0000000000000000") {
+			if pos.Index == 1 {
+				continue
+			}
+			rd, err := src.WALSegmentReader(context.Background(), pos)
+			if err != nil {
+				t.Fatal(err)
+			} else if _, err := c.WriteWALSegment(context.Background(), pos, rd); err != nil {
+				t.Fatal(err)
+			} else if err := rd.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		r := litestream.NewReplica(nil, "", c)
+		if _, err := r.GenerationWALReader(context.Background(), "0000000000000000", 0); err == nil || err.Error() != `missing wal index 0000000000000001` {
+			t.Fatalf("unexpected error: %v", err)
+		} else if rc, err := r.GenerationWALReader(context.Background(), "0000000000000000", 2); err != nil {
+			t.Fatal(err)
+		} else if err := rc.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("ErrNoWALSegments", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", src)
+		if _, err := r.GenerationWALReader(context.Background(), "0000000000000000", 3); err != litestream.ErrNoWALSegments {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestReplica_WALTransform(t *testing.T) {
+	// run writes several transactions to a new database & syncs each to the
+	// client through fn, recreating the replica halfway so the checksum
+	// chain must be recovered from the client. Returns the client & database.
+	run := func(tb testing.TB, fn func([]byte) ([]byte, error)) (*litestream.FileReplicaClient, *litestream.DB, *sql.DB) {
+		tb.Helper()
+		db, sqldb := MustOpenDBs(tb)
+		tb.Cleanup(func() { MustCloseDBs(tb, db, sqldb) })
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			tb.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+
+		c := litestream.NewFileReplicaClient(tb.TempDir())
+		for i := 0; i < 2; i++ {
+			r := litestream.NewReplica(db, "", c)
+			r.MonitorEnabled = false
+			r.MaxWALSegmentBytes = 6000
+			r.WALTransform = fn
+
+			for j := 0; j < 3; j++ {
+				if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES (hex(randomblob(500)));`); err != nil {
+					tb.Fatal(err)
+				} else if err := db.Sync(context.Background()); err != nil {
+					tb.Fatal(err)
+				} else if err := r.Sync(context.Background()); err != nil {
+					tb.Fatal(err)
+				}
+			}
+		}
+		return c, db, sqldb
+	}
+
+	t.Run("Identity", func(t *testing.T) {
+		c, db, _ := run(t, func(frame []byte) ([]byte, error) { return frame, nil })
+
+		generation := db.Pos().Generation
+		if err := litestream.NewReplica(nil, "", c).VerifyWALIntegrity(context.Background(), generation, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		filename := filepath.Join(t.TempDir(), "db")
+		if err := litestream.RestoreLatest(context.Background(), c, filename, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		}
+		rdb := MustOpenSQLDB(t, filename)
+		defer MustCloseSQLDB(t, rdb)
+
+		var n int
+		if err := rdb.QueryRow(`SELECT COUNT(*) FROM foo`).Scan(&n); err != nil {
+			t.Fatal(err)
+		} else if got, want := n, 6; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	t.Run("Count", func(t *testing.T) {
+		var frameN int
+		_, db, _ := run(t, func(frame []byte) ([]byte, error) {
+			frameN++
+			return frame, nil
+		})
+
+		// All frames remain in the first index as no checkpoint has occurred.
+		fi, err := os.Stat(db.WALPath())
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := frameN, int(fi.Size()-litestream.WALHeaderSize)/(litestream.WALFrameHeaderSize+db.PageSize()); got != want {
+			t.Fatalf("frames=%d, want %d", got, want)
+		}
+	})
+
+	t.Run("Modify", func(t *testing.T) {
+		// Changed frames are written with recalculated checksums.
+		c, db, _ := run(t, func(frame []byte) ([]byte, error) {
+			frame[len(frame)-1] ^= 0xFF
+			return frame, nil
+		})
+		if err := litestream.NewReplica(nil, "", c).VerifyWALIntegrity(context.Background(), db.Pos().Generation, 0); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		// Drop the second frame. Its page is rewritten by later transactions
+		// so the restored data is unaffected. The replica is recreated after
+		// the drop so its position must be recalculated from the client.
+		var frameN int
+		c, db, _ := run(t, func(frame []byte) ([]byte, error) {
+			if frameN++; frameN == 2 {
+				return nil, nil
+			}
+			return frame, nil
+		})
+
+		generation := db.Pos().Generation
+		if err := litestream.NewReplica(nil, "", c).VerifyWALIntegrity(context.Background(), generation, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		// Segments must span the same range of the source WAL.
+		r := litestream.NewReplica(db, "", c)
+		r.MonitorEnabled = false
+		if pos, err := r.CalcChain(context.Background(), generation); err != nil {
+			t.Fatal(err)
+		} else if got, want := pos.Pos, db.Pos(); got != want {
+			t.Fatalf("pos=%s, want %s", got, want)
+		}
+
+		filename := filepath.Join(t.TempDir(), "db")
+		if err := litestream.RestoreLatest(context.Background(), c, filename, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		}
+		rdb := MustOpenSQLDB(t, filename)
+		defer MustCloseSQLDB(t, rdb)
+
+		var n int
+		if err := rdb.QueryRow(`SELECT COUNT(*) FROM foo`).Scan(&n); err != nil {
+			t.Fatal(err)
+		} else if got, want := n, 6; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	t.Run("DropFirstFrame", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		r := litestream.NewReplica(db, "", litestream.NewFileReplicaClient(t.TempDir()))
+		r.MonitorEnabled = false
+		r.WALTransform = func(frame []byte) ([]byte, error) { return nil, nil }
+		if err := r.Sync(context.Background()); err == nil || !strings.Contains(err.Error(), "cannot drop first frame of index") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrTransform", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		r := litestream.NewReplica(db, "", litestream.NewFileReplicaClient(t.TempDir()))
+		r.MonitorEnabled = false
+		r.WALTransform = func(frame []byte) ([]byte, error) { return nil, errors.New("marker") }
+		if err := r.Sync(context.Background()); err == nil || !strings.Contains(err.Error(), "wal transform: marker") {
+			t.Fatalf("unexpected error: %v", err)
+		} else if pos := r.Pos(); !pos.IsZero() {
+			t.Fatalf("unexpected position: %s", pos)
+		}
+	})
+}
+
+func TestReplica_VerifyWALIntegrity(t *testing.T) {
+	newReplica := func(tb testing.TB) (*litestream.Replica, *litestream.FileReplicaClient) {
+		tb.Helper()
+		c := litestream.NewFileReplicaClient(tb.TempDir())
+		mustCopyReplicaClient(tb, c, litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")), "0000000000000000")
+		return litestream.NewReplica(nil, "", c), c
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		r, _ := newReplica(t)
+		for _, index := range []int{0, 1, 2} {
+			if err := r.VerifyWALIntegrity(context.Background(), "0000000000000000", index); err != nil {
+				t.Fatalf("index %d: %s", index, err)
+			}
+		}
+	})
+
+	t.Run("FlippedByte", func(t *testing.T) {
+		r, c := newReplica(t)
+		mustRewriteWALSegment(t, c, litestream.Pos{Generation: "0000000000000000", Index: 2, Offset: 0x1038}, func(b []byte) []byte {
+			b[litestream.WALFrameHeaderSize+100] ^= 0xFF
+			return b
+		})
+
+		if err := r.VerifyWALIntegrity(context.Background(), "0000000000000000", 2); !errors.Is(err, litestream.ErrChecksumMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := r.VerifyWALIntegrity(context.Background(), "0000000000000000", 0); err != nil {
+			t.Fatalf("unexpected error on other index: %s", err)
+		}
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		r, c := newReplica(t)
+		mustRewriteWALSegment(t, c, litestream.Pos{Generation: "0000000000000000", Index: 2, Offset: 0x1038}, func(b []byte) []byte {
+			return b[:len(b)-100]
+		})
+
+		if err := r.VerifyWALIntegrity(context.Background(), "0000000000000000", 2); err == nil || !strings.Contains(err.Error(), "short wal frame at offset 0000000000001038") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("BigEndian", func(t *testing.T) {
+		const pageSize = 512
+		hdr := make([]byte, litestream.WALHeaderSize)
+		binary.BigEndian.PutUint32(hdr[0:], 0x377f0683)
+		binary.BigEndian.PutUint32(hdr[4:], 3007000)
+		binary.BigEndian.PutUint32(hdr[8:], pageSize)
+		binary.BigEndian.PutUint32(hdr[16:], 1234)
+		binary.BigEndian.PutUint32(hdr[20:], 5678)
+		chksum0, chksum1 := litestream.Checksum(binary.BigEndian, 0, 0, hdr[:24])
+		binary.BigEndian.PutUint32(hdr[24:], chksum0)
+		binary.BigEndian.PutUint32(hdr[28:], chksum1)
+
+		frame := make([]byte, litestream.WALFrameHeaderSize+pageSize)
+		binary.BigEndian.PutUint32(frame[0:], 1) // pgno
+		binary.BigEndian.PutUint32(frame[4:], 1) // commit
+		copy(frame[8:], hdr[16:24])
+		copy(frame[24:], bytes.Repeat([]byte("data"), pageSize/4))
+		chksum0, chksum1 = litestream.Checksum(binary.BigEndian, chksum0, chksum1, frame[:8])
+		chksum0, chksum1 = litestream.Checksum(binary.BigEndian, chksum0, chksum1, frame[24:])
+		binary.BigEndian.PutUint32(frame[16:], chksum0)
+		binary.BigEndian.PutUint32(frame[20:], chksum1)
+
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		if _, err := c.WriteWALSegment(context.Background(), litestream.Pos{Generation: "0000000000000000"}, bytes.NewReader(mustCompressLZ4(t, append(hdr, frame...)))); err != nil {
+			t.Fatal(err)
+		}
+		if err := litestream.NewReplica(nil, "", c).VerifyWALIntegrity(context.Background(), "0000000000000000", 0); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("ErrNoWALSegments", func(t *testing.T) {
+		r, _ := newReplica(t)
+		if err := r.VerifyWALIntegrity(context.Background(), "0000000000000000", 3); err != litestream.ErrNoWALSegments {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// mustRewriteWALSegment replaces the WAL segment at pos with the result of
+// passing its decompressed data to fn.
+func mustRewriteWALSegment(tb testing.TB, c litestream.ReplicaClient, pos litestream.Pos, fn func([]byte) []byte) {
+	tb.Helper()
+	rc, err := c.WALSegmentReader(context.Background(), pos)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer rc.Close()
+
+	b, err := io.ReadAll(lz4.NewReader(rc))
+	if err != nil {
+		tb.Fatal(err)
+	} else if _, err := c.WriteWALSegment(context.Background(), pos, bytes.NewReader(mustCompressLZ4(tb, fn(b)))); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// mustCompressLZ4 returns b compressed as an LZ4 frame.
+func mustCompressLZ4(tb testing.TB, b []byte) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	zw := lz4.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		tb.Fatal(err)
+	} else if err := zw.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReplica_CalcChain(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")))
+		chain, err := r.CalcChain(context.Background(), "0000000000000000")
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := chain, (litestream.Chain{
+			Generation:    "0000000000000000",
+			SnapshotIndex: 0,
+			WALSegments: []litestream.Pos{
+				{Generation: "0000000000000000", Index: 0, Offset: 0},
+				{Generation: "0000000000000000", Index: 0, Offset: 0x2050},
+				{Generation: "0000000000000000", Index: 0, Offset: 0x3068},
+				{Generation: "0000000000000000", Index: 1, Offset: 0},
+				{Generation: "0000000000000000", Index: 2, Offset: 0},
+				{Generation: "0000000000000000", Index: 2, Offset: 0x1038},
+			},
+			Pos: litestream.Pos{Generation: "0000000000000000", Index: 2, Offset: 0x2050},
+		}); !reflect.DeepEqual(got, want) {
+			t.Fatalf("chain=%#v, want %#v", got, want)
+		}
+	})
+
+	// Ensure the chain starts at the latest snapshot & reports missing indexes.
+	t.Run("LatestSnapshot", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		mustCopyReplicaClient(t, c, litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")), "0000000000000000")
+
+		rd, err := c.SnapshotReader(context.Background(), "0000000000000000", 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 1, rd); err != nil {
+			t.Fatal(err)
+		} else if err := rd.Close(); err != nil {
+			t.Fatal(err)
+		} else if err := c.DeleteWALSegments(context.Background(), []litestream.Pos{{Generation: "0000000000000000", Index: 1}}); err != nil {
+			t.Fatal(err)
+		}
+
+		chain, err := litestream.NewReplica(nil, "", c).CalcChain(context.Background(), "0000000000000000")
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := chain.SnapshotIndex, 1; got != want {
+			t.Fatalf("SnapshotIndex=%d, want %d", got, want)
+		} else if got, want := chain.WALSegments, []litestream.Pos{
+			{Generation: "0000000000000000", Index: 2, Offset: 0},
+			{Generation: "0000000000000000", Index: 2, Offset: 0x1038},
+		}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("WALSegments=%v, want %v", got, want)
+		} else if got, want := chain.Gaps, []int{1}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Gaps=%v, want %v", got, want)
+		}
+	})
+
+	t.Run("ErrNoSnapshots", func(t *testing.T) {
+		r := litestream.NewReplica(nil, "", litestream.NewFileReplicaClient(t.TempDir()))
+		if _, err := r.CalcChain(context.Background(), "0000000000000000"); err != litestream.ErrNoSnapshots {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestReplica_Snapshot(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	r := litestream.NewReplica(db, "", c)
+
+	// Execute a query to force a write to the WAL.
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fetch current database position & snapshot.
+	pos0 := db.Pos()
+	if info, err := r.Snapshot(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if got, want := info.Pos(), pos0.Truncate(); got != want {
+		t.Fatalf("pos=%s, want %s", got, want)
+	}
+
+	// Sync database and then replica.
+	if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Execute a query to force a write to the WAL & truncate to start new index.
+	if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fetch current database position & snapshot.
+	pos1 := db.Pos()
+	if info, err := r.Snapshot(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if got, want := info.Pos(), pos1.Truncate(); got != want {
+		t.Fatalf("pos=%v, want %v", got, want)
+	}
+
+	// Verify two snapshots exist.
+	if infos, err := r.Snapshots(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if got, want := len(infos), 2; got != want {
+		t.Fatalf("len=%v, want %v", got, want)
+	} else if got, want := infos[0].Pos(), pos0.Truncate(); got != want {
+		t.Fatalf("info[0]=%s, want %s", got, want)
+	} else if got, want := infos[1].Pos(), pos1.Truncate(); got != want {
+		t.Fatalf("info[1]=%s, want %s", got, want)
+	}
+}
+
+func TestReplica_Snapshot_Exists(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	r := litestream.NewReplica(db, "", c)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	info0, err := r.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the snapshot time forward so a rewrite would be detectable.
+	createdAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	if filename, err := c.SnapshotPath(info0.Generation, info0.Index); err != nil {
+		t.Fatal(err)
+	} else {
+		mustChtimes(t, filename, createdAt)
+	}
+
+	// Snapshotting again at the same position should reuse the existing file.
+	if info1, err := r.Snapshot(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if got, want := info1.Pos(), info0.Pos(); got != want {
+		t.Fatalf("pos=%s, want %s", got, want)
+	} else if got, want := info1.CreatedAt, createdAt; !got.Equal(want) {
+		t.Fatalf("CreatedAt=%s, want %s", got, want)
+	}
+}
+
+func TestReplica_OnSnapshot(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	r := litestream.NewReplica(db, "", c)
+
+	var infos []litestream.SnapshotInfo
+	var durations []time.Duration
+	r.OnSnapshot = func(info litestream.SnapshotInfo, duration time.Duration) {
+		infos, durations = append(infos, info), append(durations, duration)
+	}
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := r.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if got, want := len(infos), 1; got != want {
+		t.Fatalf("n=%d, want %d", got, want)
+	} else if got, want := infos[0], info; !reflect.DeepEqual(got, want) {
+		t.Fatalf("info=%#v, want %#v", got, want)
+	} else if durations[0] <= 0 {
+		t.Fatalf("unexpected duration: %s", durations[0])
+	}
+
+	// Reported size should match the compressed snapshot on disk.
+	filename, err := c.SnapshotPath(info.Generation, info.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filename); err != nil {
+		t.Fatal(err)
+	} else if got, want := infos[0].Size, fi.Size(); got != want {
+		t.Fatalf("size=%d, want %d", got, want)
+	}
+
+	// Skipped snapshots are not reported.
+	if _, err := r.Snapshot(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if got, want := len(infos), 1; got != want {
+		t.Fatalf("n=%d, want %d", got, want)
+	}
+}
+
+func TestReplica_MaxSnapshotRetries(t *testing.T) {
+	// newClient returns a client which fails every snapshot write & a function
+	// returning the number of writes attempted.
+	newClient := func(tb testing.TB) (*mock.ReplicaClient, func() int) {
+		var mu sync.Mutex
+		var n int
+		fc := litestream.NewFileReplicaClient(tb.TempDir())
+		return &mock.ReplicaClient{
+			GenerationsFunc: fc.Generations,
+			SnapshotsFunc:   fc.Snapshots,
+			WALSegmentsFunc: fc.WALSegments,
+			WriteSnapshotFunc: func(ctx context.Context, generation string, index int, rd io.Reader) (litestream.SnapshotInfo, error) {
+				mu.Lock()
+				n++
+				mu.Unlock()
+				_, _ = io.Copy(io.Discard, rd)
+				return litestream.SnapshotInfo{}, fmt.Errorf("marker")
+			},
+		}, func() int { mu.Lock(); defer mu.Unlock(); return n }
+	}
+
+	t.Run("Sync", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseSQLDB(t, sqldb)
+
+		c, writeN := newClient(t)
+		r := litestream.NewReplica(db, "", c)
+		r.MonitorEnabled = false
+		r.MaxSnapshotRetries = 3
+		r.SnapshotRetryBackoff = time.Millisecond
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		var e *litestream.SnapshotFailedError
+		if err := r.Sync(context.Background()); !errors.As(err, &e) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := e.Attempts, 4; got != want {
+			t.Fatalf("Attempts=%d, want %d", got, want)
+		} else if got, want := e.Err.Error(), "marker"; got != want {
+			t.Fatalf("Err=%s, want %s", got, want)
+		} else if got, want := writeN(), 4; got != want {
+			t.Fatalf("writes=%d, want %d", got, want)
+		}
+		_ = db.Close()
+	})
+
+	// Ensure the monitor stops once retries are exhausted instead of trying a
+	// new snapshot on every sync.
+	t.Run("Monitor", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseSQLDB(t, sqldb)
+
+		c, writeN := newClient(t)
+		r := litestream.NewReplica(db, "", c)
+		r.SyncInterval = time.Millisecond
+		r.MaxSnapshotRetries = 2
+		r.SnapshotRetryBackoff = time.Millisecond
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		r.Start(context.Background())
+		defer r.Stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for r.Err() == nil {
+			if ctx.Err() != nil {
+				t.Fatal("timeout waiting for replica to stop")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if !errors.As(r.Err(), new(*litestream.SnapshotFailedError)) {
+			t.Fatalf("unexpected error: %v", r.Err())
+		}
+
+		// No further snapshots are attempted after the monitor stops.
+		time.Sleep(20 * time.Millisecond)
+		if got, want := writeN(), 3; got != want {
+			t.Fatalf("writes=%d, want %d", got, want)
+		}
+		_ = db.Close()
+	})
+}
+
+func TestReplica_Snapshot_InsufficientSpace(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	fc := litestream.NewFileReplicaClient(t.TempDir())
+	c := &freeSpaceReplicaClient{FileReplicaClient: fc, free: 1}
+	r := litestream.NewReplica(db, "", c)
+	r.MonitorEnabled = false
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Snapshot(context.Background()); !errors.Is(err, litestream.ErrInsufficientSpace) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if infos := mustSnapshotInfos(t, fc, db.Pos().Generation); len(infos) != 0 {
+		t.Fatalf("unexpected snapshots: %#v", infos)
+	}
+
+	// Snapshot is written once enough space is available.
+	c.free = 1 << 30
+	if _, err := r.Snapshot(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if infos := mustSnapshotInfos(t, fc, db.Pos().Generation); len(infos) != 1 {
+		t.Fatalf("n=%d, want 1", len(infos))
+	}
+}
+
+// freeSpaceReplicaClient wraps a file client & reports a fixed free space.
+type freeSpaceReplicaClient struct {
+	*litestream.FileReplicaClient
+	free int64
+}
+
+func (c *freeSpaceReplicaClient) FreeSpace(ctx context.Context) (int64, error) {
+	return c.free, nil
+}
+
+func TestReplica_EnforceRetention(t *testing.T) {
+	// newClient returns a client with snapshots at index 0 & 2 and WAL at
+	// indexes 0 through 2. Every file is backdated by the given ages.
+	newClient := func(tb testing.TB, snapshotAges, walAges [3]time.Duration) *litestream.FileReplicaClient {
+		tb.Helper()
+		c := litestream.NewFileReplicaClient(tb.TempDir())
+		mustCopyReplicaClient(tb, c, litestream.NewFileReplicaClient(filepath.Join("testdata", "restore", "ok")), "0000000000000000")
+
+		// Add a second snapshot at index 2.
+		rd, err := c.SnapshotReader(context.Background(), "0000000000000000", 0)
+		if err != nil {
+			tb.Fatal(err)
+		} else if _, err := c.WriteSnapshot(context.Background(), "0000000000000000", 2, rd); err != nil {
+			tb.Fatal(err)
+		} else if err := rd.Close(); err != nil {
+			tb.Fatal(err)
+		}
+
+		for index, age := range snapshotAges {
+			if age == 0 {
+				continue
+			}
+			filename, err := c.SnapshotPath("0000000000000000", index)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			mustChtimes(tb, filename, time.Now().Add(-age))
+		}
+
+		for _, pos := range mustWALSegmentPositions(tb, c, "0000000000000000") {
+			filename, err := c.WALSegmentPath(pos.Generation, pos.Index, pos.Offset)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			mustChtimes(tb, filename, time.Now().Add(-walAges[pos.Index]))
+		}
+		return c
+	}
+
+	// walIndexes returns the distinct WAL indexes remaining on the client.
+	walIndexes := func(tb testing.TB, c litestream.ReplicaClient) []int {
+		var a []int
+		for _, pos := range mustWALSegmentPositions(tb, c, "0000000000000000") {
+			if len(a) == 0 || a[len(a)-1] != pos.Index {
+				a = append(a, pos.Index)
+			}
+		}
+		return a
+	}
+
+	const day = 24 * time.Hour
+
+	t.Run("WALRetention", func(t *testing.T) {
+		c := newClient(t, [3]time.Duration{20 * day, 0, time.Hour}, [3]time.Duration{10 * day, 10 * day, time.Hour})
+
+		r := litestream.NewReplica(nil, "", c)
+		r.Retention = 30 * day
+		r.WALRetention = 7 * day
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Both snapshots are retained but older WAL files are removed.
+		if snapshots, err := r.Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(snapshots), 2; got != want {
+			t.Fatalf("len(snapshots)=%d, want %d", got, want)
+		}
+		if got, want := walIndexes(t, c), []int{2}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("WAL indexes=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure the same files are removed regardless of the local time zone,
+	// including for files close to the retention boundary.
+	t.Run("TimeZone", func(t *testing.T) {
+		defer func(loc *time.Location) { time.Local = loc }(time.Local)
+
+		var results [][2][]int
+		for _, loc := range []*time.Location{
+			time.UTC,
+			time.FixedZone("UTC-10", -10*60*60),
+			time.FixedZone("UTC+14", 14*60*60),
+		} {
+			time.Local = loc
+
+			c := newClient(t, [3]time.Duration{30*day + time.Minute, 0, 30*day - time.Minute}, [3]time.Duration{7*day + time.Minute, 7*day + time.Minute, 7*day - time.Minute})
+			r := litestream.NewReplica(nil, "", c)
+			r.Retention = 30 * day
+			r.WALRetention = 7 * day
+			if err := r.EnforceRetention(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			var result [2][]int
+			snapshots, err := r.Snapshots(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, info := range snapshots {
+				result[0] = append(result[0], info.Index)
+			}
+			result[1] = walIndexes(t, c)
+			results = append(results, result)
+		}
+
+		if got, want := results[0], [2][]int{{2}, {2}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("UTC: snapshots & WAL indexes=%v, want %v", got, want)
+		}
+		for i := 1; i < len(results); i++ {
+			if got, want := results[i], results[0]; !reflect.DeepEqual(got, want) {
+				t.Fatalf("zone %d: snapshots & WAL indexes=%v, want %v", i, got, want)
+			}
+		}
+	})
+
+	t.Run("KeepWALAfterLatestSnapshot", func(t *testing.T) {
+		c := newClient(t, [3]time.Duration{20 * day, 0, 10 * day}, [3]time.Duration{10 * day, 10 * day, 10 * day})
+
+		r := litestream.NewReplica(nil, "", c)
+		r.Retention = 30 * day
+		r.WALRetention = 7 * day
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// WAL at the latest snapshot index is kept even though it has expired.
+		if got, want := walIndexes(t, c), []int{2}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("WAL indexes=%v, want %v", got, want)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		c := newClient(t, [3]time.Duration{20 * day, 0, time.Hour}, [3]time.Duration{10 * day, 10 * day, time.Hour})
+
+		r := litestream.NewReplica(nil, "", c)
+		r.Retention = 30 * day
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := walIndexes(t, c), []int{0, 1, 2}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("WAL indexes=%v, want %v", got, want)
+		}
+	})
+
+	t.Run("ImmutableGeneration", func(t *testing.T) {
+		c := newClient(t, [3]time.Duration{40 * day, 0, 40 * day}, [3]time.Duration{40 * day, 40 * day, 40 * day})
+
+		// Add a newer generation so retention does not need to snapshot.
+		rd, err := c.SnapshotReader(context.Background(), "0000000000000000", 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := c.WriteSnapshot(context.Background(), "0000000000000001", 0, rd); err != nil {
+			t.Fatal(err)
+		} else if err := rd.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := litestream.NewReplica(nil, "", c)
+		r.Retention = 30 * day
+		if err := r.SetGenerationImmutable(context.Background(), "0000000000000000", true); err != nil {
+			t.Fatal(err)
+		}
+
+		// Marker is persisted on the replica so a new client sees it.
+		if immutable, err := litestream.NewFileReplicaClient(c.Path()).IsGenerationImmutable(context.Background(), "0000000000000000"); err != nil {
+			t.Fatal(err)
+		} else if !immutable {
+			t.Fatal("expected generation to be immutable")
+		}
+
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if generations, err := c.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := generations, []string{"0000000000000000", "0000000000000001"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("generations=%v, want %v", got, want)
+		} else if got, want := walIndexes(t, c), []int{0, 1, 2}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("WAL indexes=%v, want %v", got, want)
+		}
+
+		// Generation is removed once the marker is cleared.
+		if err := r.SetGenerationImmutable(context.Background(), "0000000000000000", false); err != nil {
+			t.Fatal(err)
+		} else if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if generations, err := c.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := generations, []string{"0000000000000001"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("generations=%v, want %v", got, want)
+		}
+	})
+
+	t.Run("RunRetentionOnStart", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		c := newClient(t, [3]time.Duration{20 * day, 0, time.Hour}, [3]time.Duration{10 * day, 10 * day, time.Hour})
+
+		r := litestream.NewReplica(db, "", c)
+		r.Retention = 30 * day
+		r.WALRetention = 7 * day
+		r.RetentionCheckInterval = day
+		r.RunRetentionOnStart = true
+		r.Start(context.Background())
+		defer r.Stop()
+
+		// Expired WAL files are removed without waiting for the check interval.
+		for i := 0; !reflect.DeepEqual(walIndexes(t, c), []int{2}); i++ {
+			if i > 100 {
+				t.Fatalf("timeout waiting for retention: WAL indexes=%v", walIndexes(t, c))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	// Ensure a single summary line is logged for all removed WAL segments.
+	t.Run("WALDeleteSummary", func(t *testing.T) {
+		c := newClient(t, [3]time.Duration{20 * day, 0, time.Hour}, [3]time.Duration{10 * day, 10 * day, time.Hour})
+		n := len(mustWALSegmentPositions(t, c, "0000000000000000"))
+
+		var buf bytes.Buffer
+		r := litestream.NewReplica(nil, "", c)
+		r.Logger = log.New(&buf, "", 0)
+		r.Retention = 30 * day
+		r.WALRetention = 7 * day
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		remaining := mustWALSegmentPositions(t, c, "0000000000000000")
+		if got, want := walIndexes(t, c), []int{2}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("WAL indexes=%v, want %v", got, want)
+		} else if got, want := strings.Count(buf.String(), "wal segments deleted"), 1; got != want {
+			t.Fatalf("summary lines=%d, want %d: %s", got, want, buf.String())
+		} else if want := fmt.Sprintf("wal segments deleted 0000000000000000/0000000000000000-0000000000000001 n=%d ", n-len(remaining)); !strings.Contains(buf.String(), want) {
+			t.Fatalf("unexpected log output: %s", buf.String())
+		}
+	})
+
+	t.Run("RunRetentionOnStartNoGeneration", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		var buf bytes.Buffer
+		r := litestream.NewReplica(db, "", litestream.NewFileReplicaClient(t.TempDir()))
+		r.Logger = log.New(&buf, "", 0)
+		r.RunRetentionOnStart = true
+		r.Start(context.Background())
+		time.Sleep(100 * time.Millisecond)
+		r.Stop()
+
+		if s := buf.String(); strings.Contains(s, "retainer error") {
+			t.Fatalf("unexpected log output: %s", s)
+		}
+	})
+
+	t.Run("OnDelete", func(t *testing.T) {
+		c := newClient(t, [3]time.Duration{20 * day, 0, time.Hour}, [3]time.Duration{20 * day, 20 * day, time.Hour})
+
+		// Add an expired generation which is removed entirely.
+		rd, err := c.SnapshotReader(context.Background(), "0000000000000000", 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := c.WriteSnapshot(context.Background(), "0000000000000001", 0, rd); err != nil {
+			t.Fatal(err)
+		} else if err := rd.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if filename, err := c.SnapshotPath("0000000000000001", 0); err != nil {
+			t.Fatal(err)
+		} else {
+			mustChtimes(t, filename, time.Now().Add(-30*day))
+		}
+
+		// Build expected deletions from the current listing.
+		type deletion struct {
+			kind, generation string
+			index            int
+			size             int64
+		}
+		var want []deletion
+		for _, generation := range []string{"0000000000000000", "0000000000000001"} {
+			snapshots, err := litestream.SliceSnapshotIterator(mustSnapshots(t, c, generation))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, info := range snapshots {
+				if generation == "0000000000000001" || info.Index == 0 {
+					want = append(want, deletion{litestream.DeleteKindSnapshot, generation, info.Index, info.Size})
+				}
+			}
+		}
+		itr, err := c.WALSegments(context.Background(), "0000000000000000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments, err := litestream.SliceWALSegmentIterator(itr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range segments {
+			if info.Index < 2 {
+				want = append(want, deletion{litestream.DeleteKindWAL, info.Generation, info.Index, info.Size})
+			}
+		}
+
+		var got []deletion
+		r := litestream.NewReplica(nil, "", c)
+		r.Retention = day
+		r.OnDelete = func(kind, generation string, index int, size int64) {
+			got = append(got, deletion{kind, generation, index, size})
+		}
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Slice(got, func(i, j int) bool { return fmt.Sprint(got[i]) < fmt.Sprint(got[j]) })
+		sort.Slice(want, func(i, j int) bool { return fmt.Sprint(want[i]) < fmt.Sprint(want[j]) })
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("deletions=%v, want %v", got, want)
+		} else if len(got) != 6 {
+			t.Fatalf("unexpected deletion count: %d", len(got))
+		}
+	})
+
+	t.Run("RetentionOverhang", func(t *testing.T) {
+		c := newClient(t, [3]time.Duration{20 * day, 0, time.Hour}, [3]time.Duration{10 * day, 10 * day, time.Hour})
+
+		// Only the first snapshot & WAL indexes 0 & 1 are past retention.
+		var wantN int
+		var wantBytes int64
+		snapshots, err := litestream.SliceSnapshotIterator(mustSnapshots(t, c, "0000000000000000"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantN, wantBytes = 1, snapshots[0].Size
+		itr, err := c.WALSegments(context.Background(), "0000000000000000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments, err := litestream.SliceWALSegmentIterator(itr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range segments {
+			if info.Index < 2 {
+				wantN, wantBytes = wantN+1, wantBytes+info.Size
+			}
+		}
+
+		r := litestream.NewReplica(nil, "", c)
+		r.Retention = day
+		if n, sz, oldest, err := r.RetentionOverhang(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := n, wantN; got != want {
+			t.Fatalf("count=%d, want %d", got, want)
+		} else if got, want := sz, wantBytes; got != want {
+			t.Fatalf("bytes=%d, want %d", got, want)
+		} else if !oldest.Equal(snapshots[0].CreatedAt) {
+			t.Fatalf("oldest=%s, want %s", oldest, snapshots[0].CreatedAt)
+		}
+
+		// Overhang is removed once retention is enforced.
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if n, sz, oldest, err := r.RetentionOverhang(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if n != 0 || sz != 0 || !oldest.IsZero() {
+			t.Fatalf("unexpected overhang: count=%d bytes=%d oldest=%s", n, sz, oldest)
+		}
+	})
+
+	t.Run("KeepSnapshotAtRetainedIndex", func(t *testing.T) {
+		fc := newClient(t, [3]time.Duration{20 * day, 0, time.Hour}, [3]time.Duration{20 * day, 20 * day, time.Hour})
+
+		// Remove the retained snapshot at index 2 after retention has listed
+		// snapshots so no snapshot exists at the index the WAL depends on.
+		var snapshotsN int
+		c := &mock.ReplicaClient{
+			GenerationsFunc:       fc.Generations,
+			DeleteGenerationFunc:  fc.DeleteGeneration,
+			DeleteSnapshotFunc:    fc.DeleteSnapshot,
+			SnapshotReaderFunc:    fc.SnapshotReader,
+			WALSegmentsFunc:       fc.WALSegments,
+			DeleteWALSegmentsFunc: fc.DeleteWALSegments,
+			SnapshotsFunc: func(ctx context.Context, generation string) (litestream.SnapshotIterator, error) {
+				if snapshotsN++; snapshotsN == 2 {
+					if err := fc.DeleteSnapshot(ctx, generation, 2); err != nil {
+						return nil, err
+					}
+				}
+				return fc.Snapshots(ctx, generation)
+			},
+		}
+
+		r := litestream.NewReplica(nil, "", c)
+		r.Retention = day
+		if err := r.EnforceRetention(context.Background()); err == nil || !strings.Contains(err.Error(), "retained snapshot not found") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// The remaining snapshot & all WAL segments should still exist.
+		if snapshots, err := litestream.SliceSnapshotIterator(mustSnapshots(t, fc, "0000000000000000")); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(snapshots), 1; got != want {
+			t.Fatalf("len(snapshots)=%d, want %d", got, want)
+		}
+		if got, want := walIndexes(t, fc), []int{0, 1, 2}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("WAL indexes=%v, want %v", got, want)
+		}
+	})
+
+	t.Run("MinRetainedSnapshots", func(t *testing.T) {
+		c := newClient(t, [3]time.Duration{20 * day, 0, 10 * day}, [3]time.Duration{20 * day, 20 * day, 10 * day})
+
+		// Add an expired generation which should be removed regardless of the floor.
+		rd, err := c.SnapshotReader(context.Background(), "0000000000000000", 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := c.WriteSnapshot(context.Background(), "0000000000000001", 0, rd); err != nil {
+			t.Fatal(err)
+		} else if err := rd.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if filename, err := c.SnapshotPath("0000000000000001", 0); err != nil {
+			t.Fatal(err)
+		} else {
+			mustChtimes(t, filename, time.Now().Add(-30*day))
+		}
+
+		// Make the newest generation "0000000000000000" retained by keeping its
+		// latest snapshot within an aggressive retention interval.
+		if filename, err := c.SnapshotPath("0000000000000000", 2); err != nil {
+			t.Fatal(err)
+		} else {
+			mustChtimes(t, filename, time.Now().Add(-time.Minute))
+		}
+
+		r := litestream.NewReplica(nil, "", c)
+		r.Retention = time.Hour
+		r.MinRetainedSnapshots = 2
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if snapshots, err := r.Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(snapshots), 2; got != want {
+			t.Fatalf("len(snapshots)=%d, want %d", got, want)
+		} else if snapshots[0].Generation != "0000000000000000" || snapshots[1].Generation != "0000000000000000" {
+			t.Fatalf("unexpected snapshots: %#v", snapshots)
+		}
+		if got, want := walIndexes(t, c), []int{0, 1, 2}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("WAL indexes=%v, want %v", got, want)
+		}
+		if generations, err := c.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := generations, []string{"0000000000000000"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Generations()=%v, want %v", got, want)
+		}
+	})
+
+	// Ensure the oldest generations are removed down to the generation limit
+	// even though their snapshots are within the retention period.
+	t.Run("MaxGenerations", func(t *testing.T) {
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		for i, generation := range []string{"0000000000000003", "0000000000000000", "0000000000000002", "0000000000000001"} {
+			if _, err := c.WriteSnapshot(context.Background(), generation, 0, strings.NewReader("data")); err != nil {
+				t.Fatal(err)
+			}
+			filename, err := c.SnapshotPath(generation, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mustChtimes(t, filename, time.Now().Add(-time.Duration(4-i)*time.Hour))
+		}
+
+		r := litestream.NewReplica(nil, "", c)
+		r.Retention = 30 * day
+		r.MaxGenerations = 2
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if generations, err := c.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := generations, []string{"0000000000000001", "0000000000000002"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Generations()=%v, want %v", got, want)
+		}
+	})
+}
+
+func TestReplica_SnapshotOnly(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	r := litestream.NewReplica(db, "", c)
+	r.Mode = litestream.ReplicaModeSnapshotOnly
+
+	for i := 0; i < 3; i++ {
+		if _, err := sqldb.Exec(`CREATE TABLE IF NOT EXISTS foo (bar TEXT); INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	generation, err := db.CurrentGeneration()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A snapshot should be written but no WAL segments.
+	snapshots, err := r.Snapshots(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if got, want := len(snapshots), 1; got != want {
+		t.Fatalf("len(snapshots)=%d, want %d", got, want)
+	} else if got, want := r.Pos(), snapshots[0].Pos(); got != want {
+		t.Fatalf("Pos()=%s, want %s", got, want)
+	}
+	if a := mustWALSegmentPositions(t, c, generation); len(a) != 0 {
+		t.Fatalf("unexpected WAL segments: %v", a)
+	}
+}
+
+func TestReplica_SyncCoalesceSegments(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	r := litestream.NewReplica(db, "", c)
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Issue many small writes, each producing its own shadow WAL segment.
+	for i := 0; i < 20; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES (?);`, fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	generation, err := db.CurrentGeneration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	itr, err := db.WALSegments(context.Background(), generation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadowSegments, err := litestream.SliceWALSegmentIterator(itr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A single sync should combine the pending segments into one file.
+	if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	positions := mustWALSegmentPositions(t, c, generation)
+	if got, want := len(positions), 2; got != want {
+		t.Fatalf("len(segments)=%d, want %d", got, want)
+	} else if len(shadowSegments) <= len(positions) {
+		t.Fatalf("expected fewer replica segments than shadow segments: %d <= %d", len(shadowSegments), len(positions))
+	} else if got, want := r.Pos(), db.Pos(); got != want {
+		t.Fatalf("Pos()=%s, want %s", got, want)
+	}
+
+	// Restored database should contain every write.
+	filename := filepath.Join(t.TempDir(), "db")
+	if err := litestream.RestoreLatest(context.Background(), c, filename, litestream.NewRestoreOptions()); err != nil {
+		t.Fatal(err)
+	}
+	restoredDB := MustOpenSQLDB(t, filename)
+	defer MustCloseSQLDB(t, restoredDB)
+
+	var n int
+	if err := restoredDB.QueryRow(`SELECT COUNT(*) FROM foo`).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if got, want := n, 20; got != want {
+		t.Fatalf("count=%d, want %d", got, want)
+	}
+}
+
+func TestReplica_VerifyWrites(t *testing.T) {
+	// newClient returns a client which optionally corrupts written WAL data.
+	newClient := func(tb testing.TB, corrupt bool) (*mock.ReplicaClient, *litestream.FileReplicaClient) {
+		fc := litestream.NewFileReplicaClient(tb.TempDir())
+		return &mock.ReplicaClient{
+			GenerationsFunc:       fc.Generations,
+			SnapshotsFunc:         fc.Snapshots,
+			WriteSnapshotFunc:     fc.WriteSnapshot,
+			SnapshotReaderFunc:    fc.SnapshotReader,
+			WALSegmentsFunc:       fc.WALSegments,
+			WALSegmentReaderFunc:  fc.WALSegmentReader,
+			DeleteWALSegmentsFunc: fc.DeleteWALSegments,
+			WriteWALSegmentFunc: func(ctx context.Context, pos litestream.Pos, rd io.Reader) (litestream.WALSegmentInfo, error) {
+				buf, err := io.ReadAll(rd)
+				if err != nil {
+					return litestream.WALSegmentInfo{}, err
+				} else if corrupt {
+					buf[len(buf)-1] ^= 0xFF
+				}
+				return fc.WriteWALSegment(ctx, pos, bytes.NewReader(buf))
+			},
+		}, fc
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		c, _ := newClient(t, false)
+		r := litestream.NewReplica(db, "", c)
+		r.WALCodec = litestream.CodecNone
+		r.VerifyWrites = true
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := r.Pos(), db.Pos(); got != want {
+			t.Fatalf("Pos()=%s, want %s", got, want)
+		}
+	})
+
+	t.Run("ErrChecksumMismatch", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		c, fc := newClient(t, true)
+		r := litestream.NewReplica(db, "", c)
+		r.WALCodec = litestream.CodecNone
+		r.VerifyWrites = true
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); !errors.Is(err, litestream.ErrChecksumMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if r.Pos() == db.Pos() {
+			t.Fatal("expected position to not advance")
+		}
+
+		// The corrupt segment should be removed from the client.
+		if a := mustWALSegmentPositions(t, fc, db.Pos().Generation); len(a) != 0 {
+			t.Fatalf("unexpected wal segments: %v", a)
+		}
+	})
+}
+
+func TestReplica_SyncRetentionConcurrent(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+
+	c := litestream.NewFileReplicaClient(t.TempDir())
+	r := litestream.NewReplica(db, "", c)
+	r.Retention = time.Nanosecond // snapshot & delete old files on every call
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var g errgroup.Group
+	g.Go(func() error {
+		for i := 0; i < 50; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+				return err
+			} else if err := db.Sync(context.Background()); err != nil {
+				return err
+			} else if err := r.Sync(context.Background()); err != nil {
+				return fmt.Errorf("sync: %w", err)
+			}
+		}
+		return nil
+	})
+	g.Go(func() error {
+		for i := 0; i < 20; i++ {
+			if err := r.EnforceRetention(context.Background()); err != nil {
+				return fmt.Errorf("enforce retention: %w", err)
+			}
+		}
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replica should still be restorable to the current position.
+	if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if ok, err := litestream.IsRestorable(context.Background(), c, r.Pos()); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatalf("position not restorable: %s", r.Pos())
+	}
+}
+
+func BenchmarkReplica_Snapshot(b *testing.B) {
+	for _, size := range []int{32 * 1024, 1024 * 1024} {
+		b.Run(fmt.Sprintf("%dKB", size/1024), func(b *testing.B) {
+			db, sqldb := MustOpenDBs(b)
+			defer MustCloseDBs(b, db, sqldb)
+
+			// Generate a large database file.
+			if _, err := sqldb.Exec(`CREATE TABLE foo (bar BLOB);`); err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < 64; i++ {
+				if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES (randomblob(1048576));`); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := db.Sync(context.Background()); err != nil {
+				b.Fatal(err)
+			} else if err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
+				b.Fatal(err)
+			}
+
+			fi, err := os.Stat(db.Path())
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(fi.Size())
+
+			c := litestream.NewFileReplicaClient(b.TempDir())
+			r := litestream.NewReplica(db, "", c)
+			r.SnapshotCodec = litestream.CodecNone
+			r.CopyBufferSize = size
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				info, err := r.Snapshot(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				// Remove snapshot so the next iteration does not reuse it.
+				b.StopTimer()
+				if err := c.DeleteSnapshot(context.Background(), info.Generation, info.Index); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// mustChtimes sets the access & modification time of filename to t.
+func mustChtimes(tb testing.TB, filename string, t time.Time) {
+	tb.Helper()
+	if err := os.Chtimes(filename, t, t); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestReplica_ReplicationLag(t *testing.T) {
+	t.Run("SameGeneration", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		r := litestream.NewReplica(db, "", c)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Replica should have no lag after a sync.
+		if indexLag, byteLag, err := r.ReplicationLag(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if indexLag != 0 || byteLag != 0 {
+			t.Fatalf("lag=(%d,%d), want (0,0)", indexLag, byteLag)
+		}
+
+		// Write to the database but only sync the shadow WAL.
+		pos0 := r.Pos()
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		dpos := db.Pos()
+		if indexLag, byteLag, err := r.ReplicationLag(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := indexLag, 0; got != want {
+			t.Fatalf("indexLag=%d, want %d", got, want)
+		} else if got, want := byteLag, dpos.Offset-pos0.Offset; got != want {
+			t.Fatalf("byteLag=%d, want %d", got, want)
+		}
+
+		// Start a new index & verify the remainder of the previous index is included.
+		if err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('bat');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		dpos = db.Pos()
+		index0Size := mustWALIndexSize(t, db, dpos.Generation, pos0.Index)
+		if indexLag, byteLag, err := r.ReplicationLag(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := indexLag, dpos.Index-pos0.Index; got != want {
+			t.Fatalf("indexLag=%d, want %d", got, want)
+		} else if got, want := byteLag, (index0Size-pos0.Offset)+dpos.Offset; got != want {
+			t.Fatalf("byteLag=%d, want %d", got, want)
+		}
+	})
+
+	t.Run("CrossGeneration", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		// Replica has never synced so it has no position in the current generation.
+		r := litestream.NewReplica(db, "", litestream.NewFileReplicaClient(t.TempDir()))
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := db.Checkpoint(context.Background(), litestream.CheckpointModeTruncate); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Entire generation should be reported as lag.
+		dpos := db.Pos()
+		var wantByteLag int64
+		for index := 0; index < dpos.Index; index++ {
+			wantByteLag += mustWALIndexSize(t, db, dpos.Generation, index)
+		}
+		wantByteLag += dpos.Offset
+
+		if indexLag, byteLag, err := r.ReplicationLag(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := indexLag, dpos.Index; got != want {
+			t.Fatalf("indexLag=%d, want %d", got, want)
+		} else if byteLag != wantByteLag {
+			t.Fatalf("byteLag=%d, want %d", byteLag, wantByteLag)
+		}
+	})
+
+	t.Run("ErrNoGeneration", func(t *testing.T) {
+		db := MustOpenDB(t)
+		defer MustCloseDB(t, db)
+
+		r := litestream.NewReplica(db, "", litestream.NewFileReplicaClient(t.TempDir()))
+		if _, _, err := r.ReplicationLag(context.Background()); err != litestream.ErrNoGeneration {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// mustWALIndexSize returns the uncompressed size of a shadow WAL index.
+func mustWALIndexSize(tb testing.TB, db *litestream.DB, generation string, index int) int64 {
+	tb.Helper()
+	rc, err := db.WALReader(context.Background(), generation, index)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer rc.Close()
+
+	n, err := io.Copy(io.Discard, rc)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return n
+}
+
+func TestOpenFileReplica(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		tempDir := t.TempDir()
+
+		r, err := litestream.OpenFileReplica(testDir)
+		if err != nil {
+			t.Fatal(err)
+		} else if r.DB() != nil {
+			t.Fatal("expected no source database")
+		}
+
+		// Listing methods should work without a source database.
+		if generations, err := r.Client().Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := generations, []string{"0000000000000000"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("generations=%v, want %v", got, want)
+		}
+		if points, err := r.RestorePoints(context.Background(), "0000000000000000"); err != nil {
+			t.Fatal(err)
+		} else if len(points) == 0 {
+			t.Fatal("expected restore points")
+		}
+
+		if err := litestream.Restore(context.Background(), r.Client(), filepath.Join(tempDir, "db"), "0000000000000000", 0, 2, litestream.NewRestoreOptions()); err != nil {
+			t.Fatal(err)
+		} else if !fileEqual(t, filepath.Join(testDir, "0000000000000002.db"), filepath.Join(tempDir, "db")) {
+			t.Fatalf("file mismatch")
+		}
+
+		// Mutating methods should fail cleanly.
+		if err := r.Sync(context.Background()); err != litestream.ErrNoSource {
+			t.Fatalf("unexpected sync error: %v", err)
+		} else if _, err := r.Snapshot(context.Background()); err != litestream.ErrNoSource {
+			t.Fatalf("unexpected snapshot error: %v", err)
+		} else if _, _, err := r.ReplicationLag(context.Background()); err != litestream.ErrNoSource {
+			t.Fatalf("unexpected replication lag error: %v", err)
+		}
+
+		r.Start(context.Background())
+		defer r.Stop()
+		if err := r.Err(); err != litestream.ErrNoSource {
+			t.Fatalf("unexpected start error: %v", err)
+		}
+	})
+
+	// Ensure retention & generation changes leave the directory untouched.
+	t.Run("ReadOnly", func(t *testing.T) {
+		testDir := filepath.Join("testdata", "restore", "ok")
+		c := litestream.NewFileReplicaClient(t.TempDir())
+		mustCopyReplicaClient(t, c, litestream.NewFileReplicaClient(testDir), "0000000000000000")
+
+		// Copy a second generation so the generation limit would delete one.
+		src := litestream.NewFileReplicaClient(t.TempDir())
+		mustCopyReplicaClient(t, src, litestream.NewFileReplicaClient(testDir), "0000000000000000")
+		if err := os.Rename(filepath.Join(src.Path(), "generations", "0000000000000000"), filepath.Join(src.Path(), "generations", "0000000000000001")); err != nil {
+			t.Fatal(err)
+		}
+		mustCopyReplicaClient(t, c, src, "0000000000000001")
+
+		r, err := litestream.OpenFileReplica(c.Path())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.MaxGenerations = 1
+
+		if err := r.EnforceRetention(context.Background()); err != litestream.ErrNoSource {
+			t.Fatalf("unexpected retention error: %v", err)
+		} else if err := r.SetGenerationImmutable(context.Background(), "0000000000000000", true); err != litestream.ErrNoSource {
+			t.Fatalf("unexpected immutable error: %v", err)
+		}
+
+		if generations, err := c.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := generations, []string{"0000000000000000", "0000000000000001"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("generations=%v, want %v", got, want)
+		} else if immutable, err := c.IsGenerationImmutable(context.Background(), "0000000000000000"); err != nil {
+			t.Fatal(err)
+		} else if immutable {
+			t.Fatal("expected generation to remain mutable")
+		}
+	})
+
+	t.Run("ErrNotExist", func(t *testing.T) {
+		if _, err := litestream.OpenFileReplica(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrNotDir", func(t *testing.T) {
+		if _, err := litestream.OpenFileReplica(filepath.Join("testdata", "restore", "ok", "README")); err == nil {
+			t.Fatal("expected error")
+		}
+	})
 }
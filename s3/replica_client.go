@@ -55,6 +55,10 @@ type ReplicaClient struct {
 	Endpoint       string
 	ForcePathStyle bool
 	SkipVerify     bool
+
+	// Determines which names are listed as generations.
+	// Uses DefaultGenerationFormat if nil.
+	GenerationFormat litestream.GenerationFormat
 }
 
 // NewReplicaClient returns a new instance of ReplicaClient.
@@ -67,6 +71,16 @@ func (c *ReplicaClient) Type() string {
 	return ReplicaClientType
 }
 
+// Location returns the bucket & path as a URL.
+func (c *ReplicaClient) Location() string {
+	return "s3://" + path.Join(c.Bucket, c.Path)
+}
+
+// IsValidGenerationName returns true if name matches the client's generation format.
+func (c *ReplicaClient) IsValidGenerationName(name string) bool {
+	return litestream.IsValidGenerationName(c.GenerationFormat, name)
+}
+
 // Init initializes the connection to S3. No-op if already initialized.
 func (c *ReplicaClient) Init(ctx context.Context) (err error) {
 	c.mu.Lock()
@@ -163,7 +177,7 @@ func (c *ReplicaClient) Generations(ctx context.Context) ([]string, error) {
 
 		for _, prefix := range page.CommonPrefixes {
 			name := path.Base(*prefix.Prefix)
-			if !litestream.IsGenerationName(name) {
+			if !c.IsValidGenerationName(name) {
 				continue
 			}
 			generations = append(generations, name)
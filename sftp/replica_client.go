@@ -43,6 +43,10 @@ type ReplicaClient struct {
 	KeyPath     string
 	HostKeyPath string
 	DialTimeout time.Duration
+
+	// Determines which names are listed as generations.
+	// Uses DefaultGenerationFormat if nil.
+	GenerationFormat litestream.GenerationFormat
 }
 
 // NewReplicaClient returns a new instance of ReplicaClient.
@@ -57,6 +61,19 @@ func (c *ReplicaClient) Type() string {
 	return ReplicaClientType
 }
 
+// Location returns the user, host & path as a URL.
+func (c *ReplicaClient) Location() string {
+	if c.User != "" {
+		return "sftp://" + c.User + "@" + path.Join(c.Host, c.Path)
+	}
+	return "sftp://" + path.Join(c.Host, c.Path)
+}
+
+// IsValidGenerationName returns true if name matches the client's generation format.
+func (c *ReplicaClient) IsValidGenerationName(name string) bool {
+	return litestream.IsValidGenerationName(c.GenerationFormat, name)
+}
+
 // Init initializes the connection to SFTP. No-op if already initialized.
 func (c *ReplicaClient) Init(ctx context.Context) (_ *sftp.Client, err error) {
 	c.mu.Lock()
@@ -151,7 +168,7 @@ func (c *ReplicaClient) Generations(ctx context.Context) (_ []string, err error)
 		}
 
 		name := path.Base(fi.Name())
-		if !litestream.IsGenerationName(name) {
+		if !c.IsValidGenerationName(name) {
 			continue
 		}
 		generations = append(generations, name)
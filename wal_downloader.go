@@ -8,7 +8,6 @@ import (
 	"sync"
 
 	"github.com/benbjohnson/litestream/internal"
-	"github.com/pierrec/lz4/v4"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -52,6 +51,10 @@ type WALDownloader struct {
 
 	// Number of downloads occurring in parallel.
 	Parallelism int
+
+	// Optional callback invoked with the number of compressed bytes read
+	// from the client. May be called concurrently from multiple downloaders.
+	Progress func(n int64)
 }
 
 // NewWALDownloader returns a new instance of WALDownloader.
@@ -269,7 +272,8 @@ func (d *WALDownloader) downloader(ctx context.Context) error {
 
 // downloadWAL sequentially downloads all the segments for WAL index from the
 // replica client and appends them to a single on-disk file. Returns the name
-// of the on-disk file on success.
+// of the on-disk file on success. Clients which implement WALIndexClient read
+// the index in a single pass.
 func (d *WALDownloader) downloadWAL(ctx context.Context, index int, offsets []int64) (string, error) {
 	// Open handle to destination WAL path.
 	walPath := fmt.Sprintf("%s-%s-wal", d.prefix, FormatIndex(index))
@@ -279,31 +283,33 @@ func (d *WALDownloader) downloadWAL(ctx context.Context, index int, offsets []in
 	}
 	defer f.Close()
 
-	// Open readers for every segment in the WAL file, in order.
+	// Read every segment in the WAL file, in order. Errors from copying are
+	// returned as-is while errors from the client are wrapped.
 	var written int64
-	for _, offset := range offsets {
-		if err := func() error {
-			// Ensure next offset is our current position in the file.
-			if written != offset {
-				return fmt.Errorf("missing WAL offset: generation=%s index=%s offset=%s", d.generation, FormatIndex(index), FormatOffset(written))
-			}
-
-			rd, err := d.client.WALSegmentReader(ctx, Pos{Generation: d.generation, Index: index, Offset: offset})
-			if err != nil {
-				return fmt.Errorf("read WAL segment: %w", err)
-			}
-			defer rd.Close()
+	var copyErr error
+	if err := readWALIndex(ctx, d.client, d.generation, index, offsets, func(offset int64, rd io.Reader) error {
+		// Ensure next offset is our current position in the file.
+		if written != offset {
+			copyErr = fmt.Errorf("missing WAL offset: generation=%s index=%s offset=%s", d.generation, FormatIndex(index), FormatOffset(written))
+			return copyErr
+		}
 
-			n, err := io.Copy(f, lz4.NewReader(rd))
-			if err != nil {
-				return fmt.Errorf("copy WAL segment: %w", err)
-			}
-			written += n
+		r := rd
+		if d.Progress != nil {
+			r = &progressReader{r: rd, fn: d.Progress}
+		}
 
-			return nil
-		}(); err != nil {
-			return "", err
+		n, err := io.Copy(f, newDecompressReader(r))
+		if err != nil {
+			copyErr = fmt.Errorf("copy WAL segment: %w", err)
+			return copyErr
 		}
+		written += n
+		return nil
+	}); err != nil && err == copyErr {
+		return "", err
+	} else if err != nil {
+		return "", fmt.Errorf("read WAL segment: %w", err)
 	}
 
 	if err := f.Close(); err != nil {